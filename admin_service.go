@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 
 	"gorm.io/gorm"
 )
@@ -20,12 +24,59 @@ func (s *AdminService) IsAdmin(userID uint) bool {
 	return err == nil
 }
 
-func (s *AdminService) MakeAdmin(userID uint) error {
+// Audit log actions
+const (
+	auditMakeAdmin   = "make_admin"
+	auditRemoveAdmin = "remove_admin"
+	auditDeleteUser  = "delete_user"
+	auditSetQuota    = "set_quota"
+	auditExport      = "export"
+	auditMaintenance = "maintenance"
+	auditCleanup     = "cleanup"
+)
+
+// auditUserTarget is the AuditLog target for actions on a user.
+func auditUserTarget(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// RecordAudit adds an entry to the audit log when audit_log is on. The
+// action it records has already happened, so a failure is only logged.
+func (s *AdminService) RecordAudit(actorID uint, action, target, detail string) {
+	if !config.AuditLog {
+		return
+	}
+	entry := &AuditLog{ActorID: actorID, Action: action, Target: target, Detail: detail}
+	if err := s.db.Create(entry).Error; err != nil {
+		log.Printf("Failed to record %s by user %d in the audit log: %v", action, actorID, err)
+	}
+}
+
+// GetAuditLog returns a page of the audit log, newest first, together with
+// the total number of entries.
+func (s *AdminService) GetAuditLog(limit, offset int) ([]AuditLog, int64, error) {
+	var total int64
+	if err := s.db.Model(&AuditLog{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var entries []AuditLog
+	if err := s.db.Order("id DESC").Limit(limit).Offset(offset).Find(&entries).Error; err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+func (s *AdminService) MakeAdmin(actorID, userID uint) error {
 	admin := &Admin{UserID: userID}
-	return s.db.Create(admin).Error
+	if err := s.db.Create(admin).Error; err != nil {
+		return err
+	}
+	s.RecordAudit(actorID, auditMakeAdmin, auditUserTarget(userID), "")
+	return nil
 }
 
-func (s *AdminService) RemoveAdmin(userID uint) error {
+func (s *AdminService) RemoveAdmin(actorID, userID uint) error {
 	result := s.db.Where("user_id = ?", userID).Delete(&Admin{})
 	if result.Error != nil {
 		return result.Error
@@ -33,6 +84,7 @@ func (s *AdminService) RemoveAdmin(userID uint) error {
 	if result.RowsAffected == 0 {
 		return errors.New("user is not an admin")
 	}
+	s.RecordAudit(actorID, auditRemoveAdmin, auditUserTarget(userID), "")
 	return nil
 }
 
@@ -56,15 +108,95 @@ func (s *AdminService) GetUserStats(userID uint) (map[string]interface{}, error)
 	var sessionCount int64
 	s.db.Model(&Session{}).Where("user_id = ?", userID).Count(&sessionCount)
 
+	var usedBytes int64
+	s.db.Model(&Paste{}).Joins(sharedContentJoin).Select("COALESCE(SUM("+pasteSizeSQL+"), 0)").Where("user_id = ?", userID).Scan(&usedBytes)
+
 	return map[string]interface{}{
 		"username":      user.Username,
 		"created_at":    user.CreatedAt,
 		"paste_count":   pasteCount,
 		"session_count": sessionCount,
+		"used_bytes":    usedBytes,
+		"quota_bytes":   effectiveQuota(&user),
 	}, nil
 }
 
-func (s *AdminService) DeleteUser(userID uint) error {
+// SetUserQuota overrides the storage quota for one user. A nil quota clears
+// the override so the global default applies again; 0 means unlimited.
+func (s *AdminService) SetUserQuota(actorID, userID uint, quotaBytes *int64) error {
+	if quotaBytes != nil && *quotaBytes < 0 {
+		return errors.New("quota cannot be negative")
+	}
+
+	result := s.db.Model(&User{}).Where("id = ?", userID).Update("quota_bytes", quotaBytes)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("user not found")
+	}
+
+	detail := "quota_bytes=default"
+	if quotaBytes != nil {
+		detail = fmt.Sprintf("quota_bytes=%d", *quotaBytes)
+	}
+	s.RecordAudit(actorID, auditSetQuota, auditUserTarget(userID), detail)
+	return nil
+}
+
+// GetStorageUsage returns the bytes stored by each user that has pastes.
+func (s *AdminService) GetStorageUsage() (map[uint]int64, error) {
+	var rows []struct {
+		UserID uint
+		Used   int64
+	}
+	if err := s.db.Model(&Paste{}).
+		Joins(sharedContentJoin).
+		Select("user_id, SUM(" + pasteSizeSQL + ") AS used").
+		Where("user_id IS NOT NULL").
+		Group("user_id").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	usage := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		usage[row.UserID] = row.Used
+	}
+	return usage, nil
+}
+
+// GetUserPastesAdmin returns a page of the user's pastes for moderation,
+// including private and unlisted ones, newest first, together with the
+// user's total paste count.
+func (s *AdminService) GetUserPastesAdmin(userID uint, limit, offset int) ([]Paste, int64, error) {
+	var user User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, 0, errors.New("user not found")
+	}
+
+	var total int64
+	if err := s.db.Model(&Paste{}).Where("user_id = ?", userID).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var pastes []Paste
+	if err := s.db.Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&pastes).Error; err != nil {
+		return nil, 0, err
+	}
+
+	return pastes, total, nil
+}
+
+func (s *AdminService) DeleteUser(actorID, userID uint) error {
+	// Keep the name for the audit log, since the user row is about to go
+	var user User
+	s.db.Select("username").First(&user, userID)
+
 	// Delete user's sessions
 	s.db.Where("user_id = ?", userID).Delete(&Session{})
 
@@ -86,5 +218,65 @@ func (s *AdminService) DeleteUser(userID uint) error {
 		return errors.New("user not found")
 	}
 
+	s.RecordAudit(actorID, auditDeleteUser, auditUserTarget(userID), user.Username)
 	return nil
 }
+
+// ExportRecord is one line of the NDJSON export.
+type ExportRecord struct {
+	Type string      `json:"type"` // "user" or "paste"
+	Data interface{} `json:"data"`
+}
+
+// Export streams the instance as newline-delimited JSON, one record per
+// line. Rows are read with a cursor so memory stays flat however large
+// the database is. Password hashes are blanked unless explicitly requested.
+func (s *AdminService) Export(w io.Writer, includeUsers, includePasswordHashes bool) error {
+	enc := json.NewEncoder(w)
+
+	if includeUsers {
+		rows, err := s.db.Model(&User{}).Order("id").Rows()
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var user User
+			if err := s.db.ScanRows(rows, &user); err != nil {
+				return err
+			}
+			if !includePasswordHashes {
+				user.PasswordHash = ""
+			}
+			if err := enc.Encode(ExportRecord{Type: "user", Data: user}); err != nil {
+				return err
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	rows, err := s.db.Model(&Paste{}).Order("created_at").Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var paste Paste
+		if err := s.db.ScanRows(rows, &paste); err != nil {
+			return err
+		}
+		// ScanRows bypasses the AfterFind hook
+		if err := paste.decode(s.db); err != nil {
+			return err
+		}
+		if err := enc.Encode(ExportRecord{Type: "paste", Data: paste}); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// API response formats. Version 1 is each endpoint's own shape: a JSON
+// object or list on success and a plain text message on error. Version 2
+// wraps both in an apiEnvelope.
+const (
+	apiVersion1      = 1
+	apiVersion2      = 2
+	latestAPIVersion = apiVersion2
+)
+
+// apiEnvelope is the version 2 response body. Exactly one of Data and Error
+// is set.
+type apiEnvelope struct {
+	Data  json.RawMessage `json:"data"`
+	Error *apiError       `json:"error"`
+}
+
+type apiError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code,omitempty"` // see messages.go, for errors that have one
+	Message string `json:"message"`
+}
+
+// requestAPIVersion returns the version asked for in the Accept-Version
+// header, or default_api_version when there is none or it isn't one we
+// know.
+func requestAPIVersion(r *http.Request) int {
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Accept-Version")), "v"))
+	if err != nil || version < apiVersion1 || version > latestAPIVersion {
+		return config.DefaultAPIVersion
+	}
+	return version
+}
+
+// envelopeRecorder holds back a response that is to be rewritten once it's
+// complete: successful JSON and plain text errors. What it holds back is
+// decided when the handler writes its header, so anything else, such as the
+// streamed admin export, goes straight through without being buffered.
+type envelopeRecorder struct {
+	http.ResponseWriter
+	status  int
+	decided bool
+	wrap    bool
+	body    bytes.Buffer
+}
+
+func (e *envelopeRecorder) WriteHeader(code int) {
+	if e.decided {
+		return
+	}
+	e.status, e.decided = code, true
+
+	mediaType, _, _ := mime.ParseMediaType(e.Header().Get("Content-Type"))
+	e.wrap = (code < 300 && mediaType == "application/json") ||
+		(code >= 400 && (mediaType == "text/plain" || mediaType == ""))
+	if !e.wrap {
+		e.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (e *envelopeRecorder) Write(b []byte) (int, error) {
+	if !e.decided {
+		e.WriteHeader(http.StatusOK)
+	}
+	if !e.wrap {
+		return e.ResponseWriter.Write(b)
+	}
+	return e.body.Write(b)
+}
+
+// Flush lets responses that aren't held back keep streaming.
+func (e *envelopeRecorder) Flush() {
+	if flusher, ok := e.ResponseWriter.(http.Flusher); ok && !e.wrap {
+		flusher.Flush()
+	}
+}
+
+// apiVersionMiddleware rewrites API responses into an apiEnvelope for
+// clients using version 2. Successful JSON responses become its data, and
+// error messages its error; anything else, such as the plain text URL a
+// non-JSON upload returns or a response without a body, is passed through
+// untouched.
+func apiVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAPIRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Version")
+		version := requestAPIVersion(r)
+		w.Header().Set("API-Version", strconv.Itoa(version))
+		if version != apiVersion2 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &envelopeRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		// Already passed through, or nothing written at all, which net/http
+		// turns into an empty 200
+		if !rec.decided || !rec.wrap {
+			return
+		}
+
+		body := rec.body.Bytes()
+		data := bytes.TrimSpace(body)
+		var envelope apiEnvelope
+		switch {
+		case rec.status >= 400:
+			envelope.Error = &apiError{
+				Status:  rec.status,
+				Code:    w.Header().Get("X-Error-Code"),
+				Message: strings.TrimSpace(string(body)),
+			}
+		case len(data) > 0 && json.Valid(data):
+			envelope.Data = json.RawMessage(data)
+		default:
+			// No body, or not the JSON it claims to be: leave it alone
+			w.WriteHeader(rec.status)
+			w.Write(body)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Del("Content-Length")
+		w.WriteHeader(rec.status)
+		json.NewEncoder(w).Encode(envelope)
+	})
+}
@@ -4,11 +4,15 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
 )
 
+// How long API key usage records are kept
+const apiKeyUsageRetention = 30 * 24 * time.Hour
+
 type APIKeyService struct {
 	db *gorm.DB
 }
@@ -18,6 +22,16 @@ func NewAPIKeyService(database *gorm.DB) *APIKeyService {
 }
 
 func (s *APIKeyService) CreateAPIKey(userID uint, name string, expiresInDays *int) (*APIKey, error) {
+	if config.MaxAPIKeysPerUser > 0 {
+		count, err := s.countAPIKeys(userID)
+		if err != nil {
+			return nil, err
+		}
+		if count >= int64(config.MaxAPIKeysPerUser) {
+			return nil, fmt.Errorf("API key limit reached (max %d); delete a key to create another", config.MaxAPIKeysPerUser)
+		}
+	}
+
 	// Generate random API key
 	keyBytes := make([]byte, 32)
 	if _, err := rand.Read(keyBytes); err != nil {
@@ -46,7 +60,34 @@ func (s *APIKeyService) CreateAPIKey(userID uint, name string, expiresInDays *in
 	return apiKey, nil
 }
 
+// countAPIKeys returns how many keys count against the user's
+// max_api_keys_per_user: the unexpired ones, or all of them with
+// api_key_limit_includes_expired, since expired keys linger until cleanup.
+func (s *APIKeyService) countAPIKeys(userID uint) (int64, error) {
+	query := s.db.Model(&APIKey{}).Where("user_id = ?", userID)
+	if !config.APIKeyLimitIncludesExpired {
+		query = query.Where("expires_at IS NULL OR expires_at > ?", time.Now())
+	}
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
 func (s *APIKeyService) ValidateAPIKey(keyString string) (*User, error) {
+	apiKey, err := s.lookupAPIKey(keyString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update last used timestamp
+	now := time.Now()
+	s.db.Model(apiKey).Update("last_used", now)
+
+	return &apiKey.User, nil
+}
+
+// lookupAPIKey finds an unexpired API key by its secret.
+func (s *APIKeyService) lookupAPIKey(keyString string) (*APIKey, error) {
 	var apiKey APIKey
 	if err := s.db.Preload("User").Where("key = ?", keyString).First(&apiKey).Error; err != nil {
 		return nil, errors.New("invalid API key")
@@ -57,11 +98,51 @@ func (s *APIKeyService) ValidateAPIKey(keyString string) (*User, error) {
 		return nil, errors.New("API key expired")
 	}
 
-	// Update last used timestamp
-	now := time.Now()
-	s.db.Model(&apiKey).Update("last_used", now)
+	return &apiKey, nil
+}
 
-	return &apiKey.User, nil
+// RecordUsage logs a request made with an API key.
+func (s *APIKeyService) RecordUsage(keyID uint, method, path string, status int) error {
+	return s.db.Create(&APIKeyUsage{APIKeyID: keyID, Method: method, Path: path, Status: status}).Error
+}
+
+// GetUsage returns the most recent requests made with one of the user's
+// keys, newest first.
+func (s *APIKeyService) GetUsage(keyID, userID uint, limit int) ([]APIKeyUsage, error) {
+	var count int64
+	s.db.Model(&APIKey{}).Where("id = ? AND user_id = ?", keyID, userID).Count(&count)
+	if count == 0 {
+		return nil, errors.New("API key not found")
+	}
+
+	var usage []APIKeyUsage
+	if err := s.db.Where("api_key_id = ?", keyID).Order("created_at DESC, id DESC").Limit(limit).Find(&usage).Error; err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// CleanupAPIKeyUsage drops usage records older than apiKeyUsageRetention.
+func (s *APIKeyService) CleanupAPIKeyUsage() (int64, error) {
+	result := s.db.Where("created_at < ?", time.Now().Add(-apiKeyUsageRetention)).Delete(&APIKeyUsage{})
+	return result.RowsAffected, result.Error
+}
+
+// CleanupExpiredAPIKeys deletes keys past their expiry, along with their
+// usage records.
+func (s *APIKeyService) CleanupExpiredAPIKeys() (int64, error) {
+	now := time.Now()
+	var removed int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Model(&APIKey{}).Select("id").Where("expires_at IS NOT NULL AND expires_at < ?", now)
+		if err := tx.Where("api_key_id IN (?)", expired).Delete(&APIKeyUsage{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("expires_at IS NOT NULL AND expires_at < ?", now).Delete(&APIKey{})
+		removed = result.RowsAffected
+		return result.Error
+	})
+	return removed, err
 }
 
 func (s *APIKeyService) GetUserAPIKeys(userID uint) ([]APIKey, error) {
@@ -80,5 +161,5 @@ func (s *APIKeyService) DeleteAPIKey(keyID uint, userID uint) error {
 	if result.RowsAffected == 0 {
 		return errors.New("API key not found")
 	}
-	return nil
+	return s.db.Where("api_key_id = ?", keyID).Delete(&APIKeyUsage{}).Error
 }
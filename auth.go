@@ -4,9 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -19,41 +19,140 @@ func NewAuthService(database *gorm.DB) *AuthService {
 	return &AuthService{db: database}
 }
 
-func (s *AuthService) Register(username, password string) (*User, error) {
+var errUsernameTaken = errors.New("username taken")
+
+// validateUsername enforces the username rules shared by registration and
+// renames.
+func validateUsername(username string) error {
 	if len(username) < 3 || len(username) > 50 {
-		return nil, errors.New("username must be between 3 and 50 characters")
+		return newCodedError(msgUsernameLength)
+	}
+	for _, reserved := range config.ReservedUsernames {
+		if strings.EqualFold(username, reserved) {
+			return newCodedError(msgUsernameNotAllowed)
+		}
+	}
+	return nil
+}
+
+func (s *AuthService) Register(username, password string) (*User, error) {
+	return s.register(username, password, nil)
+}
+
+// RegisterAcceptingTerms registers a user who has accepted the terms of
+// service, recording when they did.
+func (s *AuthService) RegisterAcceptingTerms(username, password string) (*User, error) {
+	now := time.Now()
+	return s.register(username, password, &now)
+}
+
+func (s *AuthService) register(username, password string, termsAcceptedAt *time.Time) (*User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
 	}
 	
 	if len(password) < 6 {
-		return nil, errors.New("password must be at least 6 characters")
+		return nil, newCodedError(msgPasswordTooShort)
 	}
 
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
 
 	user := &User{
-		Username:     username,
-		PasswordHash: string(hashedPassword),
+		Username:        username,
+		PasswordHash:    hashedPassword,
+		TermsAcceptedAt: termsAcceptedAt,
 	}
 
-	if err := s.db.Create(user).Error; err != nil {
-		return nil, errors.New("username already exists")
+	// Counting inside the transaction means two first registrations can't
+	// both see an empty table
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return newCodedError(msgUsernameExists)
+		}
+		if !config.FirstUserIsAdmin {
+			return nil
+		}
+
+		var count int64
+		if err := tx.Model(&User{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 1 {
+			return NewAdminService(tx).MakeAdmin(0, user.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return user, nil
 }
 
+// ProxyUser returns the user an authenticating proxy vouched for, creating
+// the account the first time it's seen. Accounts created this way have no
+// password, so they can only sign in through the proxy.
+func (s *AuthService) ProxyUser(username string) (*User, error) {
+	var user User
+	if err := s.db.Where("username = ?", username).First(&user).Error; err == nil {
+		return &user, nil
+	}
+
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	user = User{Username: username}
+	if err := s.db.Create(&user).Error; err != nil {
+		// Another request for the same new user may have got there first
+		if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &user, nil
+}
+
 func (s *AuthService) Login(username, password string) (*User, error) {
 	var user User
 	if err := s.db.Where("username = ?", username).First(&user).Error; err != nil {
-		return nil, errors.New("invalid username or password")
+		return nil, newCodedError(msgInvalidCredentials)
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, errors.New("invalid username or password")
+	if !verifyPassword(user.PasswordHash, password) {
+		return nil, newCodedError(msgInvalidCredentials)
+	}
+
+	return &user, nil
+}
+
+// ChangeUsername renames a user. Sessions and API keys reference the user
+// by ID, so they stay valid across the rename.
+func (s *AuthService) ChangeUsername(userID uint, username string) (*User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+
+	var user User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+
+	var taken int64
+	s.db.Model(&User{}).Where("username = ? AND id <> ?", username, userID).Count(&taken)
+	if taken > 0 {
+		return nil, errUsernameTaken
+	}
+
+	// The unique index still catches a rename racing another one
+	if err := s.db.Model(&user).Update("username", username).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) || strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return nil, errUsernameTaken
+		}
+		return nil, err
 	}
 
 	return &user, nil
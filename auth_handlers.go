@@ -1,20 +1,26 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
-	"html/template"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 var authService *AuthService
 var pasteService *PasteService
 var apikeyService *APIKeyService
 var adminService *AdminService
+var maintenanceService *MaintenanceService
 
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	AcceptedTerms bool   `json:"accepted_terms"`
 }
 
 type LoginRequest struct {
@@ -24,26 +30,42 @@ type LoginRequest struct {
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, http.StatusMethodNotAllowed, msgMethodNotAllowed)
 		return
 	}
 
+	if registrationRateLimiter != nil {
+		if allowed, _, reset := registrationRateLimiter.Allow("ip:" + clientIP(r)); !allowed {
+			w.Header().Set("Retry-After", registrationRateLimiter.retryAfter(reset))
+			httpError(w, http.StatusTooManyRequests, msgRegistrationRateLimited)
+			return
+		}
+	}
+
 	var req RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
 		return
 	}
 
-	user, err := authService.Register(req.Username, req.Password)
+	if config.RequireTermsAcceptance && !req.AcceptedTerms {
+		httpError(w, http.StatusBadRequest, msgTermsRequired)
+		return
+	}
+
+	register := authService.Register
+	if req.AcceptedTerms {
+		register = authService.RegisterAcceptingTerms
+	}
+	user, err := register(req.Username, req.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 
 	// Create session
 	session, err := authService.CreateSession(user.ID)
 	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		httpError(w, http.StatusInternalServerError, msgSessionFailed)
 		return
 	}
 
@@ -66,26 +88,25 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, http.StatusMethodNotAllowed, msgMethodNotAllowed)
 		return
 	}
 
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
 		return
 	}
 
 	user, err := authService.Login(req.Username, req.Password)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		writeError(w, err, http.StatusUnauthorized)
 		return
 	}
 
 	// Create session
 	session, err := authService.CreateSession(user.ID)
 	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		httpError(w, http.StatusInternalServerError, msgSessionFailed)
 		return
 	}
 
@@ -130,21 +151,31 @@ func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"success": true})
 }
 
+// requestAPIKey returns the API key from the Authorization header, which may
+// be "Bearer <key>" or just "<key>".
+func requestAPIKey(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
 func getCurrentUser(r *http.Request) *User {
 	// Check for API key in Authorization header first
-	apiKey := r.Header.Get("Authorization")
+	apiKey := requestAPIKey(r)
 	if apiKey != "" {
-		// Support "Bearer <key>" or just "<key>"
-		if strings.HasPrefix(apiKey, "Bearer ") {
-			apiKey = strings.TrimPrefix(apiKey, "Bearer ")
-		}
-
 		user, err := apikeyService.ValidateAPIKey(apiKey)
 		if err == nil && user != nil {
 			return user
 		}
 	}
 
+	// Behind an authenticating proxy, take its word for who the user is
+	if username := trustedProxyUsername(r); username != "" {
+		user, err := authService.ProxyUser(username)
+		if err == nil {
+			return user
+		}
+		log.Printf("Rejected user %q from trusted proxy: %v", username, err)
+	}
+
 	// Fall back to session cookie
 	cookie, err := r.Cookie("session")
 	if err != nil {
@@ -162,31 +193,224 @@ func getCurrentUser(r *http.Request) *User {
 func myPastesHandler(w http.ResponseWriter, r *http.Request) {
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
-	pastes, err := pasteService.GetUserPastes(user.ID)
+	page, ok := pageParam(w, r)
+	if !ok {
+		return
+	}
+	perPage, ok := pageSizeParam(w, r, "per_page", listPageSize)
+	if !ok {
+		return
+	}
+
+	language := r.URL.Query().Get("language")
+	pastes, total, err := pasteService.GetUserPastesByLanguage(user.ID, language, perPage, (page-1)*perPage)
 	if err != nil {
 		http.Error(w, "Failed to fetch pastes", http.StatusInternalServerError)
 		return
 	}
 
-	tmpl, err := template.ParseFS(templatesFolder, "templates/my-pastes.html")
+	data := struct {
+		TemplateData
+		Pagination
+		Pastes         []Paste
+		LanguageFilter string
+	}{
+		TemplateData:   templateDataForUser(user),
+		Pagination:     newPagination(page, perPage, total),
+		Pastes:         pastes,
+		LanguageFilter: language,
+	}
+
+	renderTemplate(w, http.StatusOK, "my-pastes.html", data)
+}
+
+// ChangeUsernameRequest is the body of POST /api/me/username.
+type ChangeUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+func changeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	var req ChangeUsernameRequest
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
+		return
+	}
+
+	updated, err := authService.ChangeUsername(user.ID, req.Username)
 	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+		status := http.StatusBadRequest
+		if errors.Is(err, errUsernameTaken) {
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
 
-	data := struct {
-		Username string
-		Pastes   []Paste
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":  true,
+		"username": updated.Username,
+	})
+}
+
+// ClaimPastesRequest is the body of POST /api/me/claim-pastes.
+type ClaimPastesRequest struct {
+	Tokens []string `json:"tokens"`
+}
+
+// claimPastesHandler moves anonymous pastes into the caller's account, given
+// the claim tokens their uploads returned. Results line up with the tokens.
+func claimPastesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	if allowed, _, reset := claimRateLimiter.Allow(rateLimitKey(r)); !allowed {
+		w.Header().Set("Retry-After", claimRateLimiter.retryAfter(reset))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	var req ClaimPastesRequest
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
+		return
+	}
+	if len(req.Tokens) == 0 {
+		http.Error(w, "No tokens given", http.StatusBadRequest)
+		return
+	}
+	if len(req.Tokens) > claimMaxTokens {
+		http.Error(w, fmt.Sprintf("Too many tokens (max %d)", claimMaxTokens), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchUploadResult, len(req.Tokens))
+	for i, token := range req.Tokens {
+		paste, err := pasteService.ClaimPaste(user.ID, token)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].ID = paste.ID
+		results[i].URL = config.ServePath + paste.ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// changeCursorToken is how a ChangeCursor is handed to sync clients, who
+// are only meant to pass it back.
+type changeCursorToken struct {
+	Time time.Time `json:"t"`
+	ID   string    `json:"id"`
+}
+
+func encodeChangeCursor(c ChangeCursor) string {
+	token, _ := json.Marshal(changeCursorToken(c))
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+func decodeChangeCursor(s string) (ChangeCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return ChangeCursor{}, err
+	}
+	var token changeCursorToken
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return ChangeCursor{}, err
+	}
+	return ChangeCursor(token), nil
+}
+
+// myPasteChangesHandler serves GET /api/me/pastes for sync clients: the
+// caller's pastes changed after ?updated_since= (RFC 3339, default the
+// beginning), with tombstones for deleted ones. Clients resume by passing
+// next_cursor back as ?cursor= while has_more is set.
+func myPasteChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	var after ChangeCursor
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		c, err := decodeChangeCursor(v)
+		if err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		after = c
+	} else if v := r.URL.Query().Get("updated_since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "updated_since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		after.Time = t
+	}
+
+	limit, ok := pageSizeParam(w, r, "limit", listPageSize)
+	if !ok {
+		return
+	}
+
+	changes, err := pasteService.GetUserPasteChanges(user.ID, after, limit)
+	if err != nil {
+		log.Printf("Failed to load paste changes: %v", err)
+		http.Error(w, "Failed to fetch pastes", http.StatusInternalServerError)
+		return
+	}
+
+	resp := struct {
+		Pastes     []Paste          `json:"pastes"`
+		Deleted    []PasteTombstone `json:"deleted"`
+		HasMore    bool             `json:"has_more"`
+		NextCursor string           `json:"next_cursor,omitempty"`
 	}{
-		Username: user.Username,
-		Pastes:   pastes,
+		Pastes:  changes.Updated,
+		Deleted: changes.Deleted,
+		HasMore: changes.More,
+	}
+	if resp.Pastes == nil {
+		resp.Pastes = []Paste{}
+	}
+	if resp.Deleted == nil {
+		resp.Deleted = []PasteTombstone{}
+	}
+	if !changes.Next.Time.IsZero() {
+		resp.NextCursor = encodeChangeCursor(changes.Next)
 	}
 
-	tmpl.Execute(w, data)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func meHandler(w http.ResponseWriter, r *http.Request) {
@@ -231,11 +455,15 @@ func editPastePageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tmpl, err := template.ParseFS(templatesFolder, "templates/edit-paste.html")
-	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
-		return
+	data := struct {
+		TemplateData
+		*Paste
+		LanguageChoice LanguageChoice
+	}{
+		TemplateData:   templateDataForUser(user),
+		Paste:          paste,
+		LanguageChoice: languageChoice(paste.Language),
 	}
 
-	tmpl.Execute(w, paste)
+	renderTemplate(w, http.StatusOK, "edit-paste.html", data)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// Tokens accepted per claim request
+const claimMaxTokens = 100
+
+// Returned for a token that doesn't match an ownerless paste. Unknown,
+// used and owned tokens are deliberately indistinguishable.
+var errInvalidClaimToken = errors.New("invalid or already claimed token")
+
+// newClaimToken generates the token handed out with an anonymous upload,
+// and the hash of it that gets stored.
+func newClaimToken() (token, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = "pbc_" + hex.EncodeToString(b)
+	return token, hashClaimToken(token), nil
+}
+
+func hashClaimToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ClaimPaste moves the anonymous paste token was issued for into the user's
+// account, counting it against their quota. A token works once.
+func (s *PasteService) ClaimPaste(userID uint, token string) (*Paste, error) {
+	if token == "" {
+		return nil, errInvalidClaimToken
+	}
+
+	var paste Paste
+	err := s.Transaction(func(tx *PasteService) error {
+		if err := tx.db.Where("claim_token = ? AND user_id IS NULL", hashClaimToken(token)).First(&paste).Error; err != nil {
+			return errInvalidClaimToken
+		}
+		if paste.Expired() {
+			return errInvalidClaimToken
+		}
+
+		size, err := tx.pasteStoredSize(paste.ID)
+		if err != nil {
+			return err
+		}
+		if err := tx.checkQuota(userID, size); err != nil {
+			return err
+		}
+
+		// The dedup key was computed for an anonymous owner, so it would
+		// hand this paste back to later anonymous uploads of the same text
+		result := tx.db.Model(&Paste{}).
+			Where("id = ? AND user_id IS NULL", paste.ID).
+			UpdateColumns(map[string]interface{}{
+				"user_id":     userID,
+				"claim_token": nil,
+				"dedup_key":   nil,
+				"updated_at":  time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errInvalidClaimToken
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paste.UserID = &userID
+	paste.ClaimToken = nil
+	paste.DedupKey = nil
+	return &paste, nil
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const usage = `Usage:
-  -b, --bind           address:port to run the server on (default: 0.0.0.0:3001)
+  -b, --bind           address:port or unix:/path to run the server on (default: 0.0.0.0:3001)
   -c, --config         Path to a configuration file (default: config.toml)
   -d, --database       Path to SQLite database file (default: ./pastes.db)
   -s, --serve-path     Path to serve pastes from (default: /p/)
+  --check-config       Validate the configuration, print it and exit
 
 Environment Variables:
   PB_BIND              Same as --bind
@@ -24,9 +33,53 @@ Environment Variables:
 // Default config
 func defaultConfig() Config {
 	return Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: "./pastes.db",
+		Bind:             "0.0.0.0:3001",
+		ServePath:        "/p/",
+		DatabasePath:     "./pastes.db",
+		BcryptCost:       bcrypt.DefaultCost,
+		PasswordHashAlgo: passwordAlgoBcrypt,
+
+		MaxPasteSize:          10 << 20, // 10MB
+		MaxJSONBodySize:       1 << 20,  // 1MB
+		PasteIDLength:         8,
+		MaxTitleLength:        200,
+		CompressionThreshold:  4096,
+		AllowAnonymousUploads: true,
+		Deduplication:         true,
+		DedupIncludeTitle:     true,
+		UploadQueueTimeout:    5,
+
+		ReservedUsernames: []string{"admin", "administrator", "root", "api", "support", "system", "security", "abuse"},
+
+		AuditLog: true,
+
+		SiteName: "bastepin",
+
+		IndexRecentPastes: 10,
+
+		MaxPageSize:        100,
+		EnablePublicBrowse: true,
+
+		DownloadFilename: "{id}{ext}",
+		DefaultTheme:     "github-dark",
+
+		RateLimitWindow: 60,
+
+		PurgeDeletedAfterDays: 30,
+
+		DefaultAPIVersion: apiVersion1,
+
+		RegistrationRateLimitWindow: 3600,
+
+		APIKeyUsageSampleRate: 1,
+		MaxAPIKeysPerUser:     10,
+
+		MaxHeaderBytes: http.DefaultMaxHeaderBytes,
+
+		HSTS:           true,
+		HSTSMaxAge:     31536000, // 1 year
+		FrameOptions:   "DENY",
+		ReferrerPolicy: "strict-origin-when-cross-origin",
 	}
 }
 
@@ -37,6 +90,7 @@ func GenerateConfig() Config {
 	var databasePathOpt string
 	var debugOpt bool
 	var servePathOpt string
+	var checkConfigOpt bool
 
 	flag.StringVar(&bindOpt, "b", "", "address:port to run the server on")
 	flag.StringVar(&bindOpt, "bind", "", "address:port to run the server on")
@@ -45,6 +99,7 @@ func GenerateConfig() Config {
 	flag.StringVar(&databasePathOpt, "d", "", "Path to SQLite database file")
 	flag.StringVar(&databasePathOpt, "database", "", "Path to SQLite database file")
 	flag.BoolVar(&debugOpt, "debug", false, "enable debug mode")
+	flag.BoolVar(&checkConfigOpt, "check-config", false, "validate the configuration, print it and exit")
 	flag.StringVar(&servePathOpt, "s", "", "Path to serve pastes from")
 	flag.StringVar(&servePathOpt, "serve-path", "", "Path to serve pastes from")
 
@@ -112,9 +167,234 @@ func GenerateConfig() Config {
 		config.Debug = true
 	}
 
+	if checkConfigOpt {
+		os.Exit(checkConfig(os.Stdout, config))
+	}
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v\n", err)
+	}
+
 	return config
 }
 
+// Validate checks the assembled configuration, including settings that
+// depend on each other, and reports every problem it finds at once.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := parseBind(c.Bind); err != nil {
+		invalid("bind: %v", err)
+	}
+	if !strings.HasPrefix(c.ServePath, "/") || !strings.HasSuffix(c.ServePath, "/") || c.ServePath == "/" {
+		invalid("serve_path must start and end with / and not be / itself, got %q", c.ServePath)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			invalid("trusted_proxies: %v", err)
+		}
+	}
+	if c.TrustedAuthHeader != "" && len(c.TrustedProxies) == 0 {
+		invalid("trusted_auth_header needs trusted_proxies to be set")
+	}
+	codes := make([]string, 0, len(c.Messages))
+	for code := range c.Messages {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		if _, ok := defaultMessages[code]; !ok {
+			invalid("messages: unknown error code %q", code)
+		} else if err := checkMessage(code, c.Messages[code]); err != nil {
+			invalid("messages: %s: %v", code, err)
+		}
+	}
+	if c.ServePath == shortCodePath {
+		invalid("serve_path cannot be %s, which serves short codes", shortCodePath)
+	}
+	if c.DatabasePath == "" {
+		invalid("database_path cannot be empty")
+	}
+	if c.EncryptionKey != "" {
+		if _, err := newContentCipher(c.EncryptionKey); err != nil {
+			invalid("%v", err)
+		}
+	}
+	if c.MaxPasteSize <= 0 {
+		invalid("max_paste_size must be positive, got %d", c.MaxPasteSize)
+	}
+	if c.MaxLines < 0 {
+		invalid("max_lines cannot be negative, got %d", c.MaxLines)
+	}
+	if c.CompressionThreshold < 0 {
+		invalid("compression_threshold cannot be negative, got %d", c.CompressionThreshold)
+	}
+	if c.UserQuotaBytes < 0 {
+		invalid("user_quota_bytes cannot be negative, got %d", c.UserQuotaBytes)
+	}
+	if c.PasteIDLength < minPasteIDLength || c.PasteIDLength > maxPasteIDLength {
+		invalid("paste_id_length must be between %d and %d, got %d", minPasteIDLength, maxPasteIDLength, c.PasteIDLength)
+	}
+	if !validPasteIDPrefix(c.PasteIDPrefix) {
+		invalid("paste_id_prefix may only contain letters, digits, '-' and '_' (max %d characters), got %q", maxPasteIDPrefixLength, c.PasteIDPrefix)
+	}
+	if c.RequireTermsAcceptance && c.TermsURL == "" {
+		invalid("require_terms_acceptance needs terms_url to be set")
+	}
+	if c.TemplateDir != "" {
+		if info, err := os.Stat(c.TemplateDir); err != nil || !info.IsDir() {
+			invalid("template_dir %s is not a readable directory", c.TemplateDir)
+		}
+	}
+	if c.AbuseContact != "" {
+		if _, err := contactURI(c.AbuseContact); err != nil {
+			invalid("abuse_contact %s %v", c.AbuseContact, err)
+		}
+	}
+	if c.MaxPasteTTLMinutes < 0 {
+		invalid("max_paste_ttl_minutes cannot be negative, got %d", c.MaxPasteTTLMinutes)
+	}
+	if c.MaxHeaderBytes <= 0 {
+		invalid("max_header_bytes must be positive, got %d", c.MaxHeaderBytes)
+	}
+	if c.IdleTimeout < 0 {
+		invalid("idle_timeout cannot be negative, got %d", c.IdleTimeout)
+	}
+	if c.MaxConcurrentUploads < 0 {
+		invalid("max_concurrent_uploads cannot be negative, got %d", c.MaxConcurrentUploads)
+	}
+	if c.UploadQueueTimeout < 0 {
+		invalid("upload_queue_timeout cannot be negative, got %d", c.UploadQueueTimeout)
+	}
+	if c.MaxDatabaseBytes < 0 {
+		invalid("max_database_bytes cannot be negative, got %d", c.MaxDatabaseBytes)
+	}
+	if c.AnonymousPasteMaxAgeDays < 0 {
+		invalid("anonymous_paste_max_age_days cannot be negative, got %d", c.AnonymousPasteMaxAgeDays)
+	}
+	if c.PurgeDeletedAfterDays < 0 {
+		invalid("purge_deleted_after_days cannot be negative, got %d", c.PurgeDeletedAfterDays)
+	}
+	if c.MaxJSONBodySize <= 0 {
+		invalid("max_json_body_size must be positive, got %d", c.MaxJSONBodySize)
+	}
+	if c.MaxTitleLength <= 0 {
+		invalid("max_title_length must be positive, got %d", c.MaxTitleLength)
+	}
+	if c.MaxPageSize <= 0 {
+		invalid("max_page_size must be positive, got %d", c.MaxPageSize)
+	}
+	if !validDownloadFilename(c.DownloadFilename) {
+		invalid("download_filename must contain {id} or {title} and no placeholders besides {id}, {title} and {ext}, got %q", c.DownloadFilename)
+	}
+	if !validTheme(c.DefaultTheme) {
+		invalid("default_theme must be one of the highlighter's styles, got %q", c.DefaultTheme)
+	}
+	if c.RateLimit > 0 && c.RateLimitWindow <= 0 {
+		invalid("rate_limit_window must be positive when rate_limit is set, got %d", c.RateLimitWindow)
+	}
+	if c.RegistrationRateLimit > 0 && c.RegistrationRateLimitWindow <= 0 {
+		invalid("registration_rate_limit_window must be positive when registration_rate_limit is set, got %d", c.RegistrationRateLimitWindow)
+	}
+	if c.DefaultAPIVersion < apiVersion1 || c.DefaultAPIVersion > latestAPIVersion {
+		invalid("default_api_version must be between %d and %d, got %d", apiVersion1, latestAPIVersion, c.DefaultAPIVersion)
+	}
+	if c.APIKeyUsageSampleRate < 0 || c.APIKeyUsageSampleRate > 1 {
+		invalid("api_key_usage_sample_rate must be between 0 and 1, got %g", c.APIKeyUsageSampleRate)
+	}
+	if c.MaxAPIKeysPerUser < 0 {
+		invalid("max_api_keys_per_user cannot be negative, got %d", c.MaxAPIKeysPerUser)
+	}
+	if c.BcryptCost < bcrypt.MinCost || c.BcryptCost > bcrypt.MaxCost {
+		invalid("bcrypt_cost must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, c.BcryptCost)
+	}
+	if c.PasswordHashAlgo != passwordAlgoBcrypt && c.PasswordHashAlgo != passwordAlgoArgon2id {
+		invalid("password_hash_algo must be %q or %q, got %q", passwordAlgoBcrypt, passwordAlgoArgon2id, c.PasswordHashAlgo)
+	}
+
+	return errors.Join(errs...)
+}
+
+// checkConfig implements --check-config: it validates config and prints
+// the effective settings, secrets redacted, returning the exit status.
+func checkConfig(w io.Writer, config Config) int {
+	if err := config.Validate(); err != nil {
+		fmt.Fprintf(w, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	for _, secret := range []*string{&config.SessionSecret, &config.EncryptionKey} {
+		if *secret != "" {
+			*secret = "[redacted]"
+		}
+	}
+	if err := toml.NewEncoder(w).Encode(config); err != nil {
+		fmt.Fprintf(w, "Failed to print configuration: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(w, "\n# Configuration OK")
+	return 0
+}
+
+// PublicConfig is the part of the configuration clients may see, served at
+// /api/config so tools can check limits before uploading. Fields are copied
+// one by one so new settings, secrets especially, stay private by default.
+type PublicConfig struct {
+	MaxPasteSize           int      `json:"max_paste_size"`        // bytes
+	MaxLines               int      `json:"max_lines"`             // 0 = no limit
+	MaxTitleLength         int      `json:"max_title_length"`      // characters
+	MaxPasteTTLMinutes     int      `json:"max_paste_ttl_minutes"` // longest expires_in, 0 = no limit
+	MaxBatchPastes         int      `json:"max_batch_pastes"`
+	MaxPageSize            int      `json:"max_page_size"`
+	PublicBrowse           bool     `json:"public_browse"` // /all, /api/recent and /api/trending are served
+	Languages              []string `json:"languages"`
+	AnonymousUploads       bool     `json:"anonymous_uploads"`
+	DefaultPrivateForUsers bool     `json:"default_private_for_users"`
+	Deduplication          bool     `json:"deduplication"`
+	DedupIncludeTitle      bool     `json:"dedup_include_title"`
+	TrimTrailingWhitespace bool     `json:"trim_trailing_whitespace"`
+	NormalizeLineEndings   bool     `json:"normalize_line_endings"`
+	SlidingExpiry          bool     `json:"sliding_expiry"`
+	RemoteFetch            bool     `json:"remote_fetch"`
+	RequireTermsAcceptance bool     `json:"require_terms_acceptance"`
+	TermsURL               string   `json:"terms_url,omitempty"`
+	RateLimit              int      `json:"rate_limit"`        // API requests per window, 0 = unlimited
+	RateLimitWindow        int      `json:"rate_limit_window"` // seconds
+}
+
+func publicConfig(c Config) PublicConfig {
+	names := make([]string, len(languages))
+	for i, lang := range languages {
+		names[i] = lang.Name
+	}
+
+	return PublicConfig{
+		MaxPasteSize:           c.MaxPasteSize,
+		MaxLines:               c.MaxLines,
+		MaxTitleLength:         c.MaxTitleLength,
+		MaxPasteTTLMinutes:     c.MaxPasteTTLMinutes,
+		MaxBatchPastes:         batchMaxPastes,
+		MaxPageSize:            c.MaxPageSize,
+		PublicBrowse:           c.EnablePublicBrowse,
+		Languages:              names,
+		AnonymousUploads:       c.AllowAnonymousUploads,
+		DefaultPrivateForUsers: c.DefaultPrivateForUsers,
+		Deduplication:          c.Deduplication,
+		DedupIncludeTitle:      c.DedupIncludeTitle,
+		TrimTrailingWhitespace: c.TrimTrailingWhitespace,
+		NormalizeLineEndings:   c.NormalizeLineEndings,
+		SlidingExpiry:          c.SlidingExpiry,
+		RemoteFetch:            c.RemoteFetch,
+		RequireTermsAcceptance: c.RequireTermsAcceptance,
+		TermsURL:               c.TermsURL,
+		RateLimit:              c.RateLimit,
+		RateLimitWindow:        c.RateLimitWindow,
+	}
+}
+
 func loadConfig(configFile string) Config {
 	config := defaultConfig()
 
@@ -124,3 +404,32 @@ func loadConfig(configFile string) Config {
 
 	return config
 }
+
+// parseBind turns the bind setting into a network and address for
+// net.Listen. "unix:/path/to.sock" listens on a unix socket; anything else is
+// a TCP host:port, where a bare IPv6 literal such as "::1:3001" is accepted
+// and normalized to "[::1]:3001".
+func parseBind(bind string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(bind, "unix:"); ok {
+		if path == "" {
+			return "", "", errors.New("unix bind needs a socket path, e.g. unix:/run/pb.sock")
+		}
+		return "unix", path, nil
+	}
+
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		// Unbracketed IPv6: everything after the last colon is the port
+		i := strings.LastIndex(bind, ":")
+		if i < 0 || net.ParseIP(bind[:i]) == nil || !strings.Contains(bind[:i], ":") {
+			return "", "", fmt.Errorf("invalid bind address %q: %v", bind, err)
+		}
+		host, port = bind[:i], bind[i+1:]
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port in bind address %q", bind)
+	}
+
+	return "tcp", net.JoinHostPort(host, port), nil
+}
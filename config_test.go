@@ -2,7 +2,10 @@ package main
 
 import (
 	"os"
+	"strings"
 	"testing"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestDefaultConfig(t *testing.T) {
@@ -20,6 +23,9 @@ func TestDefaultConfig(t *testing.T) {
 	if config.Debug {
 		t.Error("Expected Debug to be false")
 	}
+	if config.BcryptCost != bcrypt.DefaultCost {
+		t.Errorf("Expected BcryptCost to be %d, got %d", bcrypt.DefaultCost, config.BcryptCost)
+	}
 }
 
 func TestEnvironmentVariables(t *testing.T) {
@@ -225,6 +231,47 @@ func TestConfigPrecedence(t *testing.T) {
 	})
 }
 
+func TestParseBind(t *testing.T) {
+	tests := []struct {
+		bind    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"0.0.0.0:3001", "tcp", "0.0.0.0:3001", false},
+		{":3001", "tcp", ":3001", false},
+		{"localhost:8080", "tcp", "localhost:8080", false},
+		{"[::1]:3001", "tcp", "[::1]:3001", false},
+		{"::1:3001", "tcp", "[::1]:3001", false},
+		{"[::]:3001", "tcp", "[::]:3001", false},
+		{"unix:/run/pb/pb.sock", "unix", "/run/pb/pb.sock", false},
+		{"unix:relative.sock", "unix", "relative.sock", false},
+		{"unix:", "", "", true},
+		{"localhost", "", "", true},
+		{"localhost:http", "", "", true},
+		{"0.0.0.0:70000", "", "", true},
+		{"fe80::1", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bind, func(t *testing.T) {
+			network, address, err := parseBind(tt.bind)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %s %s", tt.bind, network, address)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if network != tt.network || address != tt.address {
+				t.Errorf("Expected %s %s, got %s %s", tt.network, tt.address, network, address)
+			}
+		})
+	}
+}
+
 // Helper function to clear all PB_ environment variables
 func clearPBEnvVars() {
 	os.Unsetenv("PB_BIND")
@@ -232,3 +279,158 @@ func clearPBEnvVars() {
 	os.Unsetenv("PB_DEBUG")
 	os.Unsetenv("PB_SERVE_PATH")
 }
+
+func TestContactURI(t *testing.T) {
+	tests := []struct {
+		contact string
+		uri     string
+		wantErr bool
+	}{
+		{"abuse@example.com", "mailto:abuse@example.com", false},
+		{"mailto:abuse@example.com", "mailto:abuse@example.com", false},
+		{"https://example.com/abuse", "https://example.com/abuse", false},
+		{"http://example.com", "http://example.com", false},
+		{"not an address", "", true},
+		{"Abuse Desk <abuse@example.com>", "", true},
+		{"ftp://example.com", "", true},
+		{"https://", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contact, func(t *testing.T) {
+			uri, err := contactURI(tt.contact)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Expected error for %q, got %s", tt.contact, uri)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if uri != tt.uri {
+				t.Errorf("Expected %s, got %s", tt.uri, uri)
+			}
+		})
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	t.Run("Valid config prints resolved values", func(t *testing.T) {
+		c := defaultConfig()
+		c.Bind = "127.0.0.1:4000"
+		c.SessionSecret = "hunter2"
+		c.EncryptionKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+		var out strings.Builder
+		if code := checkConfig(&out, c); code != 0 {
+			t.Fatalf("Expected exit status 0, got %d: %s", code, out.String())
+		}
+		printed := out.String()
+		if !strings.Contains(printed, `bind = "127.0.0.1:4000"`) || !strings.Contains(printed, `serve_path = "/p/"`) {
+			t.Errorf("Expected resolved values in output, got: %s", printed)
+		}
+		if strings.Contains(printed, "hunter2") || strings.Contains(printed, c.EncryptionKey) {
+			t.Errorf("Expected secrets to be redacted, got: %s", printed)
+		}
+	})
+
+	t.Run("Invalid config exits non-zero", func(t *testing.T) {
+		c := defaultConfig()
+		c.ServePath = "nope"
+
+		var out strings.Builder
+		if code := checkConfig(&out, c); code == 0 {
+			t.Fatal("Expected non-zero exit status")
+		}
+		if !strings.Contains(out.String(), "serve_path") {
+			t.Errorf("Expected the problem to be reported, got: %s", out.String())
+		}
+	})
+}
+
+func TestConfigValidate(t *testing.T) {
+	if err := defaultConfig().Validate(); err != nil {
+		t.Fatalf("Expected default config to be valid, got: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		want   []string
+	}{
+		{"Bad bind", func(c *Config) { c.Bind = "localhost" }, []string{"bind:"}},
+		{"Serve path without slashes", func(c *Config) { c.ServePath = "p" }, []string{"serve_path"}},
+		{"Serve path at the root", func(c *Config) { c.ServePath = "/" }, []string{"serve_path"}},
+		{"Bad trusted proxy", func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/33"} }, []string{"trusted_proxies"}},
+		{"Auth header without trusted proxies", func(c *Config) { c.TrustedAuthHeader = "X-Forwarded-User" }, []string{"trusted_auth_header"}},
+		{"Unknown message code", func(c *Config) { c.Messages = map[string]string{"no_such_code": "Nope"} }, []string{"messages"}},
+		{"Message with the wrong verb", func(c *Config) { c.Messages = map[string]string{msgPasteTooLarge: "Zu groß (%d)"} }, []string{"paste_too_large"}},
+		{"Message missing an argument", func(c *Config) { c.Messages = map[string]string{msgOriginNotAllowed: "Verboten"} }, []string{"origin_not_allowed"}},
+		{"Message with an extra argument", func(c *Config) { c.Messages = map[string]string{msgEmptyPaste: "Leer: %s"} }, []string{"empty_paste"}},
+		{"Serve path taken by short codes", func(c *Config) { c.ServePath = "/s/" }, []string{"serve_path"}},
+		{"Negative size", func(c *Config) { c.MaxPasteSize = -1 }, []string{"max_paste_size"}},
+		{"Negative line limit", func(c *Config) { c.MaxLines = -1 }, []string{"max_lines"}},
+		{"Negative deleted paste retention", func(c *Config) { c.PurgeDeletedAfterDays = -1 }, []string{"purge_deleted_after_days"}},
+		{"Malformed encryption key", func(c *Config) { c.EncryptionKey = "not base64!" }, []string{"encryption_key"}},
+		{"Terms gate without a URL", func(c *Config) { c.RequireTermsAcceptance = true }, []string{"terms_url"}},
+		{"Rate limit without a window", func(c *Config) { c.RateLimit = 10; c.RateLimitWindow = 0 }, []string{"rate_limit_window"}},
+		{"Zero page size", func(c *Config) { c.MaxPageSize = 0 }, []string{"max_page_size"}},
+		{"Download filename without a name", func(c *Config) { c.DownloadFilename = "paste{ext}" }, []string{"download_filename"}},
+		{"Unknown download placeholder", func(c *Config) { c.DownloadFilename = "{id}-{user}{ext}" }, []string{"download_filename"}},
+		{"Negative API key limit", func(c *Config) { c.MaxAPIKeysPerUser = -1 }, []string{"max_api_keys_per_user"}},
+		{"Unknown API version", func(c *Config) { c.DefaultAPIVersion = 3 }, []string{"default_api_version"}},
+		{"Unknown default theme", func(c *Config) { c.DefaultTheme = "no-such-theme" }, []string{"default_theme"}},
+		{
+			"Several problems at once",
+			func(c *Config) { c.PasteIDLength = 1; c.IdleTimeout = -1; c.PasswordHashAlgo = "md5" },
+			[]string{"paste_id_length", "idle_timeout", "password_hash_algo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.modify(&c)
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("Expected validation error")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected error mentioning %s, got: %v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	for code, text := range defaultMessages {
+		if err := checkMessage(code, text); err != nil {
+			t.Errorf("Expected default %s to pass, got: %v", code, err)
+		}
+	}
+
+	accepted := map[string]string{
+		msgTitleTooLong:  "Titel zu lang (höchstens %[2]d, nicht %[1]d Zeichen)",
+		msgPasteTooLarge: "100%% zu groß: %v",
+		msgEmptyPaste:    "Leer",
+	}
+	for code, text := range accepted {
+		if err := checkMessage(code, text); err != nil {
+			t.Errorf("Expected %q to be accepted for %s, got: %v", text, code, err)
+		}
+	}
+
+	rejected := map[string]string{
+		msgTitleTooLong:  "Titel zu lang (%d)",
+		msgPasteTooLarge: "Zu groß (%[2]s)",
+		msgEmptyPaste:    "Leer %",
+	}
+	for code, text := range rejected {
+		if err := checkMessage(code, text); err == nil {
+			t.Errorf("Expected %q to be rejected for %s", text, code)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -29,7 +30,7 @@ func initDatabase(dbPath string, debug bool) error {
 	}
 
 	// Auto-migrate the schema
-	err = db.AutoMigrate(&User{}, &Paste{}, &Session{}, &APIKey{}, &Admin{})
+	err = db.AutoMigrate(&User{}, &Paste{}, &Session{}, &APIKey{}, &Admin{}, &IdempotencyKey{}, &PasteView{}, &APIKeyUsage{}, &PasteContent{}, &AuditLog{})
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
@@ -41,6 +42,15 @@ func initDatabase(dbPath string, debug bool) error {
 	return nil
 }
 
+// pingDatabase checks that the database still answers.
+func pingDatabase(ctx context.Context) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
 func cleanExpiredSessions() error {
 	return db.Where("expires_at < ?", time.Now()).Delete(&Session{}).Error
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// AEAD used to encrypt paste content at rest, nil when no encryption_key is
+// configured and content is stored as plaintext.
+var contentCipher cipher.AEAD
+
+// newContentCipher builds an AES-256-GCM cipher from a base64-encoded
+// 32 byte key.
+func newContentCipher(encodedKey string) (cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.New("encryption_key must be base64 encoded")
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption_key must decode to 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealContent encrypts data with a random nonce, returning nonce || ciphertext.
+func sealContent(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// openContent reverses sealContent.
+func openContent(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("malformed encrypted content")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt paste content")
+	}
+	return data, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Client used for "source_url" uploads. Its dialer refuses to connect to
+// private and internal addresses, which is checked after DNS resolution so
+// a public hostname pointing at 127.0.0.1 is rejected too.
+var remoteFetchClient = newRemoteFetchClient()
+
+func newRemoteFetchClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isInternalIP(ip) {
+				return fmt.Errorf("refusing to connect to internal address %s", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               nil, // an environment proxy would bypass the address check
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			// Redirects must pass the same scheme and host checks
+			return checkRemoteURL(req.URL)
+		},
+	}
+}
+
+// isInternalIP reports whether ip is loopback, private, link-local or
+// otherwise not reachable on the public internet.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return true
+	}
+
+	// Carrier-grade NAT (100.64.0.0/10) is private in practice
+	if ip4 := ip.To4(); ip4 != nil && ip4[0] == 100 && ip4[1]&0xc0 == 64 {
+		return true
+	}
+
+	return false
+}
+
+// checkRemoteURL enforces the scheme and host allowlists.
+func checkRemoteURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("source_url must use http or https")
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return errors.New("source_url must include a host")
+	}
+
+	if len(config.RemoteFetchHosts) > 0 {
+		allowed := false
+		for _, h := range config.RemoteFetchHosts {
+			if strings.EqualFold(h, host) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("host %s is not allowed", host)
+		}
+	}
+
+	// Literal IPs can be rejected before dialing at all
+	if ip := net.ParseIP(host); ip != nil && isInternalIP(ip) {
+		return fmt.Errorf("refusing to fetch from internal address %s", host)
+	}
+
+	return nil
+}
+
+// fetchRemoteContent downloads a UTF-8 text document of at most maxBytes.
+func fetchRemoteContent(rawURL string, maxBytes int64) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", errors.New("invalid source_url")
+	}
+	if err := checkRemoteURL(u); err != nil {
+		return "", err
+	}
+
+	resp, err := remoteFetchClient.Get(u.String())
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch source_url: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch source_url: upstream returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(nil, resp.Body, maxBytes))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return "", fmt.Errorf("remote content too large (max %d bytes)", maxBytes)
+		}
+		return "", fmt.Errorf("failed to read source_url: %w", err)
+	}
+
+	if !utf8.Valid(body) {
+		return "", errors.New("remote content is not valid UTF-8 text")
+	}
+
+	return string(body), nil
+}
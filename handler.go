@@ -1,23 +1,69 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
+// Extra request body allowance on top of MaxPasteSize for JSON framing
+const uploadBodySlack = 64 << 10
+
+// maxUploadBodySize is the largest upload request body accepted: enough for
+// a paste of MaxPasteSize sent as content_base64, plus JSON framing.
+func maxUploadBodySize() int64 {
+	return int64(base64.StdEncoding.EncodedLen(config.MaxPasteSize)) + uploadBodySlack
+}
+
+// Paste content is validated as UTF-8 on upload, so raw responses can
+// always declare it rather than leaving browsers to sniff.
+const rawContentType = "text/plain; charset=utf-8"
+
+// decodeJSONBody decodes a JSON request body of at most limit bytes into v.
+// On failure it writes a 413 or 400 response and returns false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, limit int64) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Request body too large (max %s)", formatBytes(limit)), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 type UploadRequest struct {
 	Title     string `json:"title"`
 	Content   string `json:"content"`
 	Language  string `json:"language"`
-	IsPrivate bool   `json:"is_private"`
+	IsPrivate *bool  `json:"is_private"` // nil = the configured default
 	Unlisted  bool   `json:"unlisted"`
 	ExpiresIn *int   `json:"expires_in"` // minutes until expiration, nil = never
+	Validate  bool   `json:"validate"`   // reject malformed content for supported languages
+	SourceURL string `json:"source_url"` // fetch content from this URL instead
+	Filename  string `json:"filename"`   // original filename, used to infer language and title
+
+	ContentBase64 string `json:"content_base64"` // base64 of the UTF-8 content, instead of content
+	SlidingExpiry bool   `json:"sliding_expiry"` // restart the expires_in countdown on every view
+	MaxViews      *int64 `json:"max_views"`      // views before the paste becomes unavailable, nil = unlimited
+	UnlistIn      *int   `json:"unlist_in"`      // minutes until the paste drops off public listings, nil = never
+	Format        bool   `json:"format"`         // pretty-print JSON and Go content before storing it
 }
 
 type PasteUpdateRequest struct {
@@ -27,13 +73,42 @@ type PasteUpdateRequest struct {
 	Unlisted bool   `json:"unlisted"`
 }
 
+// PasteMetaRequest is the body of a PATCH update; omitted fields are left
+// unchanged.
+type PasteMetaRequest struct {
+	Title     *string    `json:"title"`
+	Content   *string    `json:"content"`
+	Language  *string    `json:"language"`
+	Unlisted  *bool      `json:"unlisted"`
+	IsPrivate *bool      `json:"is_private"`
+	ExpiresIn *int       `json:"expires_in"` // minutes from now
+	ExpiresAt *time.Time `json:"expires_at"`
+
+	NeverExpires  bool  `json:"never_expires"` // remove the expiry
+	SlidingExpiry *bool `json:"sliding_expiry"`
+}
+
+// ExtendPasteRequest is the body of POST /api/paste/{id}/extend.
+type ExtendPasteRequest struct {
+	Minutes int `json:"minutes"` // added to the expiry, negative to shorten it
+}
+
+// notfoundHandler renders the 404 page. If 404.html won't parse (say, a bad
+// override in template_dir) it logs the error and falls back to a plain-text
+// 404, rather than turning every missing page into a 500.
 func notfoundHandler(w http.ResponseWriter) {
-	tmpl, err := template.ParseFS(templatesFolder, "templates/404.html")
+	tmpl, err := template.ParseFS(templateFS, "404.html", "partials/*.html")
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Failed to parse template 404.html: %v", err)
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
 	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusNotFound)
-	tmpl.Execute(w, nil)
+	if err := tmpl.Execute(w, TemplateData{Branding: siteBranding()}); err != nil {
+		log.Printf("Failed to render template 404.html: %v", err)
+	}
 }
 
 func livezHandler(w http.ResponseWriter, req *http.Request) {
@@ -52,15 +127,296 @@ func readyzHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "200")
 }
 
+// healthHandler reports the deployed build and whether the database can be
+// reached. Load balancers poll it, so it costs a ping and nothing more;
+// admins find the cleanup backlog at GET /api/admin/cleanup.
 func healthHandler(w http.ResponseWriter, req *http.Request) {
+	resp := map[string]interface{}{
+		"status":         "ok",
+		"version":        version,
+		"commit":         buildCommit(),
+		"go_version":     runtime.Version(),
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+	}
+
+	status := http.StatusOK
+	if err := pingDatabase(req.Context()); err != nil {
+		log.Printf("Health check failed to reach the database: %v", err)
+		resp["status"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, `{"status":"ok"}`)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func languagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(languages)
+}
+
+// configHandler reports the upload limits and options clients need to know
+// about. See PublicConfig for what is included.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(publicConfig(config))
+}
+
+// trendingHandler lists the most viewed public pastes over ?window= (a Go
+// duration such as 24h, default 24h, at most 30 days).
+func trendingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.EnablePublicBrowse {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	window := 24 * time.Hour
+	if v := r.URL.Query().Get("window"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > trendingMaxWindow {
+			http.Error(w, fmt.Sprintf("Invalid window (use a duration up to %s, e.g. 24h)", trendingMaxWindow), http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+
+	trending, err := pasteService.GetTrendingPastes(time.Now().Add(-window), 10)
+	if err != nil {
+		http.Error(w, "Error loading trending pastes", http.StatusInternalServerError)
+		return
+	}
+
+	type trendingEntry struct {
+		ID        string    `json:"id"`
+		URL       string    `json:"url"`
+		Title     string    `json:"title"`
+		Language  string    `json:"language"`
+		Views     int64     `json:"views"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	entries := make([]trendingEntry, len(trending))
+	for i, p := range trending {
+		entries[i] = trendingEntry{
+			ID:        p.ID,
+			URL:       config.ServePath + p.ID,
+			Title:     p.Title,
+			Language:  p.Language,
+			Views:     p.RecentViews,
+			CreatedAt: p.CreatedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// writeRawContent sends paste content as plain text. io.WriteString hands
+// the string straight to the connection, where fmt.Fprint would first copy
+// all of it into a buffer and hold a large paste in memory twice.
+func writeRawContent(w http.ResponseWriter, content, disposition string) {
+	w.Header().Set("Content-Type", rawContentType)
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	io.WriteString(w, content)
+}
+
+// setPasteMetaHeaders describes a raw paste in X-Paste-Language and
+// X-Paste-Title, so CLI tools get its metadata without another request.
+func setPasteMetaHeaders(w http.ResponseWriter, paste *Paste) {
+	w.Header().Set("X-Paste-Language", paste.Language)
+	if paste.Title != "" {
+		w.Header().Set("X-Paste-Title", headerSafeText(paste.Title))
+	}
+}
+
+// headerSafeText returns s as-is if it is printable ASCII, and otherwise
+// percent-encoded with an RFC 5987 UTF-8 charset prefix, since header
+// values can't carry raw UTF-8 or control characters.
+func headerSafeText(s string) string {
+	plain := true
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteString("UTF-8''")
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Number of pastes returned by /api/recent unless ?limit= says otherwise
+const recentPastesDefaultLimit = 20
+
+// Pastes per page on /all and /my-pastes unless ?per_page= says otherwise
+const listPageSize = 50
+
+// pageSizeParam reads a page size from the named query parameter, falling
+// back to def, and clamps it to max_page_size. The size actually used is
+// reported in an X-Page-Size header. Anything but a positive integer gets a
+// 400 and ok = false.
+func pageSizeParam(w http.ResponseWriter, r *http.Request, name string, def int) (size int, ok bool) {
+	size = def
+	if v := r.URL.Query().Get(name); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("Invalid %s", name), http.StatusBadRequest)
+			return 0, false
+		}
+		size = n
+	}
+
+	size = min(size, config.MaxPageSize)
+	w.Header().Set("X-Page-Size", strconv.Itoa(size))
+	return size, true
+}
+
+// pageParam reads the 1-based ?page= number, 1 if absent. Anything but a
+// positive integer gets a 400 and ok = false.
+func pageParam(w http.ResponseWriter, r *http.Request) (page int, ok bool) {
+	v := r.URL.Query().Get("page")
+	if v == "" {
+		return 1, true
+	}
+	page, err := strconv.Atoi(v)
+	if err != nil || page < 1 {
+		http.Error(w, "Invalid page", http.StatusBadRequest)
+		return 0, false
+	}
+	return page, true
+}
+
+// Pagination is the paging state passed to list templates. PrevPage and
+// NextPage are 0 when there is no such page.
+type Pagination struct {
+	Page     int
+	PerPage  int
+	PrevPage int
+	NextPage int
+}
+
+func newPagination(page, perPage int, total int64) Pagination {
+	p := Pagination{Page: page, PerPage: perPage}
+	if page > 1 {
+		p.PrevPage = page - 1
+	}
+	if int64(page*perPage) < total {
+		p.NextPage = page + 1
+	}
+	return p
+}
+
+// pasteIDAvailableHandler serves GET /api/paste/available?id=foo, telling a
+// frontend whether an ID is free before it submits a paste with it.
+func pasteIDAvailableHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Missing id", http.StatusBadRequest)
+		return
+	}
+
+	if allowed, _, reset := idAvailabilityRateLimiter.Allow(rateLimitKey(r)); !allowed {
+		w.Header().Set("Retry-After", idAvailabilityRateLimiter.retryAfter(reset))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	available, reason, err := pasteService.PasteIDAvailable(id)
+	if err != nil {
+		http.Error(w, "Error checking id", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Available bool   `json:"available"`
+		Reason    string `json:"reason,omitempty"`
+	}{available, reason})
+}
+
+// recentHandler serves GET /api/recent: the newest public, listed pastes
+// as JSON, for custom frontends.
+func recentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.EnablePublicBrowse {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	limit, ok := pageSizeParam(w, r, "limit", recentPastesDefaultLimit)
+	if !ok {
+		return
+	}
+
+	recent, err := pasteService.GetRecentPublicPastes(limit)
+	if err != nil {
+		http.Error(w, "Error loading recent pastes", http.StatusInternalServerError)
+		return
+	}
+
+	type recentEntry struct {
+		ID        string    `json:"id"`
+		URL       string    `json:"url"`
+		Title     string    `json:"title"`
+		Language  string    `json:"language"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	entries := make([]recentEntry, len(recent))
+	for i, p := range recent {
+		entries[i] = recentEntry{
+			ID:        p.ID,
+			URL:       config.ServePath + p.ID,
+			Title:     p.Title,
+			Language:  p.Language,
+			CreatedAt: p.CreatedAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
 }
 
 // Serve paste
 func servePasteHandler(w http.ResponseWriter, r *http.Request) {
 	pasteID := strings.TrimPrefix(r.URL.Path, config.ServePath)
+	pasteID, asImage := strings.CutSuffix(pasteID, "/image.png")
 
 	if pasteID == "" {
 		notfoundHandler(w)
@@ -75,170 +431,694 @@ func servePasteHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	paste, err := pasteService.GetPaste(pasteID, userID)
+	if err != nil && config.PasteIDPrefix != "" && !strings.HasPrefix(pasteID, config.PasteIDPrefix) {
+		// Links with the prefix left off still resolve
+		paste, err = pasteService.GetPaste(config.PasteIDPrefix+pasteID, userID)
+	}
+	if err != nil && config.SequentialIDs {
+		// String IDs win, so a random ID that happens to be all digits still resolves
+		if seq, convErr := strconv.ParseUint(pasteID, 10, 0); convErr == nil {
+			paste, err = pasteService.GetPasteBySeq(uint(seq), userID)
+		}
+	}
 	if err != nil {
 		notfoundHandler(w)
 		return
 	}
 
-	// Check if this is an API request (raw paste)
-	if r.URL.Query().Get("raw") == "1" || r.Header.Get("Accept") == "text/plain" {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprint(w, paste.Content)
+	// Only the owner gets this far with an expired paste
+	if paste.Expired() {
+		w.Header().Set("X-Paste-Expired", "true")
+	}
+
+	// Every form of the paste counts as a view, the image included. Owners
+	// looking at their own paste don't count towards trending or max_views.
+	if userID == nil || paste.UserID == nil || *paste.UserID != *userID {
+		err := pasteService.RecordView(paste.ID)
+		if errors.Is(err, errViewLimitReached) {
+			notfoundHandler(w)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to record view of paste %s: %v", paste.ID, err)
+		}
+	}
+
+	// ?lang= re-highlights the paste for this view only
+	detected := viewLanguage(paste)
+	language := detected
+	if lang, ok := lookupLanguage(r.URL.Query().Get("lang")); ok {
+		language = lang.Name
+	}
+
+	// ?theme= picks the colours, and is remembered for later views
+	theme := viewTheme(w, r)
+
+	if asImage {
+		pasteImageHandler(w, paste, language, theme)
 		return
 	}
 
-	// Render HTML view with syntax highlighting
-	tmpl, err := template.ParseFS(templatesFolder, "templates/view-paste.html")
-	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+	// Download: the raw content as a file named after the paste
+	if r.URL.Query().Get("download") == "1" {
+		setPasteMetaHeaders(w, paste)
+		writeRawContent(w, paste.Content, fmt.Sprintf(`attachment; filename="%s"`, downloadFilename(paste, detected)))
+		return
+	}
+
+	// Check if this is an API request (raw paste)
+	if r.URL.Query().Get("raw") == "1" || r.Header.Get("Accept") == "text/plain" {
+		setPasteMetaHeaders(w, paste)
+		writeRawContent(w, paste.Content, "inline")
 		return
 	}
 
+	// Render HTML view with syntax highlighting
 	data := struct {
-		Paste    *Paste
-		CanEdit  bool
-		Username string
+		TemplateData
+		Paste         *Paste
+		Language      string // highlighting language, which ?lang= may override
+		Theme         string // highlighting theme, which ?theme= may override
+		Themes        []string
+		Highlighted   template.HTML // content highlighted server-side, empty for markdown
+		ThemeCSS      template.CSS
+		ExpiresIn     string // time left before the paste expires, empty if it doesn't
+		CanEdit       bool
+		ViewOnlyToken string // for the owner's view-only link
 	}{
-		Paste:   paste,
-		CanEdit: user != nil && paste.UserID != nil && *paste.UserID == user.ID,
+		TemplateData: templateDataForUser(user),
+		Paste:        paste,
+		Language:     language,
+		Theme:        theme,
+		Themes:       themeNames(),
+	}
+	if language != "markdown" {
+		// On failure the template falls back to the unhighlighted content,
+		// as it does for pastes too large to highlight
+		highlighted, err := highlightHTML(paste.Content, language, theme)
+		if err == nil {
+			data.ThemeCSS, err = themeCSS(theme)
+		}
+		if err != nil && !errors.Is(err, errTooLargeToHighlight) {
+			log.Printf("Failed to highlight paste %s: %v", paste.ID, err)
+		} else if err == nil {
+			data.Highlighted = highlighted
+		}
+	}
+	if paste.ExpiresAt != nil && !paste.Expired() {
+		data.ExpiresIn = humanDuration(time.Until(*paste.ExpiresAt))
 	}
 
-	if user != nil {
-		data.Username = user.Username
+	// A view-only link hides the owner's controls, e.g. for screensharing
+	isOwner := user != nil && paste.UserID != nil && *paste.UserID == user.ID
+	if isOwner && !validViewOnlyToken(paste.ID, r.URL.Query().Get("view")) {
+		data.CanEdit = true
+		data.ViewOnlyToken = viewOnlyToken(paste.ID)
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, data)
+	renderTemplate(w, http.StatusOK, "view-paste.html", data)
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Only accept POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, http.StatusMethodNotAllowed, msgMethodNotAllowed)
+		return
+	}
+
+	// Get current user
+	user := getCurrentUser(r)
+	var userID *uint
+	if user != nil {
+		userID = &user.ID
+	}
+
+	if userID == nil && !config.AllowAnonymousUploads {
+		httpError(w, http.StatusUnauthorized, msgLoginRequiredToUpload)
+		return
+	}
+
+	if err := checkUploadOrigin(r); err != nil {
+		writeError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if rejectIfUploadsBlocked(w) {
+		return
+	}
+
+	release, ok := acquireUploadSlot(w, r)
+	if !ok {
 		return
 	}
+	defer release()
+
+	// Retries carrying the same Idempotency-Key get the original paste back
+	var idempotencyKey string
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		if len(key) > 255 {
+			httpError(w, http.StatusBadRequest, msgIdempotencyKeyTooLong)
+			return
+		}
+		idempotencyKey = idempotencyScope(r, userID) + ":" + key
+		if paste, err := pasteService.GetIdempotentPaste(idempotencyKey); err == nil {
+			writeUploadResponse(w, r, paste)
+			return
+		}
+	}
 
-	// Read the raw text from the request body
+	// Read the raw text from the request body. JSON uploads carry some
+	// framing, escaping or base64 on top of the content, so allow for it;
+	// CreatePaste enforces the exact limit on the decoded content.
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBodySize())
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "Error reading paste", http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			httpError(w, http.StatusRequestEntityTooLarge, msgPasteTooLarge, formatBytes(int64(config.MaxPasteSize)))
+			return
+		}
+		httpError(w, http.StatusBadRequest, msgPasteReadFailed)
 		return
 	}
 	defer r.Body.Close()
 
 	// Check if body is empty
 	if len(body) == 0 {
-		http.Error(w, "Empty paste", http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, msgEmptyPaste)
 		return
 	}
 
 	// Check if it's valid UTF-8 text
 	text := string(body)
 	if !utf8.ValidString(text) {
-		http.Error(w, "Invalid UTF-8 text", http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, msgInvalidUTF8)
 		return
 	}
 
-	// Default values
-	title := ""
-	language := "text"
-	isPrivate := false
-	unlisted := false
-	var expiresIn *int
-
 	// Try to parse as JSON for new API
 	var uploadReq UploadRequest
-	if err := json.Unmarshal(body, &uploadReq); err == nil {
-		// JSON was parsed successfully
-		if uploadReq.Content == "" {
-			http.Error(w, "Empty paste", http.StatusBadRequest)
-			return
+	isJSON, err := parseUploadRequest(r, body, &uploadReq)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	if !isJSON {
+		// Legacy plain text upload - options come from query params
+		uploadReq = UploadRequest{
+			Content:  text,
+			Language: query.Get("language"),
+			Unlisted: query.Get("unlisted") == "1",
 		}
-		title = uploadReq.Title
-		text = uploadReq.Content
-		if uploadReq.Language != "" {
-			language = uploadReq.Language
+		if query.Has("private") {
+			private := query.Get("private") == "1"
+			uploadReq.IsPrivate = &private
 		}
-		isPrivate = uploadReq.IsPrivate
-		unlisted = uploadReq.Unlisted
-		expiresIn = uploadReq.ExpiresIn
-	} else {
-		// Legacy plain text upload - check query params
-		language = r.URL.Query().Get("language")
-		if language == "" {
-			language = "text"
+	}
+	if uploadReq.Filename == "" {
+		uploadReq.Filename = query.Get("filename")
+	}
+	uploadReq.Validate = uploadReq.Validate || query.Get("validate") == "1"
+	uploadReq.Format = uploadReq.Format || query.Get("format") == "1"
+
+	upload, status, err := prepareUpload(&uploadReq, userID)
+	if err != nil {
+		writeError(w, err, status)
+		return
+	}
+
+	paste, err := upload.create(pasteService, userID)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if idempotencyKey != "" {
+		if err := pasteService.SaveIdempotencyKey(idempotencyKey, paste.ID); err != nil {
+			log.Printf("Failed to save idempotency key for paste %s: %v", paste.ID, err)
 		}
-		isPrivate = r.URL.Query().Get("private") == "1"
-		unlisted = r.URL.Query().Get("unlisted") == "1"
 	}
 
-	// Get current user
+	writeUploadResponse(w, r, paste)
+
+	if config.Debug {
+		fmt.Printf("New paste: %s (user: %v, private: %v, language: %s)\n", paste.ID, userID, paste.IsPrivate, paste.Language)
+	}
+}
+
+// Most pastes accepted in one batch upload
+const batchMaxPastes = 50
+
+// batchUploadResult reports the outcome for the paste at the same index of
+// a batch upload: its ID and URL, or why it was rejected.
+type batchUploadResult struct {
+	ID         string `json:"id,omitempty"`
+	URL        string `json:"url,omitempty"`
+	ClaimToken string `json:"claim_token,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"` // see messages.go, for errors that have one
+}
+
+func (res *batchUploadResult) fail(err error) {
+	res.Error = err.Error()
+	res.Code = errorCode(err)
+}
+
+// batchUploadHandler serves POST /api/paste/batch: an array of upload
+// objects, each created under the same rules as a single JSON upload. One
+// bad item doesn't sink the rest, so results are reported per item.
+func batchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	user := getCurrentUser(r)
 	var userID *uint
 	if user != nil {
 		userID = &user.ID
 	}
 
-	// Anonymous users cannot create private pastes
-	if isPrivate && userID == nil {
-		http.Error(w, "Must be logged in to create private pastes", http.StatusUnauthorized)
+	if userID == nil && !config.AllowAnonymousUploads {
+		httpError(w, http.StatusUnauthorized, msgLoginRequiredToUpload)
 		return
 	}
 
-	paste, err := pasteService.CreatePaste(title, text, language, isPrivate, unlisted, expiresIn, userID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := checkUploadOrigin(r); err != nil {
+		writeError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if rejectIfUploadsBlocked(w) {
 		return
 	}
 
+	release, ok := acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// The whole batch is held in memory, so together its pastes get the
+	// allowance of a single upload
+	var items []json.RawMessage
+	if !decodeJSONBody(w, r, &items, maxUploadBodySize()) {
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, "Batch must contain at least one paste", http.StatusBadRequest)
+		return
+	}
+	if len(items) > batchMaxPastes {
+		http.Error(w, fmt.Sprintf("Batch too large (max %d pastes)", batchMaxPastes), http.StatusBadRequest)
+		return
+	}
+
+	// Validate everything (and fetch any source_urls) before touching the database
+	results := make([]batchUploadResult, len(items))
+	uploads := make([]*pasteUpload, len(items))
+	for i, item := range items {
+		var req UploadRequest
+		if err := decodeUploadRequest(item, &req); err != nil {
+			results[i].fail(err)
+			continue
+		}
+		upload, _, err := prepareUpload(&req, userID)
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+		uploads[i] = upload
+	}
+
+	if err := createUploads(uploads, results, userID); err != nil {
+		http.Error(w, "Failed to create pastes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// createUploads creates each prepared upload, recording the outcome in the
+// result at the same index. Nil uploads were already rejected and are
+// skipped. Creating in one transaction means each paste's quota check
+// counts the ones before it.
+func createUploads(uploads []*pasteUpload, results []batchUploadResult, userID *uint) error {
+	return pasteService.Transaction(func(tx *PasteService) error {
+		for i, upload := range uploads {
+			if upload == nil {
+				continue
+			}
+			paste, err := upload.create(tx, userID)
+			if err != nil {
+				results[i].fail(err)
+				continue
+			}
+			results[i].ID = paste.ID
+			results[i].URL = config.ServePath + paste.ID
+			results[i].ClaimToken = paste.claimToken
+		}
+		return nil
+	})
+}
+
+// pasteUpload is an upload request resolved into the arguments for
+// CreatePasteWithOptions.
+type pasteUpload struct {
+	title, text, language string
+	isPrivate, unlisted   bool
+	expiresIn             *int
+	opts                  PasteOptions
+}
+
+func (u *pasteUpload) create(service *PasteService, userID *uint) (*Paste, error) {
+	return service.CreatePasteWithOptions(u.title, u.text, u.language, u.isPrivate, u.unlisted, u.expiresIn, userID, u.opts)
+}
+
+// prepareUpload applies the upload rules shared by single and batch uploads:
+// fetching source_url, filename hints, the private default and the size
+// limit. Failures come with the HTTP status to report them as.
+func prepareUpload(req *UploadRequest, userID *uint) (*pasteUpload, int, error) {
+	if req.ContentBase64 != "" {
+		if req.Content != "" || req.SourceURL != "" {
+			return nil, http.StatusBadRequest, newCodedError(msgBase64WithContent)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(req.ContentBase64)
+		if err != nil {
+			return nil, http.StatusBadRequest, newCodedError(msgBase64Invalid)
+		}
+		if !utf8.Valid(decoded) {
+			return nil, http.StatusBadRequest, newCodedError(msgBase64NotUTF8)
+		}
+		req.Content = string(decoded)
+	}
+	if req.SourceURL != "" {
+		if req.Content != "" {
+			return nil, http.StatusBadRequest, newCodedError(msgSourceURLWithContent)
+		}
+		if !config.RemoteFetch {
+			return nil, http.StatusForbidden, newCodedError(msgSourceURLDisabled)
+		}
+		content, err := fetchRemoteContent(req.SourceURL, int64(config.MaxPasteSize))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		req.Content = content
+	}
+	if req.Content == "" {
+		return nil, http.StatusBadRequest, newCodedError(msgEmptyPaste)
+	}
+
+	upload := &pasteUpload{
+		title:     req.Title,
+		text:      req.Content,
+		language:  req.Language,
+		unlisted:  req.Unlisted,
+		expiresIn: req.ExpiresIn,
+		opts: PasteOptions{
+			ValidateJSON:  req.Validate,
+			Format:        req.Format,
+			SlidingExpiry: req.SlidingExpiry,
+			MaxViews:      req.MaxViews,
+			UnlistIn:      req.UnlistIn,
+		},
+	}
+
+	// A filename hint fills in whatever the client didn't set explicitly
+	if req.Filename != "" {
+		if upload.language == "" {
+			upload.language = languageForFilename(req.Filename)
+		}
+		if upload.title == "" {
+			upload.title = filenameTitle(req.Filename)
+		}
+	}
+	if upload.language == "" {
+		upload.language = "text"
+	}
+
+	// Anonymous pastes can't be private, so the default only applies to users
+	if req.IsPrivate != nil {
+		upload.isPrivate = *req.IsPrivate
+	} else if userID != nil && config.DefaultPrivateForUsers {
+		upload.isPrivate = true
+	}
+
+	// Anonymous users cannot create private pastes
+	if upload.isPrivate && userID == nil {
+		return nil, http.StatusUnauthorized, newCodedError(msgLoginRequiredForPrivate)
+	}
+
+	if len(upload.text) > config.MaxPasteSize {
+		return nil, http.StatusRequestEntityTooLarge, newCodedError(msgPasteTooLarge, formatBytes(int64(config.MaxPasteSize)))
+	}
+
+	return upload, http.StatusOK, nil
+}
+
+func writeUploadResponse(w http.ResponseWriter, r *http.Request, paste *Paste) {
 	serveURL := fmt.Sprintf("%s%s", config.ServePath, paste.ID)
 
 	// Return JSON if request was JSON, otherwise plain text
 	if r.Header.Get("Content-Type") == "application/json" {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{
+		resp := map[string]string{
 			"url": serveURL,
 			"id":  paste.ID,
-		})
+		}
+		if paste.claimToken != "" {
+			resp["claim_token"] = paste.claimToken
+		}
+		if paste.ShortCode != nil {
+			resp["short_code"] = *paste.ShortCode
+			resp["short_url"] = shortCodePath + *paste.ShortCode
+		}
+		json.NewEncoder(w).Encode(resp)
 	} else {
+		if paste.claimToken != "" {
+			w.Header().Set("X-Claim-Token", paste.claimToken)
+		}
+		if paste.ShortCode != nil {
+			w.Header().Set("X-Short-URL", shortCodePath+*paste.ShortCode)
+		}
 		fmt.Fprintf(w, serveURL)
 	}
+}
+
+// parseUploadRequest decodes a JSON upload body into req and reports whether
+// the body was JSON at all. Requests declaring Content-Type application/json
+// are decoded strictly, so misspelled fields and wrong types are errors.
+// Anything else is only treated as JSON if it happens to parse, and is
+// otherwise a legacy plain-text upload.
+func parseUploadRequest(r *http.Request, body []byte, req *UploadRequest) (bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if json.Unmarshal(body, req) != nil {
+			return false, nil
+		}
+		return true, validateUploadRequest(req)
+	}
+
+	return true, decodeUploadRequest(body, req)
+}
+
+// decodeUploadRequest strictly decodes a single JSON upload object, turning
+// decoder errors into messages that name the offending field.
+func decodeUploadRequest(data []byte, req *UploadRequest) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return newCodedError(msgRequestFieldType, typeErr.Field, jsonTypeName(typeErr.Type))
+		case errors.As(err, &typeErr):
+			return newCodedError(msgRequestNotObject)
+		case errors.As(err, &syntaxErr):
+			return newCodedError(msgRequestSyntax, syntaxErr.Offset)
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return newCodedError(msgRequestUnknownField, strings.TrimPrefix(err.Error(), "json: unknown field "))
+		default:
+			return newCodedError(msgRequestInvalidJSON)
+		}
+	}
+	if decoder.More() {
+		return newCodedError(msgRequestTrailingData)
+	}
+
+	return validateUploadRequest(req)
+}
+
+// validateUploadRequest rejects field values that parse but make no sense.
+func validateUploadRequest(req *UploadRequest) error {
+	if req.ExpiresIn != nil {
+		return validateExpiresIn(*req.ExpiresIn)
+	}
+	return nil
+}
+
+// jsonTypeName describes a Go type in JSON terms for error messages.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch kind := t.Kind(); kind {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	default:
+		return "a " + kind.String()
+	}
+}
+
+// idempotencyScope keeps Idempotency-Keys from different callers apart:
+// authenticated uploads are scoped to the user, anonymous ones to the IP.
+func idempotencyScope(r *http.Request, userID *uint) string {
+	if userID != nil {
+		return fmt.Sprintf("user:%d", *userID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+func updatePasteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	pasteID := strings.TrimPrefix(r.URL.Path, "/api/paste/update/")
+
+	// Updates can carry paste content, so they get the upload size limit
+	// rather than MaxJSONBodySize
+	var paste *Paste
+	var err error
+	if r.Method == http.MethodPatch {
+		// Partial update: only the fields present in the body change
+		var req PasteMetaRequest
+		if !decodeJSONBody(w, r, &req, int64(config.MaxPasteSize)+uploadBodySlack) {
+			return
+		}
+
+		paste, err = pasteService.UpdatePasteMeta(pasteID, user.ID, PasteMetaUpdate{
+			Title:     req.Title,
+			Content:   req.Content,
+			Language:  req.Language,
+			Unlisted:  req.Unlisted,
+			IsPrivate: req.IsPrivate,
+			ExpiresIn: req.ExpiresIn,
+			ExpiresAt: req.ExpiresAt,
+
+			NeverExpires:  req.NeverExpires,
+			SlidingExpiry: req.SlidingExpiry,
+		})
+	} else {
+		var req PasteUpdateRequest
+		if !decodeJSONBody(w, r, &req, int64(config.MaxPasteSize)+uploadBodySlack) {
+			return
+		}
+
+		paste, err = pasteService.UpdatePaste(pasteID, req.Title, req.Content, req.Language, req.Unlisted, user.ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"paste":   paste,
+	})
+}
+
+// extendPasteHandler serves POST /api/paste/{id}/extend, which lets the owner
+// push a paste's expiry back (or forward) without editing it.
+func extendPasteHandler(w http.ResponseWriter, r *http.Request) {
+	pasteID, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/paste/"), "/extend")
+	if !ok || pasteID == "" || strings.Contains(pasteID, "/") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	var req ExtendPasteRequest
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
+		return
+	}
+
+	paste, err := pasteService.ExtendPaste(pasteID, user.ID, req.Minutes)
+	switch {
+	case errors.Is(err, errPasteNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errNotPasteOwner):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if config.Debug {
-		fmt.Printf("New paste: %s (user: %v, private: %v, language: %s)\n", paste.ID, userID, isPrivate, language)
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"paste":   paste,
+	})
 }
 
-func updatePasteHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+func duplicatePasteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
-	pasteID := strings.TrimPrefix(r.URL.Path, "/api/paste/update/")
-
-	var req PasteUpdateRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if rejectIfUploadsBlocked(w) {
 		return
 	}
 
-	paste, err := pasteService.UpdatePaste(pasteID, req.Title, req.Content, req.Language, req.Unlisted, user.ID)
+	pasteID := strings.TrimPrefix(r.URL.Path, "/api/paste/duplicate/")
+
+	paste, err := pasteService.DuplicatePaste(pasteID, user.ID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"paste":   paste,
+	json.NewEncoder(w).Encode(map[string]string{
+		"url": fmt.Sprintf("%s%s", config.ServePath, paste.ID),
+		"id":  paste.ID,
 	})
 }
 
@@ -250,7 +1130,7 @@ func deletePasteHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
@@ -268,31 +1148,37 @@ func deletePasteHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func allPastesHandler(w http.ResponseWriter, r *http.Request) {
-	pastes, err := pasteService.GetAllPublicPastes()
-	if err != nil {
-		http.Error(w, "Error loading pastes", http.StatusInternalServerError)
+	if !config.EnablePublicBrowse {
+		notfoundHandler(w)
+		return
+	}
+
+	page, ok := pageParam(w, r)
+	if !ok {
+		return
+	}
+	perPage, ok := pageSizeParam(w, r, "per_page", listPageSize)
+	if !ok {
 		return
 	}
 
-	tmpl, err := template.ParseFS(templatesFolder, "templates/all-pastes.html")
+	pastes, total, err := pasteService.GetPublicPastesPage(perPage, (page-1)*perPage)
 	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+		http.Error(w, "Error loading pastes", http.StatusInternalServerError)
 		return
 	}
 
-	user := getCurrentUser(r)
 	data := struct {
-		Pastes   []Paste
-		Username string
+		TemplateData
+		Pagination
+		Pastes []Paste
 	}{
-		Pastes: pastes,
-	}
-	if user != nil {
-		data.Username = user.Username
+		TemplateData: baseTemplateData(r),
+		Pagination:   newPagination(page, perPage, total),
+		Pastes:       pastes,
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, data)
+	renderTemplate(w, http.StatusOK, "all-pastes.html", data)
 }
 
 // API Key handlers
@@ -305,22 +1191,15 @@ func apiKeysPageHandler(w http.ResponseWriter, r *http.Request) {
 
 	keys, _ := apikeyService.GetUserAPIKeys(user.ID)
 
-	tmpl, err := template.ParseFS(templatesFolder, "templates/api-keys.html")
-	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
-		return
-	}
-
 	data := struct {
-		Username string
-		Keys     []APIKey
+		TemplateData
+		Keys []APIKey
 	}{
-		Username: user.Username,
-		Keys:     keys,
+		TemplateData: templateDataForUser(user),
+		Keys:         keys,
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, data)
+	renderTemplate(w, http.StatusOK, "api-keys.html", data)
 }
 
 func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
@@ -331,7 +1210,7 @@ func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
@@ -339,8 +1218,7 @@ func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 		Name          string `json:"name"`
 		ExpiresInDays *int   `json:"expires_in_days"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
 		return
 	}
 
@@ -367,15 +1245,14 @@ func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
 	var req struct {
 		ID uint `json:"id"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
 		return
 	}
 
@@ -387,11 +1264,54 @@ func deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// Most usage records GET /api/keys/{id}/usage returns
+const maxAPIKeyUsageLimit = 500
+
+// apiKeyUsageHandler serves GET /api/keys/{id}/usage: the recent requests
+// made with one of the caller's API keys.
+func apiKeyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	idPart, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/keys/"), "/usage")
+	keyID, err := strconv.ParseUint(idPart, 10, 0)
+	if !ok || err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
+		return
+	}
+
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxAPIKeyUsageLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxAPIKeyUsageLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	usage, err := apikeyService.GetUsage(uint(keyID), user.ID, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
 // Search handler
 func searchPastesHandler(w http.ResponseWriter, r *http.Request) {
 	user := getCurrentUser(r)
 	if user == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		httpError(w, http.StatusUnauthorized, msgUnauthorized)
 		return
 	}
 
@@ -401,14 +1321,30 @@ func searchPastesHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pastes, err := pasteService.SearchUserPastes(user.ID, query)
+	opts := SearchOptions{Sort: r.URL.Query().Get("sort"), Language: r.URL.Query().Get("language")}
+	var ok bool
+	if opts.Page, ok = pageParam(w, r); !ok {
+		return
+	}
+	if opts.PerPage, ok = pageSizeParam(w, r, "per_page", 20); !ok {
+		return
+	}
+
+	pastes, total, err := pasteService.SearchUserPastesPage(user.ID, query, opts)
+	if errors.Is(err, errInvalidSearchSort) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// The body stays a plain array for existing clients; the match count
+	// across all pages is reported in a header
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(pastes)
+	json.NewEncoder(w).Encode(newSearchResults(pastes, query))
 }
 
 // Admin handlers
@@ -420,23 +1356,137 @@ func adminPanelHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	users, _ := adminService.GetAllUsers()
+	usage, _ := adminService.GetStorageUsage()
+
+	type adminUserRow struct {
+		User
+		Usage         string // "used of quota", for display
+		QuotaOverride bool
+	}
+
+	rows := make([]adminUserRow, len(users))
+	for i, u := range users {
+		quota := "unlimited"
+		if q := effectiveQuota(&u); q > 0 {
+			quota = formatBytes(q)
+		}
+		rows[i] = adminUserRow{
+			User:          u,
+			Usage:         fmt.Sprintf("%s of %s", formatBytes(usage[u.ID]), quota),
+			QuotaOverride: u.QuotaBytes != nil,
+		}
+	}
+
+	data := struct {
+		TemplateData
+		Users []adminUserRow
+	}{
+		TemplateData: templateDataForUser(user),
+		Users:        rows,
+	}
+
+	renderTemplate(w, http.StatusOK, "admin-panel.html", data)
+}
+
+// Pastes per page on the admin user pastes view
+const adminPastesPageSize = 50
+
+// adminUserPastesPageHandler shows all of one user's pastes at
+// /admin/user/{id} so admins can review them before taking action.
+func adminUserPastesPageHandler(w http.ResponseWriter, r *http.Request) {
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	targetID, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/user/"), 10, 64)
+	if err != nil {
+		notfoundHandler(w)
+		return
+	}
+
+	page, ok := pageParam(w, r)
+	if !ok {
+		return
+	}
+	perPage, ok := pageSizeParam(w, r, "per_page", adminPastesPageSize)
+	if !ok {
+		return
+	}
 
-	tmpl, err := template.ParseFS(templatesFolder, "templates/admin-panel.html")
+	pastes, total, err := adminService.GetUserPastesAdmin(uint(targetID), perPage, (page-1)*perPage)
 	if err != nil {
-		http.Error(w, "Template error", http.StatusInternalServerError)
+		notfoundHandler(w)
 		return
 	}
+	stats, _ := adminService.GetUserStats(uint(targetID))
 
 	data := struct {
-		Username string
-		Users    []User
+		TemplateData
+		Pagination
+		TargetID uint
+		Stats    map[string]interface{}
+		Pastes   []Paste
+		Total    int64
 	}{
-		Username: user.Username,
-		Users:    users,
+		TemplateData: templateDataForUser(user),
+		Pagination:   newPagination(page, perPage, total),
+		TargetID:     uint(targetID),
+		Stats:        stats,
+		Pastes:       pastes,
+		Total:        total,
 	}
 
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	tmpl.Execute(w, data)
+	renderTemplate(w, http.StatusOK, "admin-user-pastes.html", data)
+}
+
+// adminUserPastesHandler returns one user's pastes as JSON:
+// /api/admin/user-pastes?user_id=N&limit=50&offset=0
+func adminUserPastesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	targetID, err := strconv.ParseUint(query.Get("user_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	limit, offset := adminPastesPageSize, 0
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	pastes, total, err := adminService.GetUserPastesAdmin(uint(targetID), limit, offset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":  total,
+		"pastes": pastes,
+	})
 }
 
 func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -454,8 +1504,7 @@ func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		UserID uint `json:"user_id"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
 		return
 	}
 
@@ -465,10 +1514,227 @@ func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := adminService.DeleteUser(req.UserID); err != nil {
+	if err := adminService.DeleteUser(user.ID, req.UserID); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
+
+// adminQuotaHandler sets or clears a user's storage quota override.
+// A null or missing quota_bytes clears it.
+func adminQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		UserID     uint   `json:"user_id"`
+		QuotaBytes *int64 `json:"quota_bytes"`
+	}
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
+		return
+	}
+
+	if err := adminService.SetUserQuota(user.ID, req.UserID, req.QuotaBytes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := adminService.GetUserStats(req.UserID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// adminAuditHandler returns the audit log as JSON, newest first:
+// /api/admin/audit?limit=50&offset=0
+func adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	limit, offset := adminPastesPageSize, 0
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, total, err := adminService.GetAuditLog(limit, offset)
+	if err != nil {
+		log.Printf("Failed to load audit log: %v", err)
+		http.Error(w, "Failed to load audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   total,
+		"entries": entries,
+	})
+}
+
+func adminExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	includeUsers := r.URL.Query().Get("users") == "1"
+	includePasswordHashes := r.URL.Query().Get("password_hashes") == "1"
+
+	adminService.RecordAudit(user.ID, auditExport, "", fmt.Sprintf("users=%t password_hashes=%t", includeUsers, includePasswordHashes))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="pb-export.ndjson"`)
+
+	// Headers are already sent, so a failure part way can only be logged
+	if err := adminService.Export(w, includeUsers, includePasswordHashes); err != nil {
+		log.Printf("Export failed: %v", err)
+	}
+}
+
+// CleanupReport counts the rows removed by an on-demand cleanup.
+type CleanupReport struct {
+	ExpiredSessions  int64 `json:"expired_sessions"`
+	ExpiredPastes    int64 `json:"expired_pastes"`
+	ExpiredAPIKeys   int64 `json:"expired_api_keys"`
+	DeletedPastes    int64 `json:"deleted_pastes"`
+	OrphanedSessions int64 `json:"orphaned_sessions"`
+	OrphanedAPIKeys  int64 `json:"orphaned_api_keys"`
+	OrphanedAdmins   int64 `json:"orphaned_admins"`
+}
+
+// adminCleanupHandler reports what has expired but not been removed yet on
+// GET. On POST it runs the periodic cleanups plus orphan pruning right away,
+// for when waiting for the hourly run isn't an option.
+func adminCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		backlog, err := maintenanceService.CleanupBacklog()
+		if err != nil {
+			log.Printf("Failed to count cleanup backlog: %v", err)
+			http.Error(w, "Failed to count cleanup backlog", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backlog)
+		return
+	}
+
+	var report CleanupReport
+	var err error
+	if report.ExpiredSessions, err = authService.CleanupExpiredSessions(); err != nil {
+		log.Printf("Cleanup of expired sessions failed: %v", err)
+		http.Error(w, "Cleanup failed", http.StatusInternalServerError)
+		return
+	}
+	if report.ExpiredPastes, err = pasteService.CleanupExpiredPastes(); err != nil {
+		log.Printf("Cleanup of expired pastes failed: %v", err)
+		http.Error(w, "Cleanup failed", http.StatusInternalServerError)
+		return
+	}
+	if report.ExpiredAPIKeys, err = apikeyService.CleanupExpiredAPIKeys(); err != nil {
+		log.Printf("Cleanup of expired API keys failed: %v", err)
+		http.Error(w, "Cleanup failed", http.StatusInternalServerError)
+		return
+	}
+	retention := time.Duration(config.PurgeDeletedAfterDays) * 24 * time.Hour
+	if report.DeletedPastes, err = pasteService.PurgeDeletedPastes(retention); err != nil {
+		log.Printf("Purge of deleted pastes failed: %v", err)
+		http.Error(w, "Cleanup failed", http.StatusInternalServerError)
+		return
+	}
+
+	integrity, err := maintenanceService.CheckIntegrity(true)
+	if err != nil {
+		log.Printf("Orphan cleanup failed: %v", err)
+		http.Error(w, "Cleanup failed", http.StatusInternalServerError)
+		return
+	}
+	report.OrphanedSessions = integrity.OrphanedSessions.Fixed
+	report.OrphanedAPIKeys = integrity.OrphanedAPIKeys.Fixed
+	report.OrphanedAdmins = integrity.OrphanedAdmins.Fixed
+
+	log.Printf("Admin %s ran cleanup: %+v", user.Username, report)
+	adminService.RecordAudit(user.ID, auditCleanup, "", fmt.Sprintf("%+v", report))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// adminMaintenanceHandler reports integrity issues on GET and repairs them
+// on POST.
+func adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil || !adminService.IsAdmin(user.ID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	fix := r.Method == http.MethodPost
+	report, err := maintenanceService.CheckIntegrity(fix)
+	if err != nil {
+		log.Printf("Integrity check failed: %v", err)
+		http.Error(w, "Integrity check failed", http.StatusInternalServerError)
+		return
+	}
+
+	if fix {
+		log.Printf("Admin %s ran maintenance: %+v", user.Username, *report)
+		adminService.RecordAudit(user.ID, auditMaintenance, "", fmt.Sprintf("%+v", *report))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
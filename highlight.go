@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// Cookie remembering the theme a viewer last picked with ?theme=
+const themeCookie = "theme"
+
+// Limits for highlighting a paste on the server. It runs on every view and
+// its markup is many times the size of the content, so larger pastes are
+// shown as plain text instead.
+const (
+	highlightMaxBytes = 256 << 10
+	highlightMaxLines = 10000
+)
+
+var errTooLargeToHighlight = errors.New("paste too large to highlight")
+
+// validTheme reports whether name is one of the highlighter's styles.
+func validTheme(name string) bool {
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// themeNames lists the themes ?theme= accepts, for the picker on the paste
+// page.
+func themeNames() []string {
+	return styles.Names()
+}
+
+// viewTheme picks the highlighting theme for a request: ?theme= when it
+// names a known style, remembering it in a cookie for later views, then that
+// cookie, then default_theme. Unknown names are ignored rather than rejected.
+func viewTheme(w http.ResponseWriter, r *http.Request) string {
+	if theme := r.URL.Query().Get("theme"); validTheme(theme) {
+		http.SetCookie(w, &http.Cookie{
+			Name:     themeCookie,
+			Value:    theme,
+			Path:     "/",
+			MaxAge:   365 * 24 * 60 * 60, // 1 year
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return theme
+	}
+	if cookie, err := r.Cookie(themeCookie); err == nil && validTheme(cookie.Value) {
+		return cookie.Value
+	}
+	return config.DefaultTheme
+}
+
+// highlightLexer returns the lexer for language, or the plain text one.
+func highlightLexer(language string) chroma.Lexer {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	return chroma.Coalesce(lexer)
+}
+
+// highlightFormatter renders tokens as classed spans without the
+// surrounding <pre>, which the template provides.
+func highlightFormatter() *html.Formatter {
+	return html.New(html.WithClasses(true), html.PreventSurroundingPre(true))
+}
+
+// highlightHTML renders content highlighted for language. It goes inside a
+// <pre class="chroma"> styled by themeCSS for the same theme.
+func highlightHTML(content, language, theme string) (template.HTML, error) {
+	if len(content) > highlightMaxBytes || strings.Count(content, "\n") >= highlightMaxLines {
+		return "", errTooLargeToHighlight
+	}
+
+	tokens, err := highlightLexer(language).Tokenise(nil, content)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	if err := highlightFormatter().Format(&b, styles.Get(theme), tokens); err != nil {
+		return "", err
+	}
+	return template.HTML(b.String()), nil
+}
+
+// themeCSS returns the stylesheet for markup from highlightHTML.
+func themeCSS(theme string) (template.CSS, error) {
+	var b strings.Builder
+	if err := highlightFormatter().WriteCSS(&b, styles.Get(theme)); err != nil {
+		return "", err
+	}
+	return template.CSS(b.String()), nil
+}
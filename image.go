@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/styles"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Limits for pastes rendered as images. Anything larger is better shared as
+// a link, and the caps keep the rendering cost of a single request small.
+const (
+	pasteImageMaxBytes   = 16 << 10
+	pasteImageMaxLines   = 100
+	pasteImageMaxColumns = 120 // longer lines are cut off
+	pasteImagePadding    = 16
+	pasteImageLineHeight = 16
+	pasteImageTabWidth   = 4
+)
+
+var errPasteTooLargeForImage = errors.New("paste too large to render as an image")
+
+// pasteImageHandler serves GET /p/{id}/image.png: the paste rendered as a
+// PNG of code highlighted for language in theme, for sites that don't show
+// embeds.
+func pasteImageHandler(w http.ResponseWriter, paste *Paste, language, theme string) {
+	img, err := renderPasteImage(paste.Content, language, theme)
+	if errors.Is(err, errPasteTooLargeForImage) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to render image", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		http.Error(w, "Failed to render image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// renderPasteImage draws content highlighted for language in a fixed-width
+// font, coloured by theme.
+func renderPasteImage(content, language, theme string) (image.Image, error) {
+	content = strings.ReplaceAll(strings.TrimRight(content, "\n"), "\t", strings.Repeat(" ", pasteImageTabWidth))
+	lines := strings.Split(content, "\n")
+	if len(content) > pasteImageMaxBytes || len(lines) > pasteImageMaxLines {
+		return nil, errPasteTooLargeForImage
+	}
+
+	columns := 1
+	for _, line := range lines {
+		columns = max(columns, min(len([]rune(line)), pasteImageMaxColumns))
+	}
+
+	face := basicfont.Face7x13
+	width := 2*pasteImagePadding + columns*face.Advance
+	height := 2*pasteImagePadding + len(lines)*pasteImageLineHeight
+
+	style := styles.Get(theme)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(chromaColor(style.Get(chroma.Background).Background, color.Black)), image.Point{}, draw.Src)
+
+	tokens, err := highlightLexer(language).Tokenise(nil, content)
+	if err != nil {
+		return nil, err
+	}
+
+	textColor := chromaColor(style.Get(chroma.Text).Colour, color.White)
+	drawer := &font.Drawer{Dst: img, Face: face}
+	line, column := 0, 0
+	for token := tokens(); token != chroma.EOF; token = tokens() {
+		drawer.Src = image.NewUniform(chromaColor(style.Get(token.Type).Colour, textColor))
+
+		for i, segment := range strings.Split(token.Value, "\n") {
+			if i > 0 {
+				line, column = line+1, 0
+			}
+			runes := []rune(segment)
+			if room := pasteImageMaxColumns - column; len(runes) > room {
+				runes = runes[:max(room, 0)]
+			}
+			if len(runes) == 0 {
+				continue
+			}
+
+			drawer.Dot = fixed.P(
+				pasteImagePadding+column*face.Advance,
+				pasteImagePadding+line*pasteImageLineHeight+face.Ascent,
+			)
+			drawer.DrawString(string(runes))
+			column += len(runes)
+		}
+	}
+
+	return img, nil
+}
+
+// chromaColor converts a style colour, using fallback when the style
+// leaves it unset.
+func chromaColor(c chroma.Colour, fallback color.Color) color.Color {
+	if !c.IsSet() {
+		return fallback
+	}
+	return color.RGBA{R: c.Red(), G: c.Green(), B: c.Blue(), A: 0xff}
+}
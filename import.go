@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Files imported from one gist at most
+const gistImportMaxFiles = batchMaxPastes
+
+// Where gists are looked up, replaced in tests
+var gistAPIURL = "https://api.github.com/gists/"
+
+var gistIDPattern = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+
+// ImportRequest is the body of POST /api/import/gist.
+type ImportRequest struct {
+	URL       string `json:"url"`
+	IsPrivate *bool  `json:"is_private"` // nil = the configured default
+	Unlisted  bool   `json:"unlisted"`
+}
+
+// gistResponse is the part of GitHub's gist API response we use. Files
+// over 1MB come back truncated and have to be fetched from their raw URL.
+type gistResponse struct {
+	Files map[string]struct {
+		Filename  string `json:"filename"`
+		Content   string `json:"content"`
+		Truncated bool   `json:"truncated"`
+		RawURL    string `json:"raw_url"`
+	} `json:"files"`
+}
+
+// gistID returns the ID in a gist page URL, such as
+// https://gist.github.com/octocat/aa5a315d61ae9438b18d.
+func gistID(u *url.URL) (string, bool) {
+	if !strings.EqualFold(u.Hostname(), "gist.github.com") {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) > 2 || !gistIDPattern.MatchString(parts[len(parts)-1]) {
+		return "", false
+	}
+	return parts[len(parts)-1], true
+}
+
+// importUploads turns an import URL into upload requests: one per file of
+// a gist, or a single one for any other URL, which is fetched as raw text.
+// Gist files get their filenames as titles, and their languages from the
+// extensions.
+func importUploads(req ImportRequest) ([]UploadRequest, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || req.URL == "" {
+		return nil, errors.New("invalid url")
+	}
+	upload := UploadRequest{IsPrivate: req.IsPrivate, Unlisted: req.Unlisted}
+
+	id, isGist := gistID(u)
+	if !isGist {
+		// Pastebin page links have a raw counterpart
+		if pasteID := strings.Trim(u.Path, "/"); strings.EqualFold(u.Hostname(), "pastebin.com") && pasteID != "" && !strings.Contains(pasteID, "/") {
+			u.Path = "/raw" + u.Path
+		}
+		if path.Ext(u.Path) != "" {
+			upload.Filename = path.Base(u.Path)
+		}
+		upload.SourceURL = u.String()
+		return []UploadRequest{upload}, nil
+	}
+
+	// The gist's files arrive in one response, so between them they get
+	// what a batch upload does: a single upload's allowance
+	body, err := fetchRemoteContent(gistAPIURL+id, maxUploadBodySize())
+	if err != nil {
+		return nil, err
+	}
+	var gist gistResponse
+	if err := json.Unmarshal([]byte(body), &gist); err != nil {
+		return nil, errors.New("unexpected response from the gist API")
+	}
+	if len(gist.Files) == 0 {
+		return nil, errors.New("gist has no files")
+	}
+	if len(gist.Files) > gistImportMaxFiles {
+		return nil, fmt.Errorf("gist has too many files (max %d)", gistImportMaxFiles)
+	}
+
+	names := make([]string, 0, len(gist.Files))
+	for name := range gist.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	uploads := make([]UploadRequest, 0, len(names))
+	for _, name := range names {
+		file := gist.Files[name]
+		upload.Title = file.Filename
+		upload.Filename = file.Filename
+		upload.Content, upload.SourceURL = file.Content, ""
+		if file.Truncated {
+			upload.Content, upload.SourceURL = "", file.RawURL
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+// importGistHandler serves POST /api/import/gist: the files of a GitHub
+// gist, or the text at a raw paste URL, become pastes owned by the caller.
+// The response lists the outcome for each file as a batch upload does.
+// Fetching goes through the same protections as source_url uploads.
+func importGistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user := getCurrentUser(r)
+	if user == nil {
+		httpError(w, http.StatusUnauthorized, msgLoginRequiredToImport)
+		return
+	}
+
+	if !config.RemoteFetch {
+		httpError(w, http.StatusForbidden, msgImportDisabled)
+		return
+	}
+
+	if err := checkUploadOrigin(r); err != nil {
+		writeError(w, err, http.StatusForbidden)
+		return
+	}
+
+	if rejectIfUploadsBlocked(w) {
+		return
+	}
+
+	release, ok := acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	var req ImportRequest
+	if !decodeJSONBody(w, r, &req, config.MaxJSONBodySize) {
+		return
+	}
+
+	reqs, err := importUploads(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchUploadResult, len(reqs))
+	uploads := make([]*pasteUpload, len(reqs))
+	for i := range reqs {
+		upload, _, err := prepareUpload(&reqs[i], &user.ID)
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+		uploads[i] = upload
+	}
+
+	if err := createUploads(uploads, results, &user.ID); err != nil {
+		http.Error(w, "Failed to create pastes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
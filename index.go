@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The index page is the most visited page, so the data it shows is only
+// refreshed from the database this often.
+const indexCacheTTL = 10 * time.Second
+
+type indexSnapshot struct {
+	RecentPastes []Paste
+	Trending     []TrendingPaste
+	PasteCount   int64
+	UserCount    int64
+}
+
+var indexCache struct {
+	sync.Mutex
+	snapshot *indexSnapshot
+	expires  time.Time
+}
+
+// loadIndexSnapshot returns the cached index data, refreshing it if stale.
+func loadIndexSnapshot() (*indexSnapshot, error) {
+	indexCache.Lock()
+	defer indexCache.Unlock()
+
+	if indexCache.snapshot != nil && time.Now().Before(indexCache.expires) {
+		return indexCache.snapshot, nil
+	}
+
+	snapshot := &indexSnapshot{}
+	var err error
+
+	if config.EnablePublicBrowse && config.IndexRecentPastes > 0 {
+		if snapshot.RecentPastes, err = pasteService.GetRecentPublicPastes(config.IndexRecentPastes); err != nil {
+			return nil, err
+		}
+	}
+	if config.EnablePublicBrowse {
+		if snapshot.Trending, err = pasteService.GetTrendingPastes(time.Now().Add(-24*time.Hour), 5); err != nil {
+			return nil, err
+		}
+	}
+	if snapshot.PasteCount, err = pasteService.CountPastes(); err != nil {
+		return nil, err
+	}
+	if err = db.Model(&User{}).Count(&snapshot.UserCount).Error; err != nil {
+		return nil, err
+	}
+
+	indexCache.snapshot = snapshot
+	indexCache.expires = time.Now().Add(indexCacheTTL)
+	return snapshot, nil
+}
+
+// resetIndexCache forces the next index request to reload from the database.
+func resetIndexCache() {
+	indexCache.Lock()
+	indexCache.snapshot = nil
+	indexCache.Unlock()
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := loadIndexSnapshot()
+	if err != nil {
+		log.Printf("Error loading index data: %v", err)
+		http.Error(w, "Error loading page", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		TemplateData
+		*indexSnapshot
+		LanguageChoice LanguageChoice
+		DefaultPrivate bool
+		PublicBrowse   bool
+		TermsURL       string // set when registering requires accepting it
+	}{
+		TemplateData:   baseTemplateData(r),
+		indexSnapshot:  snapshot,
+		LanguageChoice: languageChoice("text"),
+		DefaultPrivate: config.DefaultPrivateForUsers,
+		PublicBrowse:   config.EnablePublicBrowse,
+	}
+	if config.RequireTermsAcceptance {
+		data.TermsURL = config.TermsURL
+	}
+
+	renderTemplate(w, http.StatusOK, "index.html", data)
+}
+
+// newPasteHandler serves /new, the paste form on a page of its own.
+// ?language= preselects a language by name or alias.
+func newPasteHandler(w http.ResponseWriter, r *http.Request) {
+	selected := "text"
+	if lang := r.URL.Query().Get("language"); lang == autoLanguage {
+		selected = autoLanguage
+	} else if known, ok := lookupLanguage(lang); ok {
+		selected = known.Name
+	}
+
+	base := baseTemplateData(r)
+	data := struct {
+		TemplateData
+		LanguageChoice LanguageChoice
+		DefaultPrivate bool
+		CanUpload      bool
+	}{
+		TemplateData:   base,
+		LanguageChoice: languageChoice(selected),
+		DefaultPrivate: config.DefaultPrivateForUsers,
+		CanUpload:      base.LoggedIn || config.AllowAnonymousUploads,
+	}
+
+	renderTemplate(w, http.StatusOK, "new-paste.html", data)
+}
@@ -2,10 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestUserWorkflow tests the complete user workflow
@@ -15,12 +24,8 @@ func TestUserWorkflow(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	// Step 1: Register a user
 	t.Log("Step 1: Registering user")
@@ -56,7 +61,7 @@ func TestUserWorkflow(t *testing.T) {
 	uploadReq := UploadRequest{
 		Content:   "Public integration test paste",
 		Language:  "python",
-		IsPrivate: false,
+		IsPrivate: boolPtr(false),
 	}
 	body, _ = json.Marshal(uploadReq)
 	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -82,7 +87,7 @@ func TestUserWorkflow(t *testing.T) {
 	privateUploadReq := UploadRequest{
 		Content:   "Private integration test paste",
 		Language:  "bash",
-		IsPrivate: true,
+		IsPrivate: boolPtr(true),
 	}
 	body, _ = json.Marshal(privateUploadReq)
 	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -168,12 +173,8 @@ func TestDeletePasteWorkflow(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	// Register user
 	t.Log("Registering user")
@@ -200,7 +201,7 @@ func TestDeletePasteWorkflow(t *testing.T) {
 	uploadReq := UploadRequest{
 		Content:   "Paste to delete",
 		Language:  "text",
-		IsPrivate: false,
+		IsPrivate: boolPtr(false),
 	}
 	body, _ = json.Marshal(uploadReq)
 	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -268,7 +269,7 @@ func TestDeletePasteWorkflow(t *testing.T) {
 	uploadReq = UploadRequest{
 		Content:   "User1's paste",
 		Language:  "text",
-		IsPrivate: false,
+		IsPrivate: boolPtr(false),
 	}
 	body, _ = json.Marshal(uploadReq)
 	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -309,19 +310,15 @@ func TestAnonymousUserWorkflow(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	// Anonymous user creates paste
 	t.Log("Anonymous user creating paste")
 	uploadReq := UploadRequest{
 		Content:   "Anonymous paste content",
 		Language:  "javascript",
-		IsPrivate: false,
+		IsPrivate: boolPtr(false),
 	}
 	body, _ := json.Marshal(uploadReq)
 	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -351,7 +348,7 @@ func TestAnonymousUserWorkflow(t *testing.T) {
 	privateReq := UploadRequest{
 		Content:   "Should fail",
 		Language:  "text",
-		IsPrivate: true,
+		IsPrivate: boolPtr(true),
 	}
 	body, _ = json.Marshal(privateReq)
 	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -370,6 +367,7 @@ func TestPasteDeduplication(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
 
 	user, _ := authService.Register("dedupuser", "password123")
 
@@ -401,12 +399,8 @@ func TestUIFeatures(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	// Register user
 	registerReq := RegisterRequest{Username: "uitestuser", Password: "testpass123"}
@@ -426,7 +420,7 @@ func TestUIFeatures(t *testing.T) {
 
 	t.Run("Raw paste view", func(t *testing.T) {
 		// Create a paste
-		uploadReq := UploadRequest{Content: "Raw content test", Language: "text", IsPrivate: false}
+		uploadReq := UploadRequest{Content: "Raw content test", Language: "text", IsPrivate: boolPtr(false)}
 		body, _ := json.Marshal(uploadReq)
 		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
@@ -449,10 +443,28 @@ func TestUIFeatures(t *testing.T) {
 		if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" {
 			t.Errorf("Expected text/plain content type for raw view")
 		}
+		if w.Header().Get("Content-Disposition") != "inline" {
+			t.Errorf("Expected inline disposition for raw view, got %q", w.Header().Get("Content-Disposition"))
+		}
 		if w.Body.String() != "Raw content test" {
 			t.Errorf("Expected raw content, got: %s", w.Body.String())
 		}
 
+		// Test download variant
+		req = httptest.NewRequest("GET", "/p/"+pasteID+"?download=1", nil)
+		w = httptest.NewRecorder()
+		servePasteHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200 for download, got %d", w.Code)
+		}
+		if want := `attachment; filename="` + pasteID + `.txt"`; w.Header().Get("Content-Disposition") != want {
+			t.Errorf("Expected disposition %q, got %q", want, w.Header().Get("Content-Disposition"))
+		}
+		if w.Body.String() != "Raw content test" {
+			t.Errorf("Expected downloaded content, got: %s", w.Body.String())
+		}
+
 		// Test raw view with Accept header
 		req = httptest.NewRequest("GET", "/p/"+pasteID, nil)
 		req.Header.Set("Accept", "text/plain")
@@ -474,7 +486,7 @@ func TestUIFeatures(t *testing.T) {
 			uploadReq := UploadRequest{
 				Content:   "Code in " + lang,
 				Language:  lang,
-				IsPrivate: false,
+				IsPrivate: boolPtr(false),
 			}
 			body, _ := json.Marshal(uploadReq)
 			req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -504,7 +516,7 @@ func TestUIFeatures(t *testing.T) {
 
 	t.Run("Edit page loads correctly", func(t *testing.T) {
 		// Create a paste
-		uploadReq := UploadRequest{Content: "Edit test content", Language: "python", IsPrivate: false}
+		uploadReq := UploadRequest{Content: "Edit test content", Language: "python", IsPrivate: boolPtr(false)}
 		body, _ := json.Marshal(uploadReq)
 		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
@@ -563,15 +575,11 @@ func TestErrorHandling(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Empty paste content", func(t *testing.T) {
-		uploadReq := UploadRequest{Content: "", Language: "text", IsPrivate: false}
+		uploadReq := UploadRequest{Content: "", Language: "text", IsPrivate: boolPtr(false)}
 		body, _ := json.Marshal(uploadReq)
 		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
@@ -586,7 +594,7 @@ func TestErrorHandling(t *testing.T) {
 	t.Run("Extremely large paste", func(t *testing.T) {
 		// Create content larger than 10MB
 		largeContent := string(make([]byte, 11<<20))
-		uploadReq := UploadRequest{Content: largeContent, Language: "text", IsPrivate: false}
+		uploadReq := UploadRequest{Content: largeContent, Language: "text", IsPrivate: boolPtr(false)}
 		body, _ := json.Marshal(uploadReq)
 		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
@@ -637,12 +645,8 @@ func TestAccessControl(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	// Create two users
 	user1, _ := authService.Register("user1", "password123")
@@ -742,19 +746,15 @@ func TestTitleField(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Create paste with title", func(t *testing.T) {
 		uploadReq := UploadRequest{
 			Content:   "# Hello World\nThis is my titled paste",
 			Language:  "markdown",
 			Title:     "My First Paste",
-			IsPrivate: false,
+			IsPrivate: boolPtr(false),
 			Unlisted:  false,
 		}
 		body, _ := json.Marshal(uploadReq)
@@ -839,19 +839,15 @@ func TestUnlistedPastes(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Create unlisted paste", func(t *testing.T) {
 		uploadReq := UploadRequest{
 			Content:   "This is an unlisted paste",
 			Language:  "text",
 			Title:     "Unlisted Paste",
-			IsPrivate: false,
+			IsPrivate: boolPtr(false),
 			Unlisted:  true,
 		}
 		body, _ := json.Marshal(uploadReq)
@@ -890,7 +886,7 @@ func TestUnlistedPastes(t *testing.T) {
 		pasteService.CreatePaste("Unlisted Paste", "Unlisted content", "text", false, true, nil, nil)
 
 		// Get all public pastes
-		publicPastes, _ := pasteService.GetAllPublicPastes()
+		publicPastes, _, _ := pasteService.GetPublicPastesPage(listPageSize, 0)
 
 		// Should only have the public paste
 		if len(publicPastes) != 1 {
@@ -907,7 +903,7 @@ func TestUnlistedPastes(t *testing.T) {
 		// Create private paste
 		pasteService.CreatePaste("Private Paste", "Private content", "text", true, false, nil, &user.ID)
 
-		publicPastes, _ := pasteService.GetAllPublicPastes()
+		publicPastes, _, _ := pasteService.GetPublicPastesPage(listPageSize, 0)
 
 		// Should not include private paste
 		for _, paste := range publicPastes {
@@ -924,12 +920,8 @@ func TestBrowsePublicPastes(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Browse page shows public pastes", func(t *testing.T) {
 		// Create various types of pastes
@@ -968,19 +960,266 @@ func TestBrowsePublicPastes(t *testing.T) {
 		}
 	})
 
-	t.Run("GetAllPublicPastes returns correct pastes", func(t *testing.T) {
-		publicPastes, err := pasteService.GetAllPublicPastes()
+	t.Run("GetPublicPastesPage returns correct pastes", func(t *testing.T) {
+		publicPastes, total, err := pasteService.GetPublicPastesPage(listPageSize, 0)
 		if err != nil {
-			t.Fatalf("GetAllPublicPastes failed: %v", err)
+			t.Fatalf("GetPublicPastesPage failed: %v", err)
+		}
+		if total != 2 || len(publicPastes) != 2 {
+			t.Errorf("Expected 2 listed pastes, got %d of %d", len(publicPastes), total)
 		}
 
 		// Verify all returned pastes are public and not unlisted
 		for _, paste := range publicPastes {
 			if paste.IsPrivate {
-				t.Errorf("GetAllPublicPastes returned private paste: %s", paste.ID)
+				t.Errorf("GetPublicPastesPage returned private paste: %s", paste.ID)
 			}
 			if paste.Unlisted {
-				t.Errorf("GetAllPublicPastes returned unlisted paste: %s", paste.ID)
+				t.Errorf("GetPublicPastesPage returned unlisted paste: %s", paste.ID)
+			}
+		}
+	})
+}
+
+// TestIndexPage tests the dynamic data on the front page
+func TestIndexPage(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	resetIndexCache()
+	defer resetIndexCache()
+
+	pasteService.CreatePaste("Fresh public paste", "index content", "text", false, false, nil, nil)
+	pasteService.CreatePaste("Hidden unlisted paste", "unlisted content", "text", false, true, nil, nil)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	indexHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Index page failed: %d", w.Code)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "Fresh public paste") {
+		t.Errorf("Index page should list the recent public paste")
+	}
+	if strings.Contains(body, "Hidden unlisted paste") {
+		t.Errorf("Index page should not list unlisted pastes")
+	}
+	if !strings.Contains(body, "2 pastes") {
+		t.Errorf("Index page should show the total paste count")
+	}
+}
+
+// TestUploadFilenameHint tests deriving language and title from a filename
+func TestUploadFilenameHint(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	upload := func(t *testing.T, req *http.Request) *Paste {
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Upload failed: %d %s", w.Code, w.Body.String())
+		}
+		id := strings.TrimPrefix(strings.TrimSpace(w.Body.String()), config.ServePath)
+		if req.Header.Get("Content-Type") == "application/json" {
+			var resp map[string]string
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			id = resp["id"]
+		}
+		paste, err := pasteService.GetPaste(id, nil)
+		if err != nil {
+			t.Fatalf("Failed to load paste %s: %v", id, err)
+		}
+		return paste
+	}
+
+	t.Run("JSON filename sets language and title", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: "print('hi')", Filename: "hello.py"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		paste := upload(t, req)
+		if paste.Language != "python" || paste.Title != "hello.py" {
+			t.Errorf("Expected python paste titled hello.py, got %s %q", paste.Language, paste.Title)
+		}
+	})
+
+	t.Run("Query filename on plain upload", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload?filename=NOTES.md", strings.NewReader("# Notes"))
+		paste := upload(t, req)
+		if paste.Language != "markdown" || paste.Title != "notes.md" {
+			t.Errorf("Expected markdown paste titled notes.md, got %s %q", paste.Language, paste.Title)
+		}
+	})
+
+	t.Run("Explicit language and title win", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Title: "Mine", Content: "SELECT 1", Language: "sql", Filename: "query.py"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+
+		paste := upload(t, req)
+		if paste.Language != "sql" || paste.Title != "Mine" {
+			t.Errorf("Expected explicit fields to be kept, got %s %q", paste.Language, paste.Title)
+		}
+	})
+}
+
+// TestTrendingPastes tests ranking public pastes by recent views
+func TestTrendingPastes(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	popular, _ := pasteService.CreatePaste("Popular", "popular content", "text", false, false, nil, nil)
+	quiet, _ := pasteService.CreatePaste("Quiet", "quiet content", "text", false, false, nil, nil)
+	stale, _ := pasteService.CreatePaste("Stale", "stale content", "text", false, false, nil, nil)
+	hidden, _ := pasteService.CreatePaste("Hidden", "hidden content", "text", false, true, nil, nil)
+
+	view := func(id string, times int) {
+		for i := 0; i < times; i++ {
+			w := httptest.NewRecorder()
+			servePasteHandler(w, httptest.NewRequest("GET", "/p/"+id+"?raw=1", nil))
+		}
+	}
+	view(popular.ID, 3)
+	view(quiet.ID, 1)
+	view(hidden.ID, 5)
+
+	// Lots of views, but all from two days ago
+	for i := 0; i < 10; i++ {
+		testDB.Create(&PasteView{PasteID: stale.ID, CreatedAt: time.Now().Add(-48 * time.Hour)})
+	}
+
+	fetch := func(t *testing.T, query string) []map[string]interface{} {
+		w := httptest.NewRecorder()
+		trendingHandler(w, httptest.NewRequest("GET", "/api/trending"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Trending request failed: %d %s", w.Code, w.Body.String())
+		}
+		var entries []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &entries)
+		return entries
+	}
+
+	t.Run("Most viewed paste ranks first within window", func(t *testing.T) {
+		entries := fetch(t, "?window=24h")
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 trending pastes, got %d", len(entries))
+		}
+		if entries[0]["id"] != popular.ID || entries[0]["views"] != float64(3) {
+			t.Errorf("Expected popular paste first with 3 views, got %v", entries[0])
+		}
+		if entries[1]["id"] != quiet.ID {
+			t.Errorf("Expected quiet paste second, got %v", entries[1])
+		}
+	})
+
+	t.Run("Wider window includes older views", func(t *testing.T) {
+		entries := fetch(t, "?window=72h")
+		if len(entries) == 0 || entries[0]["id"] != stale.ID {
+			t.Errorf("Expected stale paste to lead over 72h, got %v", entries)
+		}
+	})
+
+	t.Run("Total view counter is kept", func(t *testing.T) {
+		paste, _ := pasteService.GetPaste(popular.ID, nil)
+		if paste.Views != 3 {
+			t.Errorf("Expected 3 total views, got %d", paste.Views)
+		}
+	})
+
+	t.Run("Rejects invalid window", func(t *testing.T) {
+		for _, window := range []string{"yesterday", "-1h", "1000h"} {
+			w := httptest.NewRecorder()
+			trendingHandler(w, httptest.NewRequest("GET", "/api/trending?window="+window, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for window %s, got %d", window, w.Code)
+			}
+		}
+	})
+}
+
+func TestRecentPastesAPI(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	older, _ := pasteService.CreatePaste("Older", "older content", "text", false, false, nil, nil)
+	testDB.Model(older).UpdateColumn("created_at", time.Now().Add(-time.Hour))
+	newer, _ := pasteService.CreatePaste("Newer", "newer content", "go", false, false, nil, nil)
+	// Anonymous pastes can't be private, so flip the flag directly
+	private, _ := pasteService.CreatePaste("Private", "private content", "text", false, false, nil, nil)
+	testDB.Model(private).UpdateColumn("is_private", true)
+	unlisted, _ := pasteService.CreatePaste("Unlisted", "unlisted content", "text", false, true, nil, nil)
+	expired, _ := pasteService.CreatePaste("Expired", "expired content", "text", false, false, nil, nil)
+	testDB.Model(expired).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+
+	fetch := func(t *testing.T, query string) []map[string]interface{} {
+		w := httptest.NewRecorder()
+		recentHandler(w, httptest.NewRequest("GET", "/api/recent"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Recent request failed: %d %s", w.Code, w.Body.String())
+		}
+		var entries []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &entries)
+		return entries
+	}
+
+	t.Run("Only public listed unexpired pastes, newest first", func(t *testing.T) {
+		entries := fetch(t, "")
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 recent pastes, got %d: %v", len(entries), entries)
+		}
+		if entries[0]["id"] != newer.ID || entries[1]["id"] != older.ID {
+			t.Errorf("Expected newer then older, got %v", entries)
+		}
+		if entries[0]["title"] != "Newer" || entries[0]["language"] != "go" || entries[0]["created_at"] == nil {
+			t.Errorf("Expected title, language and created_at in entry, got %v", entries[0])
+		}
+		for _, e := range entries {
+			if e["id"] == private.ID || e["id"] == unlisted.ID || e["id"] == expired.ID {
+				t.Errorf("Expected hidden paste to be excluded, got %v", e)
+			}
+		}
+	})
+
+	t.Run("Limit is respected", func(t *testing.T) {
+		if entries := fetch(t, "?limit=1"); len(entries) != 1 || entries[0]["id"] != newer.ID {
+			t.Errorf("Expected only the newest paste, got %v", entries)
+		}
+	})
+
+	t.Run("Limit is capped", func(t *testing.T) {
+		for i := 0; i < config.MaxPageSize+5; i++ {
+			pasteService.CreatePaste("", fmt.Sprintf("content %d", i), "text", false, false, nil, nil)
+		}
+		if entries := fetch(t, "?limit=1000"); len(entries) != config.MaxPageSize {
+			t.Errorf("Expected %d pastes at the cap, got %d", config.MaxPageSize, len(entries))
+		}
+	})
+
+	t.Run("Rejects invalid limit", func(t *testing.T) {
+		for _, limit := range []string{"abc", "0", "-3"} {
+			w := httptest.NewRecorder()
+			recentHandler(w, httptest.NewRequest("GET", "/api/recent?limit="+limit, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for limit %s, got %d", limit, w.Code)
 			}
 		}
 	})
@@ -992,12 +1231,8 @@ func TestLegacyUploadFormat(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Plain text upload without JSON", func(t *testing.T) {
 		content := "Plain text paste"
@@ -1027,3 +1262,3774 @@ func TestLegacyUploadFormat(t *testing.T) {
 		}
 	})
 }
+
+// TestAnonymousUploadsDisabled tests restricting uploads to registered users
+func TestAnonymousUploadsDisabled(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.AllowAnonymousUploads = false
+	defer func() { config = testConfig() }()
+
+	user, _ := authService.Register("uploader", "password123")
+	session, _ := authService.CreateSession(user.ID)
+
+	t.Run("Anonymous upload is rejected", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: "Anonymous content", Language: "text"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for anonymous upload, got %d", w.Code)
+		}
+	})
+
+	t.Run("Anonymous legacy upload is rejected", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader([]byte("plain text")))
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for anonymous legacy upload, got %d", w.Code)
+		}
+	})
+
+	t.Run("Session upload still works", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: "Session content", Language: "text"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for authenticated upload, got %d", w.Code)
+		}
+	})
+
+	t.Run("API key upload still works", func(t *testing.T) {
+		apikeyService = NewAPIKeyService(testDB)
+		apiKey, err := apikeyService.CreateAPIKey(user.ID, "cli", nil)
+		if err != nil {
+			t.Fatalf("Failed to create API key: %v", err)
+		}
+
+		body, _ := json.Marshal(UploadRequest{Content: "API key content", Language: "text"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+apiKey.Key)
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for API key upload, got %d", w.Code)
+		}
+	})
+}
+
+// TestUploadRequestValidation tests strict decoding of JSON upload requests
+func TestUploadRequestValidation(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	upload := func(contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"Negative expiry", `{"content":"hello","expires_in":-5}`, "expires_in cannot be negative"},
+		{"Unknown field", `{"content":"hello","titel":"typo"}`, `unknown field "titel"`},
+		{"Wrong type", `{"content":"hello","expires_in":"soon"}`, "expires_in must be an integer"},
+		{"Not an object", `["hello"]`, "request body must be a JSON object"},
+		{"Trailing data", `{"content":"hello"} {"content":"again"}`, "single JSON object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := upload("application/json", tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Expected 400, got %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("Expected error mentioning %q, got: %s", tt.message, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Charset parameter is still JSON", func(t *testing.T) {
+		if w := upload("application/json; charset=utf-8", `{"content":"hello","titel":"typo"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for unknown field, got %d", w.Code)
+		}
+	})
+
+	t.Run("Valid JSON upload", func(t *testing.T) {
+		if w := upload("application/json", `{"content":"hello","expires_in":60}`); w.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Legacy uploads stay tolerant", func(t *testing.T) {
+		if w := upload("", `{"content":"legacy json","extra":true}`); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for JSON without content type, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := upload("text/plain", "just { some text"); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for plain text, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Legacy JSON still rejects negative expiry", func(t *testing.T) {
+		if w := upload("", `{"content":"legacy json","expires_in":-1}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", w.Code)
+		}
+	})
+}
+
+// TestUploadExpiryLimits tests expires_in validation and the TTL cap
+func TestUploadExpiryLimits(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.MaxPasteTTLMinutes = 1440
+	defer func() { config = testConfig() }()
+
+	upload := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		return w
+	}
+
+	rejected := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"Over the cap", `{"content":"a","expires_in":1441}`, "max 1440 minutes"},
+		{"Negative", `{"content":"b","expires_in":-10}`, "cannot be negative"},
+		{"Zero", `{"content":"c","expires_in":0}`, "must be positive"},
+	}
+	for _, tt := range rejected {
+		t.Run(tt.name, func(t *testing.T) {
+			w := upload(tt.body)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Expected 400, got %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), tt.message) {
+				t.Errorf("Expected error mentioning %q, got: %s", tt.message, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("At the cap", func(t *testing.T) {
+		if w := upload(`{"content":"d","expires_in":1440}`); w.Code != http.StatusOK {
+			t.Errorf("Expected 200 at the cap, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Omitted expiry never expires", func(t *testing.T) {
+		w := upload(`{"content":"forever"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		paste, _ := pasteService.GetPaste(resp["id"], nil)
+		if paste == nil || paste.ExpiresAt != nil {
+			t.Errorf("Expected paste without expiry")
+		}
+	})
+
+	t.Run("Cap applies to metadata updates", func(t *testing.T) {
+		user, _ := authService.Register("ttluser", "password123")
+		paste, _ := pasteService.CreatePaste("", "owned", "text", false, false, nil, &user.ID)
+		tooLong := 2000
+		if _, err := pasteService.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{ExpiresIn: &tooLong}); err == nil {
+			t.Error("Expected error for expires_in over the cap")
+		}
+		farFuture := time.Now().Add(48 * time.Hour)
+		if _, err := pasteService.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{ExpiresAt: &farFuture}); err == nil {
+			t.Error("Expected error for expires_at beyond the cap")
+		}
+	})
+}
+
+// TestJSONValidationUpload tests opt-in JSON validation on upload
+func TestJSONValidationUpload(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	t.Run("Malformed JSON rejected with validate flag", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: `{"key": }`, Language: "json", Validate: true})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for malformed JSON, got %d", w.Code)
+		}
+	})
+
+	t.Run("Legacy upload with validate query param", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload?language=json&validate=1", bytes.NewReader([]byte(`[1, 2,]`)))
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for malformed JSON, got %d", w.Code)
+		}
+	})
+
+	t.Run("Malformed JSON accepted without validate flag", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: `{"key": }`, Language: "json"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 without validation, got %d", w.Code)
+		}
+	})
+}
+
+// TestIdempotencyKey tests that retried uploads return the original paste
+func TestIdempotencyKey(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	upload := func(content, key, remoteAddr string) string {
+		body, _ := json.Marshal(UploadRequest{Content: content, Language: "text"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Upload failed with status %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp["id"]
+	}
+
+	t.Run("Same key returns the same paste", func(t *testing.T) {
+		first := upload("First attempt", "retry-1", "192.0.2.1:1234")
+		second := upload("Second attempt with different content", "retry-1", "192.0.2.1:1234")
+
+		if first != second {
+			t.Errorf("Expected same paste for repeated key, got %s and %s", first, second)
+		}
+
+		paste, _ := pasteService.GetPaste(first, nil)
+		if paste.Content != "First attempt" {
+			t.Errorf("Expected original content to be kept, got '%s'", paste.Content)
+		}
+	})
+
+	t.Run("Different keys create different pastes", func(t *testing.T) {
+		first := upload("Keyed content A", "key-a", "192.0.2.1:1234")
+		second := upload("Keyed content B", "key-b", "192.0.2.1:1234")
+
+		if first == second {
+			t.Errorf("Expected different pastes for different keys")
+		}
+	})
+
+	t.Run("Keys are scoped per client", func(t *testing.T) {
+		first := upload("Client one content", "shared-key", "192.0.2.1:1234")
+		second := upload("Client two content", "shared-key", "192.0.2.2:1234")
+
+		if first == second {
+			t.Errorf("Expected keys from different clients not to collide")
+		}
+	})
+}
+
+// TestPatchPasteMeta tests partial updates over PATCH
+func TestPatchPasteMeta(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	user, _ := authService.Register("patchuser", "password123")
+	session, _ := authService.CreateSession(user.ID)
+	paste, _ := pasteService.CreatePaste("Before", "Large content that should not be resent", "text", false, false, nil, &user.ID)
+
+	req := httptest.NewRequest("PATCH", "/api/paste/update/"+paste.ID, bytes.NewReader([]byte(`{"title":"After","expires_in":1440}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+	w := httptest.NewRecorder()
+	updatePasteHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for PATCH, got %d: %s", w.Code, w.Body.String())
+	}
+
+	updated, _ := pasteService.GetPaste(paste.ID, &user.ID)
+	if updated.Title != "After" {
+		t.Errorf("Expected title to be updated, got '%s'", updated.Title)
+	}
+	if updated.Content != "Large content that should not be resent" {
+		t.Errorf("Expected content to be unchanged, got '%s'", updated.Content)
+	}
+	if updated.ExpiresAt == nil {
+		t.Errorf("Expected expiry to be set")
+	}
+}
+
+// TestUploadFromSourceURL tests creating pastes from a remote URL
+func TestUploadFromSourceURL(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.RemoteFetch = true
+	defer func() { config = testConfig() }()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fetched from upstream"))
+	}))
+	defer upstream.Close()
+
+	upload := func(uploadReq UploadRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(uploadReq)
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		return w
+	}
+
+	t.Run("Internal address is blocked", func(t *testing.T) {
+		w := upload(UploadRequest{SourceURL: upstream.URL})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for internal address, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "internal address") {
+			t.Errorf("Expected internal address error, got: %s", w.Body.String())
+		}
+
+		// Hostnames resolving to loopback are caught by the dialer
+		w = upload(UploadRequest{SourceURL: strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for hostname resolving to loopback, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "internal address") {
+			t.Errorf("Expected internal address error, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Disallowed scheme is blocked", func(t *testing.T) {
+		w := upload(UploadRequest{SourceURL: "file:///etc/passwd"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for file scheme, got %d", w.Code)
+		}
+	})
+
+	t.Run("Successful fetch", func(t *testing.T) {
+		// The stub server lives on loopback, so skip the dialer's address check
+		remoteFetchClient = upstream.Client()
+		defer func() { remoteFetchClient = newRemoteFetchClient() }()
+		config.RemoteFetchHosts = []string{"127.0.0.1"}
+		defer func() { config.RemoteFetchHosts = nil }()
+
+		// Loopback literals are still rejected before dialing
+		w := upload(UploadRequest{SourceURL: upstream.URL})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected literal loopback URL to be rejected, got %d", w.Code)
+		}
+
+		localhostURL := strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+		config.RemoteFetchHosts = []string{"localhost"}
+		w = upload(UploadRequest{SourceURL: localhostURL, Language: "text"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for fetched paste, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		paste, err := pasteService.GetPaste(resp["id"], nil)
+		if err != nil {
+			t.Fatalf("Failed to get fetched paste: %v", err)
+		}
+		if paste.Content != "fetched from upstream" {
+			t.Errorf("Expected fetched content, got '%s'", paste.Content)
+		}
+	})
+
+	t.Run("Host not in allowlist", func(t *testing.T) {
+		config.RemoteFetchHosts = []string{"example.com"}
+		defer func() { config.RemoteFetchHosts = nil }()
+
+		w := upload(UploadRequest{SourceURL: "https://example.org/file.txt"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for host outside allowlist, got %d", w.Code)
+		}
+	})
+
+	t.Run("Content and source_url are exclusive", func(t *testing.T) {
+		w := upload(UploadRequest{Content: "inline", SourceURL: "https://example.com/file.txt"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 when both content and source_url set, got %d", w.Code)
+		}
+	})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		config.RemoteFetch = false
+		defer func() { config.RemoteFetch = true }()
+
+		w := upload(UploadRequest{SourceURL: "https://example.com/file.txt"})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 when remote fetch disabled, got %d", w.Code)
+		}
+	})
+}
+
+func TestImportGist(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.RemoteFetch = true
+	config.RemoteFetchHosts = []string{"localhost"}
+	defer func() { config = testConfig() }()
+
+	user, _ := authService.Register("importer", "password123")
+	session, _ := authService.CreateSession(user.ID)
+
+	var upstreamURL string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gists/aa5a315d61ae9438b18d":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"files": map[string]interface{}{
+					"hello.py":  map[string]interface{}{"filename": "hello.py", "content": "print('hello')\n"},
+					"README.md": map[string]interface{}{"filename": "README.md", "content": "# Notes\n"},
+					"big.txt": map[string]interface{}{
+						"filename": "big.txt", "content": "trunc", "truncated": true,
+						"raw_url": upstreamURL + "/raw/big.txt",
+					},
+				},
+			})
+		case "/gists/cc5a315d61ae9438b18d":
+			// Each file fits in a paste, but not both together
+			// Each file fits in a paste, but not all of them together
+			files := map[string]interface{}{}
+			for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+				files[name] = map[string]interface{}{"filename": name, "content": strings.Repeat("x", 60<<10)}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+		case "/raw/big.txt":
+			w.Write([]byte("the whole file"))
+		case "/snippet.go":
+			w.Write([]byte("package main\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	// The stub server lives on loopback, so skip the dialer's address check
+	upstreamURL = strings.Replace(upstream.URL, "127.0.0.1", "localhost", 1)
+	remoteFetchClient = upstream.Client()
+	defer func() { remoteFetchClient = newRemoteFetchClient() }()
+	gistAPIURL = upstreamURL + "/gists/"
+	defer func() { gistAPIURL = "https://api.github.com/gists/" }()
+
+	importURL := func(rawURL string, loggedIn bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ImportRequest{URL: rawURL})
+		req := httptest.NewRequest("POST", "/api/import/gist", bytes.NewReader(body))
+		if loggedIn {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		importGistHandler(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) []batchUploadResult {
+		var results []batchUploadResult
+		if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return results
+	}
+
+	t.Run("Gist files become pastes", func(t *testing.T) {
+		w := importURL("https://gist.github.com/octocat/aa5a315d61ae9438b18d", true)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		results := decode(w)
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results, got %+v", results)
+		}
+
+		// Files come back in name order
+		want := []struct{ title, language, content string }{
+			{"README.md", "markdown", "# Notes\n"},
+			{"big.txt", "text", "the whole file"},
+			{"hello.py", "python", "print('hello')\n"},
+		}
+		for i, result := range results {
+			if result.Error != "" {
+				t.Fatalf("Unexpected error for %s: %s", want[i].title, result.Error)
+			}
+			paste, err := pasteService.GetPaste(result.ID, &user.ID)
+			if err != nil {
+				t.Fatalf("Failed to get imported paste: %v", err)
+			}
+			if paste.Title != want[i].title || paste.Language != want[i].language || paste.Content != want[i].content {
+				t.Errorf("Expected %+v, got title %q language %q content %q", want[i], paste.Title, paste.Language, paste.Content)
+			}
+			if paste.UserID == nil || *paste.UserID != user.ID {
+				t.Errorf("Expected %s to be owned by the caller", paste.Title)
+			}
+		}
+	})
+
+	t.Run("Raw URL becomes one paste", func(t *testing.T) {
+		results := decode(importURL(upstreamURL+"/snippet.go", true))
+		if len(results) != 1 || results[0].Error != "" {
+			t.Fatalf("Expected one paste, got %+v", results)
+		}
+		paste, _ := pasteService.GetPaste(results[0].ID, &user.ID)
+		if paste == nil || paste.Content != "package main\n" || paste.Language != "go" {
+			t.Errorf("Unexpected imported paste %+v", paste)
+		}
+	})
+
+	t.Run("Unknown gist", func(t *testing.T) {
+		if w := importURL("https://gist.github.com/octocat/bb5a315d61ae9438b18d", true); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for a missing gist, got %d", w.Code)
+		}
+	})
+
+	t.Run("Gist response capped at one upload", func(t *testing.T) {
+		config.MaxPasteSize = 64 << 10
+		defer func() { config.MaxPasteSize = testConfig().MaxPasteSize }()
+		if w := importURL("https://gist.github.com/octocat/cc5a315d61ae9438b18d", true); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for files adding up to more than one upload, got %d", w.Code)
+		}
+	})
+
+	t.Run("Internal addresses are refused", func(t *testing.T) {
+		config.RemoteFetchHosts = nil
+		defer func() { config.RemoteFetchHosts = []string{"localhost"} }()
+
+		results := decode(importURL("http://127.0.0.1/secret.txt", true))
+		if len(results) != 1 || !strings.Contains(results[0].Error, "internal address") {
+			t.Errorf("Expected an internal address error, got %+v", results)
+		}
+	})
+
+	t.Run("Requires login", func(t *testing.T) {
+		if w := importURL("https://gist.github.com/octocat/aa5a315d61ae9438b18d", false); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Disabled with remote fetch", func(t *testing.T) {
+		config.RemoteFetch = false
+		defer func() { config.RemoteFetch = true }()
+		if w := importURL("https://gist.github.com/octocat/aa5a315d61ae9438b18d", true); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+	})
+}
+
+// TestUploadContentBase64 tests JSON uploads that send base64 content
+func TestUploadContentBase64(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	upload := func(uploadReq UploadRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(uploadReq)
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		return w
+	}
+
+	t.Run("Valid base64", func(t *testing.T) {
+		content := "line \"one\"\n\ttab and ünïcode\n"
+		w := upload(UploadRequest{ContentBase64: base64.StdEncoding.EncodeToString([]byte(content))})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp map[string]string
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		paste, err := pasteService.GetPaste(resp["id"], nil)
+		if err != nil {
+			t.Fatalf("Failed to load paste: %v", err)
+		}
+		if paste.Content != content {
+			t.Errorf("Expected decoded content %q, got %q", content, paste.Content)
+		}
+	})
+
+	t.Run("Invalid base64", func(t *testing.T) {
+		w := upload(UploadRequest{ContentBase64: "not base64!"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for invalid base64, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "not valid base64") {
+			t.Errorf("Expected base64 error, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Binary content is rejected", func(t *testing.T) {
+		w := upload(UploadRequest{ContentBase64: base64.StdEncoding.EncodeToString([]byte{0xff, 0xfe, 0x00})})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for non-UTF-8 content, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "UTF-8") {
+			t.Errorf("Expected UTF-8 error, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Content and content_base64 are exclusive", func(t *testing.T) {
+		w := upload(UploadRequest{Content: "inline", ContentBase64: base64.StdEncoding.EncodeToString([]byte("encoded"))})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 when both content and content_base64 set, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "cannot be combined") {
+			t.Errorf("Expected mutual exclusion error, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Full-size paste fits as base64", func(t *testing.T) {
+		config.MaxPasteSize = 1 << 20
+		defer func() { config = testConfig() }()
+
+		content := strings.Repeat("b", config.MaxPasteSize)
+		w := upload(UploadRequest{ContentBase64: base64.StdEncoding.EncodeToString([]byte(content))})
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for a paste at the size limit, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// TestOversizeUpload tests that oversize uploads get a clean 413
+func TestOversizeUpload(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.MaxPasteSize = 1 << 10 // 1KB
+	defer func() { config = testConfig() }()
+
+	t.Run("Oversize plain text body", func(t *testing.T) {
+		body := strings.Repeat("a", 200<<10)
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for oversize body, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "max 1KB") {
+			t.Errorf("Expected message to mention the limit, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Oversize JSON content within body slack", func(t *testing.T) {
+		body, _ := json.Marshal(UploadRequest{Content: strings.Repeat("a", 2<<10), Language: "text"})
+		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for oversize content, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "max 1KB") {
+			t.Errorf("Expected message to mention the limit, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Malformed request is still a 400", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(""))
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for empty body, got %d", w.Code)
+		}
+	})
+
+	t.Run("Content at the limit is accepted", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(strings.Repeat("b", 1<<10)))
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for content at the limit, got %d", w.Code)
+		}
+	})
+}
+
+// TestOversizeJSONBody tests the body cap on JSON API requests
+func TestOversizeJSONBody(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.MaxJSONBodySize = 1 << 10 // 1KB
+	defer func() { config = testConfig() }()
+
+	authService.Register("bodyuser", "password123")
+
+	t.Run("Oversize login body", func(t *testing.T) {
+		body := `{"username":"bodyuser","password":"` + strings.Repeat("a", 4<<10) + `"}`
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for oversize login body, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "max 1KB") {
+			t.Errorf("Expected message to mention the limit, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Oversize register body", func(t *testing.T) {
+		body := `{"username":"` + strings.Repeat("b", 4<<10) + `","password":"password123"}`
+		req := httptest.NewRequest("POST", "/api/register", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		registerHandler(w, req)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for oversize register body, got %d", w.Code)
+		}
+	})
+
+	t.Run("Normal login still works", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"bodyuser","password":"password123"}`))
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 for normal login, got %d", w.Code)
+		}
+	})
+
+	t.Run("Malformed body is still a 400", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader("{"))
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for malformed body, got %d", w.Code)
+		}
+	})
+}
+
+// TestAdminExport tests the NDJSON export for admins
+func TestAdminExport(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("exportadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+
+	regular, _ := authService.Register("regular", "password123")
+	regularSession, _ := authService.CreateSession(regular.ID)
+
+	paste, _ := pasteService.CreatePaste("Seeded", "Seeded export content", "text", true, false, nil, &regular.ID)
+
+	export := func(query string, session *Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/admin/export"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		adminExportHandler(w, req)
+		return w
+	}
+
+	parse := func(t *testing.T, body string) []map[string]interface{} {
+		var records []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			var record map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("Invalid NDJSON line %q: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+
+	t.Run("Non-admin is forbidden", func(t *testing.T) {
+		w := export("", regularSession)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for non-admin, got %d", w.Code)
+		}
+	})
+
+	t.Run("Export includes seeded paste", func(t *testing.T) {
+		w := export("", adminSession)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("Expected NDJSON content type, got %s", w.Header().Get("Content-Type"))
+		}
+
+		found := false
+		for _, record := range parse(t, w.Body.String()) {
+			if record["type"] == "user" {
+				t.Errorf("Users should not be exported unless requested")
+			}
+			data := record["data"].(map[string]interface{})
+			if record["type"] == "paste" && data["ID"] == paste.ID {
+				found = true
+				if data["Content"] != "Seeded export content" {
+					t.Errorf("Expected paste content in export, got %v", data["Content"])
+				}
+			}
+		}
+		if !found {
+			t.Errorf("Expected seeded paste %s in export", paste.ID)
+		}
+	})
+
+	t.Run("Users are exported with redacted hashes", func(t *testing.T) {
+		w := export("?users=1", adminSession)
+
+		users := 0
+		for _, record := range parse(t, w.Body.String()) {
+			if record["type"] != "user" {
+				continue
+			}
+			users++
+			data := record["data"].(map[string]interface{})
+			if data["PasswordHash"] != "" {
+				t.Errorf("Expected password hash to be redacted")
+			}
+		}
+		if users != 2 {
+			t.Errorf("Expected 2 users in export, got %d", users)
+		}
+
+		w = export("?users=1&password_hashes=1", adminSession)
+		for _, record := range parse(t, w.Body.String()) {
+			if record["type"] == "user" && record["data"].(map[string]interface{})["PasswordHash"] == "" {
+				t.Errorf("Expected password hash when explicitly requested")
+			}
+		}
+	})
+}
+
+// TestAdminMaintenance tests detecting and repairing integrity issues
+func TestAdminMaintenance(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	maintenanceService = NewMaintenanceService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("maintadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+
+	// A user removed behind the application's back leaves a session behind
+	gone, _ := authService.Register("gone", "password123")
+	orphan, _ := authService.CreateSession(gone.ID)
+	testDB.Delete(&User{}, gone.ID)
+
+	paste, _ := pasteService.CreatePaste("", "hashless content", "text", false, false, nil, nil)
+	testDB.Model(&Paste{}).Where("id = ?", paste.ID).UpdateColumn("content_hash", "")
+
+	run := func(method string) IntegrityReport {
+		req := httptest.NewRequest(method, "/api/admin/maintenance", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: adminSession.ID})
+		w := httptest.NewRecorder()
+		adminMaintenanceHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Maintenance request failed: %d %s", w.Code, w.Body.String())
+		}
+		var report IntegrityReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return report
+	}
+
+	t.Run("GET reports without fixing", func(t *testing.T) {
+		report := run("GET")
+		if report.OrphanedSessions.Found != 1 || report.OrphanedSessions.Fixed != 0 {
+			t.Errorf("Expected 1 orphaned session found and none fixed, got %+v", report.OrphanedSessions)
+		}
+		if report.MissingHashes.Found != 1 {
+			t.Errorf("Expected 1 paste with missing hash, got %+v", report.MissingHashes)
+		}
+		var count int64
+		testDB.Model(&Session{}).Where("id = ?", orphan.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Dry run should not delete the orphaned session")
+		}
+	})
+
+	t.Run("POST prunes orphans and recomputes hashes", func(t *testing.T) {
+		report := run("POST")
+		if report.OrphanedSessions.Fixed != 1 || report.MissingHashes.Fixed != 1 {
+			t.Errorf("Expected orphan and hash to be fixed, got %+v", report)
+		}
+
+		var count int64
+		testDB.Model(&Session{}).Where("id = ?", orphan.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected orphaned session to be pruned")
+		}
+		testDB.Model(&Session{}).Where("id = ?", adminSession.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Valid sessions must be kept")
+		}
+
+		fixed, _ := pasteService.GetPaste(paste.ID, nil)
+		if fixed.ContentHash == "" {
+			t.Errorf("Expected content hash to be recomputed")
+		}
+
+		if again := run("GET"); again.OrphanedSessions.Found != 0 || again.MissingHashes.Found != 0 {
+			t.Errorf("Expected a clean report after fixing, got %+v", again)
+		}
+	})
+
+	t.Run("Non-admin is forbidden", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/admin/maintenance", nil)
+		w := httptest.NewRecorder()
+		adminMaintenanceHandler(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+	})
+}
+
+func TestAdminCleanup(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	adminService = NewAdminService(testDB)
+	maintenanceService = NewMaintenanceService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("cleanadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+	user, _ := authService.Register("cleanuser", "password123")
+
+	past := time.Now().Add(-time.Hour)
+
+	staleSession, _ := authService.CreateSession(user.ID)
+	testDB.Model(staleSession).UpdateColumn("expires_at", past)
+
+	expiresIn := 60
+	expiredPaste, _ := pasteService.CreatePaste("", "expired content", "text", false, false, &expiresIn, &user.ID)
+	testDB.Model(expiredPaste).UpdateColumn("expires_at", past)
+	livePaste, _ := pasteService.CreatePaste("", "live content", "text", false, false, nil, &user.ID)
+	oldDeleted, _ := pasteService.CreatePaste("", "deleted long ago", "text", false, false, nil, &user.ID)
+	testDB.Model(oldDeleted).UpdateColumn("deleted_at", time.Now().AddDate(0, 0, -config.PurgeDeletedAfterDays-1))
+
+	days := 1
+	expiredKey, _ := apikeyService.CreateAPIKey(user.ID, "old", &days)
+	testDB.Model(expiredKey).UpdateColumn("expires_at", past)
+	apikeyService.RecordUsage(expiredKey.ID, "GET", "/api/me", http.StatusOK)
+	liveKey, _ := apikeyService.CreateAPIKey(user.ID, "current", nil)
+
+	gone, _ := authService.Register("vanished", "password123")
+	authService.CreateSession(gone.ID)
+	testDB.Delete(&User{}, gone.ID)
+
+	cleanup := func(session *Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/admin/cleanup", nil)
+		if session != nil {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		adminCleanupHandler(w, req)
+		return w
+	}
+
+	t.Run("Non-admin is forbidden", func(t *testing.T) {
+		userSession, _ := authService.CreateSession(user.ID)
+		if w := cleanup(userSession); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Reports and performs deletions", func(t *testing.T) {
+		w := cleanup(adminSession)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Cleanup failed: %d %s", w.Code, w.Body.String())
+		}
+		var report CleanupReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+
+		expected := CleanupReport{ExpiredSessions: 1, ExpiredPastes: 1, ExpiredAPIKeys: 1, DeletedPastes: 1, OrphanedSessions: 1}
+		if report != expected {
+			t.Errorf("Expected %+v, got %+v", expected, report)
+		}
+
+		var count int64
+		testDB.Model(&Session{}).Where("id = ?", staleSession.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected expired session to be deleted")
+		}
+		testDB.Model(&Paste{}).Where("id = ?", expiredPaste.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected expired paste to be deleted")
+		}
+		testDB.Model(&APIKeyUsage{}).Where("api_key_id = ?", expiredKey.ID).Count(&count)
+		if count != 0 {
+			t.Errorf("Expected usage of the expired key to be deleted")
+		}
+
+		testDB.Model(&Paste{}).Where("id = ?", livePaste.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Expected live paste to be kept")
+		}
+		testDB.Model(&APIKey{}).Where("id = ?", liveKey.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Expected live API key to be kept")
+		}
+		testDB.Model(&Session{}).Where("id = ?", adminSession.ID).Count(&count)
+		if count != 1 {
+			t.Errorf("Expected admin session to be kept")
+		}
+	})
+
+	t.Run("Second run finds nothing", func(t *testing.T) {
+		var report CleanupReport
+		json.Unmarshal(cleanup(adminSession).Body.Bytes(), &report)
+		if report != (CleanupReport{}) {
+			t.Errorf("Expected nothing left to clean, got %+v", report)
+		}
+	})
+}
+
+// TestUploadOriginCheck tests Origin/Referer validation for browser uploads
+func TestUploadOriginCheck(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	config = testConfig()
+	config.AllowedUploadOrigins = []string{"https://paste.example.com/"}
+
+	user, _ := authService.Register("originuser", "password123")
+	session, _ := authService.CreateSession(user.ID)
+	apiKey, _ := apikeyService.CreateAPIKey(user.ID, "cli", nil)
+
+	upload := func(content string, headers map[string]string, withCookie bool) int {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(content))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		if withCookie {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		withCookie bool
+		expected   int
+	}{
+		{"Matching Origin", map[string]string{"Origin": "https://paste.example.com"}, true, http.StatusOK},
+		{"Matching Referer", map[string]string{"Referer": "https://paste.example.com/p/abc"}, true, http.StatusOK},
+		{"Foreign Origin", map[string]string{"Origin": "https://evil.example"}, true, http.StatusForbidden},
+		{"Foreign Referer", map[string]string{"Referer": "https://evil.example/form"}, true, http.StatusForbidden},
+		{"Scheme mismatch", map[string]string{"Origin": "http://paste.example.com"}, true, http.StatusForbidden},
+		{"No Origin or Referer", nil, true, http.StatusForbidden},
+		{"API key is exempt", map[string]string{"Authorization": "Bearer " + apiKey.Key, "Origin": "https://evil.example"}, false, http.StatusOK},
+		{"Anonymous is exempt", map[string]string{"Origin": "https://evil.example"}, false, http.StatusOK},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := upload(fmt.Sprintf("origin test content %d", i), tt.headers, tt.withCookie)
+			if code != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, code)
+			}
+		})
+	}
+
+	t.Run("Disabled when no origins configured", func(t *testing.T) {
+		config.AllowedUploadOrigins = nil
+		if code := upload("unchecked content", map[string]string{"Origin": "https://evil.example"}, true); code != http.StatusOK {
+			t.Errorf("Expected 200 with the check disabled, got %d", code)
+		}
+	})
+}
+
+// TestAdminUserPastes tests admins reviewing another user's pastes
+func TestAdminUserPastes(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("moderator", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+
+	regular, _ := authService.Register("author", "password123")
+	regularSession, _ := authService.CreateSession(regular.ID)
+
+	private, _ := pasteService.CreatePaste("Private diary", "secret", "text", true, false, nil, &regular.ID)
+	unlisted, _ := pasteService.CreatePaste("Unlisted notes", "hidden", "text", false, true, nil, &regular.ID)
+
+	get := func(path string, session *Session, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	t.Run("Non-admin is forbidden", func(t *testing.T) {
+		w := get(fmt.Sprintf("/api/admin/user-pastes?user_id=%d", regular.ID), regularSession, adminUserPastesHandler)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 from API, got %d", w.Code)
+		}
+		w = get(fmt.Sprintf("/admin/user/%d", regular.ID), regularSession, adminUserPastesPageHandler)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 from page, got %d", w.Code)
+		}
+	})
+
+	t.Run("Admin sees private and unlisted pastes", func(t *testing.T) {
+		w := get(fmt.Sprintf("/api/admin/user-pastes?user_id=%d", regular.ID), adminSession, adminUserPastesHandler)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+
+		var resp struct {
+			Total  int64
+			Pastes []Paste
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Total != 2 || len(resp.Pastes) != 2 {
+			t.Fatalf("Expected 2 pastes, got %d (total %d)", len(resp.Pastes), resp.Total)
+		}
+		ids := map[string]bool{resp.Pastes[0].ID: true, resp.Pastes[1].ID: true}
+		if !ids[private.ID] || !ids[unlisted.ID] {
+			t.Errorf("Expected private and unlisted pastes in admin view")
+		}
+
+		page := get(fmt.Sprintf("/admin/user/%d", regular.ID), adminSession, adminUserPastesPageHandler)
+		if page.Code != http.StatusOK || !strings.Contains(page.Body.String(), "Private diary") {
+			t.Errorf("Expected admin page to list the private paste, got %d", page.Code)
+		}
+	})
+
+	t.Run("Paging", func(t *testing.T) {
+		w := get(fmt.Sprintf("/api/admin/user-pastes?user_id=%d&limit=1&offset=1", regular.ID), adminSession, adminUserPastesHandler)
+		var resp struct {
+			Total  int64
+			Pastes []Paste
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Total != 2 || len(resp.Pastes) != 1 {
+			t.Errorf("Expected one paste of two, got %d of %d", len(resp.Pastes), resp.Total)
+		}
+
+		page := get(fmt.Sprintf("/admin/user/%d?page=2&per_page=1", regular.ID), adminSession, adminUserPastesPageHandler)
+		if page.Code != http.StatusOK || page.Header().Get("X-Page-Size") != "1" {
+			t.Fatalf("Expected a page of one, got %d with size %q", page.Code, page.Header().Get("X-Page-Size"))
+		}
+		if body := page.Body.String(); !strings.Contains(body, "Previous") || strings.Contains(body, "Next") {
+			t.Errorf("Expected only a Previous link on the last page")
+		}
+		if w := get(fmt.Sprintf("/admin/user/%d?page=0", regular.ID), adminSession, adminUserPastesPageHandler); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for page 0, got %d", w.Code)
+		}
+	})
+
+	t.Run("Unknown user", func(t *testing.T) {
+		w := get("/api/admin/user-pastes?user_id=9999", adminSession, adminUserPastesHandler)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for unknown user, got %d", w.Code)
+		}
+	})
+}
+
+// TestSequentialPasteIDs tests resolving pastes by their numeric alias
+func TestSequentialPasteIDs(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	fetch := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", path+"?raw=1", nil))
+		return w
+	}
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		paste, _ := pasteService.CreatePaste("", "before sequential ids", "text", false, false, nil, nil)
+		if paste.Seq != nil {
+			t.Errorf("Expected no seq when disabled, got %d", *paste.Seq)
+		}
+		if w := fetch("/p/1"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for numeric path when disabled, got %d", w.Code)
+		}
+	})
+
+	config.SequentialIDs = true
+
+	first, _ := pasteService.CreatePaste("", "first numbered", "text", false, false, nil, nil)
+	second, _ := pasteService.CreatePaste("", "second numbered", "text", false, false, nil, nil)
+
+	t.Run("Numbers are assigned in order", func(t *testing.T) {
+		if first.Seq == nil || second.Seq == nil {
+			t.Fatal("Expected seq to be assigned")
+		}
+		if *first.Seq != 1 || *second.Seq != 2 {
+			t.Errorf("Expected seqs 1 and 2, got %d and %d", *first.Seq, *second.Seq)
+		}
+	})
+
+	t.Run("Retrievable by string ID and seq", func(t *testing.T) {
+		for _, path := range []string{"/p/" + second.ID, "/p/2"} {
+			w := fetch(path)
+			if w.Code != http.StatusOK || w.Body.String() != "second numbered" {
+				t.Errorf("%s: expected second paste, got %d %q", path, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Private pastes stay private by seq", func(t *testing.T) {
+		user, _ := authService.Register("seqowner", "password123")
+		private, _ := pasteService.CreatePaste("", "numbered secret", "text", true, false, nil, &user.ID)
+		if w := fetch(fmt.Sprintf("/p/%d", *private.Seq)); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for private paste by seq, got %d", w.Code)
+		}
+	})
+
+	t.Run("Unknown seq", func(t *testing.T) {
+		if w := fetch("/p/999"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", w.Code)
+		}
+	})
+}
+
+func TestShortCodes(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	resolve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		shortCodeHandler(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	t.Run("Upload returns a code that resolves", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(`{"content":"short and sweet"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		code := resp["short_code"]
+		if len(code) != shortCodeLength || resp["short_url"] != "/s/"+code {
+			t.Fatalf("Expected a short code in the response, got %v", resp)
+		}
+
+		w = resolve("/s/" + code + "?raw=1")
+		if w.Code != http.StatusFound {
+			t.Fatalf("Expected a redirect, got %d", w.Code)
+		}
+		if got := w.Header().Get("Location"); got != config.ServePath+resp["id"]+"?raw=1" {
+			t.Errorf("Expected a redirect to the paste, got %s", got)
+		}
+	})
+
+	t.Run("Codes are unique", func(t *testing.T) {
+		seen := map[string]bool{}
+		for i := 0; i < 20; i++ {
+			paste, err := pasteService.CreatePaste("", fmt.Sprintf("paste %d", i), "text", false, false, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to create paste: %v", err)
+			}
+			if paste.ShortCode == nil || seen[*paste.ShortCode] {
+				t.Fatalf("Expected a new short code, got %v", paste.ShortCode)
+			}
+			seen[*paste.ShortCode] = true
+		}
+	})
+
+	t.Run("Collisions are retried", func(t *testing.T) {
+		existing, _ := pasteService.CreatePaste("", "first holder", "text", false, false, nil, nil)
+		candidates := []string{*existing.ShortCode, *existing.ShortCode, "zzzzz"}
+		generateShortCode = func(int) (string, error) {
+			code := candidates[0]
+			candidates = candidates[1:]
+			return code, nil
+		}
+		defer func() { generateShortCode = randomShortCode }()
+
+		paste, err := pasteService.CreatePaste("", "second holder", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if *paste.ShortCode != "zzzzz" {
+			t.Errorf("Expected the first free code, got %s", *paste.ShortCode)
+		}
+		if w := resolve("/s/zzzzz"); w.Header().Get("Location") != config.ServePath+paste.ID {
+			t.Errorf("Expected the code to resolve to the new paste, got %s", w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Unlisted and private pastes stay hidden", func(t *testing.T) {
+		unlisted, _ := pasteService.CreatePaste("", "unlisted", "text", false, true, nil, nil)
+		if unlisted.ShortCode != nil {
+			t.Errorf("Expected no short code for an unlisted paste")
+		}
+
+		owner, _ := authService.Register("shortowner", "password123")
+		private, _ := pasteService.CreatePaste("", "private", "text", true, false, nil, &owner.ID)
+		if w := resolve("/s/" + *private.ShortCode); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for someone else's private paste, got %d", w.Code)
+		}
+
+		listed, _ := pasteService.CreatePaste("", "later unlisted", "text", false, false, nil, &owner.ID)
+		testDB.Model(listed).UpdateColumn("unlisted", true)
+		if w := resolve("/s/" + *listed.ShortCode); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 once the paste is unlisted, got %d", w.Code)
+		}
+		if _, err := pasteService.GetPasteByShortCode(*listed.ShortCode, &owner.ID); err != nil {
+			t.Errorf("Expected the owner to still resolve it, got %v", err)
+		}
+	})
+
+	t.Run("Unknown code", func(t *testing.T) {
+		if w := resolve("/s/nope0"); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", w.Code)
+		}
+	})
+}
+
+// TestPasteImage tests rendering pastes as PNG images
+func TestPasteImage(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	fetch := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+id+"/image.png", nil))
+		return w
+	}
+
+	t.Run("Small public paste", func(t *testing.T) {
+		paste, _ := pasteService.CreatePaste("", "package main\n\nfunc main() {\n\tprintln(\"hi\")\n}\n", "go", false, false, nil, nil)
+
+		w := fetch(paste.ID)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != "image/png" {
+			t.Errorf("Expected image/png, got %s", w.Header().Get("Content-Type"))
+		}
+
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("Expected a valid PNG: %v", err)
+		}
+		if b := img.Bounds(); b.Dx() <= 0 || b.Dy() <= 0 {
+			t.Errorf("Expected a non-empty image, got %v", b)
+		}
+	})
+
+	t.Run("Oversized paste", func(t *testing.T) {
+		paste, _ := pasteService.CreatePaste("", strings.Repeat("line\n", pasteImageMaxLines+1), "text", false, false, nil, nil)
+
+		if w := fetch(paste.ID); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for oversized paste, got %d", w.Code)
+		}
+	})
+
+	t.Run("Private paste", func(t *testing.T) {
+		user, _ := authService.Register("imageowner", "password123")
+		paste, _ := pasteService.CreatePaste("", "secret", "text", true, false, nil, &user.ID)
+
+		if w := fetch(paste.ID); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for someone else's private paste, got %d", w.Code)
+		}
+	})
+}
+
+// TestChangeUsername tests renaming the logged-in account
+func TestChangeUsername(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	user, _ := authService.Register("oldname", "password123")
+	session, _ := authService.CreateSession(user.ID)
+	authService.Register("takenname", "password123")
+
+	rename := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/me/username", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		changeUsernameHandler(w, req)
+		return w
+	}
+
+	t.Run("Too short", func(t *testing.T) {
+		if w := rename(`{"username":"ab"}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for short username, got %d", w.Code)
+		}
+	})
+
+	t.Run("Conflict", func(t *testing.T) {
+		w := rename(`{"username":"takenname"}`)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected 409 for taken username, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "username taken") {
+			t.Errorf("Expected friendly conflict message, got: %s", w.Body.String())
+		}
+	})
+
+	t.Run("Valid change", func(t *testing.T) {
+		w := rename(`{"username":"newname"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		// The existing session follows the rename
+		s, err := authService.GetSession(session.ID)
+		if err != nil || s.User.Username != "newname" {
+			t.Errorf("Expected session to stay valid for the renamed user")
+		}
+		if _, err := authService.Login("newname", "password123"); err != nil {
+			t.Errorf("Expected login with new username: %v", err)
+		}
+		if _, err := authService.Login("oldname", "password123"); err == nil {
+			t.Errorf("Expected old username to stop working")
+		}
+	})
+
+	t.Run("Requires login", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/me/username", strings.NewReader(`{"username":"anon"}`))
+		w := httptest.NewRecorder()
+		changeUsernameHandler(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+	})
+}
+
+// TestRegistrationRateLimit tests per-IP throttling of sign-ups
+func TestRegistrationRateLimit(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	registrationRateLimiter = newRateLimiter(3, time.Hour)
+	defer func() { registrationRateLimiter = nil }()
+
+	register := func(username, remoteAddr string) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"username":%q,"password":"password123"}`, username)
+		req := httptest.NewRequest("POST", "/api/register", strings.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		registerHandler(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := register(fmt.Sprintf("spammer%d", i), "203.0.113.7:4000"); w.Code != http.StatusOK {
+			t.Fatalf("Expected registration %d to succeed, got %d", i, w.Code)
+		}
+	}
+
+	w := register("spammer3", "203.0.113.7:4001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 after the limit, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header")
+	}
+	if _, err := authService.Login("spammer3", "password123"); err == nil {
+		t.Errorf("Expected throttled registration not to create an account")
+	}
+
+	if w := register("neighbour", "198.51.100.2:4000"); w.Code != http.StatusOK {
+		t.Errorf("Expected other IPs to be unaffected, got %d", w.Code)
+	}
+}
+
+// TestAPIKeyUsageLog tests recording and listing API key activity
+func TestAPIKeyUsageLog(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	owner, _ := authService.Register("keyowner", "password123")
+	ownerSession, _ := authService.CreateSession(owner.ID)
+	other, _ := authService.Register("otheruser", "password123")
+	otherSession, _ := authService.CreateSession(other.ID)
+
+	apiKey, _ := apikeyService.CreateAPIKey(owner.ID, "ci", nil)
+	handler := apiKeyUsageMiddleware(http.HandlerFunc(uploadHandler))
+
+	upload := func() {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("from CI"))
+		req.Header.Set("Authorization", "Bearer "+apiKey.Key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected upload to succeed, got %d", w.Code)
+		}
+	}
+
+	listUsage := func(session *Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/api/keys/%d/usage", apiKey.ID), nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		apiKeyUsageHandler(w, req)
+		return w
+	}
+
+	t.Run("API key request is recorded", func(t *testing.T) {
+		upload()
+
+		w := listUsage(ownerSession)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var usage []APIKeyUsage
+		json.Unmarshal(w.Body.Bytes(), &usage)
+		if len(usage) != 1 {
+			t.Fatalf("Expected 1 usage record, got %d", len(usage))
+		}
+		if usage[0].Method != "POST" || usage[0].Path != "/upload" || usage[0].Status != http.StatusOK {
+			t.Errorf("Unexpected usage record: %+v", usage[0])
+		}
+	})
+
+	t.Run("Other users can't see the log", func(t *testing.T) {
+		if w := listUsage(otherSession); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for someone else's key, got %d", w.Code)
+		}
+	})
+
+	t.Run("Sampling disabled", func(t *testing.T) {
+		config.APIKeyUsageSampleRate = 0
+		defer func() { config.APIKeyUsageSampleRate = 1 }()
+
+		upload()
+
+		var count int64
+		testDB.Model(&APIKeyUsage{}).Count(&count)
+		if count != 1 {
+			t.Errorf("Expected no new usage records with sampling off, got %d total", count)
+		}
+	})
+
+	t.Run("Session requests aren't logged", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("from browser"))
+		req.AddCookie(&http.Cookie{Name: "session", Value: ownerSession.ID})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		var count int64
+		testDB.Model(&APIKeyUsage{}).Count(&count)
+		if count != 1 {
+			t.Errorf("Expected session uploads not to be logged, got %d records", count)
+		}
+	})
+}
+
+// TestDefaultPrivateForUsers tests the private-by-default upload mode
+func TestDefaultPrivateForUsers(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.DefaultPrivateForUsers = true
+	defer func() { config = testConfig() }()
+
+	user, _ := authService.Register("privacyfan", "password123")
+	session, _ := authService.CreateSession(user.ID)
+
+	// upload returns whether the created paste is private
+	upload := func(t *testing.T, target, contentType, body string, loggedIn bool) bool {
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if loggedIn {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		id := strings.TrimPrefix(strings.TrimSpace(w.Body.String()), config.ServePath)
+		if contentType == "application/json" {
+			var resp map[string]string
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			id = resp["id"]
+		}
+		var paste Paste
+		testDB.First(&paste, "id = ?", id)
+		return paste.IsPrivate
+	}
+
+	t.Run("Default applies to logged-in JSON uploads", func(t *testing.T) {
+		if !upload(t, "/upload", "application/json", `{"content":"json default"}`, true) {
+			t.Error("Expected paste to default to private")
+		}
+	})
+
+	t.Run("Default applies to legacy uploads", func(t *testing.T) {
+		if !upload(t, "/upload", "", "legacy default", true) {
+			t.Error("Expected legacy paste to default to private")
+		}
+	})
+
+	t.Run("Explicit public overrides the default", func(t *testing.T) {
+		if upload(t, "/upload", "application/json", `{"content":"explicitly public","is_private":false}`, true) {
+			t.Error("Expected explicit is_private=false to be honoured")
+		}
+		if upload(t, "/upload?private=0", "", "legacy explicitly public", true) {
+			t.Error("Expected explicit private=0 to be honoured")
+		}
+	})
+
+	t.Run("Anonymous uploads stay public", func(t *testing.T) {
+		if upload(t, "/upload", "application/json", `{"content":"anonymous"}`, false) {
+			t.Error("Expected anonymous paste to be public")
+		}
+	})
+}
+
+func TestOwnerCanViewExpiredPaste(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	owner, _ := authService.Register("forgetful", "password123")
+	ownerSession, _ := authService.CreateSession(owner.ID)
+	other, _ := authService.Register("stranger", "password123")
+	otherSession, _ := authService.CreateSession(other.ID)
+
+	expiresIn := 60
+	paste, _ := pasteService.CreatePaste("", "lapsed content", "text", false, false, &expiresIn, &owner.ID)
+	testDB.Model(paste).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+
+	view := func(session *Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/p/"+paste.ID+"?raw=1", nil)
+		if session != nil {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		servePasteHandler(w, req)
+		return w
+	}
+
+	t.Run("Owner can still read it", func(t *testing.T) {
+		w := view(ownerSession)
+		if w.Code != http.StatusOK || w.Body.String() != "lapsed content" {
+			t.Fatalf("Expected owner to read expired paste, got %d: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("X-Paste-Expired") != "true" {
+			t.Errorf("Expected X-Paste-Expired header for expired paste")
+		}
+	})
+
+	t.Run("Anonymous viewer gets 404", func(t *testing.T) {
+		if w := view(nil); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for anonymous viewer, got %d", w.Code)
+		}
+	})
+
+	t.Run("Other user gets 404", func(t *testing.T) {
+		if w := view(otherSession); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for other user, got %d", w.Code)
+		}
+	})
+
+	t.Run("Unexpired paste has no expired header", func(t *testing.T) {
+		testDB.Model(paste).UpdateColumn("expires_at", time.Now().Add(time.Hour))
+		if w := view(ownerSession); w.Header().Get("X-Paste-Expired") != "" {
+			t.Errorf("Expected no X-Paste-Expired header on live paste")
+		}
+	})
+}
+
+func TestStorageLimitBlocksUploads(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.MaxDatabaseBytes = 100
+	defer func() {
+		config = testConfig()
+		uploadsBlocked.Store(false)
+	}()
+
+	upload := func(content string) int {
+		w := httptest.NewRecorder()
+		uploadHandler(w, httptest.NewRequest("POST", "/upload", strings.NewReader(content)))
+		return w.Code
+	}
+
+	if code := upload(strings.Repeat("a", 150)); code != http.StatusOK {
+		t.Fatalf("Expected upload under the guard to succeed, got %d", code)
+	}
+
+	t.Run("Crossing the limit blocks uploads", func(t *testing.T) {
+		if err := checkStorageLimit(); err != nil {
+			t.Fatalf("Storage check failed: %v", err)
+		}
+		if !uploadsBlocked.Load() {
+			t.Fatal("Expected uploads to be blocked over the limit")
+		}
+		if code := upload("one more"); code != http.StatusInsufficientStorage {
+			t.Errorf("Expected 507 while blocked, got %d", code)
+		}
+	})
+
+	t.Run("Soft-deleted pastes still count", func(t *testing.T) {
+		testDB.Where("1 = 1").Delete(&Paste{})
+		if err := checkStorageLimit(); err != nil {
+			t.Fatalf("Storage check failed: %v", err)
+		}
+		if !uploadsBlocked.Load() {
+			t.Fatal("Expected soft-deleted content to keep uploads blocked")
+		}
+	})
+
+	t.Run("Dropping below re-enables uploads", func(t *testing.T) {
+		testDB.Unscoped().Where("1 = 1").Delete(&Paste{})
+		if err := checkStorageLimit(); err != nil {
+			t.Fatalf("Storage check failed: %v", err)
+		}
+		if uploadsBlocked.Load() {
+			t.Fatal("Expected uploads to be re-enabled under the limit")
+		}
+		if code := upload("back in business"); code != http.StatusOK {
+			t.Errorf("Expected upload to succeed again, got %d", code)
+		}
+	})
+
+	t.Run("Disabled guard never blocks", func(t *testing.T) {
+		config.MaxDatabaseBytes = 0
+		uploadsBlocked.Store(true)
+		checkStorageLimit()
+		if uploadsBlocked.Load() {
+			t.Error("Expected disabled guard to clear the block")
+		}
+	})
+}
+
+func TestViewLanguageOverride(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	paste, _ := pasteService.CreatePaste("", "def main():\n    pass\n", "go", false, false, nil, nil)
+
+	view := func(query string) string {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+paste.ID+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	t.Run("Override changes highlighting", func(t *testing.T) {
+		body := view("?lang=py")
+		if !strings.Contains(body, `class="language-python"`) {
+			t.Errorf("Expected python highlighting for ?lang=py")
+		}
+		if strings.Contains(body, `class="language-go"`) {
+			t.Errorf("Expected stored language not to be used for highlighting")
+		}
+		if !strings.Contains(body, "saved as go") {
+			t.Errorf("Expected the stored language to still be shown")
+		}
+	})
+
+	t.Run("Stored paste is unchanged", func(t *testing.T) {
+		var stored Paste
+		testDB.First(&stored, "id = ?", paste.ID)
+		if stored.Language != "go" {
+			t.Errorf("Expected stored language to stay go, got %s", stored.Language)
+		}
+	})
+
+	t.Run("Unknown language is ignored", func(t *testing.T) {
+		if body := view("?lang=klingon"); !strings.Contains(body, `class="language-go"`) {
+			t.Errorf("Expected unknown ?lang to fall back to the stored language")
+		}
+	})
+}
+
+func TestViewTheme(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	paste, _ := pasteService.CreatePaste("", "package main\n\nfunc main() {}\n", "go", false, false, nil, nil)
+
+	// Code block rules of the default and monokai styles
+	const githubDark, monokai = ".chroma { color: #e6edf3", ".chroma { color: #f8f8f2"
+
+	view := func(path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/p/"+paste.ID+path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		servePasteHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w
+	}
+	themeCookieSet := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == themeCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	t.Run("Highlighted on the server", func(t *testing.T) {
+		body := view("", nil).Body.String()
+		if !strings.Contains(body, `<span class="kd">func</span>`) {
+			t.Error("Expected highlighted markup for the content")
+		}
+		if !strings.Contains(body, githubDark) {
+			t.Error("Expected the default theme's CSS")
+		}
+	})
+
+	t.Run("Valid theme changes the CSS and is remembered", func(t *testing.T) {
+		w := view("?theme=monokai", nil)
+		body := w.Body.String()
+		if !strings.Contains(body, monokai) || strings.Contains(body, githubDark) {
+			t.Error("Expected monokai CSS instead of the default")
+		}
+		cookie := themeCookieSet(w)
+		if cookie == nil || cookie.Value != "monokai" {
+			t.Fatalf("Expected a monokai theme cookie, got %v", cookie)
+		}
+
+		if body := view("", cookie).Body.String(); !strings.Contains(body, monokai) {
+			t.Error("Expected the cookie's theme on a later view")
+		}
+	})
+
+	t.Run("Invalid theme falls back to the default", func(t *testing.T) {
+		w := view("?theme=no-such-theme", nil)
+		if !strings.Contains(w.Body.String(), githubDark) {
+			t.Error("Expected the default theme's CSS")
+		}
+		if cookie := themeCookieSet(w); cookie != nil {
+			t.Errorf("Expected no theme cookie, got %q", cookie.Value)
+		}
+	})
+
+	t.Run("Configured default", func(t *testing.T) {
+		config.DefaultTheme = "monokai"
+		defer func() { config.DefaultTheme = testConfig().DefaultTheme }()
+		if body := view("", nil).Body.String(); !strings.Contains(body, monokai) {
+			t.Error("Expected default_theme's CSS")
+		}
+	})
+
+	t.Run("Large pastes are shown plain", func(t *testing.T) {
+		config.MaxPasteSize = 2 * highlightMaxBytes
+		defer func() { config.MaxPasteSize = testConfig().MaxPasteSize }()
+		large, err := pasteService.CreatePaste("", strings.Repeat("func main() {}\n", highlightMaxBytes/15+1), "go", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/p/"+large.ID, nil)
+		w := httptest.NewRecorder()
+		servePasteHandler(w, req)
+		body := w.Body.String()
+		if w.Code != http.StatusOK || strings.Contains(body, `<span class="kd">`) || !strings.Contains(body, "func main() {}") {
+			t.Errorf("Expected unhighlighted content, got %d", w.Code)
+		}
+	})
+
+	t.Run("Image uses the theme", func(t *testing.T) {
+		themed := view("/image.png?theme=monokai", nil).Body.Bytes()
+		plain := view("/image.png", nil).Body.Bytes()
+		if bytes.Equal(themed, plain) {
+			t.Error("Expected ?theme= to change the rendered image")
+		}
+	})
+}
+
+func TestBatchUpload(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	user, _ := authService.Register("batcher", "password123")
+	session, _ := authService.CreateSession(user.ID)
+
+	batch := func(t *testing.T, body string) (int, []batchUploadResult) {
+		req := httptest.NewRequest("POST", "/api/paste/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		batchUploadHandler(w, req)
+
+		var results []batchUploadResult
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatalf("Failed to decode batch response: %v", err)
+			}
+		}
+		return w.Code, results
+	}
+
+	t.Run("Mixed batch reports per item", func(t *testing.T) {
+		code, results := batch(t, `[
+			{"content":"package main","filename":"main.go"},
+			{"content":""},
+			{"content":"print(1)","language":"python","is_private":true},
+			{"content":"x","colour":"blue"}
+		]`)
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		if len(results) != 4 {
+			t.Fatalf("Expected 4 results, got %d", len(results))
+		}
+
+		if results[0].ID == "" || results[0].URL != config.ServePath+results[0].ID || results[0].Error != "" {
+			t.Errorf("Expected first paste to be created, got %+v", results[0])
+		}
+		if results[1].ID != "" || results[1].Error == "" {
+			t.Errorf("Expected empty paste to be rejected, got %+v", results[1])
+		}
+		if results[2].ID == "" {
+			t.Errorf("Expected third paste to be created, got %+v", results[2])
+		}
+		if !strings.Contains(results[3].Error, "colour") {
+			t.Errorf("Expected unknown field error, got %+v", results[3])
+		}
+
+		first, _ := pasteService.GetPaste(results[0].ID, &user.ID)
+		if first.Language != "go" || first.Title != "main.go" || *first.UserID != user.ID {
+			t.Errorf("Expected filename hints and owner to apply, got %+v", first)
+		}
+		third, _ := pasteService.GetPaste(results[2].ID, &user.ID)
+		if !third.IsPrivate || third.Language != "python" {
+			t.Errorf("Expected private python paste, got %+v", third)
+		}
+	})
+
+	t.Run("Quota applies across the batch", func(t *testing.T) {
+		used, _ := pasteService.StorageUsed(user.ID)
+		config.UserQuotaBytes = used + 15
+		defer func() { config.UserQuotaBytes = 0 }()
+
+		_, results := batch(t, `[{"content":"0123456789"},{"content":"abcdefghij"}]`)
+		if len(results) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(results))
+		}
+		if results[0].ID == "" {
+			t.Errorf("Expected first paste to fit the quota, got %+v", results[0])
+		}
+		if !strings.Contains(results[1].Error, "quota") {
+			t.Errorf("Expected second paste to exceed the quota, got %+v", results[1])
+		}
+	})
+
+	t.Run("Rejects empty and oversized batches", func(t *testing.T) {
+		if code, _ := batch(t, `[]`); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for empty batch, got %d", code)
+		}
+		if code, _ := batch(t, `{"content":"not an array"}`); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for non-array body, got %d", code)
+		}
+
+		items := make([]string, batchMaxPastes+1)
+		for i := range items {
+			items[i] = fmt.Sprintf(`{"content":"paste %d"}`, i)
+		}
+		if code, _ := batch(t, "["+strings.Join(items, ",")+"]"); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for oversized batch, got %d", code)
+		}
+
+		large := strings.Repeat("x", config.MaxPasteSize*3/4)
+		if code, _ := batch(t, `[{"content":"`+large+`"},{"content":"`+large+`"}]`); code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected 413 for a batch over one upload's size, got %d", code)
+		}
+	})
+}
+
+func TestSecurityTxt(t *testing.T) {
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	fetch := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		securityTxtHandler(w, httptest.NewRequest("GET", "/.well-known/security.txt", nil))
+		return w
+	}
+
+	t.Run("404 when unset", func(t *testing.T) {
+		if w := fetch(); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 without abuse_contact, got %d", w.Code)
+		}
+	})
+
+	t.Run("Email contact", func(t *testing.T) {
+		config.AbuseContact = "abuse@example.com"
+		w := fetch()
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		body := w.Body.String()
+		if !strings.Contains(body, "Contact: mailto:abuse@example.com\n") {
+			t.Errorf("Expected mailto contact, got: %s", body)
+		}
+		if !strings.Contains(body, "Expires: ") {
+			t.Errorf("Expected Expires field, got: %s", body)
+		}
+	})
+
+	t.Run("URL contact", func(t *testing.T) {
+		config.AbuseContact = "https://example.com/abuse"
+		if body := fetch().Body.String(); !strings.Contains(body, "Contact: https://example.com/abuse\n") {
+			t.Errorf("Expected URL contact, got: %s", body)
+		}
+	})
+
+	t.Run("Shown on error pages", func(t *testing.T) {
+		config.AbuseContact = "abuse@example.com"
+		w := httptest.NewRecorder()
+		notfoundHandler(w)
+		if !strings.Contains(w.Body.String(), `href="mailto:abuse@example.com"`) {
+			t.Errorf("Expected abuse contact on 404 page, got: %s", w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		serverErrorHandler(w, "abc123")
+		if !strings.Contains(w.Body.String(), "abuse@example.com") {
+			t.Errorf("Expected abuse contact on 500 page")
+		}
+	})
+}
+
+func TestViewExpiryBanner(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	expiresIn := 3 * 24 * 60
+	expiring, _ := pasteService.CreatePaste("", "going away", "text", false, false, &expiresIn, nil)
+	permanent, _ := pasteService.CreatePaste("", "here to stay", "text", false, false, nil, nil)
+
+	view := func(id string) string {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+id, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	if body := view(expiring.ID); !strings.Contains(body, "This paste expires in 3 days") {
+		t.Errorf("Expected expiry banner on expiring paste")
+	}
+	if body := view(permanent.ID); strings.Contains(body, `class="expiry-banner"`) {
+		t.Errorf("Expected no expiry banner on permanent paste")
+	}
+}
+
+func TestPasteIDPrefix(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.PasteIDPrefix = "a-"
+	defer func() { config = testConfig() }()
+
+	paste, err := pasteService.CreatePaste("", "namespaced", "text", false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+	if !strings.HasPrefix(paste.ID, "a-") || len(paste.ID) != len("a-")+config.PasteIDLength {
+		t.Fatalf("Expected prefixed ID, got %s", paste.ID)
+	}
+
+	fetch := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+id+"?raw=1", nil))
+		return w
+	}
+
+	t.Run("Resolvable with prefix", func(t *testing.T) {
+		if w := fetch(paste.ID); w.Code != http.StatusOK || w.Body.String() != "namespaced" {
+			t.Errorf("Expected paste to resolve, got %d", w.Code)
+		}
+	})
+
+	t.Run("Resolvable without prefix", func(t *testing.T) {
+		if w := fetch(strings.TrimPrefix(paste.ID, "a-")); w.Code != http.StatusOK {
+			t.Errorf("Expected paste to resolve without its prefix, got %d", w.Code)
+		}
+	})
+
+	t.Run("Prefix validation", func(t *testing.T) {
+		for _, prefix := range []string{"", "a-", "node_1-"} {
+			if !validPasteIDPrefix(prefix) {
+				t.Errorf("Expected %q to be a valid prefix", prefix)
+			}
+		}
+		for _, prefix := range []string{"a/", "a b", "a?", "%2F", strings.Repeat("x", maxPasteIDPrefixLength+1)} {
+			if validPasteIDPrefix(prefix) {
+				t.Errorf("Expected %q to be rejected", prefix)
+			}
+		}
+	})
+}
+
+func TestViewOnlyLink(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	owner, _ := authService.Register("sharer", "password123")
+	session, _ := authService.CreateSession(owner.ID)
+	paste, _ := pasteService.CreatePaste("", "screenshare me", "text", false, false, nil, &owner.ID)
+
+	view := func(query string) string {
+		req := httptest.NewRequest("GET", "/p/"+paste.ID+query, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		servePasteHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+
+	editLink := `href="/edit/` + paste.ID + `"`
+	token := viewOnlyToken(paste.ID)
+
+	t.Run("Owner link shows controls", func(t *testing.T) {
+		body := view("")
+		if !strings.Contains(body, editLink) {
+			t.Error("Expected edit link for the owner")
+		}
+		if !strings.Contains(body, "?view="+token) {
+			t.Error("Expected view-only link for the owner")
+		}
+	})
+
+	t.Run("View-only link hides controls", func(t *testing.T) {
+		body := view("?view=" + token)
+		if strings.Contains(body, editLink) || strings.Contains(body, `onclick="duplicatePaste()"`) {
+			t.Error("Expected no edit controls on the view-only link")
+		}
+		if !strings.Contains(body, "screenshare me") {
+			t.Error("Expected paste content on the view-only link")
+		}
+	})
+
+	t.Run("Forged token is ignored", func(t *testing.T) {
+		if body := view("?view=forged"); !strings.Contains(body, editLink) {
+			t.Error("Expected edit link with an invalid token")
+		}
+	})
+
+	t.Run("Token is bound to the paste", func(t *testing.T) {
+		if validViewOnlyToken("otherid", token) {
+			t.Error("Expected token to be rejected for another paste")
+		}
+	})
+}
+
+func TestMaxConcurrentUploads(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.UploadQueueTimeout = 0
+	uploadSlots = newUploadSlots(2)
+	defer func() {
+		config = testConfig()
+		uploadSlots = nil
+	}()
+
+	// Start uploads whose bodies stay open, so each holds a slot until
+	// its writer is closed
+	var wg sync.WaitGroup
+	var writers []*io.PipeWriter
+	codes := make([]int, 2)
+	for i := range codes {
+		pr, pw := io.Pipe()
+		writers = append(writers, pw)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			uploadHandler(w, httptest.NewRequest("POST", "/upload", pr))
+			codes[i] = w.Code
+		}()
+		// Once the body is being read, the upload has its slot
+		pw.Write([]byte(fmt.Sprintf("slow upload %d", i)))
+	}
+
+	upload := func() int {
+		w := httptest.NewRecorder()
+		uploadHandler(w, httptest.NewRequest("POST", "/upload", strings.NewReader("one too many")))
+		return w.Code
+	}
+
+	t.Run("Excess upload is rejected", func(t *testing.T) {
+		if code := upload(); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 with all slots taken, got %d", code)
+		}
+	})
+
+	t.Run("Excess upload waits for a slot", func(t *testing.T) {
+		config.UploadQueueTimeout = 5
+		done := make(chan int)
+		go func() { done <- upload() }()
+
+		time.Sleep(50 * time.Millisecond) // let it start waiting
+		writers[0].Close()
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected queued upload to succeed, got %d", code)
+		}
+	})
+
+	writers[1].Close()
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("Expected slow upload %d to succeed, got %d", i, code)
+		}
+	}
+}
+
+func TestPasteIDAvailable(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { idAvailabilityRateLimiter = newRateLimiter(idAvailabilityRateLimit, time.Minute) }()
+
+	taken, _ := pasteService.CreatePaste("", "already here", "text", false, false, nil, nil)
+
+	check := func(id string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		pasteIDAvailableHandler(w, httptest.NewRequest("GET", "/api/paste/available?id="+id, nil))
+		var resp map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+
+	tests := []struct {
+		name      string
+		id        string
+		available bool
+		reason    string
+	}{
+		{"Taken", taken.ID, false, "taken"},
+		{"Reserved", "Admin", false, "reserved"},
+		{"Invalid", "a/b%2Fc", false, "invalid"},
+		{"Available", "my-notes", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, resp := check(tt.id)
+			if code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", code)
+			}
+			if resp["available"] != tt.available {
+				t.Errorf("Expected available=%v, got %v", tt.available, resp["available"])
+			}
+			if reason, _ := resp["reason"].(string); reason != tt.reason {
+				t.Errorf("Expected reason %q, got %q", tt.reason, reason)
+			}
+		})
+	}
+
+	t.Run("Deleted IDs stay taken", func(t *testing.T) {
+		testDB.Delete(taken)
+		if _, resp := check(taken.ID); resp["available"] != false {
+			t.Error("Expected a deleted paste's ID to stay unavailable")
+		}
+	})
+
+	t.Run("Checks are rate limited", func(t *testing.T) {
+		idAvailabilityRateLimiter = newRateLimiter(1, time.Minute)
+		check("first-try")
+		if code, _ := check("second-try"); code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 over the limit, got %d", code)
+		}
+	})
+}
+
+func TestRegistrationTermsAcceptance(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.RequireTermsAcceptance = true
+	config.TermsURL = "https://example.com/terms"
+	defer func() { config = testConfig() }()
+
+	register := func(req RegisterRequest) int {
+		body, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		registerHandler(w, httptest.NewRequest("POST", "/api/register", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	t.Run("Blocked without acceptance", func(t *testing.T) {
+		if code := register(RegisterRequest{Username: "refuser", Password: "password123"}); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 without accepted_terms, got %d", code)
+		}
+		var count int64
+		testDB.Model(&User{}).Where("username = ?", "refuser").Count(&count)
+		if count != 0 {
+			t.Error("Expected no account to be created")
+		}
+	})
+
+	t.Run("Succeeds with acceptance", func(t *testing.T) {
+		if code := register(RegisterRequest{Username: "accepter", Password: "password123", AcceptedTerms: true}); code != http.StatusOK {
+			t.Fatalf("Expected 200 with accepted_terms, got %d", code)
+		}
+		var user User
+		testDB.Where("username = ?", "accepter").First(&user)
+		if user.TermsAcceptedAt == nil || time.Since(*user.TermsAcceptedAt) > time.Minute {
+			t.Errorf("Expected acceptance time to be recorded, got %v", user.TermsAcceptedAt)
+		}
+	})
+
+	t.Run("Index asks for acceptance", func(t *testing.T) {
+		resetIndexCache()
+		w := httptest.NewRecorder()
+		indexHandler(w, httptest.NewRequest("GET", "/", nil))
+		if !strings.Contains(w.Body.String(), `const termsURL = "https://example.com/terms"`) {
+			t.Errorf("Expected terms URL on the index page")
+		}
+	})
+}
+
+func TestPasteMaxViews(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	owner, _ := authService.Register("limiter", "password123")
+	session, _ := authService.CreateSession(owner.ID)
+
+	maxViews := int64(2)
+	paste, err := pasteService.CreatePasteWithOptions("", "see it twice", "text", false, false, nil, &owner.ID, PasteOptions{MaxViews: &maxViews})
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+
+	view := func(asOwner bool) int {
+		req := httptest.NewRequest("GET", "/p/"+paste.ID+"?raw=1", nil)
+		if asOwner {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		servePasteHandler(w, req)
+		return w.Code
+	}
+
+	if code := view(true); code != http.StatusOK {
+		t.Fatalf("Expected owner preview to succeed, got %d", code)
+	}
+	for i := 1; i <= 2; i++ {
+		if code := view(false); code != http.StatusOK {
+			t.Fatalf("Expected view %d to succeed, got %d", i, code)
+		}
+	}
+
+	t.Run("Third view 404s", func(t *testing.T) {
+		if code := view(false); code != http.StatusNotFound {
+			t.Errorf("Expected 404 after max views, got %d", code)
+		}
+	})
+
+	t.Run("Owner can still view", func(t *testing.T) {
+		if code := view(true); code != http.StatusOK {
+			t.Errorf("Expected owner to keep access, got %d", code)
+		}
+	})
+
+	t.Run("Image counts as a view", func(t *testing.T) {
+		once := int64(1)
+		limited, _ := pasteService.CreatePasteWithOptions("", "see it once", "text", false, false, nil, &owner.ID, PasteOptions{MaxViews: &once})
+		for i, want := range []int{http.StatusOK, http.StatusNotFound} {
+			w := httptest.NewRecorder()
+			servePasteHandler(w, httptest.NewRequest("GET", "/p/"+limited.ID+"/image.png", nil))
+			if w.Code != want {
+				t.Errorf("Image fetch %d: expected %d, got %d", i+1, want, w.Code)
+			}
+		}
+	})
+
+	t.Run("Limited pastes aren't deduplicated", func(t *testing.T) {
+		again, _ := pasteService.CreatePaste("", "see it twice", "text", false, false, nil, &owner.ID)
+		if again.ID == paste.ID {
+			t.Error("Expected an unlimited upload not to reuse the limited paste")
+		}
+	})
+
+	t.Run("Rejects a zero limit", func(t *testing.T) {
+		zero := int64(0)
+		if _, err := pasteService.CreatePasteWithOptions("", "never", "text", false, false, nil, nil, PasteOptions{MaxViews: &zero}); err == nil {
+			t.Error("Expected max_views of 0 to be rejected")
+		}
+	})
+}
+
+func TestRawPasteMetaHeaders(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	plain, _ := pasteService.CreatePaste("build script", "make all", "bash", false, false, nil, nil)
+	unicode, _ := pasteService.CreatePaste("Café ✓ notes", "du café", "markdown", false, false, nil, nil)
+
+	fetch := func(id, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+id+query, nil))
+		return w
+	}
+
+	t.Run("ASCII title as-is", func(t *testing.T) {
+		w := fetch(plain.ID, "?raw=1")
+		if got := w.Header().Get("X-Paste-Title"); got != "build script" {
+			t.Errorf("Expected plain title, got %q", got)
+		}
+		if got := w.Header().Get("X-Paste-Language"); got != "bash" {
+			t.Errorf("Expected language bash, got %q", got)
+		}
+	})
+
+	t.Run("Unicode title is encoded", func(t *testing.T) {
+		w := fetch(unicode.ID, "?download=1")
+		if got := w.Header().Get("X-Paste-Title"); got != "UTF-8''Caf%C3%A9%20%E2%9C%93%20notes" {
+			t.Errorf("Expected RFC 5987 encoded title, got %q", got)
+		}
+		if got := w.Header().Get("X-Paste-Language"); got != "markdown" {
+			t.Errorf("Expected language markdown, got %q", got)
+		}
+	})
+
+	t.Run("Not on the HTML view", func(t *testing.T) {
+		w := fetch(plain.ID, "")
+		if w.Header().Get("X-Paste-Title") != "" || w.Header().Get("X-Paste-Language") != "" {
+			t.Error("Expected no metadata headers on the HTML view")
+		}
+	})
+}
+
+// TestAdminAuditLog tests that admin actions are recorded and listed
+func TestAdminAuditLog(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("auditadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+
+	regular, _ := authService.Register("regular", "password123")
+	regularSession, _ := authService.CreateSession(regular.ID)
+
+	deleteUser := func(userID uint) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"user_id":%d}`, userID)
+		req := httptest.NewRequest("POST", "/api/admin/delete-user", strings.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "session", Value: adminSession.ID})
+		w := httptest.NewRecorder()
+		adminDeleteUserHandler(w, req)
+		return w
+	}
+
+	audit := func(session *Session) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/admin/audit", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		adminAuditHandler(w, req)
+		return w
+	}
+
+	t.Run("Non-admin is forbidden", func(t *testing.T) {
+		if w := audit(regularSession); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 for non-admin, got %d", w.Code)
+		}
+	})
+
+	t.Run("Deleting a user is recorded", func(t *testing.T) {
+		victim, _ := authService.Register("victim", "password123")
+		if w := deleteUser(victim.ID); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 deleting user, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w := audit(adminSession)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		var result struct {
+			Total   int64
+			Entries []AuditLog
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("Invalid JSON: %v", err)
+		}
+		if len(result.Entries) == 0 {
+			t.Fatal("Expected an audit entry")
+		}
+
+		entry := result.Entries[0]
+		if entry.Action != auditDeleteUser {
+			t.Errorf("Expected action %s, got %s", auditDeleteUser, entry.Action)
+		}
+		if entry.ActorID != admin.ID {
+			t.Errorf("Expected actor %d, got %d", admin.ID, entry.ActorID)
+		}
+		if entry.Target != fmt.Sprintf("user:%d", victim.ID) {
+			t.Errorf("Expected target user:%d, got %s", victim.ID, entry.Target)
+		}
+		if entry.Detail != "victim" {
+			t.Errorf("Expected the deleted username in the detail, got %q", entry.Detail)
+		}
+	})
+
+	t.Run("Failed deletion is not recorded", func(t *testing.T) {
+		var before int64
+		testDB.Model(&AuditLog{}).Count(&before)
+
+		if w := deleteUser(9999); w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 deleting a missing user, got %d", w.Code)
+		}
+
+		var after int64
+		testDB.Model(&AuditLog{}).Count(&after)
+		if after != before {
+			t.Errorf("Expected no new audit entries, got %d", after-before)
+		}
+	})
+
+	t.Run("Disabled audit log records nothing", func(t *testing.T) {
+		config.AuditLog = false
+		defer func() { config.AuditLog = true }()
+
+		var before int64
+		testDB.Model(&AuditLog{}).Count(&before)
+
+		other, _ := authService.Register("other", "password123")
+		if w := deleteUser(other.ID); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 deleting user, got %d", w.Code)
+		}
+
+		var after int64
+		testDB.Model(&AuditLog{}).Count(&after)
+		if after != before {
+			t.Errorf("Expected no new audit entries with audit_log off, got %d", after-before)
+		}
+	})
+}
+
+// TestPasteUnlistAt tests that a paste drops off /all once its UnlistAt
+// passes but can still be opened by its ID
+func TestPasteUnlistAt(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	unlistIn := 60
+	paste, err := pasteService.CreatePasteWithOptions("Fading paste", "here for now", "text", false, false, nil, nil, PasteOptions{UnlistIn: &unlistIn})
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+	if paste.UnlistAt == nil || time.Until(*paste.UnlistAt) < 59*time.Minute {
+		t.Fatalf("Expected UnlistAt about an hour out, got %v", paste.UnlistAt)
+	}
+
+	listed := func() bool {
+		w := httptest.NewRecorder()
+		allPastesHandler(w, httptest.NewRequest("GET", "/all", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("/all page failed: %d", w.Code)
+		}
+		return strings.Contains(w.Body.String(), "Fading paste")
+	}
+
+	t.Run("Listed before UnlistAt", func(t *testing.T) {
+		if !listed() {
+			t.Error("Expected the paste on /all before UnlistAt")
+		}
+	})
+
+	testDB.Model(&Paste{}).Where("id = ?", paste.ID).Update("unlist_at", time.Now().Add(-time.Minute))
+
+	t.Run("Gone from /all after UnlistAt", func(t *testing.T) {
+		if listed() {
+			t.Error("Expected the paste to be left off /all after UnlistAt")
+		}
+		recent, _ := pasteService.GetRecentPublicPastes(10)
+		if len(recent) != 0 {
+			t.Errorf("Expected no recent pastes, got %d", len(recent))
+		}
+	})
+
+	t.Run("Still reachable by ID", func(t *testing.T) {
+		if _, err := pasteService.GetPaste(paste.ID, nil); err != nil {
+			t.Fatalf("Expected the paste to still load, got %v", err)
+		}
+
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+paste.ID+"?raw=1", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "here for now" {
+			t.Errorf("Expected the raw paste, got %d: %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Invalid unlist_in", func(t *testing.T) {
+		zero := 0
+		if _, err := pasteService.CreatePasteWithOptions("", "never listed", "text", false, false, nil, nil, PasteOptions{UnlistIn: &zero}); err == nil {
+			t.Error("Expected unlist_in of 0 to be rejected")
+		}
+	})
+}
+
+// TestMaxPageSize tests that list endpoints clamp oversized page sizes
+func TestMaxPageSize(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.MaxPageSize = 5
+
+	user, _ := authService.Register("pager", "password123")
+	session, _ := authService.CreateSession(user.ID)
+	for i := 0; i < 8; i++ {
+		pasteService.CreatePaste("", fmt.Sprintf("findme %d", i), "text", false, false, nil, &user.ID)
+	}
+
+	// Links to pastes rendered by the server, not the ones built in scripts
+	pasteLink := regexp.MustCompile(`href="/p/[A-Za-z0-9]`)
+	countPastes := func(w *httptest.ResponseRecorder) int {
+		return len(pasteLink.FindAllString(w.Body.String(), -1))
+	}
+
+	get := func(path string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s failed: %d %s", path, w.Code, w.Body.String())
+		}
+		if size := w.Header().Get("X-Page-Size"); size != "5" {
+			t.Errorf("Expected X-Page-Size 5 for %s, got %q", path, size)
+		}
+		return w
+	}
+
+	t.Run("Browse page", func(t *testing.T) {
+		w := get("/all?per_page=1000000", allPastesHandler)
+		if n := countPastes(w); n != 5 {
+			t.Errorf("Expected 5 pastes on /all, got %d", n)
+		}
+		if !strings.Contains(w.Body.String(), "?page=2&per_page=5") {
+			t.Errorf("Expected a link to the next page at the clamped size")
+		}
+	})
+
+	t.Run("My pastes page", func(t *testing.T) {
+		w := get("/my-pastes?per_page=1000000", myPastesHandler)
+		if n := countPastes(w); n != 5 {
+			t.Errorf("Expected 5 pastes on /my-pastes, got %d", n)
+		}
+
+		w = get("/my-pastes?page=2&per_page=1000000", myPastesHandler)
+		if n := countPastes(w); n != 3 {
+			t.Errorf("Expected the remaining 3 pastes on page 2, got %d", n)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		w := get("/api/paste/search?q=findme&per_page=1000000", searchPastesHandler)
+		var results []SearchResult
+		json.Unmarshal(w.Body.Bytes(), &results)
+		if len(results) != 5 {
+			t.Errorf("Expected 5 search results, got %d", len(results))
+		}
+		if total := w.Header().Get("X-Total-Count"); total != "8" {
+			t.Errorf("Expected X-Total-Count 8, got %q", total)
+		}
+	})
+
+	t.Run("Recent", func(t *testing.T) {
+		w := get("/api/recent?limit=1000000", recentHandler)
+		var entries []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &entries)
+		if len(entries) != 5 {
+			t.Errorf("Expected 5 recent pastes, got %d", len(entries))
+		}
+	})
+
+	t.Run("Invalid sizes are still rejected", func(t *testing.T) {
+		for _, path := range []string{"/all?per_page=0", "/all?per_page=abc", "/all?page=-1"} {
+			w := httptest.NewRecorder()
+			allPastesHandler(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for %s, got %d", path, w.Code)
+			}
+		}
+	})
+}
+
+// TestAutoLanguage tests that "auto" pastes are highlighted as detected
+// while keeping "auto" as their stored language
+func TestAutoLanguage(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	owner, _ := authService.Register("autolang", "password123")
+	paste, err := pasteService.CreatePaste("", "#!/usr/bin/env python3\nprint('hi')\n", autoLanguage, false, false, nil, &owner.ID)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+
+	view := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+paste.ID+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w
+	}
+
+	t.Run("Highlighted as detected", func(t *testing.T) {
+		if body := view("").Body.String(); !strings.Contains(body, `class="language-python"`) {
+			t.Errorf("Expected python highlighting for an auto paste")
+		}
+		if disposition := view("?download=1").Header().Get("Content-Disposition"); !strings.Contains(disposition, paste.ID+".py") {
+			t.Errorf("Expected a .py download, got %s", disposition)
+		}
+	})
+
+	t.Run("Stored language stays auto", func(t *testing.T) {
+		stored, _ := pasteService.GetPaste(paste.ID, nil)
+		if stored.Language != autoLanguage {
+			t.Errorf("Expected stored language auto, got %s", stored.Language)
+		}
+	})
+
+	t.Run("Edits are detected afresh", func(t *testing.T) {
+		if _, err := pasteService.UpdatePaste(paste.ID, "", "#!/bin/bash\necho hi\n", autoLanguage, false, owner.ID); err != nil {
+			t.Fatalf("Failed to update paste: %v", err)
+		}
+		if body := view("").Body.String(); !strings.Contains(body, `class="language-bash"`) {
+			t.Errorf("Expected bash highlighting after the edit")
+		}
+		stored, _ := pasteService.GetPaste(paste.ID, nil)
+		if stored.Language != autoLanguage {
+			t.Errorf("Expected stored language to stay auto after an edit, got %s", stored.Language)
+		}
+	})
+}
+
+func TestClaimPastes(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { claimRateLimiter = newRateLimiter(claimRateLimit, time.Minute) }()
+
+	upload := func() (string, string) {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader(`{"content":"anonymous `+randomString(8, letterRunes)+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]string
+		json.NewDecoder(w.Body).Decode(&resp)
+		if resp["claim_token"] == "" {
+			t.Fatalf("Expected a claim token for an anonymous upload, got %v", resp)
+		}
+		return resp["id"], resp["claim_token"]
+	}
+
+	claim := func(userID uint, tokens ...string) (int, []batchUploadResult) {
+		session, _ := authService.CreateSession(userID)
+		body, _ := json.Marshal(ClaimPastesRequest{Tokens: tokens})
+		req := httptest.NewRequest("POST", "/api/me/claim-pastes", bytes.NewReader(body))
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		claimPastesHandler(w, req)
+		var results []batchUploadResult
+		json.NewDecoder(w.Body).Decode(&results)
+		return w.Code, results
+	}
+
+	alice, _ := authService.Register("claimalice", "password123")
+	bob, _ := authService.Register("claimbob", "password123")
+
+	t.Run("Claims an anonymous paste", func(t *testing.T) {
+		id, token := upload()
+		code, results := claim(alice.ID, token)
+		if code != http.StatusOK || len(results) != 1 || results[0].ID != id {
+			t.Fatalf("Expected %s to be claimed, got %d %+v", id, code, results)
+		}
+		paste, _ := pasteService.GetPaste(id, nil)
+		if paste.UserID == nil || *paste.UserID != alice.ID {
+			t.Errorf("Expected the paste to belong to alice, got %v", paste.UserID)
+		}
+	})
+
+	t.Run("Rejects an owned paste", func(t *testing.T) {
+		id, token := upload()
+		claim(alice.ID, token)
+		_, results := claim(bob.ID, token)
+		if len(results) != 1 || results[0].Error == "" {
+			t.Fatalf("Expected an error claiming an owned paste, got %+v", results)
+		}
+		paste, _ := pasteService.GetPaste(id, &alice.ID)
+		if *paste.UserID != alice.ID {
+			t.Errorf("Expected the paste to stay with alice")
+		}
+	})
+
+	t.Run("Results line up with tokens", func(t *testing.T) {
+		id, token := upload()
+		_, results := claim(bob.ID, "pbc_bogus", token)
+		if len(results) != 2 || results[0].Error == "" || results[1].ID != id {
+			t.Errorf("Expected [error, %s], got %+v", id, results)
+		}
+	})
+
+	t.Run("Logged-in uploads get no token", func(t *testing.T) {
+		paste, _ := pasteService.CreatePaste("", "owned content", "text", false, false, nil, &alice.ID)
+		if paste.claimToken != "" || paste.ClaimToken != nil {
+			t.Errorf("Expected no claim token on an owned paste")
+		}
+	})
+
+	t.Run("Login required", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		claimPastesHandler(w, httptest.NewRequest("POST", "/api/me/claim-pastes", strings.NewReader(`{"tokens":["x"]}`)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		claimRateLimiter = newRateLimiter(1, time.Minute)
+		if code, _ := claim(bob.ID, "pbc_bogus"); code != http.StatusOK {
+			t.Fatalf("Expected the first claim to be allowed, got %d", code)
+		}
+		if code, _ := claim(bob.ID, "pbc_bogus"); code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429, got %d", code)
+		}
+	})
+}
+
+func TestPublicBrowseDisabled(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.EnablePublicBrowse = false
+	defer func() { config = testConfig() }()
+	resetIndexCache()
+	defer resetIndexCache()
+
+	paste, err := pasteService.CreatePaste("Listed title", "public content", "text", false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/all", allPastesHandler},
+		{"/api/recent", recentHandler},
+		{"/api/trending", trendingHandler},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != http.StatusNotFound {
+				t.Errorf("Expected 404, got %d", w.Code)
+			}
+		})
+	}
+
+	t.Run("Direct links still work", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		servePasteHandler(w, httptest.NewRequest("GET", "/p/"+paste.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Index hides the lists", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		indexHandler(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		body := w.Body.String()
+		if strings.Contains(body, "Listed title") {
+			t.Errorf("Expected no recent pastes on the index")
+		}
+		if !regexp.MustCompile(`const publicBrowse =\s*false`).MatchString(body) {
+			t.Errorf("Expected the Browse button to be turned off")
+		}
+	})
+}
+
+func TestMyPasteChanges(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	user, _ := authService.Register("syncuser", "password123")
+	other, _ := authService.Register("syncother", "password123")
+	session, _ := authService.CreateSession(user.ID)
+
+	// Three pastes last synced an hour ago
+	old := time.Now().Add(-time.Hour)
+	var before []*Paste
+	for i := 0; i < 3; i++ {
+		paste, err := pasteService.CreatePaste("", fmt.Sprintf("old %d", i), "text", false, false, nil, &user.ID)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		testDB.Model(paste).UpdateColumn("updated_at", old)
+		before = append(before, paste)
+	}
+	cutoff := time.Now().Add(-30 * time.Minute)
+
+	created, _ := pasteService.CreatePaste("", "new", "text", false, false, nil, &user.ID)
+	if _, err := pasteService.UpdatePaste(before[0].ID, "", "edited", "text", false, user.ID); err != nil {
+		t.Fatalf("Failed to update paste: %v", err)
+	}
+	if err := pasteService.DeletePaste(before[1].ID, user.ID); err != nil {
+		t.Fatalf("Failed to delete paste: %v", err)
+	}
+	pasteService.CreatePaste("", "someone else's", "text", false, false, nil, &other.ID)
+
+	type changesResponse struct {
+		Pastes     []Paste          `json:"pastes"`
+		Deleted    []PasteTombstone `json:"deleted"`
+		HasMore    bool             `json:"has_more"`
+		NextCursor string           `json:"next_cursor"`
+	}
+	fetch := func(query string) (int, changesResponse) {
+		req := httptest.NewRequest("GET", "/api/me/pastes?"+query, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		myPasteChangesHandler(w, req)
+		var resp changesResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return w.Code, resp
+	}
+	since := url.Values{"updated_since": {cutoff.Format(time.RFC3339Nano)}}
+
+	t.Run("New, updated and deleted", func(t *testing.T) {
+		code, resp := fetch(since.Encode())
+		if code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", code)
+		}
+		ids := map[string]bool{}
+		for _, p := range resp.Pastes {
+			ids[p.ID] = true
+		}
+		if len(resp.Pastes) != 2 || !ids[created.ID] || !ids[before[0].ID] {
+			t.Errorf("Expected the new and the edited paste, got %v", ids)
+		}
+		if len(resp.Deleted) != 1 || resp.Deleted[0].ID != before[1].ID {
+			t.Errorf("Expected a tombstone for %s, got %+v", before[1].ID, resp.Deleted)
+		}
+		if resp.HasMore || resp.NextCursor == "" {
+			t.Errorf("Expected everything in one response with a next_cursor, got %+v", resp)
+		}
+	})
+
+	t.Run("Everything without a cutoff", func(t *testing.T) {
+		_, resp := fetch("")
+		if len(resp.Pastes) != 3 || len(resp.Deleted) != 1 {
+			t.Errorf("Expected 3 pastes and 1 tombstone, got %d and %d", len(resp.Pastes), len(resp.Deleted))
+		}
+	})
+
+	t.Run("Resumes from next_cursor", func(t *testing.T) {
+		seen := 0
+		query := since
+		for i := 0; i < 5; i++ {
+			_, resp := fetch(query.Encode() + "&limit=1")
+			seen += len(resp.Pastes) + len(resp.Deleted)
+			if !resp.HasMore {
+				break
+			}
+			query = url.Values{"cursor": {resp.NextCursor}}
+		}
+		if seen != 3 {
+			t.Errorf("Expected 3 changes over the pages, got %d", seen)
+		}
+	})
+
+	t.Run("Changes at the same moment span pages", func(t *testing.T) {
+		expiresIn := 1
+		var expiring []*Paste
+		for i := 0; i < 5; i++ {
+			paste, _ := pasteService.CreatePaste("", fmt.Sprintf("expiring %d", i), "text", false, false, &expiresIn, &user.ID)
+			expiring = append(expiring, paste)
+		}
+		_, synced := fetch("")
+		for _, paste := range expiring {
+			testDB.Model(paste).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+		}
+		// One cleanup gives all five the same deleted_at
+		if _, err := pasteService.CleanupExpiredPastes(); err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+
+		tombstones := map[string]bool{}
+		query := url.Values{"cursor": {synced.NextCursor}}
+		for i := 0; i < 10; i++ {
+			_, resp := fetch(query.Encode() + "&limit=2")
+			for _, d := range resp.Deleted {
+				tombstones[d.ID] = true
+			}
+			if !resp.HasMore {
+				break
+			}
+			query = url.Values{"cursor": {resp.NextCursor}}
+		}
+		if len(tombstones) != 5 {
+			t.Errorf("Expected 5 tombstones over the pages, got %d", len(tombstones))
+		}
+	})
+
+	t.Run("Bad timestamp", func(t *testing.T) {
+		if code, _ := fetch("updated_since=yesterday"); code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", code)
+		}
+	})
+
+	t.Run("Bad cursor", func(t *testing.T) {
+		if code, _ := fetch("cursor=not-a-cursor"); code != http.StatusBadRequest {
+			t.Errorf("Expected 400, got %d", code)
+		}
+	})
+
+	t.Run("Login required", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		myPasteChangesHandler(w, httptest.NewRequest("GET", "/api/me/pastes", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+	})
+}
+
+func TestNewPastePage(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+
+	render := func(path string) string {
+		w := httptest.NewRecorder()
+		newPasteHandler(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+		return w.Body.String()
+	}
+	selected := func(body, name string) bool {
+		return regexp.MustCompile(`value="` + name + `"\s+selected`).MatchString(body)
+	}
+
+	t.Run("Lists every supported language", func(t *testing.T) {
+		body := render("/new")
+		for _, lang := range languages {
+			if !strings.Contains(body, `<option value="`+lang.Name+`"`) {
+				t.Errorf("Expected an option for %s", lang.Name)
+			}
+		}
+		if !strings.Contains(body, ">TypeScript</option>") {
+			t.Errorf("Expected options to be labelled")
+		}
+		if !strings.Contains(body, `<option value="auto"`) {
+			t.Errorf("Expected the auto-detect option")
+		}
+		if !selected(body, "text") {
+			t.Errorf("Expected plain text to be preselected")
+		}
+	})
+
+	t.Run("Preselects by alias", func(t *testing.T) {
+		if body := render("/new?language=js"); !selected(body, "javascript") || selected(body, "text") {
+			t.Errorf("Expected javascript to be preselected")
+		}
+	})
+
+	t.Run("Edit page keeps an unknown language", func(t *testing.T) {
+		user, _ := authService.Register("newpageuser", "password123")
+		session, _ := authService.CreateSession(user.ID)
+		paste, _ := pasteService.CreatePaste("", "+[]", "brainfuck", false, false, nil, &user.ID)
+
+		req := httptest.NewRequest("GET", "/edit/"+paste.ID, nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		w := httptest.NewRecorder()
+		editPastePageHandler(w, req)
+		if !selected(w.Body.String(), "brainfuck") {
+			t.Errorf("Expected the stored language to stay selected")
+		}
+	})
+}
+
+func TestAPIVersionEnvelope(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/config", configHandler)
+	mux.HandleFunc("/upload", uploadHandler)
+	mux.HandleFunc("/p/", servePasteHandler)
+	mux.HandleFunc("/api/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		fmt.Fprintln(w, `{"line":1}`)
+		// The first line must already be on its way
+		if !strings.Contains(w.(*envelopeRecorder).ResponseWriter.(*httptest.ResponseRecorder).Body.String(), `"line":1`) {
+			t.Error("Expected a streamed response not to be held back")
+		}
+		fmt.Fprintln(w, `{"line":2}`)
+	})
+	mux.HandleFunc("/api/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := apiVersionMiddleware(mux)
+
+	do := func(method, path, version, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if version != "" {
+			req.Header.Set("Accept-Version", version)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	direct := httptest.NewRecorder()
+	configHandler(direct, httptest.NewRequest("GET", "/api/config", nil))
+
+	t.Run("Default responses are unchanged", func(t *testing.T) {
+		w := do("GET", "/api/config", "", "")
+		if w.Body.String() != direct.Body.String() {
+			t.Errorf("Expected the unwrapped config, got %s", w.Body.String())
+		}
+		if got := w.Header().Get("API-Version"); got != "1" {
+			t.Errorf("Expected API-Version 1, got %q", got)
+		}
+
+		w = do("POST", "/api/config", "", "")
+		if w.Code != http.StatusMethodNotAllowed || strings.TrimSpace(w.Body.String()) != "Method not allowed" {
+			t.Errorf("Expected a plain text error, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Version 2 wraps data", func(t *testing.T) {
+		w := do("GET", "/api/config", "2", "")
+		var envelope struct {
+			Data  map[string]interface{} `json:"data"`
+			Error *apiError              `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("Expected a JSON envelope, got %s", w.Body.String())
+		}
+		if envelope.Error != nil || envelope.Data["max_paste_size"] == nil {
+			t.Errorf("Expected the config as data, got %s", w.Body.String())
+		}
+		if !strings.Contains(w.Body.String(), `"error":null`) {
+			t.Errorf("Expected an explicit null error, got %s", w.Body.String())
+		}
+		if got := w.Header().Get("API-Version"); got != "2" {
+			t.Errorf("Expected API-Version 2, got %q", got)
+		}
+	})
+
+	t.Run("Version 2 wraps errors", func(t *testing.T) {
+		w := do("POST", "/api/config", "2", "")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("Expected the status to be kept, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected a JSON error, got %s", ct)
+		}
+		var envelope apiEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("Expected a JSON envelope, got %s", w.Body.String())
+		}
+		if string(envelope.Data) != "null" && envelope.Data != nil {
+			t.Errorf("Expected null data, got %s", envelope.Data)
+		}
+		if envelope.Error == nil || envelope.Error.Status != http.StatusMethodNotAllowed || envelope.Error.Message != "Method not allowed" {
+			t.Errorf("Unexpected error %+v", envelope.Error)
+		}
+	})
+
+	t.Run("Version 2 leaves plain text alone", func(t *testing.T) {
+		w := do("POST", "/upload", "2", "plain upload")
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/p/") || strings.Contains(w.Body.String(), `"data"`) {
+			t.Errorf("Expected the plain URL, got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Version 2 streams other responses", func(t *testing.T) {
+		w := do("GET", "/api/stream", "2", "")
+		if w.Body.String() != "{\"line\":1}\n{\"line\":2}\n" {
+			t.Errorf("Expected the stream untouched, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("Version 2 leaves empty responses alone", func(t *testing.T) {
+		w := do("GET", "/api/empty", "2", "")
+		if w.Code != http.StatusOK || w.Body.Len() != 0 {
+			t.Errorf("Expected an empty 200, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Pages are not versioned", func(t *testing.T) {
+		w := do("GET", "/p/missing", "2", "")
+		if w.Header().Get("API-Version") != "" || strings.Contains(w.Body.String(), `"error"`) {
+			t.Errorf("Expected the normal page, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Configured default", func(t *testing.T) {
+		config.DefaultAPIVersion = apiVersion2
+		defer func() { config.DefaultAPIVersion = apiVersion1 }()
+
+		if w := do("GET", "/api/config", "", ""); !strings.HasPrefix(w.Body.String(), `{"data":`) {
+			t.Errorf("Expected the envelope by default, got %s", w.Body.String())
+		}
+		if w := do("GET", "/api/config", "1", ""); w.Body.String() != direct.Body.String() {
+			t.Errorf("Expected Accept-Version: 1 to opt out, got %s", w.Body.String())
+		}
+		if w := do("GET", "/api/config", "7", ""); !strings.HasPrefix(w.Body.String(), `{"data":`) {
+			t.Errorf("Expected an unknown version to get the default, got %s", w.Body.String())
+		}
+	})
+}
+
+func TestTrustedAuthHeader(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1"}
+	config.TrustedAuthHeader = "X-Forwarded-User"
+	defer func() { config = testConfig() }()
+
+	request := func(remoteAddr, user string) *http.Request {
+		req := httptest.NewRequest("GET", "/api/me", nil)
+		req.RemoteAddr = remoteAddr
+		if user != "" {
+			req.Header.Set("X-Forwarded-User", user)
+		}
+		return req
+	}
+
+	t.Run("Trusted proxy creates and reuses the user", func(t *testing.T) {
+		user := getCurrentUser(request("10.1.2.3:5000", "alice"))
+		if user == nil || user.Username != "alice" {
+			t.Fatalf("Expected alice from the trusted proxy, got %+v", user)
+		}
+		again := getCurrentUser(request("192.168.1.1:5000", "alice"))
+		if again == nil || again.ID != user.ID {
+			t.Errorf("Expected the same account on the next request, got %+v", again)
+		}
+
+		var count int64
+		testDB.Model(&User{}).Where("username = ?", "alice").Count(&count)
+		if count != 1 {
+			t.Errorf("Expected one account, got %d", count)
+		}
+		if _, err := authService.Login("alice", ""); err == nil {
+			t.Error("Expected proxy accounts not to log in locally")
+		}
+	})
+
+	t.Run("Handlers see the proxy user", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		meHandler(w, request("10.1.2.3:5000", "bob"))
+		if !strings.Contains(w.Body.String(), `"username":"bob"`) {
+			t.Errorf("Expected bob to be authenticated, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Untrusted source is ignored", func(t *testing.T) {
+		if user := getCurrentUser(request("203.0.113.9:5000", "mallory")); user != nil {
+			t.Errorf("Expected the header to be ignored, got %+v", user)
+		}
+		if user := getCurrentUser(request("192.168.1.2:5000", "mallory")); user != nil {
+			t.Errorf("Expected only the listed address to be trusted, got %+v", user)
+		}
+		var count int64
+		testDB.Model(&User{}).Where("username = ?", "mallory").Count(&count)
+		if count != 0 {
+			t.Error("Expected no account to be created for an untrusted header")
+		}
+	})
+
+	t.Run("Untrusted header falls back to the session", func(t *testing.T) {
+		local, _ := authService.Register("localuser", "password123")
+		session, _ := authService.CreateSession(local.ID)
+		req := request("203.0.113.9:5000", "alice")
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		if user := getCurrentUser(req); user == nil || user.ID != local.ID {
+			t.Errorf("Expected the session user, got %+v", user)
+		}
+	})
+
+	t.Run("Invalid names are rejected", func(t *testing.T) {
+		if user := getCurrentUser(request("10.1.2.3:5000", "ab")); user != nil {
+			t.Errorf("Expected a too-short name to be rejected, got %+v", user)
+		}
+	})
+
+	t.Run("Disabled without the header setting", func(t *testing.T) {
+		config.TrustedAuthHeader = ""
+		defer func() { config.TrustedAuthHeader = "X-Forwarded-User" }()
+		if user := getCurrentUser(request("10.1.2.3:5000", "alice")); user != nil {
+			t.Errorf("Expected the header to be ignored, got %+v", user)
+		}
+	})
+
+	t.Run("Uploads still need an allowed origin", func(t *testing.T) {
+		config.AllowedUploadOrigins = []string{"https://paste.example.com"}
+		defer func() { config.AllowedUploadOrigins = testConfig().AllowedUploadOrigins }()
+
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("cross-site"))
+		req.RemoteAddr = "10.1.2.3:5000"
+		req.Header.Set("X-Forwarded-User", "alice")
+		req.Header.Set("Origin", "https://evil.example.com")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected a cross-site upload to be refused, got %d", w.Code)
+		}
+	})
+}
+
+func TestExtendPaste(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	owner, _ := authService.Register("extender", "password123")
+	ownerSession, _ := authService.CreateSession(owner.ID)
+	other, _ := authService.Register("bystander", "password123")
+	otherSession, _ := authService.CreateSession(other.ID)
+
+	expiresIn := 60
+	paste, _ := pasteService.CreatePaste("", "expiring soon", "text", false, false, &expiresIn, &owner.ID)
+
+	extend := func(pasteID string, session *Session, minutes int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(ExtendPasteRequest{Minutes: minutes})
+		req := httptest.NewRequest("POST", "/api/paste/"+pasteID+"/extend", bytes.NewReader(body))
+		if session != nil {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		w := httptest.NewRecorder()
+		extendPasteHandler(w, req)
+		return w
+	}
+	expiry := func(pasteID string) *time.Time {
+		var stored Paste
+		testDB.First(&stored, "id = ?", pasteID)
+		return stored.ExpiresAt
+	}
+	near := func(got *time.Time, want time.Time) bool {
+		return got != nil && got.Sub(want).Abs() < 5*time.Second
+	}
+
+	t.Run("Extends from the current expiry", func(t *testing.T) {
+		before := *expiry(paste.ID)
+		if w := extend(paste.ID, ownerSession, 30); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := expiry(paste.ID); !near(got, before.Add(30*time.Minute)) {
+			t.Errorf("Expected expiry %v, got %v", before.Add(30*time.Minute), got)
+		}
+	})
+
+	t.Run("Shortening stops at the minimum", func(t *testing.T) {
+		if w := extend(paste.ID, ownerSession, -10000); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := expiry(paste.ID); !near(got, time.Now().Add(minExtendedExpiry)) {
+			t.Errorf("Expected expiry one minute from now, got %v", got)
+		}
+	})
+
+	t.Run("Non-expiring paste gets an expiry", func(t *testing.T) {
+		forever, _ := pasteService.CreatePaste("", "forever", "text", false, false, nil, &owner.ID)
+		if w := extend(forever.ID, ownerSession, 120); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := expiry(forever.ID); !near(got, time.Now().Add(2*time.Hour)) {
+			t.Errorf("Expected expiry two hours from now, got %v", got)
+		}
+	})
+
+	t.Run("Capped at max_paste_ttl_minutes", func(t *testing.T) {
+		config.MaxPasteTTLMinutes = 90
+		defer func() { config.MaxPasteTTLMinutes = 0 }()
+
+		if w := extend(paste.ID, ownerSession, 24*60); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := expiry(paste.ID); !near(got, time.Now().Add(90*time.Minute)) {
+			t.Errorf("Expected expiry capped at 90 minutes from now, got %v", got)
+		}
+	})
+
+	t.Run("Non-owner is rejected", func(t *testing.T) {
+		before := *expiry(paste.ID)
+		if w := extend(paste.ID, otherSession, 30); w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+		if w := extend(paste.ID, nil, 30); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401, got %d", w.Code)
+		}
+		if got := expiry(paste.ID); !got.Equal(before) {
+			t.Errorf("Expected the expiry to be unchanged, got %v", got)
+		}
+	})
+
+	t.Run("Bad requests", func(t *testing.T) {
+		if w := extend(paste.ID, ownerSession, 0); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for zero minutes, got %d", w.Code)
+		}
+		if w := extend("missing", ownerSession, 30); w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for an unknown paste, got %d", w.Code)
+		}
+
+		w := httptest.NewRecorder()
+		extendPasteHandler(w, httptest.NewRequest("POST", "/api/paste/"+paste.ID+"/shrink", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for an unknown action, got %d", w.Code)
+		}
+	})
+}
+
+func TestCustomErrorMessages(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	authService.Register("catalog", "password123")
+
+	login := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"catalog","password":"wrong-password"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		loginHandler(w, req)
+		return w
+	}
+
+	t.Run("Default wording and code", func(t *testing.T) {
+		w := login()
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401, got %d", w.Code)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != "invalid username or password" {
+			t.Errorf("Expected the default message, got %q", got)
+		}
+		if got := w.Header().Get("X-Error-Code"); got != msgInvalidCredentials {
+			t.Errorf("Expected code %s, got %q", msgInvalidCredentials, got)
+		}
+	})
+
+	t.Run("Customized wording", func(t *testing.T) {
+		config.Messages = map[string]string{
+			msgInvalidCredentials: "Benutzername oder Passwort ist falsch",
+			msgPasteTooLarge:      "Zu groß (höchstens %s)",
+		}
+		defer func() { config.Messages = nil }()
+
+		w := login()
+		if got := strings.TrimSpace(w.Body.String()); got != "Benutzername oder Passwort ist falsch" {
+			t.Errorf("Expected the customized message, got %q", got)
+		}
+		if got := w.Header().Get("X-Error-Code"); got != msgInvalidCredentials {
+			t.Errorf("Expected the code to stay %s, got %q", msgInvalidCredentials, got)
+		}
+
+		config.MaxPasteSize = 10
+		w = httptest.NewRecorder()
+		uploadHandler(w, httptest.NewRequest("POST", "/upload", strings.NewReader("far more than ten bytes")))
+		if w.Code != http.StatusRequestEntityTooLarge || strings.TrimSpace(w.Body.String()) != "Zu groß (höchstens 10 bytes)" {
+			t.Errorf("Expected the customized size message, got %d %q", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Batch and import errors have codes", func(t *testing.T) {
+		config.AllowAnonymousUploads = false
+		config.Messages = map[string]string{msgLoginRequiredToUpload: "Bitte zuerst anmelden"}
+		defer func() { config.AllowAnonymousUploads = testConfig().AllowAnonymousUploads; config.Messages = nil }()
+
+		w := httptest.NewRecorder()
+		batchUploadHandler(w, httptest.NewRequest("POST", "/api/paste/batch", strings.NewReader(`[{"content":"x"}]`)))
+		if w.Code != http.StatusUnauthorized || strings.TrimSpace(w.Body.String()) != "Bitte zuerst anmelden" {
+			t.Errorf("Expected the customized login message, got %d %q", w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Error-Code"); got != msgLoginRequiredToUpload {
+			t.Errorf("Expected code %s, got %q", msgLoginRequiredToUpload, got)
+		}
+
+		w = httptest.NewRecorder()
+		importGistHandler(w, httptest.NewRequest("POST", "/api/import/gist", strings.NewReader(`{}`)))
+		if got := w.Header().Get("X-Error-Code"); w.Code != http.StatusUnauthorized || got != msgLoginRequiredToImport {
+			t.Errorf("Expected 401 with code %s, got %d %q", msgLoginRequiredToImport, w.Code, got)
+		}
+	})
+
+	t.Run("Upload validation errors have codes", func(t *testing.T) {
+		tests := []struct {
+			body string
+			code string
+		}{
+			{`{"content":"x","expires_in":0}`, msgExpiresInZero},
+			{`{"content":"x","titel":"typo"}`, msgRequestUnknownField},
+			{`{"content":"x","content_base64":"eA=="}`, msgBase64WithContent},
+			{`{"content":"x","max_views":0}`, msgMaxViewsTooLow},
+			{`{"content":"{","language":"json","validate":true}`, msgInvalidJSONAt},
+		}
+		for _, tt := range tests {
+			req := httptest.NewRequest("POST", "/upload", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			uploadHandler(w, req)
+			if got := w.Header().Get("X-Error-Code"); w.Code != http.StatusBadRequest || got != tt.code {
+				t.Errorf("%s: expected 400 with code %s, got %d %q", tt.body, tt.code, w.Code, got)
+			}
+		}
+	})
+
+	t.Run("Origin errors have codes", func(t *testing.T) {
+		config.AllowedUploadOrigins = []string{"https://paste.example.com"}
+		defer func() { config.AllowedUploadOrigins = testConfig().AllowedUploadOrigins }()
+
+		session, _ := authService.CreateSession(1)
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("content"))
+		req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		req.Header.Set("Origin", "https://evil.example")
+		w := httptest.NewRecorder()
+		uploadHandler(w, req)
+		if w.Code != http.StatusForbidden || w.Header().Get("X-Error-Code") != msgOriginNotAllowed {
+			t.Errorf("Expected 403 with code %s, got %d %q", msgOriginNotAllowed, w.Code, w.Header().Get("X-Error-Code"))
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != "Forbidden: origin https://evil.example is not allowed" {
+			t.Errorf("Expected the default wording, got %q", got)
+		}
+	})
+
+	t.Run("Code in the version 2 envelope", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"catalog","password":"wrong-password"}`))
+		req.Header.Set("Accept-Version", "2")
+		w := httptest.NewRecorder()
+		apiVersionMiddleware(http.HandlerFunc(loginHandler)).ServeHTTP(w, req)
+
+		var envelope apiEnvelope
+		if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil || envelope.Error == nil {
+			t.Fatalf("Expected an error envelope, got %s", w.Body.String())
+		}
+		if envelope.Error.Code != msgInvalidCredentials {
+			t.Errorf("Expected code %s, got %q", msgInvalidCredentials, envelope.Error.Code)
+		}
+	})
+}
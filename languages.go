@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/lexers"
+)
+
+// Language describes a paste language and how it maps to files.
+type Language struct {
+	Name      string   `json:"language"`
+	Label     string   `json:"label"` // for display, e.g. in language pickers
+	Extension string   `json:"extension"`
+	Aliases   []string `json:"aliases"`
+}
+
+// languages is the single source of truth for supported paste languages,
+// their file extensions and alternative names.
+var languages = []Language{
+	{Name: "text", Label: "Plain Text", Extension: ".txt", Aliases: []string{"plain", "plaintext", "txt"}},
+	{Name: "markdown", Label: "Markdown", Extension: ".md", Aliases: []string{"md"}},
+	{Name: "python", Label: "Python", Extension: ".py", Aliases: []string{"py", "python3"}},
+	{Name: "javascript", Label: "JavaScript", Extension: ".js", Aliases: []string{"js", "node"}},
+	{Name: "typescript", Label: "TypeScript", Extension: ".ts", Aliases: []string{"ts"}},
+	{Name: "bash", Label: "Bash", Extension: ".sh", Aliases: []string{"sh", "shell", "zsh"}},
+	{Name: "go", Label: "Go", Extension: ".go", Aliases: []string{"golang"}},
+	{Name: "rust", Label: "Rust", Extension: ".rs", Aliases: []string{"rs"}},
+	{Name: "c", Label: "C", Extension: ".c", Aliases: []string{"h"}},
+	{Name: "cpp", Label: "C++", Extension: ".cpp", Aliases: []string{"c++", "cc", "cxx", "hpp"}},
+	{Name: "java", Label: "Java", Extension: ".java", Aliases: []string{}},
+	{Name: "ruby", Label: "Ruby", Extension: ".rb", Aliases: []string{"rb"}},
+	{Name: "php", Label: "PHP", Extension: ".php", Aliases: []string{}},
+	{Name: "sql", Label: "SQL", Extension: ".sql", Aliases: []string{}},
+	{Name: "json", Label: "JSON", Extension: ".json", Aliases: []string{}},
+	{Name: "yaml", Label: "YAML", Extension: ".yaml", Aliases: []string{"yml"}},
+	{Name: "toml", Label: "TOML", Extension: ".toml", Aliases: []string{}},
+	{Name: "xml", Label: "XML", Extension: ".xml", Aliases: []string{}},
+	{Name: "html", Label: "HTML", Extension: ".html", Aliases: []string{"htm"}},
+	{Name: "css", Label: "CSS", Extension: ".css", Aliases: []string{}},
+	{Name: "dockerfile", Label: "Dockerfile", Extension: ".dockerfile", Aliases: []string{"docker"}},
+}
+
+// lookupLanguage finds a language by name or alias, case-insensitively.
+func lookupLanguage(name string) (Language, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, lang := range languages {
+		if lang.Name == name {
+			return lang, true
+		}
+		for _, alias := range lang.Aliases {
+			if alias == name {
+				return lang, true
+			}
+		}
+	}
+	return Language{}, false
+}
+
+// canonicalLanguage is the name pastes are stored under: "js" and
+// "JavaScript" both become "javascript". Unknown names, including "auto",
+// are kept as given.
+func canonicalLanguage(name string) string {
+	if lang, ok := lookupLanguage(name); ok {
+		return lang.Name
+	}
+	return name
+}
+
+// languageNames lists every spelling of name's language that may be stored,
+// for filters: pastes saved before names were canonicalized can still hold
+// an alias.
+func languageNames(name string) []string {
+	lang, ok := lookupLanguage(name)
+	if !ok {
+		return []string{name}
+	}
+	return append([]string{lang.Name}, lang.Aliases...)
+}
+
+// autoLanguage stored as a paste's language means its language is detected
+// whenever it is viewed rather than fixed at upload, so edits that change
+// what the paste contains are highlighted correctly too.
+const autoLanguage = "auto"
+
+// Only this much of a paste is looked at to detect its language
+const detectLanguageMaxBytes = 16 << 10
+
+// detectLanguage guesses which of our languages content is written in, from
+// a shebang, whether it parses as JSON, or chroma's analysers. Anything it
+// can't place is plain text.
+func detectLanguage(content string) string {
+	if len(content) > detectLanguageMaxBytes {
+		content = content[:detectLanguageMaxBytes]
+	}
+
+	// "#!/usr/bin/env python3" or "#!/bin/bash" names the language outright
+	if line, ok := strings.CutPrefix(content, "#!"); ok {
+		line, _, _ = strings.Cut(line, "\n")
+		if fields := strings.Fields(line); len(fields) > 0 {
+			interpreter := path.Base(fields[0])
+			if interpreter == "env" && len(fields) > 1 {
+				interpreter = fields[1]
+			}
+			if lang, ok := lookupLanguage(interpreter); ok {
+				return lang.Name
+			}
+		}
+	}
+
+	trimmed := strings.TrimSpace(content)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return "json"
+	}
+
+	if lexer := lexers.Analyse(content); lexer != nil {
+		cfg := lexer.Config()
+		for _, name := range append([]string{cfg.Name}, cfg.Aliases...) {
+			if lang, ok := lookupLanguage(name); ok {
+				return lang.Name
+			}
+		}
+	}
+	return "text"
+}
+
+// viewLanguage is the language to show a paste in: the stored one, or a
+// fresh guess for "auto" pastes. The stored value is left alone.
+func viewLanguage(paste *Paste) string {
+	if paste.Language == autoLanguage {
+		return detectLanguage(paste.Content)
+	}
+	return paste.Language
+}
+
+// extensionForLanguage returns the file extension for a language, falling
+// back to ".txt" for anything unknown.
+func extensionForLanguage(name string) string {
+	if lang, ok := lookupLanguage(name); ok {
+		return lang.Extension
+	}
+	return ".txt"
+}
+
+// languageForFilename infers a language from a filename's extension, e.g.
+// "main.py" is python. Extension-less names like "Dockerfile" are matched
+// as a whole. Unknown files are plain text.
+func languageForFilename(filename string) string {
+	base := strings.ToLower(path.Base(strings.ReplaceAll(filename, "\\", "/")))
+
+	if ext := path.Ext(base); ext != "" {
+		if lang, ok := lookupLanguage(strings.TrimPrefix(ext, ".")); ok {
+			return lang.Name
+		}
+		return "text"
+	}
+
+	for _, lang := range languages {
+		if "."+base == lang.Extension {
+			return lang.Name
+		}
+	}
+	return "text"
+}
+
+// filenameTitle turns a filename into a tidy default title: the base name,
+// lowercased, with runs of anything but letters, digits, dots, dashes and
+// underscores collapsed to a single dash.
+func filenameTitle(filename string) string {
+	base := path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	if base == "." || base == "/" {
+		return ""
+	}
+
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(base) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	slug := strings.NewReplacer("-.", ".", ".-", ".").Replace(b.String())
+	return strings.Trim(slug, "-")
+}
+
+// Longest title slug put in a download filename
+const maxDownloadTitleLength = 64
+
+var downloadPlaceholder = regexp.MustCompile(`\{[^{}]*\}`)
+
+// validDownloadFilename reports whether tmpl is a usable download_filename:
+// only known placeholders, and at least one of {id} and {title}.
+func validDownloadFilename(tmpl string) bool {
+	for _, p := range downloadPlaceholder.FindAllString(tmpl, -1) {
+		if p != "{id}" && p != "{title}" && p != "{ext}" {
+			return false
+		}
+	}
+	return strings.Contains(tmpl, "{id}") || strings.Contains(tmpl, "{title}")
+}
+
+// downloadFilename fills in the download_filename template for paste. The
+// title is slugged, and an untitled paste falls back to its ID when the
+// template has no {id} of its own. Anything but letters, digits, dots,
+// dashes and underscores is replaced, so the result is always safe to quote
+// in a Content-Disposition header.
+func downloadFilename(paste *Paste, language string) string {
+	tmpl := config.DownloadFilename
+	title := filenameTitle(strings.NewReplacer("/", "-", "\\", "-").Replace(paste.Title))
+	if len(title) > maxDownloadTitleLength {
+		title = title[:maxDownloadTitleLength]
+	}
+	title = strings.Trim(title, "-.")
+	if title == "" && !strings.Contains(tmpl, "{id}") {
+		title = paste.ID
+	}
+	ext := extensionForLanguage(language)
+
+	name := strings.NewReplacer("{id}", paste.ID, "{title}", title, "{ext}", ext).Replace(tmpl)
+	var b strings.Builder
+	for _, r := range name {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	// An empty {title} leaves its separators behind
+	name = strings.Trim(strings.NewReplacer("-.", ".", "_.", ".").Replace(b.String()), "-_")
+	for strings.Contains(name, "--") {
+		name = strings.ReplaceAll(name, "--", "-")
+	}
+	if strings.Trim(name, ".") == "" || name == ext {
+		return paste.ID + ext
+	}
+	return name
+}
@@ -5,27 +5,139 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"path"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	Bind          string `toml:"bind"`
-	Debug         bool   `toml:"debug"`
-	ServePath     string `toml:"serve_path"`
-	DatabasePath  string `toml:"database_path"`
-	SessionSecret string `toml:"session_secret"`
+	Bind             string `toml:"bind"`
+	Debug            bool   `toml:"debug"`
+	ServePath        string `toml:"serve_path"`
+	DatabasePath     string `toml:"database_path"`
+	SessionSecret    string `toml:"session_secret"`
+	EncryptionKey    string `toml:"encryption_key"` // base64 AES-256 key for paste content at rest, empty = plaintext
+	BcryptCost       int    `toml:"bcrypt_cost"`
+	PasswordHashAlgo string `toml:"password_hash_algo"` // "bcrypt" or "argon2id" for new passwords; existing hashes of either kind keep working
+
+	// Uploads
+	MaxPasteSize             int      `toml:"max_paste_size"`     // bytes
+	MaxLines                 int      `toml:"max_lines"`          // lines per paste, 0 = no limit
+	MaxJSONBodySize          int64    `toml:"max_json_body_size"` // bytes, for JSON API requests that don't carry paste content
+	PasteIDLength            int      `toml:"paste_id_length"`
+	MaxTitleLength           int      `toml:"max_title_length"`          // characters
+	Compression              bool     `toml:"compression"`               // gzip paste content at rest
+	CompressionThreshold     int      `toml:"compression_threshold"`     // bytes; smaller pastes are stored as-is
+	TrimTrailingWhitespace   bool     `toml:"trim_trailing_whitespace"`  // strip trailing spaces per line and trailing blank lines
+	NormalizeLineEndings     bool     `toml:"normalize_line_endings"`    // store CRLF line endings as LF
+	Deduplication            bool     `toml:"deduplication"`             // return the existing paste when identical content is uploaded again
+	DedupIncludeTitle        bool     `toml:"dedup_include_title"`       // only treat uploads as identical when their titles match too
+	GlobalDedup              bool     `toml:"global_dedup"`              // store identical content once across all users
+	PasteIDDigits            bool     `toml:"paste_id_digits"`           // include 0-9 in generated IDs
+	PasteIDPrefix            string   `toml:"paste_id_prefix"`           // prepended to generated IDs, e.g. "a-" to keep instances apart
+	SequentialIDs            bool     `toml:"sequential_ids"`            // also number pastes 1, 2, 3... as /p/{n} aliases
+	MaxPasteTTLMinutes       int      `toml:"max_paste_ttl_minutes"`     // longest expires_in accepted, 0 = no limit
+	MaxDatabaseBytes         int64    `toml:"max_database_bytes"`        // block new uploads while stored content exceeds this, 0 = no limit
+	MaxConcurrentUploads     int      `toml:"max_concurrent_uploads"`    // uploads handled at once, 0 = no limit
+	UploadQueueTimeout       int      `toml:"upload_queue_timeout"`      // seconds an upload waits for a free slot before a 503
+	DefaultPrivateForUsers   bool     `toml:"default_private_for_users"` // logged-in uploads are private unless is_private is false
+	AllowAnonymousUploads    bool     `toml:"allow_anonymous_uploads"`
+	AnonymousPasteMaxAgeDays int      `toml:"anonymous_paste_max_age_days"` // delete anonymous pastes after this many days, 0 = keep forever
+	PurgeDeletedAfterDays    int      `toml:"purge_deleted_after_days"`     // purge deleted pastes after this many days, 0 = at the next cleanup
+	UserQuotaBytes           int64    `toml:"user_quota_bytes"`             // total storage per user, 0 = unlimited
+	SlidingExpiry            bool     `toml:"sliding_expiry"`               // let pastes opt into renewing their expiry when viewed
+	RemoteFetch              bool     `toml:"remote_fetch"`                 // allow uploads from a source_url
+	RemoteFetchHosts         []string `toml:"remote_fetch_hosts"`           // empty = any public host
+	AllowedUploadOrigins     []string `toml:"allowed_upload_origins"`       // origins browser uploads may come from, empty = any
+
+	// Accounts
+	ReservedUsernames      []string `toml:"reserved_usernames"`       // names nobody can register or rename to, case-insensitive
+	RequireTermsAcceptance bool     `toml:"require_terms_acceptance"` // registration must accept the terms at TermsURL
+	TermsURL               string   `toml:"terms_url"`
+
+	// Proxy authentication
+	TrustedProxies    []string `toml:"trusted_proxies"`     // IPs or CIDRs of the reverse proxies in front of pb
+	TrustedAuthHeader string   `toml:"trusted_auth_header"` // header a trusted proxy names its authenticated user in, e.g. X-Forwarded-User
+
+	// Admin
+	AuditLog         bool `toml:"audit_log"`           // record admin actions, listed at /api/admin/audit
+	FirstUserIsAdmin bool `toml:"first_user_is_admin"` // make the first account registered on an empty database an admin
+
+	// Branding
+	SiteName     string `toml:"site_name"`
+	FooterHTML   string `toml:"footer_html"`   // limited HTML: links and basic formatting
+	AbuseContact string `toml:"abuse_contact"` // email or URL shown on error pages and in security.txt
+	TemplateDir  string `toml:"template_dir"`  // files here replace the built-in templates and static files
+
+	// Messages
+	Messages map[string]string `toml:"messages"` // error code -> wording, replacing the built-in message
+
+	// Index page
+	IndexRecentPastes int `toml:"index_recent_pastes"` // 0 hides the recent pastes list
+
+	// Listings
+	MaxPageSize        int  `toml:"max_page_size"`        // most pastes any list page or endpoint returns at once
+	EnablePublicBrowse bool `toml:"enable_public_browse"` // serve /all, /api/recent, /api/trending and the front page lists
+
+	// Downloads
+	DownloadFilename string `toml:"download_filename"` // ?download=1 filename; {id}, {title} and {ext} are filled in
+
+	// Highlighting
+	DefaultTheme string `toml:"default_theme"` // highlighting theme for viewers who haven't picked one with ?theme=
+
+	// API rate limiting
+	RateLimit       int `toml:"rate_limit"`        // requests per window, 0 = disabled
+	RateLimitWindow int `toml:"rate_limit_window"` // seconds
+
+	// API responses
+	DefaultAPIVersion int `toml:"default_api_version"` // response format for clients that don't send Accept-Version: 1 or 2
+
+	// API keys
+	APIKeyUsageSampleRate      float64 `toml:"api_key_usage_sample_rate"`      // fraction of API key requests logged, 0 disables
+	MaxAPIKeysPerUser          int     `toml:"max_api_keys_per_user"`          // keys a user can hold at once, 0 = no limit
+	APIKeyLimitIncludesExpired bool    `toml:"api_key_limit_includes_expired"` // count expired keys against max_api_keys_per_user until they're cleaned up
+
+	// Registration rate limiting
+	RegistrationRateLimit       int `toml:"registration_rate_limit"`        // sign-ups per IP per window, 0 = unlimited
+	RegistrationRateLimitWindow int `toml:"registration_rate_limit_window"` // seconds
+
+	// Server
+	MaxHeaderBytes    int  `toml:"max_header_bytes"`
+	IdleTimeout       int  `toml:"idle_timeout"`        // seconds an idle keep-alive connection stays open, 0 = no limit
+	DisableKeepAlives bool `toml:"disable_keep_alives"` // close every connection after one request, for debugging
+
+	// Security headers
+	HSTS                  bool   `toml:"hsts"`
+	HSTSMaxAge            int    `toml:"hsts_max_age"`
+	FrameOptions          string `toml:"frame_options"`
+	ReferrerPolicy        string `toml:"referrer_policy"`
+	ContentSecurityPolicy string `toml:"content_security_policy"`
 }
 
-var config Config
+var config = defaultConfig()
 
 //go:embed templates
 var templatesFolder embed.FS
 
 func main() {
 	config = GenerateConfig()
+	templateFS = newTemplateFS(config.TemplateDir)
+
+	network, address, err := parseBind(config.Bind)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if config.EncryptionKey != "" {
+		aead, err := newContentCipher(config.EncryptionKey)
+		if err != nil {
+			log.Fatalf("Invalid encryption key: %v", err)
+		}
+		contentCipher = aead
+	}
 
 	// Initialize database
 	if err := initDatabase(config.DatabasePath, config.Debug); err != nil {
@@ -37,6 +149,17 @@ func main() {
 	pasteService = NewPasteService(db)
 	apikeyService = NewAPIKeyService(db)
 	adminService = NewAdminService(db)
+	maintenanceService = NewMaintenanceService(db)
+
+	if config.MaxConcurrentUploads > 0 {
+		uploadSlots = newUploadSlots(config.MaxConcurrentUploads)
+	}
+	if config.RateLimit > 0 {
+		apiRateLimiter = newRateLimiter(config.RateLimit, time.Duration(config.RateLimitWindow)*time.Second)
+	}
+	if config.RegistrationRateLimit > 0 {
+		registrationRateLimiter = newRateLimiter(config.RegistrationRateLimit, time.Duration(config.RegistrationRateLimitWindow)*time.Second)
+	}
 
 	// Clean up expired sessions and pastes periodically
 	go func() {
@@ -44,8 +167,38 @@ func main() {
 		for range ticker.C {
 			authService.CleanupExpiredSessions()
 			pasteService.CleanupExpiredPastes()
+			pasteService.CleanupIdempotencyKeys()
+			pasteService.CleanupPasteViews()
+			apikeyService.CleanupAPIKeyUsage()
+			apikeyService.CleanupExpiredAPIKeys()
+
+			if config.AnonymousPasteMaxAgeDays > 0 {
+				maxAge := time.Duration(config.AnonymousPasteMaxAgeDays) * 24 * time.Hour
+				if n, err := pasteService.CleanupAnonymousPastes(maxAge); err != nil {
+					log.Printf("Failed to clean up anonymous pastes: %v", err)
+				} else if n > 0 {
+					log.Printf("Removed %d anonymous pastes older than %d days", n, config.AnonymousPasteMaxAgeDays)
+				}
+			}
+
+			retention := time.Duration(config.PurgeDeletedAfterDays) * 24 * time.Hour
+			if n, err := pasteService.PurgeDeletedPastes(retention); err != nil {
+				log.Printf("Failed to purge deleted pastes: %v", err)
+			} else if n > 0 {
+				log.Printf("Purged %d pastes deleted more than %d days ago", n, config.PurgeDeletedAfterDays)
+			}
 		}
 	}()
+	if config.MaxDatabaseBytes > 0 {
+		go func() {
+			for {
+				if err := checkStorageLimit(); err != nil {
+					log.Printf("Failed to check storage usage: %v", err)
+				}
+				time.Sleep(storageGuardInterval)
+			}
+		}()
+	}
 	go func() {
 		for {
 			cleanExpiredSessions()
@@ -63,34 +216,61 @@ func main() {
 	http.HandleFunc("/api/login", loginHandler)
 	http.HandleFunc("/api/logout", logoutHandler)
 	http.HandleFunc("/api/me", meHandler)
+	http.HandleFunc("/api/me/username", changeUsernameHandler)
+	http.HandleFunc("/api/me/claim-pastes", claimPastesHandler)
+	http.HandleFunc("/api/me/pastes", myPasteChangesHandler)
 
 	// Paste endpoints
 	http.HandleFunc("/upload", uploadHandler)
+	http.HandleFunc("/new", newPasteHandler)
 	http.HandleFunc("/api/paste/delete/", deletePasteHandler)
 	http.HandleFunc("/api/paste/update/", updatePasteHandler)
+	http.HandleFunc("/api/paste/duplicate/", duplicatePasteHandler)
 	http.HandleFunc("/api/paste/search", searchPastesHandler)
+	http.HandleFunc("/api/paste/batch", batchUploadHandler)
+	http.HandleFunc("/api/paste/available", pasteIDAvailableHandler)
+	http.HandleFunc("/api/paste/", extendPasteHandler)
+	http.HandleFunc("/api/import/gist", importGistHandler)
 	http.HandleFunc("/my-pastes", myPastesHandler)
 	http.HandleFunc("/all", allPastesHandler)
 	http.HandleFunc("/edit/", editPastePageHandler)
+	http.HandleFunc("/api/languages", languagesHandler)
+	http.HandleFunc("/api/config", configHandler)
+	http.HandleFunc("/api/trending", trendingHandler)
+	http.HandleFunc("/api/recent", recentHandler)
+	http.HandleFunc("/.well-known/security.txt", securityTxtHandler)
 
 	// API Key endpoints
 	http.HandleFunc("/api-keys", apiKeysPageHandler)
 	http.HandleFunc("/api/keys/create", createAPIKeyHandler)
 	http.HandleFunc("/api/keys/delete", deleteAPIKeyHandler)
+	http.HandleFunc("/api/keys/", apiKeyUsageHandler)
 
 	// Admin endpoints
 	http.HandleFunc("/admin", adminPanelHandler)
+	http.HandleFunc("/admin/user/", adminUserPastesPageHandler)
+	http.HandleFunc("/api/admin/user-pastes", adminUserPastesHandler)
 	http.HandleFunc("/api/admin/delete-user", adminDeleteUserHandler)
+	http.HandleFunc("/api/admin/quota", adminQuotaHandler)
+	http.HandleFunc("/api/admin/export", adminExportHandler)
+	http.HandleFunc("/api/admin/audit", adminAuditHandler)
+	http.HandleFunc("/api/admin/maintenance", adminMaintenanceHandler)
+	http.HandleFunc("/api/admin/cleanup", adminCleanupHandler)
 
 	// Serve pastes
 	http.HandleFunc(config.ServePath, servePasteHandler)
+	http.HandleFunc(shortCodePath, shortCodeHandler)
 
 	// Static files and templates
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Serve static files
 		if strings.HasPrefix(r.URL.Path, "/static/") {
-			filePath := path.Join("templates", r.URL.Path)
-			file, err := templatesFolder.Open(filePath)
+			filePath := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+			if !strings.HasPrefix(filePath, "static/") {
+				notfoundHandler(w)
+				return
+			}
+			file, err := templateFS.Open(filePath)
 			if err != nil {
 				notfoundHandler(w)
 				return
@@ -110,14 +290,7 @@ func main() {
 
 		// Serve index page
 		if r.URL.Path == "/" {
-			filePath := "templates/index.html"
-			file, err := templatesFolder.Open(filePath)
-			if err != nil {
-				notfoundHandler(w)
-				return
-			}
-			defer file.Close()
-			io.Copy(w, file)
+			indexHandler(w, r)
 			return
 		}
 
@@ -128,10 +301,46 @@ func main() {
 		fmt.Println("Debug mode is enabled")
 	}
 
-	fmt.Printf("Server is running on http://%s\n"+
+	listener, err := listen(network, address)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", config.Bind, err)
+	}
+
+	fmt.Printf("Server is running on %s\n"+
 		"Serving pastes at %s\n"+
 		"Database path is %s\n",
-		config.Bind, config.ServePath, config.DatabasePath)
+		listenURL(network, address), config.ServePath, config.DatabasePath)
 
-	log.Fatal(http.ListenAndServe(config.Bind, nil))
+	server := newServer(requestIDMiddleware(recoverMiddleware(securityHeadersMiddleware(apiVersionMiddleware(rateLimitMiddleware(apiKeyUsageMiddleware(http.DefaultServeMux)))))))
+	log.Fatal(server.Serve(listener))
+}
+
+// newServer builds the HTTP server around handler with the configured
+// connection limits.
+func newServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:        handler,
+		MaxHeaderBytes: config.MaxHeaderBytes,
+		IdleTimeout:    time.Duration(config.IdleTimeout) * time.Second,
+	}
+	server.SetKeepAlivesEnabled(!config.DisableKeepAlives)
+	return server
+}
+
+// listen opens the server socket. A stale unix socket left behind by a
+// previous run is removed first, since it would make the bind fail.
+func listen(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func listenURL(network, address string) string {
+	if network == "unix" {
+		return "unix:" + address
+	}
+	return "http://" + address
 }
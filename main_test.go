@@ -2,12 +2,23 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io/fs"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -18,7 +29,7 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
-	err = db.AutoMigrate(&User{}, &Paste{}, &Session{})
+	err = db.AutoMigrate(&User{}, &Paste{}, &Session{}, &APIKey{}, &Admin{}, &IdempotencyKey{}, &PasteView{}, &APIKeyUsage{}, &PasteContent{}, &AuditLog{})
 	if err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
@@ -26,6 +37,18 @@ func setupTestDB(t *testing.T) *gorm.DB {
 	return db
 }
 
+// testConfig returns the default configuration backed by an in-memory database.
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func testConfig() Config {
+	cfg := defaultConfig()
+	cfg.DatabasePath = ":memory:"
+	cfg.BcryptCost = bcrypt.MinCost
+	return cfg
+}
+
 func TestAuthService_Register(t *testing.T) {
 	testDB := setupTestDB(t)
 	authSvc := NewAuthService(testDB)
@@ -41,6 +64,9 @@ func TestAuthService_Register(t *testing.T) {
 		{"Short password", "testuser2", "12345", true},
 		{"Duplicate username", "testuser", "password123", true},
 		{"Long username", "verylongusernamethatexceedsfiftycharacterslimithere", "password123", true},
+		{"Reserved username", "admin", "password123", true},
+		{"Reserved username any case", "Support", "password123", true},
+		{"Name containing a reserved word", "admin-fan", "password123", false},
 	}
 
 	for _, tt := range tests {
@@ -62,6 +88,55 @@ func TestAuthService_Register(t *testing.T) {
 	}
 }
 
+func TestAuthService_FirstUserIsAdmin(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	t.Run("Enabled", func(t *testing.T) {
+		config.FirstUserIsAdmin = true
+		testDB := setupTestDB(t)
+		authSvc := NewAuthService(testDB)
+		adminSvc := NewAdminService(testDB)
+
+		if _, err := authSvc.Register("x", "password123"); err == nil {
+			t.Fatalf("Expected the invalid registration to fail")
+		}
+		first, err := authSvc.Register("firstuser", "password123")
+		if err != nil {
+			t.Fatalf("Failed to register: %v", err)
+		}
+		second, err := authSvc.Register("seconduser", "password123")
+		if err != nil {
+			t.Fatalf("Failed to register: %v", err)
+		}
+
+		if !adminSvc.IsAdmin(first.ID) {
+			t.Errorf("Expected the first user to be an admin")
+		}
+		if adminSvc.IsAdmin(second.ID) {
+			t.Errorf("Expected the second user not to be an admin")
+		}
+
+		entries, _, _ := adminSvc.GetAuditLog(10, 0)
+		if len(entries) != 1 || entries[0].Action != auditMakeAdmin || entries[0].ActorID != 0 {
+			t.Errorf("Expected one make_admin entry by the system, got %+v", entries)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		config.FirstUserIsAdmin = false
+		testDB := setupTestDB(t)
+		first, err := NewAuthService(testDB).Register("firstuser", "password123")
+		if err != nil {
+			t.Fatalf("Failed to register: %v", err)
+		}
+		if NewAdminService(testDB).IsAdmin(first.ID) {
+			t.Errorf("Expected no admin without first_user_is_admin")
+		}
+	})
+}
+
 func TestAuthService_Login(t *testing.T) {
 	testDB := setupTestDB(t)
 	authSvc := NewAuthService(testDB)
@@ -102,6 +177,36 @@ func TestAuthService_Login(t *testing.T) {
 	}
 }
 
+func TestAuthService_BcryptCost(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+
+	testDB := setupTestDB(t)
+	authSvc := NewAuthService(testDB)
+
+	for i, cost := range []int{bcrypt.MinCost, bcrypt.MinCost + 1} {
+		config.BcryptCost = cost
+
+		user, err := authSvc.Register(fmt.Sprintf("costuser%d", i), "password123")
+		if err != nil {
+			t.Fatalf("Failed to register user: %v", err)
+		}
+
+		hashCost, err := bcrypt.Cost([]byte(user.PasswordHash))
+		if err != nil {
+			t.Fatalf("Failed to read hash cost: %v", err)
+		}
+		if hashCost != cost {
+			t.Errorf("Expected hash cost %d, got %d", cost, hashCost)
+		}
+
+		// Login still verifies regardless of the cost used
+		if _, err := authSvc.Login(user.Username, "password123"); err != nil {
+			t.Errorf("Failed to login with custom cost hash: %v", err)
+		}
+	}
+}
+
 func TestAuthService_SessionManagement(t *testing.T) {
 	testDB := setupTestDB(t)
 	authSvc := NewAuthService(testDB)
@@ -144,6 +249,95 @@ func TestAuthService_SessionManagement(t *testing.T) {
 	}
 }
 
+func TestReservedUsernames(t *testing.T) {
+	testDB := setupTestDB(t)
+	authSvc := NewAuthService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.ReservedUsernames = []string{"Staff"}
+
+	if _, err := authSvc.Register("STAFF", "password123"); err == nil || err.Error() != "username not allowed" {
+		t.Errorf("Expected configured reserved name to be rejected, got %v", err)
+	}
+	if _, err := authSvc.Register("admin", "password123"); err != nil {
+		t.Errorf("Expected admin to be allowed once the list is replaced: %v", err)
+	}
+
+	user, _ := authSvc.Register("regular", "password123")
+	if _, err := authSvc.ChangeUsername(user.ID, "staff"); err == nil {
+		t.Error("Expected rename to a reserved name to be rejected")
+	}
+	if _, err := authSvc.ChangeUsername(user.ID, "regular2"); err != nil {
+		t.Errorf("Expected rename to a normal name to pass: %v", err)
+	}
+}
+
+func TestPasswordHashAlgorithms(t *testing.T) {
+	testDB := setupTestDB(t)
+	authSvc := NewAuthService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	t.Run("Bcrypt stores and verifies", func(t *testing.T) {
+		user, err := authSvc.Register("bcryptuser", "password123")
+		if err != nil {
+			t.Fatalf("Failed to register: %v", err)
+		}
+		if !strings.HasPrefix(user.PasswordHash, "$2") {
+			t.Errorf("Expected a bcrypt hash, got %s", user.PasswordHash)
+		}
+		if _, err := authSvc.Login("bcryptuser", "password123"); err != nil {
+			t.Errorf("Expected bcrypt login to succeed: %v", err)
+		}
+		if _, err := authSvc.Login("bcryptuser", "wrongpassword"); err == nil {
+			t.Error("Expected wrong password to fail")
+		}
+	})
+
+	config.PasswordHashAlgo = passwordAlgoArgon2id
+
+	t.Run("Argon2id stores and verifies", func(t *testing.T) {
+		user, err := authSvc.Register("argonuser", "password123")
+		if err != nil {
+			t.Fatalf("Failed to register: %v", err)
+		}
+		if !strings.HasPrefix(user.PasswordHash, "$argon2id$v=19$m=65536,t=3,p=4$") {
+			t.Errorf("Expected an Argon2id hash, got %s", user.PasswordHash)
+		}
+		if _, err := authSvc.Login("argonuser", "password123"); err != nil {
+			t.Errorf("Expected Argon2id login to succeed: %v", err)
+		}
+		if _, err := authSvc.Login("argonuser", "wrongpassword"); err == nil {
+			t.Error("Expected wrong password to fail")
+		}
+	})
+
+	t.Run("Existing bcrypt hashes keep working", func(t *testing.T) {
+		if _, err := authSvc.Login("bcryptuser", "password123"); err != nil {
+			t.Errorf("Expected bcrypt login to succeed after switching to Argon2id: %v", err)
+		}
+	})
+
+	t.Run("Argon2id hashes work after switching back", func(t *testing.T) {
+		config.PasswordHashAlgo = passwordAlgoBcrypt
+		if _, err := authSvc.Login("argonuser", "password123"); err != nil {
+			t.Errorf("Expected Argon2id login to succeed with bcrypt configured: %v", err)
+		}
+	})
+
+	t.Run("Malformed hashes never verify", func(t *testing.T) {
+		for _, hash := range []string{"", "$argon2id$", "$argon2id$v=19$m=1,t=1,p=1$!!$!!", "$argon2id$v=19$m=8,t=1,p=0$c2FsdA$a2V5", "$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$a2V5"} {
+			if verifyPassword(hash, "password123") {
+				t.Errorf("Expected malformed hash %q to fail", hash)
+			}
+		}
+	})
+}
+
 func TestPasteService_CreatePaste(t *testing.T) {
 	testDB := setupTestDB(t)
 	pasteSvc := NewPasteService(testDB)
@@ -188,6 +382,283 @@ func TestPasteService_CreatePaste(t *testing.T) {
 	}
 }
 
+func TestPasteService_DedupByTitle(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("deduper", "password123")
+
+	for _, owner := range []struct {
+		name   string
+		userID *uint
+	}{{"Anonymous", nil}, {"User", &user.ID}} {
+		t.Run(owner.name, func(t *testing.T) {
+			content := "shared body for " + owner.name
+
+			a, err := pasteSvc.CreatePaste("Notes", content, "text", false, false, nil, owner.userID)
+			if err != nil {
+				t.Fatalf("Failed to create paste: %v", err)
+			}
+
+			same, _ := pasteSvc.CreatePaste("  Notes ", content, "text", false, false, nil, owner.userID)
+			if same.ID != a.ID {
+				t.Errorf("Expected same content and title to dedup")
+			}
+
+			other, _ := pasteSvc.CreatePaste("Other notes", content, "text", false, false, nil, owner.userID)
+			if other.ID == a.ID {
+				t.Errorf("Expected same content under a different title to be a separate paste")
+			}
+
+			untitled, _ := pasteSvc.CreatePaste("", content, "text", false, false, nil, owner.userID)
+			if untitled.ID == a.ID || untitled.ID == other.ID {
+				t.Errorf("Expected untitled copy to be a separate paste")
+			}
+		})
+	}
+}
+
+func TestPasteService_DedupIgnoringTitle(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.DedupIncludeTitle = false
+
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("contentonly", "password123")
+
+	for _, owner := range []struct {
+		name   string
+		userID *uint
+	}{{"Anonymous", nil}, {"User", &user.ID}} {
+		t.Run(owner.name, func(t *testing.T) {
+			content := "content-only body for " + owner.name
+
+			a, err := pasteSvc.CreatePaste("Notes", content, "text", false, false, nil, owner.userID)
+			if err != nil {
+				t.Fatalf("Failed to create paste: %v", err)
+			}
+
+			for _, title := range []string{"Notes", "Other notes", ""} {
+				same, _ := pasteSvc.CreatePaste(title, content, "text", false, false, nil, owner.userID)
+				if same.ID != a.ID {
+					t.Errorf("Expected %q to dedup to the existing paste", title)
+				}
+				if same.Title != "Notes" {
+					t.Errorf("Expected the existing paste's title, got %q", same.Title)
+				}
+			}
+
+			// Turning titles back on, the content-only key doesn't swallow
+			// an untitled upload of the same content
+			config.DedupIncludeTitle = true
+			defer func() { config.DedupIncludeTitle = false }()
+			untitled, err := pasteSvc.CreatePaste("", content, "text", false, false, nil, owner.userID)
+			if err != nil {
+				t.Fatalf("Failed to create paste: %v", err)
+			}
+			if untitled.ID == a.ID {
+				t.Errorf("Expected a separate paste once titles count again")
+			}
+		})
+	}
+}
+
+func TestPasteService_DeduplicationDisabled(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.Deduplication = false
+
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("repeater", "password123")
+
+	for _, owner := range []struct {
+		name   string
+		userID *uint
+	}{{"Anonymous", nil}, {"User", &user.ID}} {
+		t.Run(owner.name, func(t *testing.T) {
+			a, err := pasteSvc.CreatePaste("Same", "same content", "text", false, false, nil, owner.userID)
+			if err != nil {
+				t.Fatalf("Failed to create paste: %v", err)
+			}
+			b, _ := pasteSvc.CreatePaste("Same", "same content", "text", false, false, nil, owner.userID)
+
+			if a.ID == b.ID {
+				t.Error("Expected identical uploads to get distinct IDs")
+			}
+			if a.ContentHash == "" || a.ContentHash != b.ContentHash {
+				t.Errorf("Expected the hash to still be stored, got %q and %q", a.ContentHash, b.ContentHash)
+			}
+		})
+	}
+}
+
+func TestPasteService_GlobalDedup(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.GlobalDedup = true
+
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	alice, _ := authSvc.Register("alice", "password123")
+	bob, _ := authSvc.Register("bob", "password123")
+
+	content := "a snippet everyone copies"
+	a, err := pasteSvc.CreatePaste("", content, "text", false, false, nil, &alice.ID)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+	b, err := pasteSvc.CreatePaste("", content, "text", false, false, nil, &bob.ID)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+	if a.ID == b.ID {
+		t.Fatal("Expected separate pastes for separate users")
+	}
+
+	countContent := func() int64 {
+		var n int64
+		testDB.Model(&PasteContent{}).Count(&n)
+		return n
+	}
+
+	t.Run("Identical content shares one row", func(t *testing.T) {
+		if n := countContent(); n != 1 {
+			t.Errorf("Expected 1 content row, got %d", n)
+		}
+		var inline int64
+		testDB.Model(&Paste{}).Where("content <> ''").Count(&inline)
+		if inline != 0 {
+			t.Errorf("Expected no inline content, got %d pastes", inline)
+		}
+	})
+
+	t.Run("Quota counts shared content for each user", func(t *testing.T) {
+		used, _ := pasteSvc.StorageUsed(bob.ID)
+		if used != int64(len(content)) {
+			t.Errorf("Expected %d bytes used, got %d", len(content), used)
+		}
+	})
+
+	t.Run("Deleting one keeps the other readable", func(t *testing.T) {
+		if err := pasteSvc.DeletePaste(a.ID, alice.ID); err != nil {
+			t.Fatalf("Failed to delete paste: %v", err)
+		}
+		paste, err := pasteSvc.GetPaste(b.ID, nil)
+		if err != nil {
+			t.Fatalf("Failed to get paste: %v", err)
+		}
+		if paste.Content != content {
+			t.Errorf("Expected %q, got %q", content, paste.Content)
+		}
+	})
+
+	t.Run("Editing keeps content a deleted paste still uses", func(t *testing.T) {
+		if _, err := pasteSvc.UpdatePaste(b.ID, "", "rewritten", "text", false, bob.ID); err != nil {
+			t.Fatalf("Failed to update paste: %v", err)
+		}
+		var kept int64
+		testDB.Model(&PasteContent{}).Where("content = ?", content).Count(&kept)
+		if kept != 1 {
+			t.Error("Expected content of the deleted paste to be kept")
+		}
+		if paste, _ := pasteSvc.GetPaste(b.ID, nil); paste.Content != "rewritten" {
+			t.Errorf("Expected updated content, got %q", paste.Content)
+		}
+	})
+
+	t.Run("Purging a deleted paste drops its content", func(t *testing.T) {
+		stale := func() int64 {
+			var n int64
+			testDB.Model(&PasteContent{}).Where("content = ?", content).Count(&n)
+			return n
+		}
+
+		if n, err := pasteSvc.PurgeDeletedPastes(time.Hour); err != nil || n != 0 {
+			t.Fatalf("Expected a recent deletion to be kept, purged %d (%v)", n, err)
+		}
+		if stale() != 1 {
+			t.Fatal("Expected content to stay until the paste is purged")
+		}
+
+		testDB.Unscoped().Model(&Paste{}).Where("id = ?", a.ID).UpdateColumn("deleted_at", time.Now().Add(-2*time.Hour))
+		if n, err := pasteSvc.PurgeDeletedPastes(time.Hour); err != nil || n != 1 {
+			t.Fatalf("Expected 1 paste purged, got %d (%v)", n, err)
+		}
+		var rows int64
+		testDB.Unscoped().Model(&Paste{}).Where("id = ?", a.ID).Count(&rows)
+		if rows != 0 {
+			t.Error("Expected the paste row to be gone")
+		}
+		if stale() != 0 {
+			t.Error("Expected unreferenced content to be deleted")
+		}
+	})
+
+	t.Run("Deleted pastes keep their content", func(t *testing.T) {
+		pasteSvc.DeletePaste(b.ID, bob.ID)
+		if n := countContent(); n != 1 {
+			t.Errorf("Expected 1 content row, got %d", n)
+		}
+	})
+
+	t.Run("Bulk purges drop content", func(t *testing.T) {
+		expiresIn := 1
+		p, _ := pasteSvc.CreatePaste("", "short-lived", "text", false, false, &expiresIn, nil)
+		testDB.Model(p).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+		if _, err := pasteSvc.CleanupExpiredPastes(); err != nil {
+			t.Fatalf("Cleanup failed: %v", err)
+		}
+		if n := countContent(); n != 2 {
+			t.Errorf("Expected 2 content rows after cleanup, got %d", n)
+		}
+		if _, err := pasteSvc.PurgeDeletedPastes(0); err != nil {
+			t.Fatalf("Failed to purge pastes: %v", err)
+		}
+		if n := countContent(); n != 0 {
+			t.Errorf("Expected no content rows after purging, got %d", n)
+		}
+	})
+
+	t.Run("Content of a deleted paste can be uploaded again", func(t *testing.T) {
+		p, _ := pasteSvc.CreatePaste("", "uploaded twice", "text", false, false, nil, &alice.ID)
+		pasteSvc.DeletePaste(p.ID, alice.ID)
+		// Older versions released content while its paste was only
+		// soft-deleted, leaving rows that fail to load
+		testDB.Where("content = ?", "uploaded twice").Delete(&PasteContent{})
+
+		again, err := pasteSvc.CreatePaste("", "uploaded twice", "text", false, false, nil, &alice.ID)
+		if err != nil {
+			t.Fatalf("Failed to upload again: %v", err)
+		}
+		if again.ID == p.ID {
+			t.Error("Expected a new paste after deleting the old one")
+		}
+	})
+
+	t.Run("Shared pastes stay readable with the mode off", func(t *testing.T) {
+		p, _ := pasteSvc.CreatePaste("", "written while on", "text", false, false, nil, &alice.ID)
+		config.GlobalDedup = false
+		defer func() { config.GlobalDedup = true }()
+
+		paste, err := pasteSvc.GetPaste(p.ID, nil)
+		if err != nil || paste.Content != "written while on" {
+			t.Errorf("Expected shared paste to be readable, got %v", err)
+		}
+	})
+}
+
 func TestPasteService_GetPaste(t *testing.T) {
 	testDB := setupTestDB(t)
 	pasteSvc := NewPasteService(testDB)
@@ -271,6 +742,152 @@ func TestPasteService_UpdatePaste(t *testing.T) {
 	}
 }
 
+func TestPasteService_EditCount(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("editor", "password123")
+	paste, _ := pasteSvc.CreatePaste("", "v1", "text", false, false, nil, &user.ID)
+	if paste.EditCount != 0 {
+		t.Fatalf("Expected new paste to have no edits, got %d", paste.EditCount)
+	}
+
+	first, err := pasteSvc.UpdatePaste(paste.ID, "", "v2", "text", false, user.ID)
+	if err != nil {
+		t.Fatalf("First edit failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second, err := pasteSvc.UpdatePaste(paste.ID, "", "v3", "text", false, user.ID)
+	if err != nil {
+		t.Fatalf("Second edit failed: %v", err)
+	}
+
+	if second.EditCount != 2 {
+		t.Errorf("Expected EditCount 2, got %d", second.EditCount)
+	}
+	if !second.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("Expected UpdatedAt to advance, got %v then %v", first.UpdatedAt, second.UpdatedAt)
+	}
+
+	// Failed edits don't count
+	other, _ := authSvc.Register("intruder", "password123")
+	pasteSvc.UpdatePaste(paste.ID, "", "hacked", "text", false, other.ID)
+
+	title := "Renamed"
+	updated, _ := pasteSvc.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{Title: &title})
+	if updated.EditCount != 3 {
+		t.Errorf("Expected metadata edit to count, got %d", updated.EditCount)
+	}
+}
+
+func TestPasteService_UpdatePasteMeta(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user1, _ := authSvc.Register("user1", "password123")
+	user2, _ := authSvc.Register("user2", "password123")
+
+	paste, _ := pasteSvc.CreatePaste("Original", "Original content", "text", false, false, nil, &user1.ID)
+
+	t.Run("Omitting content leaves it unchanged", func(t *testing.T) {
+		title := "Renamed"
+		unlisted := true
+		updated, err := pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{Title: &title, Unlisted: &unlisted})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if updated.Content != "Original content" {
+			t.Errorf("Expected content to be unchanged, got '%s'", updated.Content)
+		}
+		if updated.Title != "Renamed" || !updated.Unlisted {
+			t.Errorf("Expected title and unlisted flag to be updated")
+		}
+		if updated.Language != "text" {
+			t.Errorf("Expected language to be unchanged, got '%s'", updated.Language)
+		}
+	})
+
+	t.Run("Language aliases are stored by name", func(t *testing.T) {
+		for alias, want := range map[string]string{"golang": "go", "JS": "javascript"} {
+			updated, err := pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{Language: &alias})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if updated.Language != want {
+				t.Errorf("Expected %q to be stored as %q, got %q", alias, want, updated.Language)
+			}
+		}
+	})
+
+	t.Run("Expiry updates apply", func(t *testing.T) {
+		expiresIn := 60
+		updated, err := pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{ExpiresIn: &expiresIn})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if updated.ExpiresAt == nil || time.Until(*updated.ExpiresAt) < 59*time.Minute {
+			t.Errorf("Expected expiry about an hour from now, got %v", updated.ExpiresAt)
+		}
+
+		expiresAt := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+		updated, err = pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{ExpiresAt: &expiresAt})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if updated.ExpiresAt == nil || !updated.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected expiry %v, got %v", expiresAt, updated.ExpiresAt)
+		}
+
+		updated, err = pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{NeverExpires: true})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if updated.ExpiresAt != nil || updated.ExpiryMinutes != 0 {
+			t.Errorf("Expected expiry to be cleared")
+		}
+	})
+
+	t.Run("Zero expires_in means what it does on create", func(t *testing.T) {
+		zero := 0
+		_, createErr := pasteSvc.CreatePaste("", "zero expiry", "text", false, false, &zero, &user1.ID)
+		_, updateErr := pasteSvc.UpdatePasteMeta(paste.ID, user1.ID, PasteMetaUpdate{ExpiresIn: &zero})
+		if createErr == nil || updateErr == nil {
+			t.Fatalf("Expected expires_in 0 to be rejected, got %v and %v", createErr, updateErr)
+		}
+		if errorCode(updateErr) != msgExpiresInZero || errorCode(createErr) != errorCode(updateErr) {
+			t.Errorf("Expected both to fail with %s, got %q and %q", msgExpiresInZero, errorCode(createErr), errorCode(updateErr))
+		}
+		if current, _ := pasteSvc.GetPaste(paste.ID, &user1.ID); current.ExpiresAt != nil {
+			t.Errorf("Expected the rejected update to leave the paste alone")
+		}
+	})
+
+	t.Run("Invalid updates are rejected", func(t *testing.T) {
+		negative := -5
+		past := time.Now().Add(-time.Hour)
+		empty := ""
+		title := "Hacked"
+
+		updates := map[string]struct {
+			userID uint
+			update PasteMetaUpdate
+		}{
+			"negative expires_in":           {user1.ID, PasteMetaUpdate{ExpiresIn: &negative}},
+			"never_expires with expires_in": {user1.ID, PasteMetaUpdate{ExpiresIn: &negative, NeverExpires: true}},
+			"past expires_at":               {user1.ID, PasteMetaUpdate{ExpiresAt: &past}},
+			"empty content":                 {user1.ID, PasteMetaUpdate{Content: &empty}},
+			"non-owner":                     {user2.ID, PasteMetaUpdate{Title: &title}},
+		}
+		for name, tt := range updates {
+			if _, err := pasteSvc.UpdatePasteMeta(paste.ID, tt.userID, tt.update); err == nil {
+				t.Errorf("Expected error for %s", name)
+			}
+		}
+	})
+}
+
 func TestPasteService_DeletePaste(t *testing.T) {
 	testDB := setupTestDB(t)
 	pasteSvc := NewPasteService(testDB)
@@ -313,7 +930,7 @@ func TestPasteService_DeletePaste(t *testing.T) {
 	}
 }
 
-func TestPasteService_GetUserPastes(t *testing.T) {
+func TestPasteService_GetUserPastesPage(t *testing.T) {
 	testDB := setupTestDB(t)
 	pasteSvc := NewPasteService(testDB)
 	authSvc := NewAuthService(testDB)
@@ -330,17 +947,17 @@ func TestPasteService_GetUserPastes(t *testing.T) {
 	pasteSvc.CreatePaste("", "User2 paste 1", "text", false, false, nil, &user2.ID)
 
 	// Get user1's pastes
-	pastes, err := pasteSvc.GetUserPastes(user1.ID)
+	pastes, total, err := pasteSvc.GetUserPastesPage(user1.ID, listPageSize, 0)
 	if err != nil {
 		t.Errorf("Failed to get user pastes: %v", err)
 	}
 
-	if len(pastes) != 3 {
-		t.Errorf("Expected 3 pastes for user1, got %d", len(pastes))
+	if len(pastes) != 3 || total != 3 {
+		t.Errorf("Expected 3 pastes for user1, got %d of %d", len(pastes), total)
 	}
 
 	// Get user2's pastes
-	pastes, err = pasteSvc.GetUserPastes(user2.ID)
+	pastes, _, err = pasteSvc.GetUserPastesPage(user2.ID, listPageSize, 0)
 	if err != nil {
 		t.Errorf("Failed to get user pastes: %v", err)
 	}
@@ -392,15 +1009,946 @@ func TestPasteService_CanEdit(t *testing.T) {
 	}
 }
 
-func TestHashFunctions(t *testing.T) {
-	content := "test content"
-	hash1, err := computeFileHash(bytes.NewReader([]byte(content)))
+func TestPasteService_DuplicatePaste(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user1, _ := authSvc.Register("user1", "password123")
+	user2, _ := authSvc.Register("user2", "password123")
+
+	original, _ := pasteSvc.CreatePaste("Snippet", "Private snippet", "go", true, true, nil, &user1.ID)
+
+	duplicate, err := pasteSvc.DuplicatePaste(original.ID, user1.ID)
 	if err != nil {
-		t.Errorf("Failed to compute hash: %v", err)
+		t.Fatalf("Failed to duplicate paste: %v", err)
 	}
 
-	hash2, err := computeFileHash(bytes.NewReader([]byte(content)))
-	if err != nil {
+	if duplicate.ID == original.ID {
+		t.Errorf("Expected duplicate to get a new ID")
+	}
+	if !duplicate.IsPrivate || !duplicate.Unlisted {
+		t.Errorf("Expected duplicate to preserve privacy flags")
+	}
+	if duplicate.Content != original.Content || duplicate.Title != original.Title || duplicate.Language != original.Language {
+		t.Errorf("Expected duplicate to copy title, content and language")
+	}
+
+	// The duplicate is a real, separately editable paste
+	if !pasteSvc.CanEdit(duplicate.ID, user1.ID) {
+		t.Errorf("Expected owner to be able to edit the duplicate")
+	}
+	if _, err := pasteSvc.UpdatePaste(duplicate.ID, "Snippet v2", "Changed", "go", true, user1.ID); err != nil {
+		t.Fatalf("Failed to update duplicate: %v", err)
+	}
+	unchanged, _ := pasteSvc.GetPaste(original.ID, &user1.ID)
+	if unchanged.Content != "Private snippet" {
+		t.Errorf("Editing the duplicate should not change the original")
+	}
+
+	if _, err := pasteSvc.DuplicatePaste(original.ID, user2.ID); err == nil {
+		t.Errorf("Expected error when duplicating another user's paste")
+	}
+	if _, err := pasteSvc.DuplicatePaste("nonexistent", user1.ID); err == nil {
+		t.Errorf("Expected error when duplicating non-existent paste")
+	}
+}
+
+func TestPasteService_TitleLength(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.MaxTitleLength = 10
+
+	user, _ := authSvc.Register("user1", "password123")
+
+	t.Run("Trims and collapses whitespace", func(t *testing.T) {
+		paste, err := pasteSvc.CreatePaste("  my \t\n title  ", "content", "text", false, false, nil, &user.ID)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if paste.Title != "my title" {
+			t.Errorf("Expected normalized title 'my title', got %q", paste.Title)
+		}
+	})
+
+	t.Run("Rejects over-length titles", func(t *testing.T) {
+		if _, err := pasteSvc.CreatePaste("eleven char", "other content", "text", false, false, nil, &user.ID); err == nil {
+			t.Errorf("Expected error for over-length title on create")
+		}
+
+		// Length is counted in characters, not bytes
+		if _, err := pasteSvc.CreatePaste("ünïcödé", "unicode content", "text", false, false, nil, &user.ID); err != nil {
+			t.Errorf("Expected multi-byte title within limit to be accepted: %v", err)
+		}
+	})
+
+	t.Run("Applies to updates", func(t *testing.T) {
+		paste, _ := pasteSvc.CreatePaste("short", "update content", "text", false, false, nil, &user.ID)
+
+		if _, err := pasteSvc.UpdatePaste(paste.ID, "far too long a title", "update content", "text", false, user.ID); err == nil {
+			t.Errorf("Expected error for over-length title on update")
+		}
+
+		longTitle := "also much too long"
+		if _, err := pasteSvc.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{Title: &longTitle}); err == nil {
+			t.Errorf("Expected error for over-length title on partial update")
+		}
+
+		spaced := "  new   one "
+		updated, err := pasteSvc.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{Title: &spaced})
+		if err != nil {
+			t.Fatalf("Failed to update title: %v", err)
+		}
+		if updated.Title != "new one" {
+			t.Errorf("Expected normalized title 'new one', got %q", updated.Title)
+		}
+	})
+}
+
+func TestPasteService_StorageQuota(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+	adminSvc := NewAdminService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.UserQuotaBytes = 10
+
+	user1, _ := authSvc.Register("user1", "password123")
+	user2, _ := authSvc.Register("user2", "password123")
+
+	if _, err := pasteSvc.CreatePaste("", "12345678", "text", false, false, nil, &user1.ID); err != nil {
+		t.Fatalf("Failed to create paste within quota: %v", err)
+	}
+	if _, err := pasteSvc.CreatePaste("", "abcdef", "text", false, false, nil, &user1.ID); err == nil {
+		t.Fatalf("Expected global quota to reject paste")
+	}
+
+	t.Run("Admin override lets user exceed global default", func(t *testing.T) {
+		quota := int64(100)
+		if err := adminSvc.SetUserQuota(0, user1.ID, &quota); err != nil {
+			t.Fatalf("Failed to set quota: %v", err)
+		}
+		if _, err := pasteSvc.CreatePaste("", "abcdef", "text", false, false, nil, &user1.ID); err != nil {
+			t.Errorf("Expected paste to fit raised quota: %v", err)
+		}
+
+		stats, _ := adminSvc.GetUserStats(user1.ID)
+		if stats["used_bytes"] != int64(14) || stats["quota_bytes"] != int64(100) {
+			t.Errorf("Expected 14 of 100 bytes used, got %v of %v", stats["used_bytes"], stats["quota_bytes"])
+		}
+
+		// Other users still get the default
+		if _, err := pasteSvc.CreatePaste("", "this is too long", "text", false, false, nil, &user2.ID); err == nil {
+			t.Errorf("Expected global quota to still apply to other users")
+		}
+	})
+
+	t.Run("Clearing override restores global default", func(t *testing.T) {
+		if err := adminSvc.SetUserQuota(0, user1.ID, nil); err != nil {
+			t.Fatalf("Failed to clear quota: %v", err)
+		}
+		if _, err := pasteSvc.CreatePaste("", "more", "text", false, false, nil, &user1.ID); err == nil {
+			t.Errorf("Expected global quota to apply after clearing override")
+		}
+	})
+
+	t.Run("Counts compressed pastes by stored size", func(t *testing.T) {
+		config.Compression = true
+		config.CompressionThreshold = 1024
+		defer func() {
+			config.Compression, config.CompressionThreshold = testConfig().Compression, testConfig().CompressionThreshold
+		}()
+		quota := int64(2000)
+		adminSvc.SetUserQuota(0, user2.ID, &quota)
+
+		// Far over the quota as plaintext, far under it compressed
+		paste, err := pasteSvc.CreatePaste("", strings.Repeat("compressible ", 1000), "text", false, false, nil, &user2.ID)
+		if err != nil {
+			t.Fatalf("Expected compressed paste to fit the quota: %v", err)
+		}
+		used, _ := pasteSvc.StorageUsed(user2.ID)
+		if used >= quota {
+			t.Fatalf("Expected compressed size under the quota, got %d", used)
+		}
+
+		// Growing it by what's left as plaintext still fits once compressed
+		if _, err := pasteSvc.UpdatePaste(paste.ID, "", strings.Repeat("compressible ", 1200), "text", false, user2.ID); err != nil {
+			t.Errorf("Expected the edit to be charged by stored size: %v", err)
+		}
+	})
+
+	t.Run("Rejects invalid quota", func(t *testing.T) {
+		negative := int64(-1)
+		if err := adminSvc.SetUserQuota(0, user1.ID, &negative); err == nil {
+			t.Errorf("Expected error for negative quota")
+		}
+		if err := adminSvc.SetUserQuota(0, 9999, nil); err == nil {
+			t.Errorf("Expected error for unknown user")
+		}
+	})
+}
+
+func TestPasteService_SlidingExpiry(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	user, _ := authSvc.Register("slider", "password123")
+	sliding := PasteOptions{SlidingExpiry: true}
+	expiresIn := 60
+
+	// backdate moves a paste's expiry to simulate time passing
+	backdate := func(id string, expiry time.Time) {
+		testDB.Model(&Paste{}).Where("id = ?", id).UpdateColumn("expires_at", expiry)
+	}
+
+	t.Run("Rejected when disabled", func(t *testing.T) {
+		if _, err := pasteSvc.CreatePasteWithOptions("", "disabled", "text", false, false, &expiresIn, &user.ID, sliding); err == nil {
+			t.Error("Expected error when sliding_expiry is off")
+		}
+	})
+
+	config.SlidingExpiry = true
+
+	t.Run("Requires an expiry", func(t *testing.T) {
+		if _, err := pasteSvc.CreatePasteWithOptions("", "forever", "text", false, false, nil, &user.ID, sliding); err == nil {
+			t.Error("Expected error for sliding expiry without expires_in")
+		}
+	})
+
+	t.Run("Viewing extends expiry", func(t *testing.T) {
+		paste, err := pasteSvc.CreatePasteWithOptions("", "keep me alive", "text", false, false, &expiresIn, &user.ID, sliding)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+
+		backdate(paste.ID, time.Now().Add(time.Minute))
+
+		viewed, err := pasteSvc.GetPaste(paste.ID, nil)
+		if err != nil {
+			t.Fatalf("Failed to view paste: %v", err)
+		}
+		if time.Until(*viewed.ExpiresAt) < 59*time.Minute {
+			t.Errorf("Expected expiry to be pushed back an hour, got %v", time.Until(*viewed.ExpiresAt))
+		}
+
+		var stored Paste
+		testDB.First(&stored, "id = ?", paste.ID)
+		if !stored.ExpiresAt.Equal(*viewed.ExpiresAt) {
+			t.Errorf("Expected renewed expiry to be saved")
+		}
+	})
+
+	t.Run("Unviewed paste still expires", func(t *testing.T) {
+		paste, _ := pasteSvc.CreatePasteWithOptions("", "forgotten", "text", false, false, &expiresIn, &user.ID, sliding)
+		backdate(paste.ID, time.Now().Add(-time.Minute))
+
+		if _, err := pasteSvc.GetPaste(paste.ID, nil); err == nil {
+			t.Error("Expected expired sliding paste to be gone")
+		}
+	})
+
+	t.Run("Fixed expiry is not extended", func(t *testing.T) {
+		paste, _ := pasteSvc.CreatePaste("", "fixed", "text", false, false, &expiresIn, &user.ID)
+		expiry := time.Now().Add(time.Minute)
+		backdate(paste.ID, expiry)
+
+		viewed, _ := pasteSvc.GetPaste(paste.ID, nil)
+		if time.Until(*viewed.ExpiresAt) > 2*time.Minute {
+			t.Errorf("Expected fixed expiry to stay put, got %v", time.Until(*viewed.ExpiresAt))
+		}
+	})
+
+	t.Run("Owner can toggle via meta update", func(t *testing.T) {
+		paste, _ := pasteSvc.CreatePaste("", "toggle", "text", false, false, &expiresIn, &user.ID)
+		on, off := true, false
+
+		updated, err := pasteSvc.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{SlidingExpiry: &on})
+		if err != nil || !updated.SlidingExpiry {
+			t.Fatalf("Expected sliding expiry to be enabled: %v", err)
+		}
+		updated, err = pasteSvc.UpdatePasteMeta(paste.ID, user.ID, PasteMetaUpdate{SlidingExpiry: &off})
+		if err != nil || updated.SlidingExpiry {
+			t.Fatalf("Expected sliding expiry to be disabled: %v", err)
+		}
+
+		permanent, _ := pasteSvc.CreatePaste("", "permanent", "text", false, false, nil, &user.ID)
+		if _, err := pasteSvc.UpdatePasteMeta(permanent.ID, user.ID, PasteMetaUpdate{SlidingExpiry: &on}); err == nil {
+			t.Error("Expected error enabling sliding expiry on a paste that never expires")
+		}
+	})
+}
+
+func TestPasteService_CleanupAnonymousPastes(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("keeper", "password123")
+
+	// age backdates a paste's creation time
+	age := func(p *Paste, days int) {
+		testDB.Model(&Paste{}).Where("id = ?", p.ID).UpdateColumn("created_at", time.Now().AddDate(0, 0, -days))
+	}
+
+	oldAnon, _ := pasteSvc.CreatePaste("", "old anonymous", "text", false, false, nil, nil)
+	age(oldAnon, 40)
+	newAnon, _ := pasteSvc.CreatePaste("", "new anonymous", "text", false, false, nil, nil)
+	age(newAnon, 5)
+	oldOwned, _ := pasteSvc.CreatePaste("", "old owned", "text", false, false, nil, &user.ID)
+	age(oldOwned, 400)
+
+	removed, err := pasteSvc.CleanupAnonymousPastes(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("Expected 1 paste removed, got %d", removed)
+	}
+
+	if _, err := pasteSvc.GetPaste(oldAnon.ID, nil); err == nil {
+		t.Error("Expected old anonymous paste to be removed")
+	}
+	if _, err := pasteSvc.GetPaste(newAnon.ID, nil); err != nil {
+		t.Error("Expected recent anonymous paste to be kept")
+	}
+	if _, err := pasteSvc.GetPaste(oldOwned.ID, &user.ID); err != nil {
+		t.Error("Expected owned paste to be kept regardless of age")
+	}
+}
+
+func TestPasteService_TrimTrailingWhitespace(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	t.Run("Exact bytes by default", func(t *testing.T) {
+		a, _ := pasteSvc.CreatePaste("", "untrimmed  \n", "text", false, false, nil, nil)
+		b, _ := pasteSvc.CreatePaste("", "untrimmed", "text", false, false, nil, nil)
+		if a.ID == b.ID {
+			t.Error("Expected whitespace differences to matter when trimming is off")
+		}
+		if a.Content != "untrimmed  \n" {
+			t.Errorf("Expected content unchanged, got %q", a.Content)
+		}
+	})
+
+	config.TrimTrailingWhitespace = true
+
+	t.Run("Whitespace-only differences dedup", func(t *testing.T) {
+		a, err := pasteSvc.CreatePaste("", "line one  \n\tline two\t\r\n\n\n", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		b, _ := pasteSvc.CreatePaste("", "line one\n\tline two", "text", false, false, nil, nil)
+
+		if a.ID != b.ID {
+			t.Errorf("Expected pastes differing in trailing whitespace to dedup")
+		}
+		if a.Content != "line one\n\tline two" {
+			t.Errorf("Expected trimmed content, got %q", a.Content)
+		}
+	})
+
+	t.Run("Whitespace-only paste is empty", func(t *testing.T) {
+		if _, err := pasteSvc.CreatePaste("", "  \n\t\n", "text", false, false, nil, nil); err == nil {
+			t.Error("Expected whitespace-only paste to be rejected")
+		}
+	})
+}
+
+func TestPasteService_NormalizeLineEndings(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	t.Run("Exact bytes by default", func(t *testing.T) {
+		a, _ := pasteSvc.CreatePaste("", "windows\r\ntext\r\n", "text", false, false, nil, nil)
+		b, _ := pasteSvc.CreatePaste("", "windows\ntext\n", "text", false, false, nil, nil)
+		if a.ID == b.ID {
+			t.Error("Expected line endings to matter when normalization is off")
+		}
+		if a.Content != "windows\r\ntext\r\n" {
+			t.Errorf("Expected content unchanged, got %q", a.Content)
+		}
+	})
+
+	config.NormalizeLineEndings = true
+
+	t.Run("CRLF and LF dedup", func(t *testing.T) {
+		a, err := pasteSvc.CreatePaste("", "from windows\r\nsecond line\r\n", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		b, _ := pasteSvc.CreatePaste("", "from windows\nsecond line\n", "text", false, false, nil, nil)
+
+		if a.ID != b.ID {
+			t.Errorf("Expected CRLF and LF versions to dedup")
+		}
+
+		stored, _ := pasteSvc.GetPaste(a.ID, nil)
+		if stored.Content != "from windows\nsecond line\n" {
+			t.Errorf("Expected LF content, got %q", stored.Content)
+		}
+	})
+}
+
+func TestPasteService_Encryption(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("user1", "password123")
+
+	// Written before encryption is enabled, must stay readable afterwards
+	legacy, _ := pasteSvc.CreatePaste("", "legacy plaintext", "text", false, false, nil, &user.ID)
+
+	aead, err := newContentCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+	contentCipher = aead
+	defer func() { contentCipher = nil }()
+
+	storedContent := func(id string) string {
+		var content string
+		testDB.Raw("SELECT content FROM pastes WHERE id = ?", id).Scan(&content)
+		return content
+	}
+
+	secret := "top secret content"
+	paste, err := pasteSvc.CreatePaste("Secret", secret, "text", false, false, nil, &user.ID)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+
+	t.Run("Stores ciphertext", func(t *testing.T) {
+		stored := storedContent(paste.ID)
+		if stored == secret || strings.Contains(stored, "secret") {
+			t.Errorf("Expected ciphertext in database, got %q", stored)
+		}
+		if paste.Content != secret {
+			t.Errorf("Expected returned paste to hold plaintext, got %q", paste.Content)
+		}
+	})
+
+	t.Run("Round-trips on read", func(t *testing.T) {
+		got, err := pasteSvc.GetPaste(paste.ID, &user.ID)
+		if err != nil {
+			t.Fatalf("Failed to get paste: %v", err)
+		}
+		if got.Content != secret {
+			t.Errorf("Expected decrypted content %q, got %q", secret, got.Content)
+		}
+
+		old, err := pasteSvc.GetPaste(legacy.ID, &user.ID)
+		if err != nil || old.Content != "legacy plaintext" {
+			t.Errorf("Expected plaintext paste to remain readable, got %v %v", old, err)
+		}
+	})
+
+	t.Run("Dedup uses plaintext hash", func(t *testing.T) {
+		again, err := pasteSvc.CreatePaste("Secret", secret, "text", false, false, nil, &user.ID)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if again.ID != paste.ID {
+			t.Errorf("Expected identical content to be deduplicated")
+		}
+	})
+
+	t.Run("Updates and search work on plaintext", func(t *testing.T) {
+		updated, err := pasteSvc.UpdatePaste(paste.ID, "Secret", "new hidden words", "text", false, user.ID)
+		if err != nil {
+			t.Fatalf("Failed to update paste: %v", err)
+		}
+		if updated.Content != "new hidden words" || strings.Contains(storedContent(paste.ID), "hidden") {
+			t.Errorf("Expected update to be re-encrypted")
+		}
+
+		results, _, _ := pasteSvc.SearchUserPastesPage(user.ID, "HIDDEN", SearchOptions{})
+		if len(results) != 1 || results[0].ID != paste.ID {
+			t.Errorf("Expected search to match decrypted content, got %d results", len(results))
+		}
+	})
+
+	t.Run("Fails without key", func(t *testing.T) {
+		contentCipher = nil
+		defer func() { contentCipher = aead }()
+
+		if _, err := pasteSvc.GetPaste(paste.ID, &user.ID); err == nil {
+			t.Errorf("Expected encrypted paste to be unreadable without a key")
+		}
+	})
+
+	t.Run("Rejects bad keys", func(t *testing.T) {
+		if _, err := newContentCipher("not base64!"); err == nil {
+			t.Errorf("Expected error for non-base64 key")
+		}
+		if _, err := newContentCipher(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+			t.Errorf("Expected error for short key")
+		}
+	})
+}
+
+func TestPasteService_Compression(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	// Written before compression is enabled, must stay readable afterwards
+	legacy, _ := pasteSvc.CreatePaste("", strings.Repeat("legacy ", 1000), "text", false, false, nil, nil)
+
+	config.Compression = true
+	config.CompressionThreshold = 1024
+
+	stored := func(id string) (content string, compressed bool) {
+		var row struct {
+			Content    string
+			Compressed bool
+		}
+		testDB.Raw("SELECT content, compressed FROM pastes WHERE id = ?", id).Scan(&row)
+		return row.Content, row.Compressed
+	}
+
+	original := strings.Repeat("all work and no play makes jack a dull boy\n", 500)
+	paste, err := pasteSvc.CreatePaste("", original, "text", false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+
+	t.Run("Stores compressible content smaller", func(t *testing.T) {
+		content, compressed := stored(paste.ID)
+		if !compressed {
+			t.Fatalf("Expected paste to be stored compressed")
+		}
+		if len(content) >= len(original)/10 {
+			t.Errorf("Expected stored size well below %d bytes, got %d", len(original), len(content))
+		}
+	})
+
+	t.Run("Round-trips on read", func(t *testing.T) {
+		got, err := pasteSvc.GetPaste(paste.ID, nil)
+		if err != nil {
+			t.Fatalf("Failed to get paste: %v", err)
+		}
+		if got.Content != original {
+			t.Errorf("Expected decompressed content to match original")
+		}
+
+		old, err := pasteSvc.GetPaste(legacy.ID, nil)
+		if err != nil || old.Content != strings.Repeat("legacy ", 1000) {
+			t.Errorf("Expected uncompressed paste to remain readable")
+		}
+	})
+
+	t.Run("Dedup uses plaintext hash", func(t *testing.T) {
+		again, _ := pasteSvc.CreatePaste("", original, "text", false, false, nil, nil)
+		if again.ID != paste.ID {
+			t.Errorf("Expected identical content to be deduplicated")
+		}
+	})
+
+	t.Run("Small pastes stay uncompressed", func(t *testing.T) {
+		small, _ := pasteSvc.CreatePaste("", "tiny", "text", false, false, nil, nil)
+		if content, compressed := stored(small.ID); compressed || content != "tiny" {
+			t.Errorf("Expected small paste to be stored as-is")
+		}
+	})
+
+	t.Run("Combines with encryption", func(t *testing.T) {
+		aead, _ := newContentCipher(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32)))
+		contentCipher = aead
+		defer func() { contentCipher = nil }()
+
+		both, err := pasteSvc.CreatePaste("", original+"encrypted", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if _, compressed := stored(both.ID); !compressed {
+			t.Errorf("Expected encrypted paste to be compressed too")
+		}
+		got, _ := pasteSvc.GetPaste(both.ID, nil)
+		if got == nil || got.Content != original+"encrypted" {
+			t.Errorf("Expected compressed and encrypted paste to round-trip")
+		}
+	})
+}
+
+func TestPasteService_SearchUserPastesPage(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("user1", "password123")
+	other, _ := authSvc.Register("user2", "password123")
+
+	titleMatch, _ := pasteSvc.CreatePaste("Deploy notes", "nothing relevant here", "text", false, false, nil, &user.ID)
+	// Created later, so it would come first if ordering were by date alone
+	contentMatch, _ := pasteSvc.CreatePaste("Misc", "remember to deploy on friday", "text", false, false, nil, &user.ID)
+	testDB.Model(&Paste{}).Where("id = ?", contentMatch.ID).UpdateColumn("created_at", time.Now().Add(time.Hour))
+	pasteSvc.CreatePaste("Unrelated", "cats", "text", false, false, nil, &user.ID)
+	pasteSvc.CreatePaste("Deploy", "someone else's deploy", "text", false, false, nil, &other.ID)
+
+	t.Run("Title match outranks content match", func(t *testing.T) {
+		results, total, err := pasteSvc.SearchUserPastesPage(user.ID, "DEPLOY", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if total != 2 || len(results) != 2 {
+			t.Fatalf("Expected 2 matches, got %d (total %d)", len(results), total)
+		}
+		if results[0].ID != titleMatch.ID || results[1].ID != contentMatch.ID {
+			t.Errorf("Expected title match first, got %s then %s", results[0].Title, results[1].Title)
+		}
+	})
+
+	t.Run("Sort by date", func(t *testing.T) {
+		newest, _, _ := pasteSvc.SearchUserPastesPage(user.ID, "deploy", SearchOptions{Sort: "newest"})
+		if newest[0].ID != contentMatch.ID {
+			t.Errorf("Expected newest paste first")
+		}
+		oldest, _, _ := pasteSvc.SearchUserPastesPage(user.ID, "deploy", SearchOptions{Sort: "oldest"})
+		if oldest[0].ID != titleMatch.ID {
+			t.Errorf("Expected oldest paste first")
+		}
+		if _, _, err := pasteSvc.SearchUserPastesPage(user.ID, "deploy", SearchOptions{Sort: "random"}); err == nil {
+			t.Errorf("Expected error for unknown sort")
+		}
+	})
+
+	t.Run("Pagination keeps total", func(t *testing.T) {
+		page2, total, _ := pasteSvc.SearchUserPastesPage(user.ID, "deploy", SearchOptions{Page: 2, PerPage: 1})
+		if total != 2 || len(page2) != 1 || page2[0].ID != contentMatch.ID {
+			t.Errorf("Expected second result alone on page 2 with total 2, got %d results, total %d", len(page2), total)
+		}
+		page3, _, _ := pasteSvc.SearchUserPastesPage(user.ID, "deploy", SearchOptions{Page: 3, PerPage: 1})
+		if len(page3) != 0 {
+			t.Errorf("Expected empty page past the end, got %d", len(page3))
+		}
+	})
+
+	t.Run("Wildcards match literally", func(t *testing.T) {
+		pasteSvc.CreatePaste("Progress", "100% done", "text", false, false, nil, &user.ID)
+
+		results, total, _ := pasteSvc.SearchUserPastesPage(user.ID, "0%", SearchOptions{})
+		if total != 1 || len(results) != 1 || results[0].Title != "Progress" {
+			t.Errorf("Expected only the paste containing 0%%, got %d (total %d)", len(results), total)
+		}
+		if _, total, _ := pasteSvc.SearchUserPastesPage(user.ID, "_", SearchOptions{}); total != 0 {
+			t.Errorf("Expected _ to match no pastes, got %d", total)
+		}
+	})
+
+	t.Run("Matches shared content", func(t *testing.T) {
+		oldDedup := config.GlobalDedup
+		config.GlobalDedup = true
+		defer func() { config.GlobalDedup = oldDedup }()
+
+		shared, _ := pasteSvc.CreatePaste("Shared", "kept in paste_contents", "text", false, false, nil, &user.ID)
+		results, _, err := pasteSvc.SearchUserPastesPage(user.ID, "PASTE_CONTENTS", SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if len(results) != 1 || results[0].ID != shared.ID || results[0].Content != "kept in paste_contents" {
+			t.Errorf("Expected the shared paste with its content, got %d results", len(results))
+		}
+	})
+}
+
+func TestSearchSnippets(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	authSvc := NewAuthService(testDB)
+
+	user, _ := authSvc.Register("user1", "password123")
+
+	filler := strings.Repeat("lorem ipsum dolor ", 5000)
+	long, _ := pasteSvc.CreatePaste("Long", filler+"the NEEDLE is here"+filler, "text", false, false, nil, &user.ID)
+	titleOnly, _ := pasteSvc.CreatePaste("needle in the title", "nothing to see", "text", false, false, nil, &user.ID)
+
+	pastes, _, err := pasteSvc.SearchUserPastesPage(user.ID, "needle", SearchOptions{})
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	results := newSearchResults(pastes, "needle")
+	byID := map[string]SearchResult{}
+	for _, result := range results {
+		byID[result.ID] = result
+	}
+
+	t.Run("Match in a long paste gives a bounded snippet", func(t *testing.T) {
+		result, ok := byID[long.ID]
+		if !ok || result.Snippet == nil {
+			t.Fatalf("Expected a snippet for the long paste, got %+v", result.Snippet)
+		}
+		snippet := result.Snippet
+		if snippet.Match != "NEEDLE" {
+			t.Errorf("Expected the match as written in the paste, got %q", snippet.Match)
+		}
+		if !strings.HasPrefix(snippet.Before, "…") || !strings.HasSuffix(snippet.After, "…") {
+			t.Errorf("Expected ellipses on both sides, got %q / %q", snippet.Before, snippet.After)
+		}
+		if !strings.HasSuffix(snippet.Before, "the ") || !strings.HasPrefix(snippet.After, " is here") {
+			t.Errorf("Expected context around the match, got %q / %q", snippet.Before, snippet.After)
+		}
+		if n := utf8.RuneCountInString(snippet.Before + snippet.Match + snippet.After); n > 2*searchSnippetContext+len("NEEDLE")+2 {
+			t.Errorf("Expected a short snippet, got %d runes", n)
+		}
+		if result.Content != "" {
+			t.Errorf("Expected full content to be left out of results")
+		}
+	})
+
+	t.Run("Title-only match has no snippet", func(t *testing.T) {
+		if result := byID[titleOnly.ID]; result.Snippet != nil {
+			t.Errorf("Expected no snippet, got %+v", result.Snippet)
+		}
+	})
+
+	t.Run("Short content is not cut", func(t *testing.T) {
+		snippet := searchSnippet("ünïcode needle ✓", regexp.MustCompile("(?i)needle"))
+		if snippet == nil || snippet.Before != "ünïcode " || snippet.After != " ✓" {
+			t.Errorf("Expected the whole content without ellipses, got %+v", snippet)
+		}
+	})
+}
+
+func TestPasteService_ValidateJSON(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	validate := PasteOptions{ValidateJSON: true}
+
+	tests := []struct {
+		name        string
+		content     string
+		language    string
+		opts        PasteOptions
+		expectError string
+	}{
+		{"Valid JSON", `{"name": "pb", "tags": [1, 2]}`, "json", validate, ""},
+		{"Malformed JSON", "{\n  \"name\": \"pb\",\n  \"tags\": [1 2]\n}", "json", validate, "line 3, column 14"},
+		{"Trailing data", `{"a": 1} {"b": 2}`, "json", validate, "invalid JSON"},
+		{"Malformed JSON without validation", `{"broken": `, "json", PasteOptions{}, ""},
+		{"Non-JSON language ignores validation", `{"broken": `, "text", validate, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pasteSvc.CreatePasteWithOptions("", tt.content, tt.language, false, false, nil, nil, tt.opts)
+			if tt.expectError == "" {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+			if !strings.Contains(err.Error(), tt.expectError) {
+				t.Errorf("Expected error containing '%s', got '%s'", tt.expectError, err.Error())
+			}
+		})
+	}
+}
+
+func TestPasteService_Format(t *testing.T) {
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	format := PasteOptions{Format: true}
+
+	tests := []struct {
+		name        string
+		content     string
+		language    string
+		opts        PasteOptions
+		want        string
+		expectError string
+	}{
+		{"JSON is indented", `{"b":1,"a":[1,2.50]}`, "json", format, "{\n  \"b\": 1,\n  \"a\": [\n    1,\n    2.50\n  ]\n}", ""},
+		{"JSON by alias", `[1,2]`, "JSON", format, "[\n  1,\n  2\n]", ""},
+		{"Malformed JSON", `{"a": 1,}`, "json", format, "", "invalid JSON"},
+		{"Go is gofmt'd", "package main\nfunc main(){x:=1\n_=x}", "go", format, "package main\n\nfunc main() {\n\tx := 1\n\t_ = x\n}\n", ""},
+		{"Malformed Go", "package main\nfunc main() {", "go", format, "", "invalid Go source"},
+		{"Other languages untouched", `{"a":1}`, "text", format, `{"a":1}`, ""},
+		{"Off by default", `{"c":1}`, "json", PasteOptions{}, `{"c":1}`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paste, err := pasteSvc.CreatePasteWithOptions("", tt.content, tt.language, false, false, nil, nil, tt.opts)
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("Expected error containing '%s', got %v", tt.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			stored, _ := pasteSvc.GetPaste(paste.ID, nil)
+			if stored.Content != tt.want {
+				t.Errorf("Expected content %q, got %q", tt.want, stored.Content)
+			}
+		})
+	}
+}
+
+func TestMaxLines(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.MaxLines = 3
+
+	testDB := setupTestDB(t)
+	pasteSvc := NewPasteService(testDB)
+	userID := uint(1)
+
+	for _, tt := range []struct {
+		content string
+		lines   int
+	}{
+		{"", 0}, {"a", 1}, {"a\n", 1}, {"a\nb", 2}, {"\n\n", 2}, {"a\nb\nc\n", 3},
+	} {
+		if got := countLines(tt.content); got != tt.lines {
+			t.Errorf("countLines(%q) = %d, want %d", tt.content, got, tt.lines)
+		}
+	}
+
+	t.Run("Exactly the limit", func(t *testing.T) {
+		for _, content := range []string{"a\nb\nc", "a\nb\nc\n"} {
+			if _, err := pasteSvc.CreatePaste("", content, "text", false, false, nil, &userID); err != nil {
+				t.Errorf("Expected %q to be allowed, got %v", content, err)
+			}
+		}
+	})
+
+	t.Run("One over", func(t *testing.T) {
+		_, err := pasteSvc.CreatePaste("", "a\nb\nc\nd", "text", false, false, nil, &userID)
+		if err == nil || !strings.Contains(err.Error(), "too many lines (max 3)") {
+			t.Errorf("Expected a line limit error, got %v", err)
+		}
+	})
+
+	t.Run("Edits", func(t *testing.T) {
+		paste, _ := pasteSvc.CreatePaste("", "short", "text", false, false, nil, &userID)
+		if _, err := pasteSvc.UpdatePaste(paste.ID, "", "1\n2\n3\n4\n", "text", false, userID); err == nil {
+			t.Errorf("Expected an update over the limit to fail")
+		}
+		content := "1\n2\n3\n4"
+		if _, err := pasteSvc.UpdatePasteMeta(paste.ID, userID, PasteMetaUpdate{Content: &content}); err == nil {
+			t.Errorf("Expected a patch over the limit to fail")
+		}
+		if _, err := pasteSvc.UpdatePaste(paste.ID, "", "1\n2\n3", "text", false, userID); err != nil {
+			t.Errorf("Expected an update at the limit to work, got %v", err)
+		}
+	})
+
+	t.Run("Unlimited by default", func(t *testing.T) {
+		config.MaxLines = 0
+		if _, err := pasteSvc.CreatePaste("", strings.Repeat("x\n", 1000), "text", false, false, nil, &userID); err != nil {
+			t.Errorf("Expected no line limit, got %v", err)
+		}
+	})
+}
+
+func TestAPIKeyLimit(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.MaxAPIKeysPerUser = 2
+
+	testDB := setupTestDB(t)
+	authSvc := NewAuthService(testDB)
+	keySvc := NewAPIKeyService(testDB)
+	user, _ := authSvc.Register("keyholder", "password123")
+	other, _ := authSvc.Register("otherholder", "password123")
+
+	first, err := keySvc.CreateAPIKey(user.ID, "first", nil)
+	if err != nil {
+		t.Fatalf("Failed to create first key: %v", err)
+	}
+	if _, err := keySvc.CreateAPIKey(user.ID, "second", nil); err != nil {
+		t.Fatalf("Failed to create second key: %v", err)
+	}
+
+	t.Run("Beyond the limit is rejected", func(t *testing.T) {
+		_, err := keySvc.CreateAPIKey(user.ID, "third", nil)
+		if err == nil || !strings.Contains(err.Error(), "limit") {
+			t.Errorf("Expected a limit error, got %v", err)
+		}
+	})
+
+	t.Run("Limit is per user", func(t *testing.T) {
+		if _, err := keySvc.CreateAPIKey(other.ID, "theirs", nil); err != nil {
+			t.Errorf("Expected another user's key to be allowed, got %v", err)
+		}
+	})
+
+	t.Run("Deleting one allows another", func(t *testing.T) {
+		if err := keySvc.DeleteAPIKey(first.ID, user.ID); err != nil {
+			t.Fatalf("Failed to delete key: %v", err)
+		}
+		if _, err := keySvc.CreateAPIKey(user.ID, "replacement", nil); err != nil {
+			t.Errorf("Expected a key to be allowed after deleting one, got %v", err)
+		}
+	})
+
+	t.Run("Expired keys", func(t *testing.T) {
+		var key APIKey
+		testDB.Where("user_id = ? AND name = ?", user.ID, "replacement").First(&key)
+		testDB.Model(&key).UpdateColumn("expires_at", time.Now().Add(-time.Hour))
+
+		config.APIKeyLimitIncludesExpired = true
+		if _, err := keySvc.CreateAPIKey(user.ID, "counted", nil); err == nil {
+			t.Error("Expected the expired key to count when configured to")
+		}
+
+		config.APIKeyLimitIncludesExpired = false
+		if _, err := keySvc.CreateAPIKey(user.ID, "uncounted", nil); err != nil {
+			t.Errorf("Expected the expired key not to count, got %v", err)
+		}
+	})
+
+	t.Run("Zero means no limit", func(t *testing.T) {
+		config.MaxAPIKeysPerUser = 0
+		if _, err := keySvc.CreateAPIKey(user.ID, "unlimited", nil); err != nil {
+			t.Errorf("Expected no limit, got %v", err)
+		}
+	})
+}
+
+func TestHashFunctions(t *testing.T) {
+	content := "test content"
+	hash1, err := computeFileHash(bytes.NewReader([]byte(content)))
+	if err != nil {
+		t.Errorf("Failed to compute hash: %v", err)
+	}
+
+	hash2, err := computeFileHash(bytes.NewReader([]byte(content)))
+	if err != nil {
 		t.Errorf("Failed to compute hash: %v", err)
 	}
 
@@ -413,22 +1961,455 @@ func TestHashFunctions(t *testing.T) {
 		t.Errorf("Failed to compute hash: %v", err)
 	}
 
-	if hash1 == hash3 {
-		t.Errorf("Expected different hashes for different content")
-	}
-}
+	if hash1 == hash3 {
+		t.Errorf("Expected different hashes for different content")
+	}
+}
+
+func TestRandFilename(t *testing.T) {
+	filename1 := randfilename(8, ".txt")
+	filename2 := randfilename(8, ".txt")
+
+	if len(filename1) != 12 { // 8 chars + .txt
+		t.Errorf("Expected filename length 12, got %d", len(filename1))
+	}
+
+	if filename1 == filename2 {
+		t.Errorf("Expected different random filenames")
+	}
+}
+
+func TestNewPasteID(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+
+	tests := []struct {
+		name     string
+		length   int
+		digits   bool
+		alphabet string
+	}{
+		{"Default letters only", 8, false, letterRunes},
+		{"Longer with digits", 16, true, letterRunes + digitRunes},
+		{"Minimum length", minPasteIDLength, false, letterRunes},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.PasteIDLength = tt.length
+			config.PasteIDDigits = tt.digits
+
+			sawDigit := false
+			for i := 0; i < 200; i++ {
+				id := newPasteID()
+				if len(id) != tt.length {
+					t.Fatalf("Expected ID length %d, got %d (%s)", tt.length, len(id), id)
+				}
+				for _, c := range id {
+					if !strings.ContainsRune(tt.alphabet, c) {
+						t.Fatalf("Unexpected character %q in ID %s", c, id)
+					}
+					if strings.ContainsRune(digitRunes, c) {
+						sawDigit = true
+					}
+				}
+			}
+			if tt.digits && !sawDigit {
+				t.Errorf("Expected digits to appear in generated IDs")
+			}
+		})
+	}
+
+	t.Run("CreatePaste uses configured length", func(t *testing.T) {
+		config.PasteIDLength = 12
+		config.PasteIDDigits = true
+
+		pasteSvc := NewPasteService(setupTestDB(t))
+		paste, err := pasteSvc.CreatePaste("", "ID length test", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if len(paste.ID) != 12 {
+			t.Errorf("Expected 12 character paste ID, got %s", paste.ID)
+		}
+	})
+}
+
+func TestLanguages(t *testing.T) {
+	tests := []struct {
+		name      string
+		extension string
+	}{
+		{"python", ".py"},
+		{"javascript", ".js"},
+		{"go", ".go"},
+		{"markdown", ".md"},
+		{"bash", ".sh"},
+		{"yaml", ".yaml"},
+		{"text", ".txt"},
+		{"js", ".js"},       // alias
+		{"Python", ".py"},   // case-insensitive
+		{"klingon", ".txt"}, // unknown falls back to text
+	}
+
+	for _, tt := range tests {
+		if ext := extensionForLanguage(tt.name); ext != tt.extension {
+			t.Errorf("Expected %s to map to %s, got %s", tt.name, tt.extension, ext)
+		}
+	}
+
+	// Names and aliases must be unique so lookups are unambiguous
+	seen := map[string]string{}
+	for _, lang := range languages {
+		for _, name := range append([]string{lang.Name}, lang.Aliases...) {
+			if other, ok := seen[name]; ok {
+				t.Errorf("Name %q used by both %s and %s", name, other, lang.Name)
+			}
+			seen[name] = lang.Name
+		}
+	}
+
+	t.Run("Languages endpoint", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/languages", nil)
+		w := httptest.NewRecorder()
+		languagesHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", w.Code)
+		}
+
+		var resp []Language
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if len(resp) != len(languages) {
+			t.Errorf("Expected %d languages, got %d", len(languages), len(resp))
+		}
+		for _, lang := range resp {
+			if lang.Name == "python" && lang.Extension != ".py" {
+				t.Errorf("Expected python extension .py, got %s", lang.Extension)
+			}
+		}
+	})
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Shebang through env", "#!/usr/bin/env python3\nprint('hi')\n", "python"},
+		{"Shebang path", "#!/bin/bash\necho hi\n", "bash"},
+		{"JSON object", `{"name": "pb", "tags": [1, 2]}`, "json"},
+		{"Go source", "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(1)\n}\n", "go"},
+		{"Prose", "just some notes", "text"},
+		{"Unknown interpreter", "#!/usr/bin/env klingon\n", "text"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectLanguage(tt.content); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPublicConfigEndpoint(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+
+	config = testConfig()
+	config.MaxPasteSize = 12345
+	config.SessionSecret = "do-not-leak-session"
+	config.EncryptionKey = "do-not-leak-key"
+	config.DatabasePath = "/var/lib/pb/do-not-leak.db"
+
+	req := httptest.NewRequest("GET", "/api/config", nil)
+	w := httptest.NewRecorder()
+	configHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	var resp map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp["max_paste_size"] != float64(12345) {
+		t.Errorf("Expected max_paste_size 12345, got %v", resp["max_paste_size"])
+	}
+	if langs, _ := resp["languages"].([]interface{}); len(langs) != len(languages) {
+		t.Errorf("Expected %d languages, got %v", len(languages), resp["languages"])
+	}
+
+	for _, key := range []string{"session_secret", "encryption_key", "database_path"} {
+		if _, ok := resp[key]; ok {
+			t.Errorf("Expected %s to be left out", key)
+		}
+	}
+	if strings.Contains(body, "do-not-leak") {
+		t.Errorf("Response leaks a secret: %s", body)
+	}
+}
+
+func TestLanguageForFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		language string
+		title    string
+	}{
+		{"script.py", "python", "script.py"},
+		{"README.md", "markdown", "readme.md"},
+		{"notes", "text", "notes"},
+		{"archive.unknown", "text", "archive.unknown"},
+		{"config.YML", "yaml", "config.yml"},
+		{"Dockerfile", "dockerfile", "dockerfile"},
+		{"/home/me/My Script (1).sh", "bash", "my-script-1.sh"},
+		{`C:\Users\me\main.go`, "go", "main.go"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			if got := languageForFilename(tt.filename); got != tt.language {
+				t.Errorf("Expected language %s, got %s", tt.language, got)
+			}
+			if got := filenameTitle(tt.filename); got != tt.title {
+				t.Errorf("Expected title %q, got %q", tt.title, got)
+			}
+		})
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	config = testConfig()
+	defer func() { config = testConfig() }()
+
+	tests := []struct {
+		name     string
+		template string
+		title    string
+		want     string
+	}{
+		{"Default", "{id}{ext}", "Deploy script", "AbCd.py"},
+		{"Title and ID", "{title}-{id}{ext}", "Deploy Script (v2)", "deploy-script-v2-AbCd.py"},
+		{"Title and ID, untitled", "{title}-{id}{ext}", "", "AbCd.py"},
+		{"ID then title, untitled", "{id}_{title}{ext}", "", "AbCd.py"},
+		{"Title only", "{title}{ext}", "notes", "notes.py"},
+		{"Title only, untitled", "{title}{ext}", "", "AbCd.py"},
+		{"Header injection", "{title}{ext}", "a\"\r\nSet-Cookie: x=1", "a-set-cookie-x-1.py"},
+		{"Path in title", "{title}{ext}", "../../etc/passwd", "etc-passwd.py"},
+		{"Long title", "{title}{ext}", strings.Repeat("a", 100), strings.Repeat("a", maxDownloadTitleLength) + ".py"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.DownloadFilename = tt.template
+			paste := &Paste{ID: "AbCd", Title: tt.title}
+			if got := downloadFilename(paste, "python"); got != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	oldVersion, oldCommit := version, commit
+	defer func() { version, commit = oldVersion, oldCommit }()
+	version, commit = "v9.9.9-test", "abc1234"
+	db = setupTestDB(t)
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+	healthHandler(w, req)
+
+	var resp map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if resp["status"] != "ok" {
+		t.Errorf("Expected status ok, got %v", resp["status"])
+	}
+	if resp["version"] != "v9.9.9-test" {
+		t.Errorf("Expected injected version, got %v", resp["version"])
+	}
+	if resp["commit"] != "abc1234" {
+		t.Errorf("Expected injected commit, got %v", resp["commit"])
+	}
+	if resp["go_version"] == "" || resp["uptime_seconds"] == nil {
+		t.Errorf("Expected go_version and uptime_seconds, got %v", resp)
+	}
+	if _, ok := resp["cleanup_backlog"]; ok {
+		t.Error("Expected no backlog counts for unauthenticated callers")
+	}
+
+	t.Run("Unreachable database", func(t *testing.T) {
+		sqlDB, _ := db.DB()
+		sqlDB.Close()
+
+		w := httptest.NewRecorder()
+		healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", w.Code)
+		}
+	})
+}
+
+func TestCleanupBacklog(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	adminService = NewAdminService(testDB)
+	maintenanceService = NewMaintenanceService(testDB)
+	config = testConfig()
+
+	admin, _ := authService.Register("backlogadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+	user, _ := authService.Register("backloguser", "password123")
+	past := time.Now().Add(-time.Hour)
+	expiresIn := 60
+
+	// Two expired pastes, one live one and one that never expires
+	for i := 0; i < 3; i++ {
+		paste, _ := pasteService.CreatePaste("", fmt.Sprintf("content %d", i), "text", false, false, &expiresIn, &user.ID)
+		if i < 2 {
+			testDB.Model(paste).UpdateColumn("expires_at", past)
+		}
+	}
+	pasteService.CreatePaste("", "forever", "text", false, false, nil, &user.ID)
+
+	// One paste deleted long enough ago to be purged, one deleted just now
+	for i, deletedAt := range []time.Time{time.Now().AddDate(0, 0, -config.PurgeDeletedAfterDays-1), time.Now()} {
+		paste, _ := pasteService.CreatePaste("", fmt.Sprintf("deleted %d", i), "text", false, false, nil, &user.ID)
+		testDB.Model(paste).UpdateColumn("deleted_at", deletedAt)
+	}
+
+	expired, _ := authService.CreateSession(user.ID)
+	testDB.Model(expired).UpdateColumn("expires_at", past)
+	authService.CreateSession(user.ID)
+
+	days := 1
+	key, _ := apikeyService.CreateAPIKey(user.ID, "old", &days)
+	testDB.Model(key).UpdateColumn("expires_at", past)
+	apikeyService.CreateAPIKey(user.ID, "forever", nil)
+
+	req := httptest.NewRequest("GET", "/api/admin/cleanup", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: adminSession.ID})
+	w := httptest.NewRecorder()
+	adminCleanupHandler(w, req)
+
+	var resp CleanupBacklog
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := CleanupBacklog{ExpiredPastes: 2, ExpiredSessions: 1, ExpiredAPIKeys: 1, DeletedPastes: 1}
+	if resp != want {
+		t.Errorf("Expected backlog %+v, got %+v", want, resp)
+	}
+
+	t.Run("Admins only", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		adminCleanupHandler(w, httptest.NewRequest("GET", "/api/admin/cleanup", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Expected 403, got %d", w.Code)
+		}
+	})
+
+	// The cleanups clear the backlog
+	pasteService.CleanupExpiredPastes()
+	pasteService.PurgeDeletedPastes(time.Duration(config.PurgeDeletedAfterDays) * 24 * time.Hour)
+	authService.CleanupExpiredSessions()
+	apikeyService.CleanupExpiredAPIKeys()
+	backlog, err := maintenanceService.CleanupBacklog()
+	if err != nil {
+		t.Fatalf("Failed to count backlog: %v", err)
+	}
+	if *backlog != (CleanupBacklog{}) {
+		t.Errorf("Expected an empty backlog after cleanup, got %+v", *backlog)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+
+	now := time.Now()
+	apiRateLimiter = newRateLimiter(3, time.Minute)
+	apiRateLimiter.now = func() time.Time { return now }
+	defer func() { apiRateLimiter = nil }()
+
+	handler := rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Remaining decrements across requests", func(t *testing.T) {
+		for i, expected := range []string{"2", "1", "0"} {
+			w := request("/api/me", "192.0.2.10:1000")
+			if w.Code != http.StatusOK {
+				t.Fatalf("Request %d: expected 200, got %d", i+1, w.Code)
+			}
+			if w.Header().Get("X-RateLimit-Limit") != "3" {
+				t.Errorf("Expected limit header 3, got %s", w.Header().Get("X-RateLimit-Limit"))
+			}
+			if got := w.Header().Get("X-RateLimit-Remaining"); got != expected {
+				t.Errorf("Request %d: expected remaining %s, got %s", i+1, expected, got)
+			}
+			if w.Header().Get("X-RateLimit-Reset") != fmt.Sprint(now.Add(time.Minute).Unix()) {
+				t.Errorf("Expected reset at end of window, got %s", w.Header().Get("X-RateLimit-Reset"))
+			}
+		}
+
+		w := request("/api/me", "192.0.2.10:1000")
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected 429 once quota is used up, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected Retry-After header on 429")
+		}
+	})
+
+	t.Run("Callers have separate buckets", func(t *testing.T) {
+		w := request("/api/me", "192.0.2.11:1000")
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != "2" {
+			t.Errorf("Expected fresh bucket for another caller, got remaining %s", got)
+		}
+	})
 
-func TestRandFilename(t *testing.T) {
-	filename1 := randfilename(8, ".txt")
-	filename2 := randfilename(8, ".txt")
+	t.Run("Non-API pages are not limited", func(t *testing.T) {
+		w := request("/all", "192.0.2.10:1000")
+		if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Errorf("Expected page request to bypass the rate limiter")
+		}
+	})
 
-	if len(filename1) != 12 { // 8 chars + .txt
-		t.Errorf("Expected filename length 12, got %d", len(filename1))
-	}
+	t.Run("Quota resets after the window", func(t *testing.T) {
+		now = now.Add(time.Minute + time.Second)
 
-	if filename1 == filename2 {
-		t.Errorf("Expected different random filenames")
-	}
+		w := request("/api/me", "192.0.2.10:1000")
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected 200 after window reset, got %d", w.Code)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != "2" {
+			t.Errorf("Expected remaining 2 after reset, got %s", got)
+		}
+	})
 }
 
 func TestHTTPHandlers(t *testing.T) {
@@ -437,12 +2418,8 @@ func TestHTTPHandlers(t *testing.T) {
 	db = testDB
 	authService = NewAuthService(testDB)
 	pasteService = NewPasteService(testDB)
-	config = Config{
-		Bind:         "0.0.0.0:3001",
-		ServePath:    "/p/",
-		DatabasePath: ":memory:",
-		Debug:        false,
-	}
+	adminService = NewAdminService(testDB)
+	config = testConfig()
 
 	t.Run("Register endpoint", func(t *testing.T) {
 		reqBody := RegisterRequest{
@@ -495,7 +2472,7 @@ func TestHTTPHandlers(t *testing.T) {
 		reqBody := UploadRequest{
 			Content:   "Test paste content",
 			Language:  "python",
-			IsPrivate: false,
+			IsPrivate: boolPtr(false),
 		}
 		body, _ := json.Marshal(reqBody)
 		req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body))
@@ -572,8 +2549,616 @@ func TestHTTPHandlers(t *testing.T) {
 	})
 }
 
+func TestBranding(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	adminService = NewAdminService(testDB)
+
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.SiteName = "Acme Paste"
+	config.FooterHTML = `Hosted by <a href="https://acme.example" onclick="x()">Acme</a> &copy; 2026`
+
+	t.Run("Site name and footer appear in rendered page", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/all", nil)
+		w := httptest.NewRecorder()
+		allPastesHandler(w, req)
+
+		body := w.Body.String()
+		if !strings.Contains(body, "<title>Browse Public Pastes - Acme Paste</title>") {
+			t.Errorf("Expected configured site name in page title")
+		}
+		if !strings.Contains(body, `Hosted by <a href="https://acme.example">Acme</a> © 2026`) {
+			t.Errorf("Expected sanitized footer in page, got:\n%s", body)
+		}
+	})
+
+	t.Run("404 page is branded", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		notfoundHandler(w)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "Acme Paste") {
+			t.Errorf("Expected branded 404 page, got %d", w.Code)
+		}
+	})
+
+	t.Run("Footer sanitization", func(t *testing.T) {
+		tests := []struct {
+			in       string
+			expected string
+		}{
+			{`<b>bold</b> <em>it</em><br/>`, `<b>bold</b> <em>it</em><br>`},
+			{`<script>alert(1)</script>`, `&lt;script&gt;alert(1)&lt;/script&gt;`},
+			{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+			{`<a href='//evil.example'>x</a>`, `<a>x</a>`},
+			{`<a href="/about">about</a>`, `<a href="/about">about</a>`},
+			{`<img src=x onerror=alert(1)>`, `&lt;img src=x onerror=alert(1)&gt;`},
+			{`<span style="color:red">red</span>`, `<span>red</span>`},
+			{`1 < 2 & "quotes"`, `1 &lt; 2 &amp; &#34;quotes&#34;`},
+		}
+		for _, tt := range tests {
+			if got := string(sanitizeFooterHTML(tt.in)); got != tt.expected {
+				t.Errorf("sanitizeFooterHTML(%q) = %q, expected %q", tt.in, got, tt.expected)
+			}
+		}
+	})
+}
+
+func TestTemplateDirOverride(t *testing.T) {
+	oldConfig, oldFS := config, templateFS
+	defer func() { config, templateFS = oldConfig, oldFS }()
+	config = testConfig()
+	config.FooterHTML = "Footer from the embedded partial"
+
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/partials", 0o755)
+	os.MkdirAll(dir+"/static", 0o755)
+	os.WriteFile(dir+"/404.html", []byte(`<h1>Custom missing page</h1>{{ template "extra" . }}{{ template "footer" . }}`), 0o644)
+	os.WriteFile(dir+"/partials/extra.html", []byte(`{{ define "extra" }}<p>Extra partial</p>{{ end }}`), 0o644)
+	os.WriteFile(dir+"/static/style.css", []byte("body { color: red; }"), 0o644)
+
+	render404 := func() string {
+		w := httptest.NewRecorder()
+		notfoundHandler(w)
+		return w.Body.String()
+	}
+
+	t.Run("Embedded templates by default", func(t *testing.T) {
+		templateFS = newTemplateFS("")
+		if body := render404(); !strings.Contains(body, "404 - Not Found") {
+			t.Errorf("Expected embedded 404 page, got: %s", body)
+		}
+	})
+
+	templateFS = newTemplateFS(dir)
+
+	t.Run("Override file is used when present", func(t *testing.T) {
+		body := render404()
+		if !strings.Contains(body, "Custom missing page") || strings.Contains(body, "404 - Not Found") {
+			t.Errorf("Expected overridden 404 page, got: %s", body)
+		}
+		// New and embedded partials are both available
+		if !strings.Contains(body, "Extra partial") || !strings.Contains(body, "Footer from the embedded partial") {
+			t.Errorf("Expected override and embedded partials, got: %s", body)
+		}
+	})
+
+	t.Run("Embedded files fill the gaps", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		renderTemplate(w, http.StatusOK, "index.html", struct {
+			TemplateData
+			*indexSnapshot
+		}{TemplateData{Branding: siteBranding()}, &indexSnapshot{}})
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected embedded index page to render, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if _, err := fs.ReadFile(templateFS, "static/script.js"); err != nil {
+			t.Errorf("Expected embedded static file through overlay: %v", err)
+		}
+		if data, err := fs.ReadFile(templateFS, "static/style.css"); err != nil || !strings.Contains(string(data), "color: red") {
+			t.Errorf("Expected override static file, got %q (%v)", data, err)
+		}
+	})
+}
+
+func TestNotFoundTemplateFallback(t *testing.T) {
+	oldFS := templateFS
+	defer func() { templateFS = oldFS }()
+
+	dir := t.TempDir()
+	os.WriteFile(dir+"/404.html", []byte(`<h1>{{ .SiteName </h1>`), 0o644)
+	templateFS = newTemplateFS(dir)
+
+	w := httptest.NewRecorder()
+	notfoundHandler(w)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 with a broken template, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "404 page not found") {
+		t.Errorf("Expected plain-text fallback, got: %s", body)
+	}
+}
+
+func TestBaseTemplateData(t *testing.T) {
+	testDB := setupTestDB(t)
+	db = testDB
+	authService = NewAuthService(testDB)
+	pasteService = NewPasteService(testDB)
+	apikeyService = NewAPIKeyService(testDB)
+	adminService = NewAdminService(testDB)
+
+	admin, _ := authService.Register("siteadmin", "password123")
+	adminService.MakeAdmin(0, admin.ID)
+	adminSession, _ := authService.CreateSession(admin.ID)
+
+	regular, _ := authService.Register("regular", "password123")
+	regularSession, _ := authService.CreateSession(regular.ID)
+
+	requestAs := func(session *Session) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		if session != nil {
+			req.AddCookie(&http.Cookie{Name: "session", Value: session.ID})
+		}
+		return req
+	}
+
+	t.Run("Admin", func(t *testing.T) {
+		data := baseTemplateData(requestAs(adminSession))
+		if !data.IsAdmin || !data.LoggedIn || data.Username != "siteadmin" {
+			t.Errorf("Expected logged-in admin context, got %+v", data)
+		}
+		if data.SiteName != config.SiteName {
+			t.Errorf("Expected branding in context, got %q", data.SiteName)
+		}
+	})
+
+	t.Run("Regular user", func(t *testing.T) {
+		data := baseTemplateData(requestAs(regularSession))
+		if data.IsAdmin || !data.LoggedIn || data.Username != "regular" {
+			t.Errorf("Expected logged-in non-admin context, got %+v", data)
+		}
+	})
+
+	t.Run("Anonymous", func(t *testing.T) {
+		data := baseTemplateData(requestAs(nil))
+		if data.IsAdmin || data.LoggedIn || data.Username != "" {
+			t.Errorf("Expected anonymous context, got %+v", data)
+		}
+	})
+
+	t.Run("Admin link rendered for admins only", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		allPastesHandler(w, requestAs(adminSession))
+		if !strings.Contains(w.Body.String(), `href="/admin"`) {
+			t.Errorf("Expected admin link for admin")
+		}
+
+		w = httptest.NewRecorder()
+		allPastesHandler(w, requestAs(regularSession))
+		if strings.Contains(w.Body.String(), `href="/admin"`) {
+			t.Errorf("Expected no admin link for regular user")
+		}
+	})
+}
+
+func TestSecurityHeadersMiddleware(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = defaultConfig()
+	config.ContentSecurityPolicy = "default-src 'self'"
+
+	handler := securityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	t.Run("Normal response", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/all", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		expected := map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "DENY",
+			"Referrer-Policy":         "strict-origin-when-cross-origin",
+			"Content-Security-Policy": "default-src 'self'",
+		}
+		for header, value := range expected {
+			if got := w.Header().Get(header); got != value {
+				t.Errorf("Expected %s to be '%s', got '%s'", header, value, got)
+			}
+		}
+
+		// Plain HTTP requests never get HSTS
+		if w.Header().Get("Strict-Transport-Security") != "" {
+			t.Errorf("Expected no HSTS header on plain HTTP request")
+		}
+	})
+
+	t.Run("HSTS on secure request", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/all", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Header().Get("Strict-Transport-Security") == "" {
+			t.Errorf("Expected HSTS header on secure request")
+		}
+	})
+
+	t.Run("HSTS disabled", func(t *testing.T) {
+		config.HSTS = false
+		defer func() { config.HSTS = true }()
+
+		req := httptest.NewRequest("GET", "/all", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Header().Get("Strict-Transport-Security") != "" {
+			t.Errorf("Expected no HSTS header when disabled")
+		}
+	})
+}
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Second, "less than a minute"},
+		{time.Minute, "1 minute"},
+		{45 * time.Minute, "45 minutes"},
+		{59*time.Minute + 50*time.Second, "1 hour"},
+		{time.Hour + 10*time.Minute, "1 hour"},
+		{47 * time.Hour, "47 hours"},
+		{72*time.Hour - time.Second, "3 days"},
+		{72*time.Hour + time.Minute, "3 days"},
+	}
+
+	for _, tt := range tests {
+		if got := humanDuration(tt.d); got != tt.want {
+			t.Errorf("humanDuration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+	config.MaxHeaderBytes = 4096
+	config.IdleTimeout = 30
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	})
+
+	server := newServer(handler)
+	if server.MaxHeaderBytes != 4096 {
+		t.Errorf("Expected MaxHeaderBytes 4096, got %d", server.MaxHeaderBytes)
+	}
+	if server.IdleTimeout != 30*time.Second {
+		t.Errorf("Expected IdleTimeout 30s, got %v", server.IdleTimeout)
+	}
+
+	// serve starts a server built from the current config and makes one request
+	serve := func(t *testing.T) *http.Response {
+		srv := httptest.NewUnstartedServer(handler)
+		srv.Config = newServer(handler)
+		srv.Start()
+		defer srv.Close()
+
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	t.Run("Keep-alives on by default", func(t *testing.T) {
+		if resp := serve(t); resp.Close {
+			t.Error("Expected the connection to be kept alive")
+		}
+	})
+
+	t.Run("Keep-alives disabled", func(t *testing.T) {
+		config.DisableKeepAlives = true
+		defer func() { config.DisableKeepAlives = false }()
+		if resp := serve(t); !resp.Close {
+			t.Error("Expected the server to close the connection")
+		}
+	})
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	handler := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("something broke")
+	}))
+
+	req := httptest.NewRequest("GET", "/all", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Expected HTML error page, got Content-Type '%s'", ct)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, "500 - Internal Server Error") {
+		t.Errorf("Expected 500 template in body, got: %s", body)
+	}
+	if !strings.Contains(body, "request ID <code>") {
+		t.Errorf("Expected request ID in body, got: %s", body)
+	}
+	if strings.Contains(body, "something broke") {
+		t.Errorf("Expected panic value not to leak into the response")
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r)
+	}))
+
+	t.Run("Generated when missing", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		id := w.Header().Get("X-Request-ID")
+		if id == "" {
+			t.Fatal("Expected X-Request-ID response header")
+		}
+		if seen != id {
+			t.Errorf("Expected handler to see request ID '%s', got '%s'", id, seen)
+		}
+	})
+
+	t.Run("Incoming ID preserved", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "proxy-1234.abc")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("X-Request-ID"); got != "proxy-1234.abc" {
+			t.Errorf("Expected incoming request ID to be echoed, got '%s'", got)
+		}
+		if seen != "proxy-1234.abc" {
+			t.Errorf("Expected handler to see incoming request ID, got '%s'", seen)
+		}
+	})
+
+	t.Run("Unsafe incoming ID replaced", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "bad id\nforged log line")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if got := w.Header().Get("X-Request-ID"); got == "" || strings.Contains(got, " ") {
+			t.Errorf("Expected a generated request ID, got '%s'", got)
+		}
+	})
+
+	t.Run("Shown on error page", func(t *testing.T) {
+		panicking := requestIDMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("boom")
+		})))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Request-ID", "trace-42")
+		w := httptest.NewRecorder()
+		panicking.ServeHTTP(w, req)
+
+		if !strings.Contains(w.Body.String(), "trace-42") {
+			t.Errorf("Expected error page to show the request ID, got: %s", w.Body.String())
+		}
+	})
+}
+
 func TestMain(m *testing.M) {
 	// Run tests
 	code := m.Run()
 	os.Exit(code)
 }
+
+// discardResponseWriter drops the body like a network connection would,
+// so benchmarks only count the handler's own allocations. It implements
+// io.StringWriter like net/http's response does.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) WriteHeader(int)             {}
+func (d *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d *discardResponseWriter) WriteString(s string) (int, error) {
+	return len(s), nil
+}
+
+func BenchmarkWriteRawContent(b *testing.B) {
+	content := strings.Repeat("0123456789abcdef\n", 1<<16) // about 1MB
+
+	b.Run("Fprint", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := &discardResponseWriter{header: http.Header{}}
+			w.Header().Set("Content-Type", rawContentType)
+			fmt.Fprint(w, content)
+		}
+	})
+
+	b.Run("writeRawContent", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeRawContent(&discardResponseWriter{header: http.Header{}}, content, "inline")
+		}
+	})
+}
+
+func TestPasteService_ConcurrentDedup(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config = testConfig()
+
+	// A file database, since every connection to :memory: is a separate one
+	testDB, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "race.db")+"?_busy_timeout=5000&_journal_mode=WAL"), &gorm.Config{})
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	if err := testDB.AutoMigrate(&User{}, &Paste{}, &PasteContent{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	pasteSvc := NewPasteService(testDB)
+
+	const uploads = 10
+
+	// Hold every upload back after its dedup lookup until all of them have
+	// missed it, so they really do race to insert
+	var arrived sync.WaitGroup
+	var waiting atomic.Int32
+	arrived.Add(uploads)
+	testDB.Callback().Create().Before("gorm:begin_transaction").Register("test:race", func(tx *gorm.DB) {
+		if tx.Statement.Table == "pastes" && waiting.Add(1) <= uploads {
+			arrived.Done()
+			arrived.Wait()
+		}
+	})
+
+	ids := make([]string, uploads)
+	var wg sync.WaitGroup
+	for i := range uploads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			paste, err := pasteSvc.CreatePaste("", "raced content", "text", false, false, nil, nil)
+			if err != nil {
+				t.Errorf("Failed to create paste: %v", err)
+				return
+			}
+			ids[i] = paste.ID
+		}()
+	}
+	wg.Wait()
+
+	var count int64
+	testDB.Model(&Paste{}).Count(&count)
+	if count != 1 {
+		t.Errorf("Expected exactly one paste, got %d", count)
+	}
+	for _, id := range ids {
+		if id != ids[0] {
+			t.Errorf("Expected every upload to get %s, got %s", ids[0], id)
+		}
+	}
+
+	t.Run("Deleted paste gives up its key", func(t *testing.T) {
+		testDB.Where("id = ?", ids[0]).Delete(&Paste{})
+		paste, err := pasteSvc.CreatePaste("", "raced content", "text", false, false, nil, nil)
+		if err != nil {
+			t.Fatalf("Failed to recreate paste: %v", err)
+		}
+		if paste.ID == ids[0] {
+			t.Error("Expected a new paste after deleting the old one")
+		}
+	})
+
+	t.Run("Edited paste still dedups", func(t *testing.T) {
+		user, _ := NewAuthService(testDB).Register("editor", "password123")
+		original, _ := pasteSvc.CreatePaste("", "first draft", "text", false, false, nil, &user.ID)
+		pasteSvc.UpdatePaste(original.ID, "", "final draft", "text", false, user.ID)
+
+		again, err := pasteSvc.CreatePaste("", "final draft", "text", false, false, nil, &user.ID)
+		if err != nil {
+			t.Fatalf("Failed to create paste: %v", err)
+		}
+		if again.ID != original.ID {
+			t.Error("Expected upload matching the edited paste to return it")
+		}
+		if _, err := pasteSvc.CreatePaste("", "first draft", "text", false, false, nil, &user.ID); err != nil {
+			t.Errorf("Expected the pre-edit content to be uploadable: %v", err)
+		}
+	})
+}
+
+func TestLanguageAliasFiltering(t *testing.T) {
+	testDB := setupTestDB(t)
+	service := NewPasteService(testDB)
+	config = testConfig()
+
+	userID := uint(1)
+	stored, err := service.CreatePaste("", "console.log(1)", "JS", false, false, nil, &userID)
+	if err != nil {
+		t.Fatalf("Failed to create paste: %v", err)
+	}
+	if stored.Language != "javascript" {
+		t.Errorf("Expected the alias to be stored as javascript, got %s", stored.Language)
+	}
+
+	// A paste saved before names were canonicalized
+	legacy, _ := service.CreatePaste("", "console.log(2)", "javascript", false, false, nil, &userID)
+	testDB.Model(legacy).UpdateColumn("language", "js")
+
+	service.CreatePaste("", "print(1)", "python", false, false, nil, &userID)
+	custom, _ := service.CreatePaste("", "x", "brainfuck", false, false, nil, &userID)
+	if custom.Language != "brainfuck" {
+		t.Errorf("Expected an unknown language to be kept, got %s", custom.Language)
+	}
+
+	for _, filter := range []string{"js", "javascript", "Node"} {
+		t.Run(filter, func(t *testing.T) {
+			pastes, total, err := service.GetUserPastesByLanguage(userID, filter, 10, 0)
+			if err != nil {
+				t.Fatalf("Failed to list pastes: %v", err)
+			}
+			if total != 2 || len(pastes) != 2 {
+				t.Errorf("Expected both javascript pastes, got %d of %d", len(pastes), total)
+			}
+		})
+	}
+
+	t.Run("No filter", func(t *testing.T) {
+		if _, total, _ := service.GetUserPastesByLanguage(userID, "", 10, 0); total != 4 {
+			t.Errorf("Expected all 4 pastes, got %d", total)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		pastes, total, err := service.SearchUserPastesPage(userID, "console", SearchOptions{Language: "js"})
+		if err != nil {
+			t.Fatalf("Search failed: %v", err)
+		}
+		if total != 2 || len(pastes) != 2 {
+			t.Errorf("Expected 2 javascript matches, got %d", total)
+		}
+		if _, total, _ := service.SearchUserPastesPage(userID, "console", SearchOptions{Language: "py"}); total != 0 {
+			t.Errorf("Expected no python matches, got %d", total)
+		}
+	})
+
+	t.Run("Edits are canonicalized", func(t *testing.T) {
+		updated, err := service.UpdatePaste(custom.ID, "", "x", "py", false, userID)
+		if err != nil {
+			t.Fatalf("Failed to update paste: %v", err)
+		}
+		if updated.Language != "python" {
+			t.Errorf("Expected python after the edit, got %s", updated.Language)
+		}
+	})
+}
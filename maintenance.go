@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// MaintenanceService runs consistency checks across tables that the
+// database itself doesn't enforce (SQLite foreign keys are off).
+type MaintenanceService struct {
+	db *gorm.DB
+}
+
+func NewMaintenanceService(database *gorm.DB) *MaintenanceService {
+	return &MaintenanceService{db: database}
+}
+
+// IntegrityIssue counts one kind of problem, and how many were repaired.
+type IntegrityIssue struct {
+	Found int64 `json:"found"`
+	Fixed int64 `json:"fixed"`
+}
+
+// IntegrityReport summarizes a CheckIntegrity run.
+type IntegrityReport struct {
+	MissingHashes    IntegrityIssue `json:"missing_hashes"`
+	OrphanedSessions IntegrityIssue `json:"orphaned_sessions"`
+	OrphanedAPIKeys  IntegrityIssue `json:"orphaned_api_keys"`
+	OrphanedAdmins   IntegrityIssue `json:"orphaned_admins"`
+	Fixed            bool           `json:"fixed"`
+}
+
+// CleanupBacklog counts rows that are past their expiry but not yet removed.
+// It should stay near zero; growth means the hourly cleanup isn't keeping up.
+type CleanupBacklog struct {
+	ExpiredPastes   int64 `json:"expired_pastes"`
+	ExpiredSessions int64 `json:"expired_sessions"`
+	ExpiredAPIKeys  int64 `json:"expired_api_keys"`
+	DeletedPastes   int64 `json:"deleted_pastes"` // past purge_deleted_after_days, not yet purged
+}
+
+// CleanupBacklog reports what the next cleanup run would remove.
+func (s *MaintenanceService) CleanupBacklog() (*CleanupBacklog, error) {
+	var backlog CleanupBacklog
+	now := time.Now()
+	if err := s.db.Model(&Paste{}).Where("expires_at IS NOT NULL AND expires_at < ?", now).Count(&backlog.ExpiredPastes).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&Session{}).Where("expires_at < ?", now).Count(&backlog.ExpiredSessions).Error; err != nil {
+		return nil, err
+	}
+	if err := s.db.Model(&APIKey{}).Where("expires_at IS NOT NULL AND expires_at < ?", now).Count(&backlog.ExpiredAPIKeys).Error; err != nil {
+		return nil, err
+	}
+	purgeBefore := now.Add(-time.Duration(config.PurgeDeletedAfterDays) * 24 * time.Hour)
+	if err := s.db.Unscoped().Model(&Paste{}).Where("deleted_at IS NOT NULL AND deleted_at < ?", purgeBefore).Count(&backlog.DeletedPastes).Error; err != nil {
+		return nil, err
+	}
+	return &backlog, nil
+}
+
+// Rows whose user_id no longer refers to a user
+const orphanCondition = "user_id NOT IN (SELECT id FROM users)"
+
+// CheckIntegrity looks for pastes without a content hash and for sessions,
+// API keys and admin grants left behind by deleted users. With fix set it
+// recomputes the hashes and deletes the orphans.
+func (s *MaintenanceService) CheckIntegrity(fix bool) (*IntegrityReport, error) {
+	report := &IntegrityReport{Fixed: fix}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := s.checkHashes(tx, fix, &report.MissingHashes); err != nil {
+			return err
+		}
+		if err := checkOrphans(tx, &Session{}, fix, &report.OrphanedSessions); err != nil {
+			return err
+		}
+		if err := checkOrphans(tx, &APIKey{}, fix, &report.OrphanedAPIKeys); err != nil {
+			return err
+		}
+		return checkOrphans(tx, &Admin{}, fix, &report.OrphanedAdmins)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (s *MaintenanceService) checkHashes(tx *gorm.DB, fix bool, issue *IntegrityIssue) error {
+	var pastes []Paste
+	if err := tx.Where("content_hash IS NULL OR content_hash = ''").Find(&pastes).Error; err != nil {
+		return err
+	}
+	issue.Found = int64(len(pastes))
+	if !fix {
+		return nil
+	}
+
+	for _, paste := range pastes {
+		hash, err := computeFileHash(bytes.NewReader([]byte(paste.Content)))
+		if err != nil {
+			return err
+		}
+		// UpdateColumn leaves the stored (possibly encoded) content alone
+		if err := tx.Model(&Paste{}).Where("id = ?", paste.ID).UpdateColumn("content_hash", hash).Error; err != nil {
+			return err
+		}
+		issue.Fixed++
+	}
+	return nil
+}
+
+func checkOrphans(tx *gorm.DB, model interface{}, fix bool, issue *IntegrityIssue) error {
+	if err := tx.Model(model).Where(orphanCondition).Count(&issue.Found).Error; err != nil {
+		return err
+	}
+	if !fix || issue.Found == 0 {
+		return nil
+	}
+
+	result := tx.Where(orphanCondition).Delete(model)
+	if result.Error != nil {
+		return result.Error
+	}
+	issue.Fixed = result.RowsAffected
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error codes. Handlers report errors by code, sent to clients in the
+// X-Error-Code header and the version 2 error envelope, and the message
+// shown for each comes from defaultMessages unless the operator reworded it
+// under [messages] in the config, say to translate it.
+const (
+	msgMethodNotAllowed        = "method_not_allowed"
+	msgRegistrationRateLimited = "registration_rate_limited"
+	msgTermsRequired           = "terms_required"
+	msgUsernameLength          = "username_length"
+	msgUsernameNotAllowed      = "username_not_allowed"
+	msgUsernameExists          = "username_exists"
+	msgPasswordTooShort        = "password_too_short"
+	msgInvalidCredentials      = "invalid_credentials"
+	msgSessionFailed           = "session_failed"
+	msgUnauthorized            = "unauthorized"
+	msgLoginRequiredToUpload   = "login_required_to_upload"
+	msgLoginRequiredToImport   = "login_required_to_import"
+	msgLoginRequiredForPrivate = "login_required_for_private"
+	msgOriginMissing           = "origin_missing"
+	msgOriginNotAllowed        = "origin_not_allowed"
+	msgUploadsBlocked          = "uploads_blocked"
+	msgSourceURLDisabled       = "source_url_disabled"
+	msgImportDisabled          = "import_disabled"
+	msgIdempotencyKeyTooLong   = "idempotency_key_too_long"
+	msgPasteTooLarge           = "paste_too_large"
+	msgPasteReadFailed         = "paste_read_failed"
+	msgEmptyPaste              = "empty_paste"
+	msgInvalidUTF8             = "invalid_utf8"
+	msgBase64WithContent       = "base64_with_content"
+	msgBase64Invalid           = "base64_invalid"
+	msgBase64NotUTF8           = "base64_not_utf8"
+	msgSourceURLWithContent    = "source_url_with_content"
+	msgRequestFieldType        = "request_field_type"
+	msgRequestNotObject        = "request_not_object"
+	msgRequestSyntax           = "request_syntax"
+	msgRequestUnknownField     = "request_unknown_field"
+	msgRequestInvalidJSON      = "request_invalid_json"
+	msgRequestTrailingData     = "request_trailing_data"
+	msgExpiresInNegative       = "expires_in_negative"
+	msgExpiresInZero           = "expires_in_zero"
+	msgExpiresInTooLarge       = "expires_in_too_large"
+	msgSlidingExpiryDisabled   = "sliding_expiry_disabled"
+	msgSlidingExpiryNoExpiry   = "sliding_expiry_no_expiry"
+	msgMaxViewsTooLow          = "max_views_too_low"
+	msgUnlistInTooLow          = "unlist_in_too_low"
+	msgTitleTooLong            = "title_too_long"
+	msgTooManyLines            = "too_many_lines"
+	msgFormattedTooLarge       = "formatted_too_large"
+	msgInvalidJSON             = "invalid_json"
+	msgInvalidJSONAt           = "invalid_json_at"
+	msgInvalidGo               = "invalid_go"
+	msgQuotaExceeded           = "quota_exceeded"
+)
+
+// defaultMessages is the built-in wording for each error code. Some are fmt
+// formats: a replacement gets the same arguments, in the same order.
+var defaultMessages = map[string]string{
+	msgMethodNotAllowed:        "Method not allowed",
+	msgRegistrationRateLimited: "Too many registrations, try again later",
+	msgTermsRequired:           "You must accept the terms of service to register",
+	msgUsernameLength:          "username must be between 3 and 50 characters",
+	msgUsernameNotAllowed:      "username not allowed",
+	msgUsernameExists:          "username already exists",
+	msgPasswordTooShort:        "password must be at least 6 characters",
+	msgInvalidCredentials:      "invalid username or password",
+	msgSessionFailed:           "Failed to create session",
+	msgUnauthorized:            "Unauthorized",
+	msgLoginRequiredToUpload:   "Must be logged in to upload pastes",
+	msgLoginRequiredToImport:   "Must be logged in to import pastes",
+	msgLoginRequiredForPrivate: "Must be logged in to create private pastes",
+	msgOriginMissing:           "Forbidden: missing Origin header",
+	msgOriginNotAllowed:        "Forbidden: origin %s is not allowed",
+	msgUploadsBlocked:          "Uploads are temporarily disabled: server storage is full",
+	msgSourceURLDisabled:       "Uploading from source_url is disabled",
+	msgImportDisabled:          "Importing from URLs is disabled",
+	msgIdempotencyKeyTooLong:   "Idempotency-Key too long (max 255 characters)",
+	msgPasteTooLarge:           "Paste too large (max %s)",
+	msgPasteReadFailed:         "Error reading paste",
+	msgEmptyPaste:              "Empty paste",
+	msgInvalidUTF8:             "Invalid UTF-8 text",
+	msgBase64WithContent:       "content_base64 cannot be combined with content or source_url",
+	msgBase64Invalid:           "content_base64 is not valid base64",
+	msgBase64NotUTF8:           "content_base64 is not valid UTF-8 text",
+	msgSourceURLWithContent:    "content and source_url are mutually exclusive",
+	msgRequestFieldType:        "%s must be %s",
+	msgRequestNotObject:        "request body must be a JSON object",
+	msgRequestSyntax:           "invalid JSON at offset %d",
+	msgRequestUnknownField:     "unknown field %s",
+	msgRequestInvalidJSON:      "invalid JSON",
+	msgRequestTrailingData:     "request body must contain a single JSON object",
+	msgExpiresInNegative:       "expires_in cannot be negative",
+	msgExpiresInZero:           "expires_in must be positive; pastes that never expire have no expires_in",
+	msgExpiresInTooLarge:       "expires_in too large (max %d minutes)",
+	msgSlidingExpiryDisabled:   "sliding expiry is disabled",
+	msgSlidingExpiryNoExpiry:   "sliding expiry requires an expiry",
+	msgMaxViewsTooLow:          "max_views must be at least 1",
+	msgUnlistInTooLow:          "unlist_in must be at least 1 minute",
+	msgTitleTooLong:            "title too long (%d characters, max %d)",
+	msgTooManyLines:            "paste has too many lines (max %d)",
+	msgFormattedTooLarge:       "formatted paste too large (max %s)",
+	msgInvalidJSON:             "invalid JSON: %v",
+	msgInvalidJSONAt:           "invalid JSON at line %d, column %d: %v",
+	msgInvalidGo:               "invalid Go source: %v",
+	msgQuotaExceeded:           "storage quota exceeded (%s of %s used)",
+}
+
+// message returns the configured wording for code, filled in with args.
+func message(code string, args ...interface{}) string {
+	text, ok := config.Messages[code]
+	if !ok {
+		text = defaultMessages[code]
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// checkMessage makes sure a replacement for code's default message formats
+// the same arguments with the same verbs, in whatever order, so a typo in
+// [messages] fails at startup rather than garbling errors. %v fits any
+// argument.
+func checkMessage(code, text string) error {
+	want, err := messageVerbs(defaultMessages[code])
+	if err != nil {
+		return err
+	}
+	got, err := messageVerbs(text)
+	if err != nil {
+		return err
+	}
+	for arg, verb := range want {
+		if got[arg] == 0 {
+			return fmt.Errorf("argument %d (%%%c) is missing", arg, verb)
+		}
+		if got[arg] != verb && got[arg] != 'v' {
+			return fmt.Errorf("argument %d must be formatted with %%%c, not %%%c", arg, verb, got[arg])
+		}
+	}
+	for arg := range got {
+		if want[arg] == 0 {
+			return fmt.Errorf("there is no argument %d", arg)
+		}
+	}
+	return nil
+}
+
+// messageVerbs maps the 1-based arguments a format uses to the verb each is
+// formatted with, following explicit indexes such as %[2]s.
+func messageVerbs(format string) (map[int]byte, error) {
+	verbs := make(map[int]byte)
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i = skipFormatFlags(format, i+1)
+		if i < len(format) && format[i] == '%' {
+			continue
+		}
+		if i < len(format) && format[i] == '[' {
+			end := strings.IndexByte(format[i:], ']')
+			if end < 0 {
+				return nil, errors.New("unterminated argument index")
+			}
+			n, err := strconv.Atoi(format[i+1 : i+end])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("bad argument index %q", format[i:i+end+1])
+			}
+			arg = n
+			i = skipFormatFlags(format, i+end+1)
+		}
+		if i >= len(format) || !isASCIILetter(format[i]) {
+			return nil, errors.New("% without a verb")
+		}
+		if verbs[arg] != 0 && verbs[arg] != format[i] {
+			return nil, fmt.Errorf("argument %d is formatted as both %%%c and %%%c", arg, verbs[arg], format[i])
+		}
+		verbs[arg] = format[i]
+		arg++
+	}
+	return verbs, nil
+}
+
+// skipFormatFlags returns the index of the first byte at or after i that
+// isn't a flag, width or precision.
+func skipFormatFlags(format string, i int) int {
+	for i < len(format) && strings.IndexByte("+-# 0123456789.", format[i]) >= 0 {
+		i++
+	}
+	return i
+}
+
+func isASCIILetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// codedError is an error reported by code. Its text is looked up when it's
+// shown, so it follows the configured wording.
+type codedError struct {
+	code string
+	args []interface{}
+}
+
+func newCodedError(code string, args ...interface{}) error {
+	return &codedError{code: code, args: args}
+}
+
+func (e *codedError) Error() string {
+	return message(e.code, e.args...)
+}
+
+// errorCode returns the code err was reported with, or "" for errors that
+// don't have one yet.
+func errorCode(err error) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return ""
+}
+
+// httpError writes the message for code as a plain text error response.
+func httpError(w http.ResponseWriter, status int, code string, args ...interface{}) {
+	writeError(w, newCodedError(code, args...), status)
+}
+
+// writeError is http.Error for errors that may carry a code, which is sent
+// along in X-Error-Code.
+func writeError(w http.ResponseWriter, err error, status int) {
+	if code := errorCode(err); code != "" {
+		w.Header().Set("X-Error-Code", code)
+	}
+	http.Error(w, err.Error(), status)
+}
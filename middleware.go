@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// securityHeadersMiddleware sets hardening headers on every response.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := w.Header()
+		headers.Set("X-Content-Type-Options", "nosniff")
+
+		if config.FrameOptions != "" {
+			headers.Set("X-Frame-Options", config.FrameOptions)
+		}
+		if config.ReferrerPolicy != "" {
+			headers.Set("Referrer-Policy", config.ReferrerPolicy)
+		}
+		if config.ContentSecurityPolicy != "" {
+			headers.Set("Content-Security-Policy", config.ContentSecurityPolicy)
+		}
+
+		// HSTS is only meaningful over HTTPS, and browsers ignore it otherwise
+		if config.HSTS && isSecureRequest(r) {
+			headers.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", config.HSTSMaxAge))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isSecureRequest reports whether the request reached us (or the proxy in
+// front of us) over TLS.
+func isSecureRequest(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// parseTrustedProxy parses a trusted_proxies entry, either a CIDR or a
+// single address.
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if strings.Contains(proxy, "/") {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", proxy)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// fromTrustedProxy reports whether the directly connected client is one of
+// the trusted_proxies.
+func fromTrustedProxy(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range config.TrustedProxies {
+		if network, err := parseTrustedProxy(proxy); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedProxyUsername returns the user named in trusted_auth_header, or ""
+// when the header is unset or didn't come from a trusted proxy. Anyone can
+// send the header, so it only counts from a proxy that sets it itself.
+func trustedProxyUsername(r *http.Request) string {
+	if config.TrustedAuthHeader == "" || !fromTrustedProxy(r) {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get(config.TrustedAuthHeader))
+}
+
+// clientIP returns the address of the directly connected client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkUploadOrigin rejects cookie-authenticated uploads whose Origin (or,
+// failing that, Referer) isn't in AllowedUploadOrigins, as a guard against
+// cross-site form posts. Requests carrying an Authorization header can't be
+// forged cross-site and are exempt, as are anonymous requests.
+func checkUploadOrigin(r *http.Request) error {
+	if len(config.AllowedUploadOrigins) == 0 || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	if _, err := r.Cookie("session"); err != nil && trustedProxyUsername(r) == "" {
+		return nil
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if referer, err := url.Parse(r.Header.Get("Referer")); err == nil && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	if origin == "" {
+		return newCodedError(msgOriginMissing)
+	}
+
+	for _, allowed := range config.AllowedUploadOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return newCodedError(msgOriginNotAllowed, origin)
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// apiKeyUsageMiddleware logs requests made with a valid API key, sampled at
+// APIKeyUsageSampleRate, for the key's owner to review.
+func apiKeyUsageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r)
+		if key == "" || mathrand.Float64() >= config.APIKeyUsageSampleRate {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey, err := apikeyService.lookupAPIKey(key)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if err := apikeyService.RecordUsage(apiKey.ID, r.Method, r.URL.Path, rec.status); err != nil {
+			log.Printf("Failed to record usage of API key %d: %v", apiKey.ID, err)
+		}
+	})
+}
+
+// newRequestID returns a short random identifier for correlating a
+// response with the server logs.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// recoverMiddleware turns a panicking handler into a logged stack trace and
+// a 500 page instead of a dropped connection.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// The server aborts the response silently for this one, by design
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			requestID := requestIDFromContext(r)
+			if requestID == "" {
+				requestID = newRequestID()
+			}
+			log.Printf("[%s] panic serving %s %s: %v\n%s", requestID, r.Method, r.URL.Path, err, debug.Stack())
+			serverErrorHandler(w, requestID)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+type requestIDContextKey struct{}
+
+// Incoming IDs longer than this are replaced rather than trusted
+const maxRequestIDLength = 64
+
+// validRequestID reports whether an incoming X-Request-ID is safe to reuse
+// in logs and response headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the ID assigned by requestIDMiddleware, or ""
+// outside of it.
+func requestIDFromContext(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestIDMiddleware tags each request with an ID, reusing the
+// X-Request-ID set by a proxy in front of us when there is one, and echoes
+// it back in the response. With debug on, each request is logged with it.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", requestID)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, requestID))
+
+		if !config.Debug {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		log.Printf("[%s] %s %s %d %s", requestID, r.Method, r.URL.Path, rec.status, time.Since(start).Round(time.Millisecond))
+	})
+}
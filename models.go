@@ -7,27 +7,55 @@ import (
 )
 
 type User struct {
-	ID           uint      `gorm:"primaryKey"`
-	Username     string    `gorm:"uniqueIndex;not null"`
-	PasswordHash string    `gorm:"not null"`
-	CreatedAt    time.Time `gorm:"autoCreateTime"`
-	Pastes       []Paste   `gorm:"foreignKey:UserID"`
+	ID              uint       `gorm:"primaryKey"`
+	Username        string     `gorm:"uniqueIndex;not null"`
+	PasswordHash    string     `gorm:"not null"`
+	CreatedAt       time.Time  `gorm:"autoCreateTime"`
+	QuotaBytes      *int64     // storage quota override, nil = use the global default, 0 = unlimited
+	TermsAcceptedAt *time.Time // when the user accepted the terms of service at registration, nil if never asked
+	Pastes          []Paste    `gorm:"foreignKey:UserID"`
 }
 
 type Paste struct {
-	ID          string         `gorm:"primaryKey"`
-	Title       string         `gorm:"default:''"`
-	Content     string         `gorm:"not null"`
-	ContentHash string         `gorm:"index;not null"`
-	Language    string         `gorm:"default:'text'"`
-	IsPrivate   bool           `gorm:"default:false"`
-	Unlisted    bool           `gorm:"default:false;index"`
-	ExpiresAt   *time.Time     `gorm:"index"` // nil = never expires
-	UserID      *uint          `gorm:"index"`
-	User        *User          `gorm:"foreignKey:UserID"`
-	CreatedAt   time.Time      `gorm:"autoCreateTime"`
-	UpdatedAt   time.Time      `gorm:"autoUpdateTime"`
-	DeletedAt   gorm.DeletedAt `gorm:"index"`
+	ID            string         `gorm:"primaryKey"`
+	Seq           *uint          `gorm:"uniqueIndex"` // numeric alias, only assigned when sequential_ids is on
+	ShortCode     *string        `gorm:"uniqueIndex"` // /s/{code} alias for sharing by hand, only assigned to pastes listed at creation
+	Title         string         `gorm:"default:''"`
+	Content       string         `gorm:"not null"`
+	Compressed    bool           `gorm:"default:false" json:"-"`    // Content is stored gzipped
+	Encrypted     bool           `gorm:"default:false" json:"-"`    // Content is stored AES-GCM sealed
+	ContentHash   string         `gorm:"index;not null"`            // computed over the plaintext
+	DedupKey      *string        `gorm:"uniqueIndex" json:"-"`      // see dedupKey; nil for pastes that don't take part in deduplication
+	ClaimToken    *string        `gorm:"uniqueIndex" json:"-"`      // hash of the token that moves an anonymous paste into an account, nil once claimed
+	ContentRef    string         `gorm:"index;default:''" json:"-"` // PasteContent holding the content under global_dedup, empty when stored inline
+	Language      string         `gorm:"default:'text'"`
+	Views         int64          `gorm:"default:0"`
+	MaxViews      *int64         // views before the paste is gone for everyone but the owner, nil = unlimited
+	EditCount     uint           `gorm:"default:0"` // successful updates since creation
+	IsPrivate     bool           `gorm:"default:false"`
+	Unlisted      bool           `gorm:"default:false;index"`
+	ExpiresAt     *time.Time     `gorm:"index"`         // nil = never expires
+	UnlistAt      *time.Time     `gorm:"index"`         // drops off public listings from then on but stays reachable by link, nil = never
+	ExpiryMinutes int            `gorm:"default:0"`     // lifetime the paste was given, renewed by sliding expiry
+	SlidingExpiry bool           `gorm:"default:false"` // push ExpiresAt back by ExpiryMinutes on every view
+	UserID        *uint          `gorm:"index"`
+	User          *User          `gorm:"foreignKey:UserID"`
+	CreatedAt     time.Time      `gorm:"autoCreateTime"`
+	UpdatedAt     time.Time      `gorm:"autoUpdateTime"`
+	DeletedAt     gorm.DeletedAt `gorm:"index"`
+
+	plainContent string // Content while an encoded save is in flight
+	loadedRef    string // ContentRef as last read or written, to release it when it changes
+	claimToken   string // the raw claim token, only on the Paste an anonymous create returns
+}
+
+// PasteContent is content shared by every paste with the same text, when
+// global_dedup is on. Rows are dropped once no paste refers to them.
+type PasteContent struct {
+	Hash       string `gorm:"primaryKey"` // SHA-256 of the plaintext
+	Content    string `gorm:"not null"`
+	Compressed bool   `gorm:"default:false"`
+	Encrypted  bool   `gorm:"default:false"`
 }
 
 type Session struct {
@@ -49,9 +77,48 @@ type APIKey struct {
 	CreatedAt time.Time `gorm:"autoCreateTime"`
 }
 
+// APIKeyUsage records one request authenticated with an API key, so owners
+// can review what their keys have been doing.
+type APIKeyUsage struct {
+	ID        uint      `gorm:"primaryKey"`
+	APIKeyID  uint      `gorm:"not null;index"`
+	Method    string    `gorm:"not null"`
+	Path      string    `gorm:"not null"`
+	Status    int       `gorm:"not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`
+}
+
 type Admin struct {
 	ID        uint      `gorm:"primaryKey"`
 	UserID    uint      `gorm:"uniqueIndex;not null"`
 	User      User      `gorm:"foreignKey:UserID"`
 	CreatedAt time.Time `gorm:"autoCreateTime"`
 }
+
+// AuditLog records one action taken by an admin. Target names what it was
+// taken on, e.g. "user:5", and Detail carries anything else worth keeping,
+// such as the username of a deleted account.
+type AuditLog struct {
+	ID        uint      `gorm:"primaryKey"`
+	ActorID   uint      `gorm:"not null;index"` // admin who acted, 0 for changes made outside the web interface
+	Action    string    `gorm:"not null;index"`
+	Target    string    `gorm:"default:''"`
+	Detail    string    `gorm:"default:''"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`
+}
+
+// IdempotencyKey remembers which paste an upload with a given
+// Idempotency-Key header produced, so client retries don't create duplicates.
+type IdempotencyKey struct {
+	Key       string    `gorm:"primaryKey"` // scope (user or IP) + client-supplied key
+	PasteID   string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`
+}
+
+// PasteView records a single view of a paste, so views can be counted over a
+// time window (see GetTrendingPastes).
+type PasteView struct {
+	ID        uint      `gorm:"primaryKey"`
+	PasteID   string    `gorm:"not null;index"`
+	CreatedAt time.Time `gorm:"autoCreateTime;index"`
+}
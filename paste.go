@@ -3,15 +3,104 @@ package main
 import (
 	"math/rand"
 	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	letterRunes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitRunes  = "0123456789"
+)
+
+// Bounds for the configurable paste ID length
+const (
+	minPasteIDLength = 4
+	maxPasteIDLength = 64
 )
 
+// Longest paste_id_prefix accepted
+const maxPasteIDPrefixLength = 16
+
+// validPasteIDPrefix reports whether prefix is safe to put in URLs as-is:
+// letters, digits, "-" and "_" only.
+func validPasteIDPrefix(prefix string) bool {
+	return len(prefix) <= maxPasteIDPrefixLength && validPasteIDChars(prefix)
+}
+
+func validPasteIDChars(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// IDs that can't be claimed as custom slugs because they read as part of the
+// site rather than as a paste. Matched case-insensitively.
+var reservedPasteIDs = map[string]bool{
+	"admin": true, "api": true, "all": true, "edit": true, "embed": true, "login": true,
+	"logout": true, "new": true, "raw": true, "register": true, "static": true,
+}
+
+// validPasteIDSyntax reports whether id could be used as a paste ID: the
+// configured length bounds, and only characters that are safe in URLs.
+func validPasteIDSyntax(id string) bool {
+	return len(id) >= minPasteIDLength && len(id) <= maxPasteIDLength && validPasteIDChars(id)
+}
+
 func randfilename(length int, extension string) string {
-	letterRunes := []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	return randomString(length, letterRunes) + extension
+}
+
+// newPasteID generates a paste ID with the configured prefix, length and
+// charset.
+func newPasteID() string {
+	alphabet := letterRunes
+	if config.PasteIDDigits {
+		alphabet += digitRunes
+	}
+	return config.PasteIDPrefix + randomString(config.PasteIDLength, alphabet)
+}
+
+func randomString(length int, alphabet string) string {
+	letters := []rune(alphabet)
 	randomRunes := make([]rune, length)
 	seed := rand.NewSource(time.Now().UnixNano())
 	rand := rand.New(seed)
 	for index := range randomRunes {
-		randomRunes[index] = letterRunes[rand.Intn(len(letterRunes))]
+		randomRunes[index] = letters[rand.Intn(len(letters))]
 	}
-	return string(randomRunes) + extension
+	return string(randomRunes)
+}
+
+// Expired reports whether the paste is past its expiry time. Expired pastes
+// linger until the hourly cleanup removes them.
+func (p *Paste) Expired() bool {
+	return p.ExpiresAt != nil && time.Now().After(*p.ExpiresAt)
+}
+
+// BeforeCreate gives listed pastes a short code, and numbers new pastes when
+// sequential IDs are enabled. It runs inside the create transaction, and the
+// unique index on seq rejects the loser should two creates still race.
+func (p *Paste) BeforeCreate(tx *gorm.DB) error {
+	if p.ShortCode == nil && !p.Unlisted && p.UnlistAt == nil {
+		if err := p.assignShortCode(tx); err != nil {
+			return err
+		}
+	}
+
+	if !config.SequentialIDs || p.Seq != nil {
+		return nil
+	}
+
+	var last uint
+	if err := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&Paste{}).
+		Select("COALESCE(MAX(seq), 0)").Scan(&last).Error; err != nil {
+		return err
+	}
+
+	seq := last + 1
+	p.Seq = &seq
+	return nil
 }
@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"go/format"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type PasteService struct {
@@ -16,25 +27,98 @@ func NewPasteService(database *gorm.DB) *PasteService {
 	return &PasteService{db: database}
 }
 
+// PasteOptions holds optional per-upload behaviour for CreatePasteWithOptions.
+type PasteOptions struct {
+	// ValidateJSON rejects malformed content when the language is "json"
+	ValidateJSON bool
+	// Format pretty-prints the content before it is stored, for languages
+	// formatContent knows; content it can't parse is rejected
+	Format bool
+	// SlidingExpiry renews the expiry on every view; requires expiresIn
+	SlidingExpiry bool
+	// MaxViews makes the paste unavailable after that many views, nil = unlimited
+	MaxViews *int64
+	// UnlistIn takes the paste off public listings after that many minutes,
+	// without deleting it; nil = listed for as long as it exists
+	UnlistIn *int
+}
+
+// errViewLimitReached is returned by RecordView for a paste that has used up
+// its MaxViews.
+var errViewLimitReached = errors.New("paste view limit reached")
+
 func (s *PasteService) CreatePaste(title, content, language string, isPrivate, unlisted bool, expiresIn *int, userID *uint) (*Paste, error) {
+	return s.CreatePasteWithOptions(title, content, language, isPrivate, unlisted, expiresIn, userID, PasteOptions{})
+}
+
+func (s *PasteService) CreatePasteWithOptions(title, content, language string, isPrivate, unlisted bool, expiresIn *int, userID *uint, opts PasteOptions) (*Paste, error) {
+	content = normalizeContent(content)
 	if len(content) == 0 {
-		return nil, errors.New("paste content cannot be empty")
+		return nil, newCodedError(msgEmptyPaste)
 	}
 
-	if len(content) > 10<<20 { // 10MB
-		return nil, errors.New("paste too large (max 10MB)")
+	if len(content) > config.MaxPasteSize {
+		return nil, newCodedError(msgPasteTooLarge, formatBytes(int64(config.MaxPasteSize)))
 	}
 
 	// Anonymous users cannot create private pastes
 	if isPrivate && userID == nil {
-		return nil, errors.New("must be logged in to create private pastes")
+		return nil, newCodedError(msgLoginRequiredForPrivate)
+	}
+
+	title, err := normalizeTitle(title)
+	if err != nil {
+		return nil, err
+	}
+
+	language = canonicalLanguage(language)
+	if opts.Format {
+		if content, err = formatContent(content, language); err != nil {
+			return nil, err
+		}
+		if len(content) > config.MaxPasteSize {
+			return nil, newCodedError(msgFormattedTooLarge, formatBytes(int64(config.MaxPasteSize)))
+		}
+	}
+	if err := checkLineCount(content); err != nil {
+		return nil, err
+	}
+
+	if opts.ValidateJSON && language == "json" {
+		if err := validateJSON(content); err != nil {
+			return nil, err
+		}
 	}
 
 	// Calculate expiration time
 	var expiresAt *time.Time
-	if expiresIn != nil && *expiresIn > 0 {
+	expiryMinutes := 0
+	if expiresIn != nil {
+		if err := validateExpiresIn(*expiresIn); err != nil {
+			return nil, err
+		}
 		expiry := time.Now().Add(time.Duration(*expiresIn) * time.Minute)
 		expiresAt = &expiry
+		expiryMinutes = *expiresIn
+	}
+
+	if opts.SlidingExpiry {
+		if err := checkSlidingExpiry(expiryMinutes); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.MaxViews != nil && *opts.MaxViews < 1 {
+		return nil, newCodedError(msgMaxViewsTooLow)
+	}
+
+	var unlistAt *time.Time
+	if opts.UnlistIn != nil {
+		if *opts.UnlistIn < 1 {
+			return nil, newCodedError(msgUnlistInTooLow)
+		}
+		at := time.Now().Add(time.Duration(*opts.UnlistIn) * time.Minute)
+		unlistAt = &at
 	}
 
 	// Compute hash for deduplication
@@ -43,64 +127,216 @@ func (s *PasteService) CreatePaste(title, content, language string, isPrivate, u
 		return nil, err
 	}
 
-	// Check if identical paste exists for this user (or public if anonymous)
-	var existingPaste Paste
-	query := s.db.Where("content_hash = ?", hash)
-	if userID != nil {
-		query = query.Where("user_id = ?", *userID)
-	} else {
-		query = query.Where("user_id IS NULL")
+	// Check if identical paste exists for this user (or public if anonymous).
+	// The same content under a different title is a separate paste unless
+	// dedup_include_title is off, and pastes limited to a number of views are
+	// never shared. The hash is stored either way.
+	var key *string
+	if config.Deduplication && opts.MaxViews == nil {
+		k := dedupKey(userID, hash, title)
+		key = &k
+
+		var existingPaste Paste
+		query := s.db.Where("content_hash = ? AND max_views IS NULL", hash)
+		if config.DedupIncludeTitle {
+			query = query.Where("title = ?", title)
+		}
+		if userID != nil {
+			query = query.Where("user_id = ?", *userID)
+		} else {
+			query = query.Where("user_id IS NULL")
+		}
+
+		if err := query.First(&existingPaste).Error; err == nil {
+			// Identical paste exists, return it
+			return &existingPaste, nil
+		}
 	}
 
-	if err := query.First(&existingPaste).Error; err == nil {
-		// Identical paste exists, return it
-		return &existingPaste, nil
+	if userID != nil {
+		growth, err := s.quotaGrowth(content, "")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkQuota(*userID, growth); err != nil {
+			return nil, err
+		}
 	}
 
 	// Generate unique ID
-	pasteID := randfilename(8, "")
+	pasteID := newPasteID()
 
 	paste := &Paste{
-		ID:          pasteID,
-		Title:       title,
-		Content:     content,
-		ContentHash: hash,
-		Language:    language,
-		IsPrivate:   isPrivate,
-		Unlisted:    unlisted,
-		ExpiresAt:   expiresAt,
-		UserID:      userID,
+		ID:            pasteID,
+		Title:         title,
+		Content:       content,
+		ContentHash:   hash,
+		Language:      language,
+		IsPrivate:     isPrivate,
+		Unlisted:      unlisted,
+		ExpiresAt:     expiresAt,
+		ExpiryMinutes: expiryMinutes,
+		UnlistAt:      unlistAt,
+		SlidingExpiry: opts.SlidingExpiry,
+		MaxViews:      opts.MaxViews,
+		UserID:        userID,
+		DedupKey:      key,
+	}
+
+	if userID == nil {
+		token, tokenHash, err := newClaimToken()
+		if err != nil {
+			return nil, err
+		}
+		paste.ClaimToken = &tokenHash
+		paste.claimToken = token
 	}
 
 	if err := s.db.Create(paste).Error; err != nil {
-		return nil, err
+		if key == nil {
+			return nil, err
+		}
+		// An identical upload may have been created since the lookup above,
+		// in which case the unique dedup_key rejected ours
+		existing, retry, lookupErr := s.claimDedupKey(*key)
+		if lookupErr != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return existing, nil
+		}
+		if !retry {
+			return nil, err
+		}
+		paste.Content = content // the failed save left it encoded
+		if err := s.db.Create(paste).Error; err != nil {
+			return nil, err
+		}
 	}
 
 	return paste, nil
 }
 
+// dedupKey identifies what makes two uploads identical: same owner (or both
+// anonymous), content and, with dedup_include_title, title. The unique index
+// on it makes deduplication hold up against concurrent uploads. Content-only
+// keys are built differently from ones with an empty title, so pastes keyed
+// under one setting don't capture uploads after it is changed.
+func dedupKey(userID *uint, hash, title string) string {
+	owner := "anon"
+	if userID != nil {
+		owner = fmt.Sprintf("user:%d", *userID)
+	}
+	key := owner + "\x00" + hash
+	if config.DedupIncludeTitle {
+		key += "\x00" + title
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// claimDedupKey looks up the paste holding key after an insert conflict.
+// A live paste is returned for the caller to use instead. A deleted one
+// gives up the key, and retry tells the caller to insert again.
+func (s *PasteService) claimDedupKey(key string) (existing *Paste, retry bool, err error) {
+	// Without hooks, since a deleted holder's content needn't load
+	var holder Paste
+	if err := s.db.Session(&gorm.Session{SkipHooks: true}).Unscoped().Select("id", "deleted_at").
+		Where("dedup_key = ?", key).First(&holder).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if !holder.DeletedAt.Valid {
+		var live Paste
+		if err := s.db.Where("id = ?", holder.ID).First(&live).Error; err != nil {
+			return nil, false, err
+		}
+		return &live, false, nil
+	}
+	if err := s.db.Unscoped().Model(&holder).UpdateColumn("dedup_key", nil).Error; err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
+
+// validateExpiresIn checks a paste lifetime in minutes against
+// MaxPasteTTLMinutes. Pastes that never expire leave expires_in out rather
+// than passing 0.
+func validateExpiresIn(minutes int) error {
+	if minutes < 0 {
+		return newCodedError(msgExpiresInNegative)
+	}
+	if minutes == 0 {
+		return newCodedError(msgExpiresInZero)
+	}
+	if config.MaxPasteTTLMinutes > 0 && minutes > config.MaxPasteTTLMinutes {
+		return newCodedError(msgExpiresInTooLarge, config.MaxPasteTTLMinutes)
+	}
+	return nil
+}
+
+// checkSlidingExpiry reports whether a paste with the given lifetime may use
+// sliding expiry.
+func checkSlidingExpiry(expiryMinutes int) error {
+	if !config.SlidingExpiry {
+		return newCodedError(msgSlidingExpiryDisabled)
+	}
+	if expiryMinutes <= 0 {
+		return newCodedError(msgSlidingExpiryNoExpiry)
+	}
+	return nil
+}
+
 func (s *PasteService) GetPaste(pasteID string, viewerUserID *uint) (*Paste, error) {
 	var paste Paste
 	if err := s.db.Preload("User").Where("id = ?", pasteID).First(&paste).Error; err != nil {
 		return nil, errors.New("paste not found")
 	}
 
-	// Check if paste has expired
-	if paste.ExpiresAt != nil && time.Now().After(*paste.ExpiresAt) {
+	isOwner := viewerUserID != nil && paste.UserID != nil && *viewerUserID == *paste.UserID
+
+	// Expired pastes are gone for everyone but the owner, who can still
+	// recover them until the cleanup deletes them
+	expired := paste.Expired()
+	if expired && !isOwner {
+		return nil, errors.New("paste not found")
+	}
+
+	// Only owner can view private pastes
+	if paste.IsPrivate && !isOwner {
+		return nil, errors.New("paste not found")
+	}
+
+	// Pastes that have used up their views stay visible to the owner only
+	if paste.MaxViews != nil && paste.Views >= *paste.MaxViews && !isOwner {
 		return nil, errors.New("paste not found")
 	}
 
-	// Check privacy
-	if paste.IsPrivate {
-		// Only owner can view private pastes
-		if viewerUserID == nil || paste.UserID == nil || *viewerUserID != *paste.UserID {
-			return nil, errors.New("paste not found")
+	// Sliding expiry: every view restarts the paste's lifetime. Turning the
+	// option off in config freezes existing pastes at their current expiry.
+	if !expired && paste.SlidingExpiry && config.SlidingExpiry && paste.ExpiresAt != nil && paste.ExpiryMinutes > 0 {
+		expiry := time.Now().Add(time.Duration(paste.ExpiryMinutes) * time.Minute)
+		if err := s.db.Model(&paste).UpdateColumn("expires_at", expiry).Error; err != nil {
+			return nil, err
 		}
+		paste.ExpiresAt = &expiry
 	}
 
 	return &paste, nil
 }
 
+// GetPasteBySeq resolves a numeric alias to its paste, applying the same
+// expiry and privacy checks as GetPaste.
+func (s *PasteService) GetPasteBySeq(seq uint, viewerUserID *uint) (*Paste, error) {
+	var paste Paste
+	if err := s.db.Select("id").Where("seq = ?", seq).First(&paste).Error; err != nil {
+		return nil, errors.New("paste not found")
+	}
+	return s.GetPaste(paste.ID, viewerUserID)
+}
+
 func (s *PasteService) UpdatePaste(pasteID, title, content, language string, unlisted bool, userID uint) (*Paste, error) {
 	var paste Paste
 	if err := s.db.Where("id = ?", pasteID).First(&paste).Error; err != nil {
@@ -112,6 +348,23 @@ func (s *PasteService) UpdatePaste(pasteID, title, content, language string, unl
 		return nil, errors.New("you can only edit your own pastes")
 	}
 
+	title, err := normalizeTitle(title)
+	if err != nil {
+		return nil, err
+	}
+
+	content = normalizeContent(content)
+	if err := checkLineCount(content); err != nil {
+		return nil, err
+	}
+	growth, err := s.quotaGrowth(content, paste.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(userID, growth); err != nil {
+		return nil, err
+	}
+
 	// Update content and hash
 	hash, err := computeFileHash(bytes.NewReader([]byte(content)))
 	if err != nil {
@@ -121,8 +374,10 @@ func (s *PasteService) UpdatePaste(pasteID, title, content, language string, unl
 	paste.Title = title
 	paste.Content = content
 	paste.ContentHash = hash
-	paste.Language = language
+	paste.DedupKey = nil // edited pastes are still found by the lookup, but no longer hold the key
+	paste.Language = canonicalLanguage(language)
 	paste.Unlisted = unlisted
+	paste.EditCount++
 	paste.UpdatedAt = time.Now()
 
 	if err := s.db.Save(&paste).Error; err != nil {
@@ -132,12 +387,336 @@ func (s *PasteService) UpdatePaste(pasteID, title, content, language string, unl
 	return &paste, nil
 }
 
-func (s *PasteService) GetUserPastes(userID uint) ([]Paste, error) {
+// PasteMetaUpdate lists the fields UpdatePasteMeta should change; nil fields
+// are left untouched.
+type PasteMetaUpdate struct {
+	Title     *string
+	Content   *string
+	Language  *string
+	Unlisted  *bool
+	IsPrivate *bool
+	ExpiresIn *int       // minutes from now, positive as for CreatePaste
+	ExpiresAt *time.Time // absolute expiry, mutually exclusive with ExpiresIn
+
+	// NeverExpires removes the expiry; it can't be combined with ExpiresIn
+	// or ExpiresAt
+	NeverExpires bool
+
+	SlidingExpiry *bool
+}
+
+// UpdatePasteMeta applies a partial update to a paste, so changing its title,
+// flags or expiry doesn't require resending the content.
+func (s *PasteService) UpdatePasteMeta(pasteID string, userID uint, update PasteMetaUpdate) (*Paste, error) {
+	var paste Paste
+	if err := s.db.Where("id = ?", pasteID).First(&paste).Error; err != nil {
+		return nil, errors.New("paste not found")
+	}
+
+	// Check ownership
+	if paste.UserID == nil || *paste.UserID != userID {
+		return nil, errors.New("you can only edit your own pastes")
+	}
+
+	if update.ExpiresIn != nil && update.ExpiresAt != nil {
+		return nil, errors.New("expires_in and expires_at cannot both be set")
+	}
+	if update.NeverExpires && (update.ExpiresIn != nil || update.ExpiresAt != nil) {
+		return nil, errors.New("never_expires cannot be combined with expires_in or expires_at")
+	}
+
+	if update.Content != nil {
+		content := normalizeContent(*update.Content)
+		if len(content) == 0 {
+			return nil, errors.New("paste content cannot be empty")
+		}
+		if err := checkLineCount(content); err != nil {
+			return nil, err
+		}
+		growth, err := s.quotaGrowth(content, paste.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.checkQuota(userID, growth); err != nil {
+			return nil, err
+		}
+		hash, err := computeFileHash(bytes.NewReader([]byte(content)))
+		if err != nil {
+			return nil, err
+		}
+		paste.Content = content
+		paste.ContentHash = hash
+		paste.DedupKey = nil
+	}
+	if update.Title != nil {
+		title, err := normalizeTitle(*update.Title)
+		if err != nil {
+			return nil, err
+		}
+		paste.Title = title
+		paste.DedupKey = nil
+	}
+	if update.Language != nil {
+		paste.Language = canonicalLanguage(*update.Language)
+	}
+	if update.Unlisted != nil {
+		paste.Unlisted = *update.Unlisted
+	}
+	if update.IsPrivate != nil {
+		paste.IsPrivate = *update.IsPrivate
+	}
+	if update.ExpiresIn != nil {
+		if err := validateExpiresIn(*update.ExpiresIn); err != nil {
+			return nil, err
+		}
+		expiry := time.Now().Add(time.Duration(*update.ExpiresIn) * time.Minute)
+		paste.ExpiresAt = &expiry
+		paste.ExpiryMinutes = *update.ExpiresIn
+	}
+	if update.NeverExpires {
+		paste.ExpiresAt = nil
+		paste.ExpiryMinutes = 0
+	}
+	if update.ExpiresAt != nil {
+		if !update.ExpiresAt.After(time.Now()) {
+			return nil, errors.New("expires_at must be in the future")
+		}
+		if maxTTL := time.Duration(config.MaxPasteTTLMinutes) * time.Minute; maxTTL > 0 && time.Until(*update.ExpiresAt) > maxTTL {
+			return nil, fmt.Errorf("expires_at too far in the future (max %d minutes)", config.MaxPasteTTLMinutes)
+		}
+		paste.ExpiresAt = update.ExpiresAt
+		paste.ExpiryMinutes = int(math.Ceil(time.Until(*update.ExpiresAt).Minutes()))
+	}
+	if update.SlidingExpiry != nil {
+		if *update.SlidingExpiry {
+			if err := checkSlidingExpiry(paste.ExpiryMinutes); err != nil {
+				return nil, err
+			}
+		}
+		paste.SlidingExpiry = *update.SlidingExpiry
+	}
+	// Removing the expiry leaves nothing to slide
+	if paste.ExpiresAt == nil {
+		paste.SlidingExpiry = false
+	}
+	paste.EditCount++
+	paste.UpdatedAt = time.Now()
+
+	if err := s.db.Save(&paste).Error; err != nil {
+		return nil, err
+	}
+
+	return &paste, nil
+}
+
+// Limits for ExtendPaste. The minimum keeps a shortened paste around long
+// enough to notice the mistake, and the maximum keeps the arithmetic sane
+// when max_paste_ttl_minutes doesn't cap it.
+const (
+	minExtendedExpiry = time.Minute
+	maxExtendMinutes  = 100 * 365 * 24 * 60
+)
+
+var (
+	errNotPasteOwner = errors.New("you can only extend your own pastes")
+	errPasteNotFound = errors.New("paste not found")
+)
+
+// ExtendPaste moves a paste's expiry by minutes, counting from now for a
+// paste that has already expired or never did. Negative minutes shorten it,
+// but not to less than minExtendedExpiry from now. The result is capped at
+// max_paste_ttl_minutes from now. Content and edit history are untouched.
+func (s *PasteService) ExtendPaste(pasteID string, userID uint, minutes int) (*Paste, error) {
+	if minutes == 0 || minutes < -maxExtendMinutes || minutes > maxExtendMinutes {
+		return nil, fmt.Errorf("minutes must be non-zero and between -%d and %d", maxExtendMinutes, maxExtendMinutes)
+	}
+
+	var paste Paste
+	if err := s.db.Where("id = ?", pasteID).First(&paste).Error; err != nil {
+		return nil, errPasteNotFound
+	}
+	if paste.UserID == nil || *paste.UserID != userID {
+		return nil, errNotPasteOwner
+	}
+
+	now := time.Now()
+	base := now
+	if paste.ExpiresAt != nil && paste.ExpiresAt.After(now) {
+		base = *paste.ExpiresAt
+	}
+	expiry := base.Add(time.Duration(minutes) * time.Minute)
+	if earliest := now.Add(minExtendedExpiry); expiry.Before(earliest) {
+		expiry = earliest
+	}
+	if maxTTL := time.Duration(config.MaxPasteTTLMinutes) * time.Minute; maxTTL > 0 && expiry.After(now.Add(maxTTL)) {
+		expiry = now.Add(maxTTL)
+	}
+
+	// A sliding paste renews for as long as it now has left
+	expiryMinutes := int(math.Ceil(expiry.Sub(now).Minutes()))
+	if err := s.db.Model(&paste).UpdateColumns(map[string]interface{}{
+		"expires_at":     expiry,
+		"expiry_minutes": expiryMinutes,
+		"updated_at":     now,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	paste.ExpiresAt = &expiry
+	paste.ExpiryMinutes = expiryMinutes
+	paste.UpdatedAt = now
+	return &paste, nil
+}
+
+// DuplicatePaste copies one of the user's own pastes into a new paste with a
+// fresh ID. Unlike CreatePaste it skips deduplication, since getting a
+// separate copy is the whole point.
+func (s *PasteService) DuplicatePaste(pasteID string, userID uint) (*Paste, error) {
+	var original Paste
+	if err := s.db.Where("id = ?", pasteID).First(&original).Error; err != nil {
+		return nil, errors.New("paste not found")
+	}
+
+	// Check ownership
+	if original.UserID == nil || *original.UserID != userID {
+		return nil, errors.New("you can only duplicate your own pastes")
+	}
+
+	// Expired pastes are as good as gone
+	if original.ExpiresAt != nil && time.Now().After(*original.ExpiresAt) {
+		return nil, errors.New("paste not found")
+	}
+
+	growth, err := s.quotaGrowth(original.Content, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(userID, growth); err != nil {
+		return nil, err
+	}
+
+	paste := &Paste{
+		ID:          newPasteID(),
+		Title:       original.Title,
+		Content:     original.Content,
+		ContentHash: original.ContentHash,
+		Language:    original.Language,
+		IsPrivate:   original.IsPrivate,
+		Unlisted:    original.Unlisted,
+		UserID:      &userID,
+	}
+
+	if err := s.db.Create(paste).Error; err != nil {
+		return nil, err
+	}
+
+	return paste, nil
+}
+
+// userListing selects the user's pastes in language, or all of them when
+// language is empty. Aliases match too, see languageNames.
+func (s *PasteService) userListing(userID uint, language string) *gorm.DB {
+	query := s.db.Model(&Paste{}).Where("user_id = ?", userID)
+	if language != "" {
+		query = query.Where("language IN ?", languageNames(language))
+	}
+	return query
+}
+
+// GetUserPastesPage returns up to limit of the user's pastes, newest first,
+// starting at offset, together with how many pastes the user has.
+func (s *PasteService) GetUserPastesPage(userID uint, limit, offset int) ([]Paste, int64, error) {
+	return s.GetUserPastesByLanguage(userID, "", limit, offset)
+}
+
+// GetUserPastesByLanguage is GetUserPastesPage limited to one language,
+// given by name or alias. An empty language matches every paste.
+func (s *PasteService) GetUserPastesByLanguage(userID uint, language string, limit, offset int) ([]Paste, int64, error) {
+	var total int64
+	if err := s.userListing(userID, language).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
 	var pastes []Paste
-	if err := s.db.Where("user_id = ?", userID).Order("created_at DESC").Find(&pastes).Error; err != nil {
+	if err := s.userListing(userID, language).
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&pastes).Error; err != nil {
+		return nil, 0, err
+	}
+	return pastes, total, nil
+}
+
+// PasteTombstone records that a paste was deleted, for sync clients.
+type PasteTombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// ChangeCursor is a place in a user's paste changes: the time of a change
+// and the paste's ID, which orders changes made at the same moment, such as
+// pastes expired by one cleanup. The zero cursor is before every change.
+type ChangeCursor struct {
+	Time time.Time
+	ID   string
+}
+
+func (c ChangeCursor) before(t time.Time, id string) bool {
+	return c.Time.Before(t) || (c.Time.Equal(t) && c.ID < id)
+}
+
+// PasteChanges is what changed in a user's pastes after some point: pastes
+// created or updated, and pastes deleted, each oldest change first.
+type PasteChanges struct {
+	Updated []Paste
+	Deleted []PasteTombstone
+	Next    ChangeCursor // the newest change included, zero if none
+	More    bool         // changes after Next were left out to keep within the limit
+}
+
+// GetUserPasteChanges returns up to limit of the user's changes after the
+// cursor. Deleted pastes only show up while their soft-deleted rows remain.
+func (s *PasteService) GetUserPasteChanges(userID uint, after ChangeCursor, limit int) (*PasteChanges, error) {
+	// Stored times are local, and SQLite compares them as text
+	since := after.Time.Local()
+
+	var updated []Paste
+	if err := s.db.Where("user_id = ? AND (updated_at > ? OR (updated_at = ? AND id > ?))", userID, since, since, after.ID).
+		Order("updated_at ASC, id ASC").
+		Limit(limit + 1).
+		Find(&updated).Error; err != nil {
 		return nil, err
 	}
-	return pastes, nil
+
+	// Scanned rather than found, so the hooks don't try to load content
+	// that went with the paste
+	var deleted []PasteTombstone
+	if err := s.db.Unscoped().Model(&Paste{}).
+		Select("id, deleted_at").
+		Where("user_id = ? AND deleted_at IS NOT NULL AND (deleted_at > ? OR (deleted_at = ? AND id > ?))", userID, since, since, after.ID).
+		Order("deleted_at ASC, id ASC").
+		Limit(limit + 1).
+		Scan(&deleted).Error; err != nil {
+		return nil, err
+	}
+
+	// Merge the two in cursor order, so Next is a safe place to resume from
+	changes := &PasteChanges{}
+	i, j := 0, 0
+	for i+j < limit && (i < len(updated) || j < len(deleted)) {
+		if j == len(deleted) || (i < len(updated) && (ChangeCursor{updated[i].UpdatedAt, updated[i].ID}).before(deleted[j].DeletedAt, deleted[j].ID)) {
+			changes.Updated = append(changes.Updated, updated[i])
+			changes.Next = ChangeCursor{updated[i].UpdatedAt, updated[i].ID}
+			i++
+		} else {
+			changes.Deleted = append(changes.Deleted, deleted[j])
+			changes.Next = ChangeCursor{deleted[j].DeletedAt, deleted[j].ID}
+			j++
+		}
+	}
+	changes.More = i < len(updated) || j < len(deleted)
+	return changes, nil
 }
 
 func (s *PasteService) CanEdit(pasteID string, userID uint) bool {
@@ -166,27 +745,613 @@ func (s *PasteService) DeletePaste(pasteID string, userID uint) error {
 	return nil
 }
 
-func (s *PasteService) GetAllPublicPastes() ([]Paste, error) {
+// publicListing selects the public pastes that belong on listings: not
+// private, not unlisted and not past their UnlistAt.
+func (s *PasteService) publicListing() *gorm.DB {
+	return s.db.Model(&Paste{}).
+		Where("is_private = ? AND unlisted = ?", false, false).
+		Where("unlist_at IS NULL OR unlist_at > ?", time.Now())
+}
+
+// GetPublicPastesPage returns up to limit listed public pastes, newest
+// first, starting at offset, together with the total number listed. Pastes
+// past their UnlistAt are left out.
+func (s *PasteService) GetPublicPastesPage(limit, offset int) ([]Paste, int64, error) {
+	var total int64
+	if err := s.publicListing().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
 	var pastes []Paste
-	if err := s.db.Preload("User").Where("is_private = ? AND unlisted = ?", false, false).Order("created_at DESC").Find(&pastes).Error; err != nil {
-		return nil, err
+	if err := s.publicListing().Preload("User").
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&pastes).Error; err != nil {
+		return nil, 0, err
 	}
-	return pastes, nil
+	return pastes, total, nil
 }
 
-func (s *PasteService) SearchUserPastes(userID uint, query string) ([]Paste, error) {
+// GetRecentPublicPastes returns up to limit of the newest public pastes
+// that have not expired or been unlisted.
+func (s *PasteService) GetRecentPublicPastes(limit int) ([]Paste, error) {
 	var pastes []Paste
-	searchPattern := "%" + query + "%"
-	if err := s.db.Where("user_id = ? AND (title LIKE ? OR content LIKE ?)", userID, searchPattern, searchPattern).
+	if err := s.db.Preload("User").
+		Where("is_private = ? AND unlisted = ?", false, false).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		Where("unlist_at IS NULL OR unlist_at > ?", time.Now()).
 		Order("created_at DESC").
+		Limit(limit).
 		Find(&pastes).Error; err != nil {
 		return nil, err
 	}
 	return pastes, nil
 }
 
+// Longest window GetTrendingPastes can look back over; older view records
+// are pruned by CleanupPasteViews.
+const trendingMaxWindow = 30 * 24 * time.Hour
+
+// Transaction runs fn with a PasteService whose queries share one database
+// transaction, committed if fn returns nil.
+func (s *PasteService) Transaction(fn func(tx *PasteService) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(NewPasteService(tx))
+	})
+}
+
+// RecordView logs a view of the paste and bumps its total view counter.
+func (s *PasteService) RecordView(pasteID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		// The limit is checked again here so concurrent viewers can't
+		// overshoot MaxViews between GetPaste and this update
+		result := tx.Model(&Paste{}).
+			Where("id = ? AND (max_views IS NULL OR views < max_views)", pasteID).
+			UpdateColumn("views", gorm.Expr("views + ?", 1))
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errViewLimitReached
+		}
+		return tx.Create(&PasteView{PasteID: pasteID}).Error
+	})
+}
+
+// TrendingPaste is a public paste with its view count over a time window.
+type TrendingPaste struct {
+	Paste
+	RecentViews int64
+}
+
+// GetTrendingPastes returns up to limit public, unexpired pastes ranked by
+// how often they were viewed since the given time.
+func (s *PasteService) GetTrendingPastes(since time.Time, limit int) ([]TrendingPaste, error) {
+	var counts []struct {
+		PasteID   string
+		ViewCount int64
+	}
+	if err := s.db.Table("paste_views").
+		Select("paste_views.paste_id, COUNT(*) AS view_count").
+		Joins("JOIN pastes ON pastes.id = paste_views.paste_id").
+		Where("paste_views.created_at >= ?", since).
+		Where("pastes.deleted_at IS NULL AND pastes.is_private = ? AND pastes.unlisted = ?", false, false).
+		Where("pastes.expires_at IS NULL OR pastes.expires_at > ?", time.Now()).
+		Where("pastes.unlist_at IS NULL OR pastes.unlist_at > ?", time.Now()).
+		Group("paste_views.paste_id").
+		Order("view_count DESC, MAX(paste_views.created_at) DESC").
+		Limit(limit).
+		Scan(&counts).Error; err != nil {
+		return nil, err
+	}
+	if len(counts) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(counts))
+	for i, c := range counts {
+		ids[i] = c.PasteID
+	}
+	var pastes []Paste
+	if err := s.db.Preload("User").Where("id IN ?", ids).Find(&pastes).Error; err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Paste, len(pastes))
+	for _, p := range pastes {
+		byID[p.ID] = p
+	}
+
+	trending := make([]TrendingPaste, 0, len(counts))
+	for _, c := range counts {
+		if p, ok := byID[c.PasteID]; ok {
+			trending = append(trending, TrendingPaste{Paste: p, RecentViews: c.ViewCount})
+		}
+	}
+	return trending, nil
+}
+
+// CleanupPasteViews drops view records too old to matter for trending.
+func (s *PasteService) CleanupPasteViews() (int64, error) {
+	result := s.db.Where("created_at < ?", time.Now().Add(-trendingMaxWindow)).Delete(&PasteView{})
+	return result.RowsAffected, result.Error
+}
+
+// CountPastes returns the total number of stored pastes.
+func (s *PasteService) CountPastes() (int64, error) {
+	var count int64
+	err := s.db.Model(&Paste{}).Count(&count).Error
+	return count, err
+}
+
+// errInvalidSearchSort is returned by SearchUserPastesPage for a sort it
+// doesn't know.
+var errInvalidSearchSort = errors.New("sort must be relevance, newest or oldest")
+
+// SearchOptions controls ordering and paging of SearchUserPastesPage.
+type SearchOptions struct {
+	Sort     string // "relevance" (default), "newest" or "oldest"
+	Page     int    // 1-based, 0 = first page
+	PerPage  int    // 0 = all results
+	Language string // name or alias to limit results to, empty = any
+}
+
+// SearchUserPastesPage finds the user's pastes whose title or content
+// contains query, case-insensitively, and returns one page of them along
+// with the total number of matches. Relevance ranks title matches above
+// content-only matches, newest first within each rank.
+func (s *PasteService) SearchUserPastesPage(userID uint, query string, opts SearchOptions) ([]Paste, int64, error) {
+	switch opts.Sort {
+	case "":
+		opts.Sort = "relevance"
+	case "relevance", "newest", "oldest":
+	default:
+		return nil, 0, errInvalidSearchSort
+	}
+
+	// Compressed or encrypted content can't be matched in SQL. Only when
+	// none of the user's pastes are stored that way can the matching,
+	// ordering and paging all be left to the database.
+	var encoded int64
+	if err := s.userListing(userID, opts.Language).
+		Joins(sharedContentJoin).
+		Where("pastes.compressed = ? OR pastes.encrypted = ? OR paste_contents.compressed = ? OR paste_contents.encrypted = ?", true, true, true, true).
+		Count(&encoded).Error; err != nil {
+		return nil, 0, err
+	}
+	if encoded > 0 {
+		return s.searchDecodedPastes(userID, query, opts)
+	}
+
+	pattern := likePattern(query)
+	matching := func() *gorm.DB {
+		return s.userListing(userID, opts.Language).
+			Joins(sharedContentJoin).
+			Where("pastes.title LIKE ? ESCAPE '\\' OR COALESCE(paste_contents.content, pastes.content) LIKE ? ESCAPE '\\'", pattern, pattern)
+	}
+
+	var total int64
+	if err := matching().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	listing := matching().Select("pastes.*")
+	switch opts.Sort {
+	case "relevance":
+		// Same scores as searchDecodedPastes: 2 for the title, 1 for content
+		listing = listing.Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:                "(pastes.title LIKE ? ESCAPE '\\') * 2 + (COALESCE(paste_contents.content, pastes.content) LIKE ? ESCAPE '\\') DESC, pastes.created_at DESC",
+			Vars:               []interface{}{pattern, pattern},
+			WithoutParentheses: true,
+		}})
+	case "newest":
+		listing = listing.Order("pastes.created_at DESC")
+	case "oldest":
+		listing = listing.Order("pastes.created_at ASC")
+	}
+	if opts.PerPage > 0 {
+		listing = listing.Limit(opts.PerPage).Offset((max(opts.Page, 1) - 1) * opts.PerPage)
+	}
+
+	var pastes []Paste
+	if err := listing.Find(&pastes).Error; err != nil {
+		return nil, 0, err
+	}
+	return pastes, total, nil
+}
+
+// searchDecodedPastes is SearchUserPastesPage for users with compressed or
+// encrypted pastes: those rows are fetched as candidates and matched, ranked
+// and paged after decoding.
+func (s *PasteService) searchDecodedPastes(userID uint, query string, opts SearchOptions) ([]Paste, int64, error) {
+	var pastes []Paste
+
+	searchPattern := likePattern(query)
+
+	order := "pastes.created_at DESC"
+	if opts.Sort == "oldest" {
+		order = "pastes.created_at ASC"
+	}
+	if err := s.userListing(userID, opts.Language).
+		Joins(sharedContentJoin).
+		Select("pastes.*").
+		Where("pastes.title LIKE ? ESCAPE '\\' OR COALESCE(paste_contents.content, pastes.content) LIKE ? ESCAPE '\\' OR pastes.compressed = ? OR pastes.encrypted = ? OR paste_contents.compressed = ? OR paste_contents.encrypted = ?",
+			searchPattern, searchPattern, true, true, true, true).
+		Order(order).
+		Find(&pastes).Error; err != nil {
+		return nil, 0, err
+	}
+
+	needle := strings.ToLower(query)
+	matches := pastes[:0]
+	scores := make(map[string]int)
+	for _, paste := range pastes {
+		score := 0
+		if strings.Contains(strings.ToLower(paste.Title), needle) {
+			score += 2
+		}
+		if strings.Contains(strings.ToLower(paste.Content), needle) {
+			score++
+		}
+		if score > 0 {
+			matches = append(matches, paste)
+			scores[paste.ID] = score
+		}
+	}
+
+	if opts.Sort == "relevance" {
+		// Stable, so the newest-first order from the query breaks ties
+		sort.SliceStable(matches, func(i, j int) bool {
+			return scores[matches[i].ID] > scores[matches[j].ID]
+		})
+	}
+
+	total := int64(len(matches))
+	if opts.PerPage > 0 {
+		page := max(opts.Page, 1)
+		start := min((page-1)*opts.PerPage, len(matches))
+		end := min(start+opts.PerPage, len(matches))
+		matches = matches[start:end]
+	}
+
+	return matches, total, nil
+}
+
+// likePattern turns query into a LIKE pattern matching it anywhere, with
+// its own wildcards escaped by a backslash.
+func likePattern(query string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query)
+	return "%" + escaped + "%"
+}
+
+// Runes of context shown either side of a match in a search snippet
+const searchSnippetContext = 60
+
+// SearchSnippet is an excerpt of paste content around a search match, split
+// so clients can mark the match however suits them. Before and After start
+// or end with "…" when the content goes on past them.
+type SearchSnippet struct {
+	Before string
+	Match  string
+	After  string
+}
+
+// SearchResult is a paste as returned by search: its content is replaced by
+// a snippet around the first match, since the full text could be huge.
+type SearchResult struct {
+	Paste
+	Snippet *SearchSnippet `json:",omitempty"` // nil when only the title matched
+}
+
+// newSearchResults turns pastes found by SearchUserPastesPage into results
+// with snippets for query.
+func newSearchResults(pastes []Paste, query string) []SearchResult {
+	pattern := regexp.MustCompile("(?i)" + regexp.QuoteMeta(query))
+
+	results := make([]SearchResult, len(pastes))
+	for i, paste := range pastes {
+		results[i] = SearchResult{Paste: paste, Snippet: searchSnippet(paste.Content, pattern)}
+		results[i].Content = ""
+	}
+	return results
+}
+
+// searchSnippet cuts content down to the first match of pattern with up to
+// searchSnippetContext runes either side, or returns nil if it has none.
+func searchSnippet(content string, pattern *regexp.Regexp) *SearchSnippet {
+	loc := pattern.FindStringIndex(content)
+	if loc == nil {
+		return nil
+	}
+
+	start, end := loc[0], loc[1]
+	for i := 0; i < searchSnippetContext && start > 0; i++ {
+		_, size := utf8.DecodeLastRuneInString(content[:start])
+		start -= size
+	}
+	for i := 0; i < searchSnippetContext && end < len(content); i++ {
+		_, size := utf8.DecodeRuneInString(content[end:])
+		end += size
+	}
+
+	snippet := &SearchSnippet{
+		Before: content[start:loc[0]],
+		Match:  content[loc[0]:loc[1]],
+		After:  content[loc[1]:end],
+	}
+	if start > 0 {
+		snippet.Before = "…" + snippet.Before
+	}
+	if end < len(content) {
+		snippet.After += "…"
+	}
+	return snippet
+}
+
+// How long an Idempotency-Key keeps pointing at the paste it created
+const idempotencyKeyTTL = 1 * time.Hour
+
+// normalizeTitle trims a title and collapses internal runs of whitespace
+// (including newlines) to single spaces, then enforces MaxTitleLength.
+func normalizeTitle(title string) (string, error) {
+	title = strings.Join(strings.Fields(title), " ")
+	if n := utf8.RuneCountInString(title); n > config.MaxTitleLength {
+		return "", newCodedError(msgTitleTooLong, n, config.MaxTitleLength)
+	}
+	return title, nil
+}
+
+// normalizeContent converts CRLF line endings to LF when
+// NormalizeLineEndings is on, and strips trailing whitespace from every
+// line and drops trailing blank lines when TrimTrailingWhitespace is on, so
+// pastes that only differ in editor whitespace hash the same. Otherwise
+// content is kept byte for byte.
+func normalizeContent(content string) string {
+	if config.NormalizeLineEndings {
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	}
+	if !config.TrimTrailingWhitespace {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// effectiveQuota returns the storage quota that applies to user in bytes,
+// 0 meaning unlimited.
+func effectiveQuota(user *User) int64 {
+	if user.QuotaBytes != nil {
+		return *user.QuotaBytes
+	}
+	return config.UserQuotaBytes
+}
+
+// StorageUsed returns the total size in bytes of the user's pastes.
+func (s *PasteService) StorageUsed(userID uint) (int64, error) {
+	var used int64
+	err := s.db.Model(&Paste{}).
+		Joins(sharedContentJoin).
+		Select("COALESCE(SUM("+pasteSizeSQL+"), 0)").
+		Where("user_id = ?", userID).
+		Scan(&used).Error
+	return used, err
+}
+
+// storedSize is how many bytes plaintext takes up once stored, compressed
+// and/or encrypted as configured. Quotas are counted in stored bytes.
+func storedSize(plaintext string) (int64, error) {
+	stored, _, _, err := encodeContent(plaintext)
+	return int64(len(stored)), err
+}
+
+// pasteStoredSize returns the stored bytes StorageUsed counts for a paste,
+// which may have been written under a different configuration.
+func (s *PasteService) pasteStoredSize(pasteID string) (int64, error) {
+	var size int64
+	err := s.db.Model(&Paste{}).
+		Joins(sharedContentJoin).
+		Select(pasteSizeSQL).
+		Where("pastes.id = ?", pasteID).
+		Scan(&size).Error
+	return size, err
+}
+
+// quotaGrowth returns by how many stored bytes saving content grows its
+// owner's storage, in place of the paste replacing or, when that's empty,
+// as a new paste.
+func (s *PasteService) quotaGrowth(content, replacing string) (int64, error) {
+	size, err := storedSize(content)
+	if err != nil || replacing == "" {
+		return size, err
+	}
+	old, err := s.pasteStoredSize(replacing)
+	return size - old, err
+}
+
+// checkQuota rejects a change that would grow the user's storage by delta
+// stored bytes beyond their quota. Shrinking is always allowed.
+func (s *PasteService) checkQuota(userID uint, delta int64) error {
+	if delta <= 0 {
+		return nil
+	}
+
+	// A user without a row (e.g. deleted mid-request) gets the global quota
+	var user User
+	if err := s.db.First(&user, userID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	quota := effectiveQuota(&user)
+	if quota == 0 {
+		return nil
+	}
+
+	used, err := s.StorageUsed(userID)
+	if err != nil {
+		return err
+	}
+	if used+delta > quota {
+		return newCodedError(msgQuotaExceeded, formatBytes(used), formatBytes(quota))
+	}
+
+	return nil
+}
+
+// Reasons PasteIDAvailable gives for an ID that can't be used
+const (
+	pasteIDInvalid  = "invalid"
+	pasteIDReserved = "reserved"
+	pasteIDTaken    = "taken"
+)
+
+// PasteIDAvailable reports whether id is free to use for a new paste, and
+// if not, why. Deleted pastes keep their ID, as their rows are only
+// soft-deleted.
+func (s *PasteService) PasteIDAvailable(id string) (bool, string, error) {
+	if !validPasteIDSyntax(id) {
+		return false, pasteIDInvalid, nil
+	}
+	if reservedPasteIDs[strings.ToLower(id)] {
+		return false, pasteIDReserved, nil
+	}
+
+	var count int64
+	if err := s.db.Unscoped().Model(&Paste{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		return false, "", err
+	}
+	if count > 0 {
+		return false, pasteIDTaken, nil
+	}
+	return true, "", nil
+}
+
+// GetIdempotentPaste returns the paste previously created with this
+// idempotency key, if the key is still within its window.
+func (s *PasteService) GetIdempotentPaste(key string) (*Paste, error) {
+	var record IdempotencyKey
+	if err := s.db.Where("key = ? AND created_at > ?", key, time.Now().Add(-idempotencyKeyTTL)).First(&record).Error; err != nil {
+		return nil, errors.New("idempotency key not found")
+	}
+
+	var paste Paste
+	if err := s.db.Where("id = ?", record.PasteID).First(&paste).Error; err != nil {
+		return nil, errors.New("paste not found")
+	}
+
+	return &paste, nil
+}
+
+// SaveIdempotencyKey records the paste created for an idempotency key,
+// replacing any stale record for the same key.
+func (s *PasteService) SaveIdempotencyKey(key, pasteID string) error {
+	return s.db.Save(&IdempotencyKey{Key: key, PasteID: pasteID, CreatedAt: time.Now()}).Error
+}
+
+func (s *PasteService) CleanupIdempotencyKeys() (int64, error) {
+	result := s.db.Where("created_at < ?", time.Now().Add(-idempotencyKeyTTL)).Delete(&IdempotencyKey{})
+	return result.RowsAffected, result.Error
+}
+
 func (s *PasteService) CleanupExpiredPastes() (int64, error) {
 	now := time.Now()
 	result := s.db.Where("expires_at IS NOT NULL AND expires_at < ?", now).Delete(&Paste{})
 	return result.RowsAffected, result.Error
 }
+
+// CleanupAnonymousPastes deletes anonymous pastes created more than maxAge
+// ago, whatever their expiry. Pastes with an owner are never touched.
+func (s *PasteService) CleanupAnonymousPastes(maxAge time.Duration) (int64, error) {
+	result := s.db.Where("user_id IS NULL AND created_at < ?", time.Now().Add(-maxAge)).Delete(&Paste{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeDeletedPastes hard-deletes pastes that were deleted more than
+// retention ago, along with shared content nothing else uses. Until then
+// they stay behind as tombstones for sync clients.
+func (s *PasteService) PurgeDeletedPastes(retention time.Duration) (int64, error) {
+	result := s.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", time.Now().Add(-retention)).Delete(&Paste{})
+	return result.RowsAffected, result.Error
+}
+
+// validateJSON checks that content is a single well-formed JSON value,
+// pointing at the offending line and column when it isn't.
+func validateJSON(content string) error {
+	var value interface{}
+	err := json.Unmarshal([]byte(content), &value)
+	if err == nil {
+		return nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		// Offset counts the offending byte itself, so the error sits at the
+		// last character read
+		before := content[:syntaxErr.Offset]
+		line := strings.Count(before, "\n") + 1
+		column := len(before) - strings.LastIndex(before, "\n") - 1
+		if column < 1 {
+			column = 1
+		}
+		return newCodedError(msgInvalidJSONAt, line, column, syntaxErr)
+	}
+
+	return newCodedError(msgInvalidJSON, err)
+}
+
+// countLines counts lines the way an editor shows them: a final line
+// without a trailing newline still counts, an empty string has none.
+func countLines(content string) int {
+	lines := strings.Count(content, "\n")
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// checkLineCount enforces max_lines, which keeps pathological pastes with
+// millions of short lines away from the highlighter.
+func checkLineCount(content string) error {
+	if config.MaxLines > 0 && countLines(content) > config.MaxLines {
+		return newCodedError(msgTooManyLines, config.MaxLines)
+	}
+	return nil
+}
+
+// formatContent rewrites content in its language's canonical style: JSON
+// indented by two spaces, keeping key order and numbers as written, and Go
+// as gofmt would. Other languages are returned unchanged.
+func formatContent(content, language string) (string, error) {
+	switch language {
+	case "json":
+		if err := validateJSON(content); err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(strings.TrimSpace(content)), "", "  "); err != nil {
+			return "", newCodedError(msgInvalidJSON, err)
+		}
+		return buf.String(), nil
+	case "go":
+		formatted, err := format.Source([]byte(content))
+		if err != nil {
+			return "", newCodedError(msgInvalidGo, err)
+		}
+		return string(formatted), nil
+	}
+	return content, nil
+}
+
+// formatBytes renders a byte count for error messages, e.g. "10MB".
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
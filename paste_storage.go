@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// The hooks below keep Paste.Content plaintext everywhere in memory and only
+// compress and/or encrypt it on its way into the database. The Compressed
+// and Encrypted columns record how each row was stored, so rows written
+// under a different configuration stay readable.
+//
+// With global_dedup on, content goes to the paste_contents table instead,
+// once per distinct text, and the paste only keeps a ContentRef to it.
+
+// encodeContent prepares plaintext for storage: compressed when enabled and
+// worthwhile, then encrypted when a key is configured. Encoded content is
+// stored as base64 since the column is text.
+func encodeContent(plaintext string) (stored string, compressed, encrypted bool, err error) {
+	data := []byte(plaintext)
+
+	if config.Compression && len(data) >= config.CompressionThreshold {
+		packed, err := compressContent(data)
+		if err != nil {
+			return "", false, false, err
+		}
+		// Base64 costs a third, so only keep it if it still saves space
+		if base64.StdEncoding.EncodedLen(len(packed)) < len(data) {
+			data = packed
+			compressed = true
+		}
+	}
+
+	if contentCipher != nil {
+		if data, err = sealContent(contentCipher, data); err != nil {
+			return "", false, false, err
+		}
+		encrypted = true
+	}
+
+	if !compressed && !encrypted {
+		return plaintext, false, false, nil
+	}
+	return base64.StdEncoding.EncodeToString(data), compressed, encrypted, nil
+}
+
+// decodeContent reverses encodeContent.
+func decodeContent(stored string, compressed, encrypted bool) (string, error) {
+	if !compressed && !encrypted {
+		return stored, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", errors.New("malformed stored content")
+	}
+
+	if encrypted {
+		if contentCipher == nil {
+			return "", errors.New("paste is encrypted but no encryption_key is configured")
+		}
+		if data, err = openContent(contentCipher, data); err != nil {
+			return "", err
+		}
+	}
+
+	if compressed {
+		if data, err = decompressContent(data); err != nil {
+			return "", fmt.Errorf("failed to decompress paste content: %w", err)
+		}
+	}
+
+	return string(data), nil
+}
+
+func (p *Paste) BeforeSave(tx *gorm.DB) error {
+	p.plainContent = p.Content
+
+	if config.GlobalDedup {
+		ref, err := storeSharedContent(tx, p.Content)
+		if err != nil {
+			return err
+		}
+		p.ContentRef = ref
+		p.Content = ""
+		p.Compressed = false
+		p.Encrypted = false
+		return nil
+	}
+
+	stored, compressed, encrypted, err := encodeContent(p.Content)
+	if err != nil {
+		return err
+	}
+	p.Content = stored
+	p.Compressed = compressed
+	p.Encrypted = encrypted
+	p.ContentRef = ""
+	return nil
+}
+
+func (p *Paste) AfterSave(tx *gorm.DB) error {
+	p.Content = p.plainContent
+
+	// An edit may have left the old shared content unreferenced
+	if p.loadedRef != "" && p.loadedRef != p.ContentRef {
+		if err := releaseSharedContent(tx, p.loadedRef); err != nil {
+			return err
+		}
+	}
+	p.loadedRef = p.ContentRef
+	return nil
+}
+
+func (p *Paste) AfterFind(tx *gorm.DB) error {
+	return p.decode(tx)
+}
+
+// AfterDelete drops shared content the deleted pastes were the last users
+// of. Soft-deleted rows still point at their content, so only hard deletes,
+// such as PurgeDeletedPastes, can free any. Bulk deletes don't say which
+// pastes went, so they sweep every row.
+func (p *Paste) AfterDelete(tx *gorm.DB) error {
+	if !tx.Statement.Unscoped {
+		return nil
+	}
+	if p.ContentRef != "" {
+		return releaseSharedContent(tx, p.ContentRef)
+	}
+	if p.ID == "" {
+		return releaseSharedContent(tx)
+	}
+	return nil
+}
+
+// decode turns a freshly loaded row back into plaintext. It is called by
+// AfterFind, and directly where rows are scanned without hooks.
+func (p *Paste) decode(tx *gorm.DB) error {
+	p.loadedRef = p.ContentRef
+	if p.ContentRef != "" {
+		var shared PasteContent
+		if err := tx.Session(&gorm.Session{NewDB: true}).Where("hash = ?", p.ContentRef).First(&shared).Error; err != nil {
+			return fmt.Errorf("failed to load shared content: %w", err)
+		}
+		p.Content, p.Compressed, p.Encrypted = shared.Content, shared.Compressed, shared.Encrypted
+	}
+
+	content, err := decodeContent(p.Content, p.Compressed, p.Encrypted)
+	if err != nil {
+		return err
+	}
+	p.Content = content
+	return nil
+}
+
+// Stored size of a paste for quota purposes, which counts shared content in
+// full for every paste using it. Needs sharedContentJoin.
+const (
+	pasteSizeSQL      = "LENGTH(CAST(COALESCE(paste_contents.content, pastes.content) AS BLOB))"
+	sharedContentJoin = "LEFT JOIN paste_contents ON paste_contents.hash = pastes.content_ref"
+)
+
+// storeSharedContent makes sure plaintext is in paste_contents and returns
+// its key. The key is a SHA-256 rather than the MD5 ContentHash, as a
+// collision here would show one user's paste in place of another's.
+func storeSharedContent(tx *gorm.DB, plaintext string) (string, error) {
+	sum := sha256.Sum256([]byte(plaintext))
+	ref := hex.EncodeToString(sum[:])
+
+	stored, compressed, encrypted, err := encodeContent(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	// Inserting unconditionally takes the write lock up front, so a
+	// concurrent release can't delete the row before our paste refers to it
+	err = tx.Session(&gorm.Session{NewDB: true}).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&PasteContent{Hash: ref, Content: stored, Compressed: compressed, Encrypted: encrypted}).Error
+	return ref, err
+}
+
+// releaseSharedContent deletes shared content no paste refers to any more,
+// limited to refs when any are given. Deleted pastes count, since they keep
+// needing their content until they are purged.
+func releaseSharedContent(tx *gorm.DB, refs ...string) error {
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	query := tx.Where("hash NOT IN (?)", tx.Unscoped().Model(&Paste{}).Select("content_ref").Where("content_ref <> ''"))
+	if len(refs) > 0 {
+		query = query.Where("hash IN ?", refs)
+	}
+	return query.Delete(&PasteContent{}).Error
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a fixed-window request counter keyed by caller.
+type rateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	buckets map[string]*rateBucket
+	now     func() time.Time
+}
+
+type rateBucket struct {
+	count int
+	reset time.Time
+}
+
+// Above this many tracked callers, expired buckets are swept on the next request
+const rateLimiterSweepThreshold = 10000
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: make(map[string]*rateBucket),
+		now:     time.Now,
+	}
+}
+
+// Allow records a request for key and reports whether it fits in the
+// current window, how many requests remain, and when the window resets.
+func (l *rateLimiter) Allow(key string) (allowed bool, remaining int, reset time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+
+	if len(l.buckets) > rateLimiterSweepThreshold {
+		for k, b := range l.buckets {
+			if !now.Before(b.reset) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok || !now.Before(bucket.reset) {
+		bucket = &rateBucket{reset: now.Add(l.window)}
+		l.buckets[key] = bucket
+	}
+
+	if bucket.count >= l.limit {
+		return false, 0, bucket.reset
+	}
+
+	bucket.count++
+	return true, l.limit - bucket.count, bucket.reset
+}
+
+// retryAfter is the Retry-After value, in whole seconds, for a window
+// ending at reset.
+func (l *rateLimiter) retryAfter(reset time.Time) string {
+	return strconv.Itoa(int(reset.Sub(l.now()).Seconds()) + 1)
+}
+
+// Limiter for API requests, nil when rate limiting is disabled
+var apiRateLimiter *rateLimiter
+
+// Limiter for account registrations per IP, nil when disabled
+var registrationRateLimiter *rateLimiter
+
+// Limiter for ID availability checks, which would otherwise let anyone
+// enumerate paste IDs, even with API rate limiting off
+var idAvailabilityRateLimiter = newRateLimiter(idAvailabilityRateLimit, time.Minute)
+
+// Availability checks allowed per caller per minute
+const idAvailabilityRateLimit = 30
+
+// Limiter for paste claims, so claim tokens can't be guessed at speed
+var claimRateLimiter = newRateLimiter(claimRateLimit, time.Minute)
+
+// Claim requests allowed per user per minute
+const claimRateLimit = 10
+
+// rateLimitKey identifies the caller: authenticated users (by session or
+// API key) share one bucket across addresses, everyone else is keyed by IP.
+func rateLimitKey(r *http.Request) string {
+	if user := getCurrentUser(r); user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// isAPIRequest reports whether the path is part of the programmatic API.
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/upload"
+}
+
+// rateLimitMiddleware enforces apiRateLimiter on API requests and reports
+// the caller's quota in X-RateLimit-* headers.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiRateLimiter == nil || !isAPIRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed, remaining, reset := apiRateLimiter.Allow(rateLimitKey(r))
+
+		headers := w.Header()
+		headers.Set("X-RateLimit-Limit", strconv.Itoa(apiRateLimiter.limit))
+		headers.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		headers.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if !allowed {
+			headers.Set("Retry-After", apiRateLimiter.retryAfter(reset))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How far ahead security.txt's Expires field points. RFC 9116 asks for less
+// than a year, and the file is generated per request so it never goes stale.
+const securityTxtLifetime = 180 * 24 * time.Hour
+
+var errContactFormat = errors.New("must be an email address or an http(s) URL")
+
+// contactURI turns the configured abuse contact into a URI: a bare email
+// address becomes a mailto: link, http(s) and mailto: URLs are kept as-is.
+func contactURI(contact string) (string, error) {
+	if u, err := url.Parse(contact); err == nil && u.Scheme != "" {
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			return contact, nil
+		case "http", "https":
+			if u.Host != "" {
+				return contact, nil
+			}
+		}
+		return "", errContactFormat
+	}
+
+	addr, err := mail.ParseAddress(contact)
+	if err != nil || addr.Name != "" {
+		return "", errContactFormat
+	}
+	return "mailto:" + addr.Address, nil
+}
+
+// securityTxtHandler serves /.well-known/security.txt (RFC 9116) pointing at
+// the abuse contact, or a 404 when none is configured.
+func securityTxtHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	contact, err := contactURI(config.AbuseContact)
+	if config.AbuseContact == "" || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Contact: %s\nExpires: %s\n", contact, time.Now().Add(securityTxtLifetime).UTC().Format(time.RFC3339))
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Short codes are meant to be read out or typed, so they're much shorter
+// than paste IDs. After shortCodeAttempts collisions in a row the space is
+// getting crowded, and longer codes are tried instead.
+const (
+	shortCodeLength   = 5
+	shortCodeAttempts = 5
+	shortCodeAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shortCodePath     = "/s/"
+)
+
+// Generates a candidate code, replaced in tests to force collisions
+var generateShortCode = randomShortCode
+
+func randomShortCode(length int) (string, error) {
+	max := big.NewInt(int64(len(shortCodeAlphabet)))
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = shortCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// assignShortCode gives the paste a short code no other paste has, deleted
+// ones included. The unique index still rejects a create that races another
+// to the same code.
+func (p *Paste) assignShortCode(tx *gorm.DB) error {
+	db := tx.Session(&gorm.Session{NewDB: true}).Unscoped()
+	for attempt := 0; attempt < 2*shortCodeAttempts; attempt++ {
+		length := shortCodeLength
+		if attempt >= shortCodeAttempts {
+			length++
+		}
+		code, err := generateShortCode(length)
+		if err != nil {
+			return err
+		}
+
+		var taken int64
+		if err := db.Model(&Paste{}).Where("short_code = ?", code).Count(&taken).Error; err != nil {
+			return err
+		}
+		if taken == 0 {
+			p.ShortCode = &code
+			return nil
+		}
+	}
+	return errors.New("failed to generate a unique short code")
+}
+
+// GetPasteByShortCode resolves a short code to its paste, applying the same
+// expiry and privacy checks as GetPaste. Codes are short enough to guess, so
+// they never lead anyone but the owner to an unlisted paste.
+func (s *PasteService) GetPasteByShortCode(code string, viewerUserID *uint) (*Paste, error) {
+	var found Paste
+	if err := s.db.Select("id").Where("short_code = ?", code).First(&found).Error; err != nil {
+		return nil, errors.New("paste not found")
+	}
+
+	paste, err := s.GetPaste(found.ID, viewerUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	isOwner := viewerUserID != nil && paste.UserID != nil && *viewerUserID == *paste.UserID
+	unlisted := paste.Unlisted || (paste.UnlistAt != nil && time.Now().After(*paste.UnlistAt))
+	if unlisted && !isOwner {
+		return nil, errors.New("paste not found")
+	}
+	return paste, nil
+}
+
+// shortCodeHandler serves GET /s/{code}: a redirect to the paste the code
+// belongs to, keeping any query such as ?raw=1.
+func shortCodeHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, shortCodePath)
+	if code == "" || strings.Contains(code, "/") {
+		notfoundHandler(w)
+		return
+	}
+
+	var userID *uint
+	if user := getCurrentUser(r); user != nil {
+		userID = &user.ID
+	}
+
+	paste, err := pasteService.GetPasteByShortCode(code, userID)
+	if err != nil {
+		notfoundHandler(w)
+		return
+	}
+
+	target := config.ServePath + paste.ID
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
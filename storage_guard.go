@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// How often the background check compares storage against MaxDatabaseBytes
+const storageGuardInterval = time.Minute
+
+// uploadsBlocked is set while stored paste content exceeds MaxDatabaseBytes.
+// The server stays up for reading, but refuses new pastes until cleanup
+// brings usage back under the limit.
+var uploadsBlocked atomic.Bool
+
+// TotalStorageUsed returns the bytes of paste content stored across all
+// users, as stored (after compression, with shared content counted once).
+// Soft-deleted pastes are counted until they're purged, as their rows are
+// still in the database.
+func (s *PasteService) TotalStorageUsed() (int64, error) {
+	var inline, shared int64
+	if err := s.db.Unscoped().Model(&Paste{}).
+		Select("COALESCE(SUM(LENGTH(CAST(content AS BLOB))), 0)").
+		Scan(&inline).Error; err != nil {
+		return 0, err
+	}
+	err := s.db.Model(&PasteContent{}).
+		Select("COALESCE(SUM(LENGTH(CAST(content AS BLOB))), 0)").
+		Scan(&shared).Error
+	return inline + shared, err
+}
+
+// checkStorageLimit blocks or unblocks uploads depending on current usage,
+// logging whenever the state changes.
+func checkStorageLimit() error {
+	if config.MaxDatabaseBytes <= 0 {
+		uploadsBlocked.Store(false)
+		return nil
+	}
+
+	used, err := pasteService.TotalStorageUsed()
+	if err != nil {
+		return err
+	}
+
+	over := used > config.MaxDatabaseBytes
+	if uploadsBlocked.Swap(over) != over {
+		if over {
+			log.Printf("Storage limit reached (%s of %s used), new uploads are blocked", formatBytes(used), formatBytes(config.MaxDatabaseBytes))
+		} else {
+			log.Printf("Storage back under limit (%s of %s used), uploads re-enabled", formatBytes(used), formatBytes(config.MaxDatabaseBytes))
+		}
+	}
+	return nil
+}
+
+// rejectIfUploadsBlocked writes a 507 and returns true while the storage
+// guard has uploads blocked.
+func rejectIfUploadsBlocked(w http.ResponseWriter) bool {
+	if !uploadsBlocked.Load() {
+		return false
+	}
+	httpError(w, http.StatusInsufficientStorage, msgUploadsBlocked)
+	return true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// templateFS holds the page templates, partials and static files, rooted at
+// the templates directory. main swaps it for an overlay when template_dir
+// is configured.
+var templateFS = newTemplateFS("")
+
+// newTemplateFS returns the embedded templates, overlaid with dir when set
+// so operators can replace individual files without rebuilding.
+func newTemplateFS(dir string) fs.FS {
+	embedded, err := fs.Sub(templatesFolder, "templates")
+	if err != nil {
+		panic(err)
+	}
+	if dir == "" {
+		return embedded
+	}
+	return overlayFS{primary: os.DirFS(dir), fallback: embedded}
+}
+
+// overlayFS serves files from primary, falling back to fallback for anything
+// primary doesn't have. Directory listings merge both, so globs such as
+// partials/*.html see overridden and embedded files alike.
+type overlayFS struct {
+	primary  fs.FS
+	fallback fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.primary.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.fallback.Open(name)
+	}
+	return f, err
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	primary, primaryErr := fs.ReadDir(o.primary, name)
+	fallback, fallbackErr := fs.ReadDir(o.fallback, name)
+	if primaryErr != nil && fallbackErr != nil {
+		return nil, primaryErr
+	}
+
+	seen := make(map[string]bool)
+	var entries []fs.DirEntry
+	for _, entry := range append(primary, fallback...) {
+		if !seen[entry.Name()] {
+			seen[entry.Name()] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Branding is the operator-configurable site identity shown on every page,
+// available to templates as .SiteName, .Footer and .AbuseContact.
+type Branding struct {
+	SiteName        string
+	Footer          template.HTML
+	AbuseContact    string
+	AbuseContactURL string // AbuseContact as a link target
+}
+
+func siteBranding() Branding {
+	branding := Branding{
+		SiteName: config.SiteName,
+		Footer:   sanitizeFooterHTML(config.FooterHTML),
+	}
+	if uri, err := contactURI(config.AbuseContact); err == nil {
+		branding.AbuseContact = config.AbuseContact
+		branding.AbuseContactURL = uri
+	}
+	return branding
+}
+
+// TemplateData holds the fields every page can rely on. Page data structs
+// embed it, so templates can always use .Username, .IsAdmin and .LoggedIn
+// alongside the branding.
+type TemplateData struct {
+	Branding
+	Username string
+	IsAdmin  bool
+	LoggedIn bool
+}
+
+// baseTemplateData builds the common page fields for the request's viewer.
+func baseTemplateData(r *http.Request) TemplateData {
+	return templateDataForUser(getCurrentUser(r))
+}
+
+// templateDataForUser is baseTemplateData for handlers that have already
+// looked up the viewer; user may be nil.
+func templateDataForUser(user *User) TemplateData {
+	data := TemplateData{Branding: siteBranding()}
+	if user != nil {
+		data.Username = user.Username
+		data.IsAdmin = adminService.IsAdmin(user.ID)
+		data.LoggedIn = true
+	}
+	return data
+}
+
+// LanguageChoice feeds the "language-options" partial, so language pickers
+// list exactly the languages the server supports.
+type LanguageChoice struct {
+	Languages        []Language
+	SelectedLanguage string
+}
+
+// languageChoice offers every supported language with selected picked. A
+// selected language we don't know, stored before it was dropped say, is
+// offered too, so saving a form doesn't quietly change it.
+func languageChoice(selected string) LanguageChoice {
+	choice := LanguageChoice{Languages: languages, SelectedLanguage: selected}
+	if _, ok := lookupLanguage(selected); !ok && selected != autoLanguage && selected != "" {
+		choice.Languages = append(append([]Language{}, languages...), Language{Name: selected, Label: selected})
+	}
+	return choice
+}
+
+// renderTemplate renders one page together with the shared partials in
+// templates/partials.
+func renderTemplate(w http.ResponseWriter, status int, name string, data interface{}) {
+	tmpl, err := template.ParseFS(templateFS, name, "partials/*.html")
+	if err != nil {
+		requestID := newRequestID()
+		log.Printf("[%s] Failed to parse template %s: %v", requestID, name, err)
+		serverErrorHandler(w, requestID)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("Failed to render template %s: %v", name, err)
+	}
+}
+
+// serverErrorHandler renders the 500 page, showing requestID so users can
+// quote it. It parses the page itself rather than going through
+// renderTemplate, whose own failures end up here.
+func serverErrorHandler(w http.ResponseWriter, requestID string) {
+	tmpl, err := template.ParseFS(templateFS, "500.html", "partials/*.html")
+	if err != nil {
+		log.Printf("[%s] Failed to parse template 500.html: %v", requestID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		TemplateData
+		RequestID string
+	}{
+		TemplateData: TemplateData{Branding: siteBranding()},
+		RequestID:    requestID,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Printf("[%s] Failed to render template 500.html: %v", requestID, err)
+	}
+}
+
+var (
+	footerTagPattern  = regexp.MustCompile(`(?i)^<(/?)(a|b|i|em|strong|small|span|p|br|code)\b([^<>]*)>`)
+	footerHrefPattern = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// sanitizeFooterHTML keeps a small set of formatting tags and links from
+// the configured footer and escapes everything else. Attributes other than
+// a link's href are dropped, and hrefs must be http(s), mailto or relative.
+func sanitizeFooterHTML(raw string) template.HTML {
+	var b strings.Builder
+	for len(raw) > 0 {
+		i := strings.IndexByte(raw, '<')
+		if i < 0 {
+			b.WriteString(escapeFooterText(raw))
+			break
+		}
+		b.WriteString(escapeFooterText(raw[:i]))
+		raw = raw[i:]
+
+		m := footerTagPattern.FindStringSubmatch(raw)
+		if m == nil {
+			b.WriteString("&lt;")
+			raw = raw[1:]
+			continue
+		}
+		raw = raw[len(m[0]):]
+
+		closing, tag, attrs := m[1] == "/", strings.ToLower(m[2]), m[3]
+		switch {
+		case closing:
+			if tag != "br" {
+				b.WriteString("</" + tag + ">")
+			}
+		case tag == "a":
+			b.WriteString("<a")
+			if href := footerHref(attrs); href != "" {
+				b.WriteString(` href="` + html.EscapeString(href) + `"`)
+			}
+			b.WriteString(">")
+		default:
+			b.WriteString("<" + tag + ">")
+		}
+	}
+	return template.HTML(b.String())
+}
+
+// escapeFooterText escapes text while letting entities such as &copy;
+// through as the characters they stand for.
+func escapeFooterText(text string) string {
+	return html.EscapeString(html.UnescapeString(text))
+}
+
+func footerHref(attrs string) string {
+	m := footerHrefPattern.FindStringSubmatch(attrs)
+	if m == nil {
+		return ""
+	}
+	href := strings.TrimSpace(m[1] + m[2])
+	lower := strings.ToLower(href)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") ||
+		strings.HasPrefix(lower, "mailto:") || (strings.HasPrefix(href, "/") && !strings.HasPrefix(href, "//")) {
+		return href
+	}
+	return ""
+}
+
+// humanDuration renders d rounded to a single unit for display, e.g.
+// "3 days" or "1 hour".
+func humanDuration(d time.Duration) string {
+	unit := func(n time.Duration, name string) string {
+		if n == 1 {
+			return "1 " + name
+		}
+		return fmt.Sprintf("%d %ss", n, name)
+	}
+
+	switch {
+	case d < time.Minute:
+		return "less than a minute"
+	case d < time.Hour-30*time.Second:
+		return unit(d.Round(time.Minute)/time.Minute, "minute")
+	case d < 47*time.Hour+30*time.Minute:
+		return unit(d.Round(time.Hour)/time.Hour, "hour")
+	default:
+		return unit(d.Round(24*time.Hour)/(24*time.Hour), "day")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Slots for uploads being handled at once, nil when unlimited. Each upload
+// buffers up to MaxPasteSize, so this bounds memory under a burst no matter
+// how many clients it comes from.
+var uploadSlots *semaphore.Weighted
+
+func newUploadSlots(n int) *semaphore.Weighted {
+	return semaphore.NewWeighted(int64(n))
+}
+
+// acquireUploadSlot waits up to UploadQueueTimeout for a free upload slot.
+// If none frees up it writes a 503 and returns false; otherwise the caller
+// must call release once it's done with the request body.
+func acquireUploadSlot(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if uploadSlots == nil {
+		return func() {}, true
+	}
+
+	if !uploadSlots.TryAcquire(1) {
+		timeout := time.Duration(config.UploadQueueTimeout) * time.Second
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		if timeout <= 0 || uploadSlots.Acquire(ctx, 1) != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(max(config.UploadQueueTimeout, 1)))
+			http.Error(w, "Server busy, too many uploads in progress", http.StatusServiceUnavailable)
+			return nil, false
+		}
+	}
+
+	return func() { uploadSlots.Release(1) }, true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"runtime/debug"
+	"time"
+)
+
+// Build information, injected at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=abc1234"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// Process start, for reporting uptime
+var startTime = time.Now()
+
+// buildCommit returns the injected commit, falling back to the VCS revision
+// the Go toolchain embeds when building from a git checkout.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+)
+
+var (
+	viewOnlyKeyOnce sync.Once
+	viewOnlyKeyData []byte
+)
+
+// viewOnlyKey signs view-only links. It comes from session_secret so links
+// survive restarts; without one, a random key lasts until the next restart.
+func viewOnlyKey() []byte {
+	viewOnlyKeyOnce.Do(func() {
+		if config.SessionSecret != "" {
+			viewOnlyKeyData = []byte(config.SessionSecret)
+			return
+		}
+		viewOnlyKeyData = make([]byte, 32)
+		rand.Read(viewOnlyKeyData)
+	})
+	return viewOnlyKeyData
+}
+
+// viewOnlyToken is the ?view= value that opens a paste without its edit
+// controls, even for the owner.
+func viewOnlyToken(pasteID string) string {
+	mac := hmac.New(sha256.New, viewOnlyKey())
+	mac.Write([]byte("view-only:" + pasteID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validViewOnlyToken reports whether token is the view-only token for pasteID.
+func validViewOnlyToken(pasteID, token string) bool {
+	return token != "" && hmac.Equal([]byte(token), []byte(viewOnlyToken(pasteID)))
+}